@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/internal/env"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// settings are the environment variables the server reads, which are also
+// the keys of CONFIG_FILE.
+var settings = env.Settings{
+	"ACCESS_LOG":                         env.StringKind,
+	"ACCESS_LOG_FORMAT":                  env.StringKind,
+	"ACCESS_LOG_MAX_BACKUPS":             env.IntKind,
+	"ACCESS_LOG_MAX_SIZE_MB":             env.IntKind,
+	"ACME_CACHE_DIR":                     env.StringKind,
+	"ACME_DOMAIN":                        env.StringKind,
+	"ACME_EMAIL":                         env.StringKind,
+	"ACME_HTTP_ADDR":                     env.StringKind,
+	"ALLOWED_CIDRS":                      env.StringKind,
+	"ALLOWED_DESTINATION_DOMAINS":        env.StringKind,
+	"ALLOWED_DESTINATION_SCHEMES":        env.StringKind,
+	"ALLOWED_EMAIL_DOMAINS":              env.StringKind,
+	"ANALYTICS_BUFFER_SIZE":              env.IntKind,
+	"ANALYTICS_FLUSH_INTERVAL":           env.DurationKind,
+	"ANALYTICS_SINKS":                    env.StringKind,
+	"API_ALLOWED_CIDRS":                  env.StringKind,
+	"API_DENIED_CIDRS":                   env.StringKind,
+	"API_TOKENS":                         env.StringKind,
+	"AUDIT_LOG_FILE":                     env.StringKind,
+	"AWS_ACCESS_KEY_ID":                  env.StringKind,
+	"AWS_REGION":                         env.StringKind,
+	"AWS_SECRET_ACCESS_KEY":              env.StringKind,
+	"AWS_SESSION_TOKEN":                  env.StringKind,
+	"BIGQUERY_TABLE":                     env.StringKind,
+	"BLOOM_FILTER_MIN_LINKS":             env.IntKind,
+	"CANONICAL_URL":                      env.StringKind,
+	"DATABASE_CONN_MAX_IDLE_TIME":        env.DurationKind,
+	"DATABASE_CONN_MAX_LIFETIME":         env.DurationKind,
+	"DATABASE_MAX_IDLE_CONNS":            env.IntKind,
+	"DATABASE_MAX_OPEN_CONNS":            env.IntKind,
+	"DATABASE_REPLICA_URL":               env.StringKind,
+	"DATABASE_URL":                       env.StringKind,
+	"DEBUG_ENDPOINTS":                    env.BoolKind,
+	"DENIED_CIDRS":                       env.StringKind,
+	"DNS_SERVER":                         env.StringKind,
+	"DNS_ZONE":                           env.StringKind,
+	"DOMAINS":                            env.StringKind,
+	"FALLBACK_URL":                       env.StringKind,
+	"GEOIP_COUNTRY_HEADER":               env.StringKind,
+	"GEOIP_DATABASE":                     env.StringKind,
+	"GOOGLE_API_KEY":                     env.StringKind,
+	"GOOGLE_APPLICATION_CREDENTIALS":     env.StringKind,
+	"GOOGLE_OAUTH_CLIENT_ID":             env.StringKind,
+	"GOOGLE_OAUTH_CLIENT_SECRET":         env.StringKind,
+	"GOOGLE_OAUTH_REDIRECT_URL":          env.StringKind,
+	"GOOGLE_SHEET_ID":                    env.StringKind,
+	"GO_HOSTNAMES":                       env.StringKind,
+	"GRPC_ADDR":                          env.StringKind,
+	"H2C":                                env.BoolKind,
+	"HTTPS_PROXY":                        env.StringKind,
+	"HTTP_PROXY":                         env.StringKind,
+	"IDLE_TIMEOUT":                       env.DurationKind,
+	"INVALIDATION_CHANNEL":               env.StringKind,
+	"INVALIDATION_REDIS_URL":             env.StringKind,
+	"KAFKA_REST_URL":                     env.StringKind,
+	"KAFKA_TOPIC":                        env.StringKind,
+	"LATENCY_SLO":                        env.DurationKind,
+	"LINKS_DIR":                          env.StringKind,
+	"LINKS_FILE":                         env.StringKind,
+	"LINKS_WATCH_INTERVAL":               env.DurationKind,
+	"LINK_APPROVAL":                      env.BoolKind,
+	"LINK_CHECK_CONCURRENCY":             env.IntKind,
+	"LINK_CHECK_INTERVAL":                env.DurationKind,
+	"LINK_CHECK_SLACK_WEBHOOK":           env.StringKind,
+	"LINK_CHECK_TIMEOUT":                 env.DurationKind,
+	"LINK_QUOTA":                         env.IntKind,
+	"LISTEN_ADDR":                        env.StringKind,
+	"MAINTENANCE_MESSAGE":                env.StringKind,
+	"MAINTENANCE_MODE":                   env.BoolKind,
+	"MAINTENANCE_PAGE":                   env.StringKind,
+	"MAINTENANCE_RETRY_AFTER":            env.DurationKind,
+	"MAX_REQUEST_BODY":                   env.IntKind,
+	"NAMESPACE_SHEETS":                   env.StringKind,
+	"NOT_FOUND_CACHE_SIZE":               env.IntKind,
+	"NOT_FOUND_CACHE_TTL":                env.DurationKind,
+	"NO_PROXY":                           env.StringKind,
+	"OPENSEARCH_NAME":                    env.StringKind,
+	"OTEL_EXPORTER_OTLP_ENDPOINT":        env.StringKind,
+	"OTEL_EXPORTER_OTLP_HEADERS":         env.StringKind,
+	"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": env.StringKind,
+	"OTEL_SERVICE_NAME":                  env.StringKind,
+	"OTEL_TRACES_SAMPLER_ARG":            env.FloatKind,
+	"OUTBOUND_CA_FILE":                   env.StringKind,
+	"OUTBOUND_TLS_CERT":                  env.StringKind,
+	"OUTBOUND_TLS_KEY":                   env.StringKind,
+	"PAC_PROXY":                          env.StringKind,
+	"PAGE_INFO_CONCURRENCY":              env.IntKind,
+	"PAGE_INFO_INTERVAL":                 env.DurationKind,
+	"PAGE_INFO_TIMEOUT":                  env.DurationKind,
+	"PATH_FALLBACK":                      env.BoolKind,
+	"PATH_FALLBACK_DEPTH":                env.IntKind,
+	"PERMANENT_REDIRECTS":                env.BoolKind,
+	"PORT":                               env.IntKind,
+	"PREVIEW_MODE":                       env.BoolKind,
+	"PRIVATE_ALLOWED_CIDRS":              env.StringKind,
+	"PROVIDER":                           env.StringKind,
+	"PROVIDERS":                          env.StringKind,
+	"PROVIDER_BREAKER_COOLDOWN":          env.DurationKind,
+	"PROVIDER_BREAKER_FAILURES":          env.IntKind,
+	"PROVIDER_TIMEOUT":                   env.DurationKind,
+	"PUBLIC_NEW_LINKS":                   env.BoolKind,
+	"RATE_LIMIT_BURST":                   env.IntKind,
+	"RATE_LIMIT_RPS":                     env.FloatKind,
+	"READY_MAX_FAILING":                  env.DurationKind,
+	"READ_HEADER_TIMEOUT":                env.DurationKind,
+	"READ_ONLY":                          env.BoolKind,
+	"READ_TIMEOUT":                       env.DurationKind,
+	"REDIRECT_CACHE_CONTROL":             env.StringKind,
+	"REDIS_KEY_PREFIX":                   env.StringKind,
+	"REDIS_TTL":                          env.DurationKind,
+	"REDIS_URL":                          env.StringKind,
+	"REFRESH_ADAPTIVE_MAX":               env.DurationKind,
+	"REFRESH_MAX_INTERVAL":               env.DurationKind,
+	"REFRESH_MIN_INTERVAL":               env.DurationKind,
+	"REPORT_BASE_URL":                    env.StringKind,
+	"REPORT_EMAIL_DOMAIN":                env.StringKind,
+	"REPORT_EXPIRING_WITHIN":             env.DurationKind,
+	"REPORT_FROM":                        env.StringKind,
+	"REPORT_INTERVAL":                    env.DurationKind,
+	"REPORT_UNUSED_MONTHS":               env.IntKind,
+	"RESERVED_SHEET_NAME":                env.StringKind,
+	"RESERVED_SHORTCUTS":                 env.StringKind,
+	"RESERVED_SHORTCUTS_FILE":            env.StringKind,
+	"ROBOTS_TXT_FILE":                    env.StringKind,
+	"S3_BUCKET":                          env.StringKind,
+	"S3_ENDPOINT":                        env.StringKind,
+	"S3_PREFIX":                          env.StringKind,
+	"S3_REGION":                          env.StringKind,
+	"SELF_HOSTNAMES":                     env.StringKind,
+	"SERVE_STALE":                        env.BoolKind,
+	"SESSION_TTL":                        env.DurationKind,
+	"SHADOW_COMPARE_INTERVAL":            env.DurationKind,
+	"SHADOW_PROVIDER":                    env.StringKind,
+	"SHEETS_WRITE_DELAY":                 env.DurationKind,
+	"SHEET_CSV_URL":                      env.StringKind,
+	"SHEET_NAME":                         env.StringKind,
+	"SHORTCUT_CASE_SENSITIVE":            env.BoolKind,
+	"SHORTCUT_IGNORE_SEPARATORS":         env.BoolKind,
+	"SHORTCUT_LANGUAGE":                  env.StringKind,
+	"SHORTCUT_TRAILING_SLASH":            env.StringKind,
+	"SHORTCUT_UNICODE_FORM":              env.StringKind,
+	"SHUTDOWN_TIMEOUT":                   env.DurationKind,
+	"SIGNING_KEY":                        env.StringKind,
+	"SLACK_SIGNING_SECRET":               env.StringKind,
+	"SLUG_LENGTH":                        env.IntKind,
+	"SMTP_ADDR":                          env.StringKind,
+	"SMTP_PASSWORD":                      env.StringKind,
+	"SMTP_USERNAME":                      env.StringKind,
+	"SNAPSHOT_DIR":                       env.StringKind,
+	"SOCKET_MODE":                        env.StringKind,
+	"SSO_ADMIN_EMAILS":                   env.StringKind,
+	"SSO_SCOPE":                          env.StringKind,
+	"STALE_MAX_AGE":                      env.DurationKind,
+	"STICKY_SPLITS":                      env.BoolKind,
+	"SUFFIX_COMMANDS":                    env.StringKind,
+	"TENANTS_FILE":                       env.StringKind,
+	"TLS_CERT":                           env.StringKind,
+	"TLS_KEY":                            env.StringKind,
+	"TRASH_RETENTION":                    env.DurationKind,
+	"TRUST_PROXY":                        env.BoolKind,
+	"UNLOCK_TTL":                         env.DurationKind,
+	"WARM_RETRY":                         env.DurationKind,
+	"WARM_TIMEOUT":                       env.DurationKind,
+	"WEBHOOK_CLICK_THRESHOLDS":           env.StringKind,
+	"WEBHOOK_EVENTS":                     env.StringKind,
+	"WEBHOOK_MAX_ATTEMPTS":               env.IntKind,
+	"WEBHOOK_SECRET":                     env.StringKind,
+	"WEBHOOK_URLS":                       env.StringKind,
+	"WRITE_TIMEOUT":                      env.DurationKind,
+}
+
+// providerSettings are the settings selecting a backend when PROVIDER is
+// not set, by backend, see store.DefaultProvider.
+var providerSettings = map[string]string{
+	"sql":   "DATABASE_URL",
+	"redis": "REDIS_URL",
+	"csv":   "SHEET_CSV_URL",
+	"file":  "LINKS_FILE",
+	"dir":   "LINKS_DIR",
+	"dns":   "DNS_ZONE",
+}
+
+// checkConfig returns every problem of the settings in the environment:
+// values of the wrong kind, and settings that contradict each other or are
+// missing, which would otherwise only show once links are loaded.
+func checkConfig() []error {
+	errs := env.Validate(settings)
+
+	// Without PROVIDER the first backend configured wins, silently; the
+	// shadow backend may be configured besides.
+	if os.Getenv("PROVIDER") == "" && os.Getenv("PROVIDERS") == "" {
+		shadow := providerSettings[os.Getenv("SHADOW_PROVIDER")]
+		var set []string
+		for _, name := range []string{"DATABASE_URL", "REDIS_URL", "SHEET_CSV_URL", "LINKS_FILE", "LINKS_DIR", "DNS_ZONE"} {
+			if name != shadow && os.Getenv(name) != "" {
+				set = append(set, name)
+			}
+		}
+		if len(set) > 1 {
+			errs = append(errs, fmt.Errorf("conflicting providers: %s are all set, choose one with PROVIDER", strings.Join(set, ", ")))
+		}
+	}
+
+	if store.DefaultProvider() == "sheets" || os.Getenv("SHADOW_PROVIDER") == "sheets" {
+		for _, name := range []string{"GOOGLE_SHEET_ID", "SHEET_NAME"} {
+			if os.Getenv(name) == "" {
+				errs = append(errs, fmt.Errorf("%s is required by the sheets provider, or configure another one such as DATABASE_URL", name))
+			}
+		}
+	}
+	return errs
+}
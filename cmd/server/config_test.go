@@ -0,0 +1,56 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// notSettings are the environment variables the server reads that can't be
+// set in CONFIG_FILE: the file itself, and those of systemd.
+var notSettings = map[string]bool{
+	"CONFIG_FILE":    true,
+	"LISTEN_FDNAMES": true,
+	"LISTEN_FDS":     true,
+	"LISTEN_PID":     true,
+}
+
+// TestSettingsComplete checks that every environment variable named in the
+// server, such as by os.Getenv or env.Duration, is a setting, so that
+// CONFIG_FILE doesn't reject it as unknown.
+func TestSettingsComplete(t *testing.T) {
+	name := regexp.MustCompile(`^[A-Z][A-Z0-9]*(_[A-Z0-9]+)*$`)
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, path := range files {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			lit, ok := n.(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				return true
+			}
+			v, err := strconv.Unquote(lit.Value)
+			if err != nil || !name.MatchString(v) || notSettings[v] {
+				return true
+			}
+			if _, ok := settings[v]; !ok {
+				t.Errorf("%s: %s is read but missing from settings", fset.Position(lit.Pos()), v)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/internal/env"
+)
+
+// listenFlag collects the values of a repeatable --listen flag.
+type listenFlag []string
+
+func (l *listenFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listenFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// listen opens a listener for addr, which is one of:
+//
+//	host:port            TCP, dual-stack when host is empty or "::"
+//	tcp4:host:port       IPv4 only
+//	tcp6:[host]:port     IPv6 only
+//	unix:/path/to.sock   Unix domain socket
+func listen(addr string) (net.Listener, error) {
+	network, address := "tcp", addr
+	if i := strings.Index(addr, ":"); i > 0 {
+		switch addr[:i] {
+		case "tcp", "tcp4", "tcp6", "unix":
+			network, address = addr[:i], addr[i+1:]
+		}
+	}
+
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	// A socket file left behind by a previous run would make bind fail.
+	// Anything else at the path is more likely a typo than a leftover.
+	if fi, err := os.Lstat(address); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", address)
+		}
+		if err := os.Remove(address); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	// Let a proxy running as another user connect, see SOCKET_MODE.
+	if mode := os.Getenv("SOCKET_MODE"); mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err == nil {
+			err = os.Chmod(address, os.FileMode(m))
+		}
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to apply SOCKET_MODE %q: %w", mode, err)
+		}
+	}
+	return l, nil
+}
+
+// listenAddr returns the address to listen on without --listen flags:
+// LISTEN_ADDR when it names a network, such as unix:/run/shortener.sock, else
+// LISTEN_ADDR (default localhost) and PORT (default 8080).
+func listenAddr() string {
+	addr := os.Getenv("LISTEN_ADDR")
+	if i := strings.Index(addr, ":"); i > 0 {
+		switch addr[:i] {
+		case "tcp", "tcp4", "tcp6", "unix":
+			return addr
+		}
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	if addr == "" {
+		addr = "localhost"
+	}
+	return net.JoinHostPort(addr, port)
+}
+
+// sdListenFDsStart is the first file descriptor passed by systemd.
+const sdListenFDsStart = 3
+
+// activatedListeners returns the sockets passed by systemd socket
+// activation, keyed by their FileDescriptorName ("" when unnamed), or nil
+// when the process was not socket activated.
+func activatedListeners() (map[string][]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n := env.Int("LISTEN_FDS", 0, 0, 1024)
+	if n == 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// Child processes must not take the sockets for theirs.
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(v)
+	}
+
+	out := make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(sdListenFDsStart+i), "LISTEN_FD_"+strconv.Itoa(sdListenFDsStart+i))
+		l, err := net.FileListener(f)
+		// FileListener dups the descriptor.
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d (%q) from systemd is not a listening socket: %w", sdListenFDsStart+i, name, err)
+		}
+		out[name] = append(out[name], l)
+	}
+	return out, nil
+}
+
+// listenersFor returns the sockets passed by systemd for a server, if any,
+// or listens on the address in the environment variable name, if set.
+func listenersFor(activated []net.Listener, name string) []net.Listener {
+	if len(activated) > 0 {
+		return activated
+	}
+	addr := os.Getenv(name)
+	if addr == "" {
+		return nil
+	}
+	l, err := listen(addr)
+	if err != nil {
+		log.Fatalf("failed to listen on %s: %v", addr, err)
+	}
+	return []net.Listener{l}
+}
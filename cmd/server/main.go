@@ -0,0 +1,590 @@
+// Command server runs the URL shortener, configured from the environment.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/httpapi"
+	"github.com/denizyoldas/url-shorter/internal/env"
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+	"github.com/denizyoldas/url-shorter/internal/tracing"
+	"github.com/denizyoldas/url-shorter/resolver"
+	"github.com/denizyoldas/url-shorter/store"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// version and commit identify the build on the /status page, set with
+// -ldflags "-X main.version=... -X main.commit=...".
+var version, commit string
+
+func main() {
+	var listenAddrs listenFlag
+	flag.Var(&listenAddrs, "listen", "address to listen on: host:port, tcp4:host:port, tcp6:[host]:port or unix:/path (repeatable)")
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML file of settings; environment variables override it")
+	checkOnly := flag.Bool("check-config", false, "check the settings and exit")
+	flag.Parse()
+
+	if *configFile != "" {
+		if err := env.LoadFile(*configFile, settings); err != nil {
+			log.Fatalf("failed to load %s: %v", *configFile, err)
+		}
+	}
+	if errs := checkConfig(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("config: %v", err)
+		}
+		log.Fatalf("invalid configuration, %d problems", len(errs))
+	}
+	if *checkOnly {
+		log.Printf("configuration ok")
+		return
+	}
+
+	activated, err := activatedListeners()
+	if err != nil {
+		log.Fatalf("socket activation: %v", err)
+	}
+	if len(listenAddrs) == 0 && activated == nil {
+		listenAddrs = append(listenAddrs, listenAddr())
+	}
+
+	norm, err := store.NewNormalizer()
+	if err != nil {
+		log.Fatalf("failed to configure shortcut normalization: %v", err)
+	}
+	store.Norm = norm
+
+	// The clients of providers, sinks and webhooks share the default
+	// transport, which already honors HTTPS_PROXY and NO_PROXY.
+	outboundTLS, err := clientTLS()
+	if err != nil {
+		log.Fatalf("failed to configure outbound TLS: %v", err)
+	}
+	if outboundTLS != nil {
+		http.DefaultTransport.(*http.Transport).TLSClientConfig = outboundTLS
+	}
+
+	if tracing.Default, err = tracing.NewTracer(); err != nil {
+		log.Fatalf("failed to configure tracing: %v", err)
+	}
+
+	provider, err := store.NewProvider(store.DefaultProvider())
+	if err != nil {
+		log.Fatalf("failed to configure provider: %v", err)
+	}
+
+	ttl := env.Duration("REFRESH_MIN_INTERVAL", time.Second*5)
+	sched := resolver.NewScheduler(ttl, env.Duration("REFRESH_MAX_INTERVAL", time.Minute*5))
+	if d := env.DurationOrZero("REFRESH_ADAPTIVE_MAX", 0); d > 0 {
+		sched.Adapt(d)
+	}
+
+	slugLength := env.Int("SLUG_LENGTH", 6, 1, 64)
+
+	recorder, _ := provider.(store.ClickRecorder)
+	clicks := httpapi.NewAnalytics(env.Int("ANALYTICS_BUFFER_SIZE", 10000, 1, 1<<24), recorder)
+	sinks, err := store.NewAnalyticsSinks(os.Getenv("ANALYTICS_SINKS"))
+	if err != nil {
+		log.Fatalf("failed to configure analytics sinks: %v", err)
+	}
+	for _, s := range sinks {
+		clicks.AddSink(s)
+		log.Printf("Exporting clicks to %s", s.Name())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go clicks.Run(ctx, env.Duration("ANALYTICS_FLUSH_INTERVAL", time.Second*10))
+	if tracing.Default != nil {
+		go tracing.Default.Run(ctx, time.Second*5)
+	}
+
+	notFound := resolver.NewNotFoundCache(env.Int("NOT_FOUND_CACHE_SIZE", 4096, 0, 1<<20),
+		env.Duration("NOT_FOUND_CACHE_TTL", time.Second*30))
+	db := resolver.NewCache(provider, sched, notFound)
+	if db.Reserved, err = resolver.NewReservedWords(); err != nil {
+		log.Fatalf("failed to configure reserved shortcuts: %v", err)
+	}
+	doms, err := resolver.NewDomains()
+	if err != nil {
+		log.Fatalf("failed to configure domains: %v", err)
+	}
+	// Links must not lead back here, where they would loop.
+	var selfHosts []string
+	if u, err := url.Parse(os.Getenv("CANONICAL_URL")); err == nil && u.Host != "" {
+		selfHosts = append(selfHosts, u.Host)
+	}
+	if db.Destinations, err = resolver.NewDestinationPolicy(doms, selfHosts...); err != nil {
+		log.Fatalf("failed to configure destinations: %v", err)
+	}
+	db.ServeStale = env.Bool("SERVE_STALE", true)
+	db.MaxStale = env.DurationOrZero("STALE_MAX_AGE", 0)
+	// Bounds every backend call, whether a refresh or made for a request.
+	providerTimeout := env.Duration("PROVIDER_TIMEOUT", time.Second*30)
+	db.Timeout = providerTimeout
+	db.Breaker = resolver.NewBreaker(env.Int("PROVIDER_BREAKER_FAILURES", 5, 0, 1000),
+		env.Duration("PROVIDER_BREAKER_COOLDOWN", time.Minute))
+	db.WarmRetry = env.Duration("WARM_RETRY", time.Second)
+	db.BloomMinLinks = env.Int("BLOOM_FILTER_MIN_LINKS", 0, 0, 1<<30)
+	go db.Run(ctx)
+
+	if rawURL := os.Getenv("INVALIDATION_REDIS_URL"); rawURL != "" {
+		channel := os.Getenv("INVALIDATION_CHANNEL")
+		if channel == "" {
+			channel = "url-shortener:invalidate"
+		}
+		db.Peers, err = resolver.NewInvalidator(rawURL, channel)
+		if err != nil {
+			log.Fatalf("failed to configure invalidation: %v", err)
+		}
+		go db.Peers.Run(ctx, db.InvalidateLocal)
+	}
+
+	if w, ok := provider.(store.Watcher); ok {
+		go w.Watch(ctx, db.InvalidateLocal)
+	}
+
+	var accessLog *httpapi.AccessLog
+	if dest := os.Getenv("ACCESS_LOG"); dest != "" {
+		accessLog, err = httpapi.NewAccessLog(dest, os.Getenv("ACCESS_LOG_FORMAT"),
+			int64(env.Int("ACCESS_LOG_MAX_SIZE_MB", 100, 0, 1<<20))<<20, env.Int("ACCESS_LOG_MAX_BACKUPS", 5, 0, 1000))
+		if err != nil {
+			log.Fatalf("failed to open ACCESS_LOG: %v", err)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("received SIGHUP, reloading links")
+			db.Invalidate()
+			if err := accessLog.Reopen(); err != nil {
+				log.Printf("warn: failed to reopen ACCESS_LOG: %v", err)
+			}
+		}
+	}()
+
+	signingKey := []byte(os.Getenv("SIGNING_KEY"))
+	if len(signingKey) == 0 {
+		// Unlocked links and SSO sessions then end on restart and on other
+		// replicas.
+		signingKey = make([]byte, 32)
+		if _, err := rand.Read(signingKey); err != nil {
+			log.Fatalf("failed to generate a signing key: %v", err)
+		}
+	}
+
+	trustProxy := env.Bool("TRUST_PROXY", false)
+	tokens, _ := provider.(store.TokenStore)
+	auth, err := httpapi.NewAuthenticator(os.Getenv("API_TOKENS"), tokens)
+	if err != nil {
+		log.Fatalf("failed to configure authentication: %v", err)
+	}
+	if id := os.Getenv("GOOGLE_OAUTH_CLIENT_ID"); id != "" {
+		scopes := os.Getenv("SSO_SCOPE")
+		if scopes == "" {
+			scopes = "write"
+		}
+		scope, err := store.ParseScopes(scopes)
+		if err != nil {
+			log.Fatalf("invalid SSO_SCOPE: %v", err)
+		}
+		sso, err := httpapi.NewSSO(id, os.Getenv("GOOGLE_OAUTH_CLIENT_SECRET"), os.Getenv("ALLOWED_EMAIL_DOMAINS"), os.Getenv("SSO_ADMIN_EMAILS"), scope, signingKey)
+		if err != nil {
+			log.Fatalf("failed to configure Google sign-in: %v", err)
+		}
+		sso.RedirectURL = os.Getenv("GOOGLE_OAUTH_REDIRECT_URL")
+		sso.SessionTTL = env.Duration("SESSION_TTL", 12*time.Hour)
+		sso.TrustProxy = trustProxy
+		auth.SSO = sso
+	}
+	if !auth.Enabled() {
+		log.Printf("warn: API_TOKENS not set, /api and /admin are unauthenticated")
+	}
+
+	privateNets, err := httpapi.ParseCIDRs(os.Getenv("PRIVATE_ALLOWED_CIDRS"))
+	if err != nil {
+		log.Fatalf("invalid PRIVATE_ALLOWED_CIDRS: %v", err)
+	}
+	access, err := httpapi.NewIPAccess(os.Getenv("ALLOWED_CIDRS"), os.Getenv("DENIED_CIDRS"))
+	if err != nil {
+		log.Fatalf("invalid ALLOWED_CIDRS or DENIED_CIDRS: %v", err)
+	}
+	apiAccess, err := httpapi.NewIPAccess(os.Getenv("API_ALLOWED_CIDRS"), os.Getenv("API_DENIED_CIDRS"))
+	if err != nil {
+		log.Fatalf("invalid API_ALLOWED_CIDRS or API_DENIED_CIDRS: %v", err)
+	}
+
+	// Unknown paths fall back to their longest prefix shortcut, passing on
+	// at most PATH_FALLBACK_DEPTH segments.
+	res := resolver.NewResolver(db, doms)
+	res.NoPrefixFallback = !env.Bool("PATH_FALLBACK", true)
+	res.MaxFallbackDepth = env.Int("PATH_FALLBACK_DEPTH", 0, 0, 1<<10)
+
+	// A shadow backend answers every lookup too, without serving visitors,
+	// to check a migration before switching PROVIDER.
+	var shadow *resolver.Shadow
+	if name := os.Getenv("SHADOW_PROVIDER"); name != "" {
+		shadowProvider, err := store.NewProvider(name)
+		if err != nil {
+			log.Fatalf("failed to configure shadow provider: %v", err)
+		}
+		shadowDB := resolver.NewCache(shadowProvider, resolver.NewScheduler(ttl, env.Duration("REFRESH_MAX_INTERVAL", time.Minute*5)), nil)
+		shadowDB.Reserved = db.Reserved
+		shadowDB.Destinations = db.Destinations
+		shadowDB.Timeout = providerTimeout
+		shadow = resolver.NewShadow(res, shadowDB, doms)
+		go shadowDB.Run(ctx)
+		go shadow.Run(ctx, env.Duration("SHADOW_COMPARE_INTERVAL", time.Minute*5))
+		log.Printf("Comparing lookups with shadow provider %q", name)
+	}
+
+	var fallbackURL string
+	if v := os.Getenv("FALLBACK_URL"); v != "" {
+		if fallbackURL, err = httpapi.ParseFallbackURL(v); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	cacheControl := os.Getenv("REDIRECT_CACHE_CONTROL")
+	if cacheControl == "" {
+		cacheControl = "max-age=60"
+	}
+	if cacheControl, err = store.ParseCacheControl(cacheControl); err != nil {
+		log.Fatalf("invalid REDIRECT_CACHE_CONTROL: %v", err)
+	}
+
+	var geoIP *httpapi.GeoIP
+	if path := os.Getenv("GEOIP_DATABASE"); path != "" {
+		if geoIP, err = httpapi.OpenGeoIP(path); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	goHostnames, err := httpapi.ParseGoHostnames(os.Getenv("GO_HOSTNAMES"))
+	if err != nil {
+		log.Fatalf("invalid GO_HOSTNAMES: %v", err)
+	}
+
+	suffixCommands, err := httpapi.ParseSuffixCommands(os.Getenv("SUFFIX_COMMANDS"))
+	if err != nil {
+		log.Fatalf("invalid SUFFIX_COMMANDS: %v", err)
+	}
+
+	mode, err := httpapi.NewMode()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if mode.Maintenance() {
+		log.Printf("warn: starting in maintenance mode, redirects are answered with a status page")
+	}
+	if mode.ReadOnly() {
+		log.Printf("warn: starting in read-only mode, changes to links are refused")
+	}
+
+	srv := &httpapi.Server{
+		Links:              db,
+		Resolver:           res,
+		Analytics:          clicks,
+		SlugLength:         slugLength,
+		LinkQuota:          env.Int("LINK_QUOTA", 0, 0, 1<<30),
+		PreviewAll:         env.Bool("PREVIEW_MODE", false),
+		SuffixCommands:     suffixCommands,
+		MaxRequestBody:     int64(env.Int("MAX_REQUEST_BODY", 1<<20, 1<<10, 1<<30)),
+		PublicNewLinks:     env.Bool("PUBLIC_NEW_LINKS", false),
+		LinkApproval:       env.Bool("LINK_APPROVAL", false),
+		FallbackURL:        fallbackURL,
+		Auth:               auth,
+		PrivateNets:        privateNets,
+		TrustProxy:         trustProxy,
+		Access:             access,
+		APIAccess:          apiAccess,
+		Domains:            doms,
+		Shadow:             shadow,
+		GeoIP:              geoIP,
+		CountryHeader:      os.Getenv("GEOIP_COUNTRY_HEADER"),
+		StickySplits:       env.Bool("STICKY_SPLITS", true),
+		CacheControl:       cacheControl,
+		PermanentRedirects: env.Bool("PERMANENT_REDIRECTS", false),
+		ProviderTimeout:    providerTimeout,
+		Mode:               mode,
+		AuditLog:           store.NewAuditLog(provider),
+		AccessLog:          accessLog,
+		ReadyMaxFailing:    env.Duration("READY_MAX_FAILING", time.Minute*10),
+		SlackSecret:        os.Getenv("SLACK_SIGNING_SECRET"),
+		SigningKey:         signingKey,
+		UnlockTTL:          env.Duration("UNLOCK_TTL", time.Hour),
+		DebugEndpoints:     env.Bool("DEBUG_ENDPOINTS", false),
+		GoHostnames:        goHostnames,
+		PACProxy:           os.Getenv("PAC_PROXY"),
+		SnapshotDir:        os.Getenv("SNAPSHOT_DIR"),
+		Version:            version,
+		Commit:             commit,
+		Backend:            store.DefaultProvider(),
+	}
+
+	srv.Resolver.Latency.SLO = env.Duration("LATENCY_SLO", srv.Resolver.Latency.SLO)
+	if path := os.Getenv("ROBOTS_TXT_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("failed to read ROBOTS_TXT_FILE: %v", err)
+		}
+		srv.RobotsTxt = string(b)
+	}
+
+	// Deleted links stay restorable for TRASH_RETENTION; 0 deletes them
+	// right away.
+	if srv.TrashRetention = env.DurationOrZero("TRASH_RETENTION", 30*24*time.Hour); srv.TrashRetention > 0 {
+		go db.RunPurge(ctx, srv.TrashRetention)
+	}
+
+	if interval := env.DurationOrZero("LINK_CHECK_INTERVAL", 0); interval > 0 {
+		srv.Checker = resolver.NewLinkChecker(db)
+		go srv.Checker.Run(ctx, interval)
+	}
+	if interval := env.DurationOrZero("PAGE_INFO_INTERVAL", 0); interval > 0 {
+		srv.Pages = resolver.NewPageFetcher(db)
+		go srv.Pages.Run(ctx, interval)
+	}
+
+	if period := env.DurationOrZero("REPORT_INTERVAL", 0); period > 0 {
+		reporter, err := httpapi.NewReporter(srv, os.Getenv("SMTP_ADDR"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("REPORT_FROM"))
+		if err != nil {
+			log.Fatalf("failed to configure link reports: %v", err)
+		}
+		if reporter.Base = os.Getenv("REPORT_BASE_URL"); reporter.Base == "" {
+			reporter.Base = os.Getenv("CANONICAL_URL")
+		}
+		if reporter.Base == "" {
+			log.Fatalf("REPORT_INTERVAL needs REPORT_BASE_URL or CANONICAL_URL to link to the shortcuts")
+		}
+		reporter.Domain = os.Getenv("REPORT_EMAIL_DOMAIN")
+		reporter.ExpiringWithin = env.Duration("REPORT_EXPIRING_WITHIN", reporter.ExpiringWithin)
+		reporter.UnusedMonths = env.Int("REPORT_UNUSED_MONTHS", reporter.UnusedMonths, 0, 120)
+		go reporter.Run(ctx, period)
+	}
+
+	// Event streams end a second before WRITE_TIMEOUT would cut them off.
+	writeTimeout := env.Duration("WRITE_TIMEOUT", time.Second*10)
+	srv.Events = httpapi.NewEvents()
+	srv.StreamTimeout = writeTimeout - time.Second
+	if srv.StreamTimeout < time.Second {
+		srv.StreamTimeout = writeTimeout
+	}
+	go srv.Events.Run(ctx, db)
+
+	if urls := os.Getenv("WEBHOOK_URLS"); urls != "" {
+		hooks, err := httpapi.NewWebhooks(urls, os.Getenv("WEBHOOK_EVENTS"), os.Getenv("WEBHOOK_SECRET"))
+		if err != nil {
+			log.Fatalf("failed to configure webhooks: %v", err)
+		}
+		if hooks.ClickThresholds, err = httpapi.ParseClickThresholds(os.Getenv("WEBHOOK_CLICK_THRESHOLDS")); err != nil {
+			log.Fatalf("invalid WEBHOOK_CLICK_THRESHOLDS: %v", err)
+		}
+		hooks.MaxAttempts = env.Int("WEBHOOK_MAX_ATTEMPTS", 5, 1, 100)
+		srv.Webhooks = hooks
+		go hooks.Run(ctx, db, clicks)
+	}
+
+	metrics.NewGaugeFunc("shortener_refresh_interval_seconds",
+		"Current effective interval between link table refreshes.",
+		func() float64 { return sched.Interval().Seconds() })
+
+	if rps := env.Float("RATE_LIMIT_RPS", 0); rps > 0 {
+		srv.Limiter = httpapi.NewRateLimiter(rps, env.Int("RATE_LIMIT_BURST", 20, 1, 1<<20), trustProxy)
+		go srv.Limiter.Run(ctx)
+	}
+	if srv.DebugEndpoints && !auth.Enabled() {
+		log.Printf("warn: DEBUG_ENDPOINTS needs API_TOKENS or Google sign-in, not serving /debug")
+		srv.DebugEndpoints = false
+	}
+	if srv.LinkApproval && !auth.Enabled() {
+		log.Fatalf("LINK_APPROVAL needs API_TOKENS or Google sign-in to tell admins apart")
+	}
+	if srv.SnapshotDir != "" && !auth.Enabled() {
+		log.Fatalf("SNAPSHOT_DIR needs API_TOKENS or Google sign-in to protect /api/snapshots")
+	}
+	if path := os.Getenv("TENANTS_FILE"); path != "" {
+		if !auth.Enabled() {
+			log.Fatalf("TENANTS_FILE needs API_TOKENS or Google sign-in to protect /api/tenants")
+		}
+		if srv.Tenants, err = httpapi.NewTenants(ctx, path, srv); err != nil {
+			log.Fatalf("failed to configure tenants: %v", err)
+		}
+	}
+	// A mux of our own, since importing net/http/pprof registers the
+	// profiles on the default one, unauthenticated.
+	mux := http.NewServeMux()
+	srv.Register(mux)
+
+	var handler http.Handler = tracing.Handler(muxRoute(mux), mux)
+	handler = srv.Tenants.Handler(handler)
+	if v := os.Getenv("CANONICAL_URL"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			log.Fatalf("invalid CANONICAL_URL %q, expected scheme://host", v)
+		}
+		// The hosts of tenants are theirs to keep too.
+		keep := func(host string) bool { return doms.Configured(host) || srv.Tenants.Serves(host) }
+		handler = httpapi.CanonicalHost(strings.ToLower(u.Scheme), u.Host, trustProxy, keep, handler)
+	}
+
+	tlsConfig, acmeHandler, err := serverTLS()
+	if err != nil {
+		log.Fatalf("failed to configure TLS: %v", err)
+	}
+
+	// Load the links before taking traffic, so the first visitors after a
+	// deploy don't wait for the backend or fail on its hiccups.
+	warmUp(ctx, db, env.DurationOrZero("WARM_TIMEOUT", time.Second*30))
+
+	// Sockets passed by systemd serve the site, except those named grpc and
+	// acme in the .socket unit, see GRPC_ADDR and ACME_HTTP_ADDR.
+	var listeners []net.Listener
+	for name, ls := range activated {
+		if name != "grpc" && name != "acme" {
+			listeners = append(listeners, ls...)
+		}
+	}
+	for _, addr := range listenAddrs {
+		l, err := listen(addr)
+		if err != nil {
+			log.Fatalf("failed to listen on %s: %v", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	idleTimeout := env.Duration("IDLE_TIMEOUT", time.Second*60)
+	// Proxies may speak HTTP/2 to the backend without TLS.
+	if tlsConfig == nil && env.Bool("H2C", false) {
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: idleTimeout})
+	}
+
+	httpSrv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: env.Duration("READ_HEADER_TIMEOUT", time.Second*5),
+		ReadTimeout:       env.Duration("READ_TIMEOUT", time.Second*10),
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		TLSConfig:         tlsConfig,
+	}
+	servers := []*http.Server{httpSrv}
+	errc := make(chan error, len(listeners)+2)
+	for _, l := range listeners {
+		log.Printf("Starting server at %s", l.Addr())
+		go func(l net.Listener) {
+			if tlsConfig != nil {
+				errc <- httpSrv.ServeTLS(l, "", "")
+			} else {
+				errc <- httpSrv.Serve(l)
+			}
+		}(l)
+	}
+	// ACME HTTP-01 challenges must be answered on port 80.
+	if acmeListeners := listenersFor(activated["acme"], "ACME_HTTP_ADDR"); len(acmeListeners) > 0 && acmeHandler != nil {
+		acmeSrv := &http.Server{Handler: acmeHandler, ReadHeaderTimeout: httpSrv.ReadHeaderTimeout}
+		servers = append(servers, acmeSrv)
+		for _, l := range acmeListeners {
+			log.Printf("Answering ACME challenges at %s", l.Addr())
+			go func(l net.Listener) {
+				errc <- acmeSrv.Serve(l)
+			}(l)
+		}
+	}
+	// gRPC runs on its own listener: streams outlive WriteTimeout and plain
+	// text HTTP/2 needs h2c.
+	if grpcListeners := listenersFor(activated["grpc"], "GRPC_ADDR"); len(grpcListeners) > 0 {
+		grpcSrv := &http.Server{
+			Handler:           h2c.NewHandler(srv.GRPCHandler(ctx.Done()), &http2.Server{}),
+			ReadHeaderTimeout: httpSrv.ReadHeaderTimeout,
+			IdleTimeout:       httpSrv.IdleTimeout,
+			TLSConfig:         tlsConfig,
+		}
+		servers = append(servers, grpcSrv)
+		for _, l := range grpcListeners {
+			log.Printf("Starting gRPC server at %s", l.Addr())
+			go func(l net.Listener) {
+				if tlsConfig != nil {
+					errc <- grpcSrv.ServeTLS(l, "", "")
+				} else {
+					errc <- grpcSrv.Serve(l)
+				}
+			}(l)
+		}
+	}
+
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	// Stop accepting connections and wait for in-flight requests; a second
+	// signal kills the process immediately since stop() restored the
+	// default handlers.
+	shutdownTimeout := env.Duration("SHUTDOWN_TIMEOUT", time.Second*30)
+	log.Printf("shutting down, draining connections for up to %v", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			log.Printf("warn: shutdown: %v", err)
+		}
+	}
+	if err := clicks.Flush(shutdownCtx); err != nil {
+		log.Printf("warn: failed to flush analytics: %v", err)
+	}
+	if err := srv.Tenants.Flush(shutdownCtx); err != nil {
+		log.Printf("warn: failed to flush the analytics of tenants: %v", err)
+	}
+	if tracing.Default != nil {
+		if err := tracing.Default.Flush(shutdownCtx); err != nil {
+			log.Printf("warn: failed to export spans: %v", err)
+		}
+	}
+	log.Printf("server stopped")
+}
+
+// muxRoute names server spans after the pattern of mux that serves the
+// request, to keep span names few.
+func muxRoute(mux *http.ServeMux) func(*http.Request) string {
+	return func(req *http.Request) string {
+		_, pattern := mux.Handler(req)
+		return pattern
+	}
+}
+
+// warmer is the part of the link cache that warmUp needs.
+type warmer interface {
+	WaitWarm(ctx context.Context) error
+}
+
+// warmUp waits up to timeout for db to load the links. A zero timeout
+// skips the wait, for deployments that would rather listen right away.
+func warmUp(ctx context.Context, db warmer, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	start := time.Now()
+	wctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := db.WaitWarm(wctx); err != nil {
+		log.Printf("warn: links not loaded after %v, serving anyway", timeout)
+		return
+	}
+	log.Printf("links loaded in %v", time.Since(start).Round(time.Millisecond))
+}
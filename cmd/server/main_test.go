@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type countingWarmer int
+
+func (w *countingWarmer) WaitWarm(context.Context) error {
+	*w++
+	return nil
+}
+
+func TestWarmUp(t *testing.T) {
+	var w countingWarmer
+	warmUp(context.Background(), &w, 0)
+	if w != 0 {
+		t.Errorf("WARM_TIMEOUT=0 waited for the links %d times", w)
+	}
+	warmUp(context.Background(), &w, time.Second)
+	if w != 1 {
+		t.Errorf("WARM_TIMEOUT=1s waited for the links %d times, want 1", w)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serverTLS configures HTTPS from the environment: either a certificate and
+// key from TLS_CERT and TLS_KEY, or certificates obtained from Let's Encrypt
+// for the comma-separated ACME_DOMAIN. It returns a nil config when TLS is
+// off. In ACME mode, the returned handler answers HTTP-01 challenges and
+// redirects everything else to HTTPS.
+func serverTLS() (*tls.Config, http.Handler, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	domains := os.Getenv("ACME_DOMAIN")
+
+	switch {
+	case domains != "" && (certFile != "" || keyFile != ""):
+		return nil, nil, errors.New("ACME_DOMAIN and TLS_CERT/TLS_KEY are mutually exclusive")
+
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, nil, errors.New("TLS_CERT and TLS_KEY must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load certificate: %w", err)
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}, nil, nil
+
+	case domains != "":
+		var hosts []string
+		for _, d := range strings.Split(domains, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				hosts = append(hosts, strings.ToLower(d))
+			}
+		}
+		cacheDir := os.Getenv("ACME_CACHE_DIR")
+		if cacheDir == "" {
+			cacheDir = "autocert-cache"
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cacheDir),
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Email:      os.Getenv("ACME_EMAIL"),
+		}
+		cfg := m.TLSConfig()
+		cfg.MinVersion = tls.VersionTLS12
+		return cfg, m.HTTPHandler(nil), nil
+	}
+	return nil, nil, nil
+}
+
+// clientTLS configures the HTTPS clients of the server, which reach the
+// providers, webhooks, analytics sinks and checked links through
+// http.DefaultTransport: OUTBOUND_CA_FILE adds PEM certificates to the
+// trusted roots, for egress proxies with a private CA, and
+// OUTBOUND_TLS_CERT and OUTBOUND_TLS_KEY present a client certificate. It
+// returns a nil config when none is set.
+func clientTLS() (*tls.Config, error) {
+	caFile := os.Getenv("OUTBOUND_CA_FILE")
+	certFile, keyFile := os.Getenv("OUTBOUND_TLS_CERT"), os.Getenv("OUTBOUND_TLS_KEY")
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read OUTBOUND_CA_FILE: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil || roots == nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates in OUTBOUND_CA_FILE %s", caFile)
+		}
+		cfg.RootCAs = roots
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("OUTBOUND_TLS_CERT and OUTBOUND_TLS_KEY must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
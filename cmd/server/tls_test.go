@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the tests, writing them and their keys as
+// PEM files into dir.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{t: t, dir: t.TempDir()}
+	ca.cert, ca.key = ca.issue("test CA", nil)
+	return ca
+}
+
+// issue returns a new certificate named name, signed by the CA, or by
+// itself when template is nil.
+func (ca *testCA) issue(name string, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	parent, signer := tmpl, key
+	if template == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.ExtKeyUsage = template.ExtKeyUsage
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return cert, key
+}
+
+// write saves the PEM blocks of typ with the contents der as file name,
+// returning its path.
+func (ca *testCA) write(name, typ string, der ...[]byte) string {
+	ca.t.Helper()
+	var b []byte
+	for _, d := range der {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: d})...)
+	}
+	path := filepath.Join(ca.dir, name)
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return path
+}
+
+// clientPair issues a client certificate, returning the paths of its
+// certificate and key files.
+func (ca *testCA) clientPair(name string) (certFile, keyFile string) {
+	ca.t.Helper()
+	cert, key := ca.issue(name, &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return ca.write(name+".pem", "CERTIFICATE", cert.Raw), ca.write(name+"-key.pem", "EC PRIVATE KEY", der)
+}
+
+func setClientTLSEnv(t *testing.T, caFile, certFile, keyFile string) {
+	t.Setenv("OUTBOUND_CA_FILE", caFile)
+	t.Setenv("OUTBOUND_TLS_CERT", certFile)
+	t.Setenv("OUTBOUND_TLS_KEY", keyFile)
+}
+
+func TestClientTLS(t *testing.T) {
+	ca := newTestCA(t)
+	caFile := ca.write("ca.pem", "CERTIFICATE", ca.cert.Raw)
+	certFile, keyFile := ca.clientPair("client")
+	otherCert, otherKey := ca.clientPair("other")
+	badPEM := filepath.Join(ca.dir, "bad.pem")
+	if err := os.WriteFile(badPEM, []byte("-----BEGIN CERTIFICATE-----\nnot base64\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	setClientTLSEnv(t, "", "", "")
+	if cfg, err := clientTLS(); cfg != nil || err != nil {
+		t.Errorf("nothing set: clientTLS() = %v, %v, want nil", cfg, err)
+	}
+
+	setClientTLSEnv(t, caFile, "", "")
+	cfg, err := clientTLS()
+	if err != nil {
+		t.Fatalf("CA only: %v", err)
+	}
+	if cfg.RootCAs == nil || len(cfg.Certificates) != 0 {
+		t.Errorf("CA only: roots = %v, %d certificates", cfg.RootCAs, len(cfg.Certificates))
+	}
+	if _, err := ca.cert.Verify(x509.VerifyOptions{Roots: cfg.RootCAs}); err != nil {
+		t.Errorf("CA only: the CA isn't trusted: %v", err)
+	}
+
+	setClientTLSEnv(t, "", certFile, keyFile)
+	if cfg, err := clientTLS(); err != nil || len(cfg.Certificates) != 1 {
+		t.Errorf("client certificate: clientTLS() = %v, %v", cfg, err)
+	}
+
+	for _, tt := range []struct {
+		name                      string
+		caFile, certFile, keyFile string
+		want                      string
+	}{
+		{"bad PEM", badPEM, "", "", "no PEM certificates"},
+		{"missing CA file", filepath.Join(ca.dir, "missing.pem"), "", "", "failed to read OUTBOUND_CA_FILE"},
+		{"mismatched certificate and key", "", certFile, otherKey, "failed to load client certificate"},
+		{"certificate without key", "", otherCert, "", "must be set together"},
+		{"key without certificate", "", "", keyFile, "must be set together"},
+		{"key as certificate", "", keyFile, keyFile, "failed to load client certificate"},
+	} {
+		setClientTLSEnv(t, tt.caFile, tt.certFile, tt.keyFile)
+		if _, err := clientTLS(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// TestClientTLSRoundTrip reaches a server that requires a client
+// certificate, with a client built like those of the providers and sinks,
+// which rely on http.DefaultTransport.
+func TestClientTLSRoundTrip(t *testing.T) {
+	ca := newTestCA(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func() (string, error) {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport)
+	defer func(cfg *tls.Config) {
+		transport.TLSClientConfig = cfg
+		transport.CloseIdleConnections()
+	}(transport.TLSClientConfig)
+	if _, err := get(); err == nil {
+		t.Fatal("reached the server without trusting its CA")
+	}
+
+	certFile, keyFile := ca.clientPair("shortener")
+	setClientTLSEnv(t, ca.write("server-ca.pem", "CERTIFICATE", ts.Certificate().Raw), certFile, keyFile)
+	cfg, err := clientTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.TLSClientConfig = cfg
+	transport.CloseIdleConnections()
+	name, err := get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "shortener" {
+		t.Errorf("server saw client certificate %q, want shortener", name)
+	}
+}
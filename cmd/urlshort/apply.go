@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// linkFile is a file of declared links for urlshort apply:
+//
+//	links:
+//	  docs:
+//	    url: https://example.com/docs
+//	    description: Team documentation
+//	    tags: [oncall]
+//	  status:
+//	    type: markdown
+//	    content: "All systems **operational**."
+type linkFile struct {
+	Links map[string]linkSpec `yaml:"links"`
+}
+
+// linkSpec is a declared link. Fields left out are reset on the server, as
+// a PUT does, except the owner, which then stays as it is.
+type linkSpec struct {
+	URL          string     `yaml:"url,omitempty"`
+	Type         string     `yaml:"type,omitempty"`
+	Content      string     `yaml:"content,omitempty"`
+	Description  string     `yaml:"description,omitempty"`
+	Tags         []string   `yaml:"tags,omitempty"`
+	Owner        string     `yaml:"owner,omitempty"`
+	Status       int        `yaml:"status,omitempty"`
+	Params       string     `yaml:"params,omitempty"`
+	CacheControl string     `yaml:"cache_control,omitempty"`
+	Private      bool       `yaml:"private,omitempty"`
+	Preview      bool       `yaml:"preview,omitempty"`
+	MaxClicks    int64      `yaml:"max_clicks,omitempty"`
+	ActiveFrom   *time.Time `yaml:"active_from,omitempty"`
+	ActiveUntil  *time.Time `yaml:"active_until,omitempty"`
+	Disabled     bool       `yaml:"disabled,omitempty"`
+}
+
+// loadLinkFile reads a file of declared links, normalizing shortcuts and
+// tags the way the server does.
+func loadLinkFile(path string) (map[string]linkSpec, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f linkFile
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	specs := make(map[string]linkSpec, len(f.Links))
+	for k, spec := range f.Links {
+		shortcut := strings.ToLower(strings.Trim(k, "/"))
+		if shortcut == "" {
+			return nil, fmt.Errorf("%s: empty shortcut", path)
+		}
+		if _, ok := specs[shortcut]; ok {
+			return nil, fmt.Errorf("%s: shortcut %q is declared twice", path, shortcut)
+		}
+		specs[shortcut] = spec.normalized()
+	}
+	return specs, nil
+}
+
+// normalized returns spec with lowercase tags without duplicates and times
+// in UTC, so that it compares equal to what the server returns.
+func (spec linkSpec) normalized() linkSpec {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, t := range spec.Tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	spec.Tags = tags
+	for _, t := range []**time.Time{&spec.ActiveFrom, &spec.ActiveUntil} {
+		if *t != nil {
+			utc := (*t).UTC()
+			*t = &utc
+		}
+	}
+	return spec
+}
+
+// specOf returns the declaration matching the link l on the server.
+func specOf(l link) linkSpec {
+	return linkSpec{
+		URL:          l.URL,
+		Type:         l.Type,
+		Content:      l.Content,
+		Description:  l.Description,
+		Tags:         l.Tags,
+		Owner:        l.Owner,
+		Status:       l.Status,
+		Params:       l.Params,
+		CacheControl: l.CacheControl,
+		Private:      l.Private,
+		Preview:      l.Preview,
+		MaxClicks:    l.MaxClicks,
+		ActiveFrom:   l.ActiveFrom,
+		ActiveUntil:  l.ExpiresAt,
+		Disabled:     l.Disabled,
+	}.normalized()
+}
+
+// link returns the request creating or replacing shortcut with spec.
+func (spec linkSpec) link(shortcut string) link {
+	return link{
+		Shortcut:     shortcut,
+		URL:          spec.URL,
+		Type:         spec.Type,
+		Content:      spec.Content,
+		Description:  spec.Description,
+		Tags:         spec.Tags,
+		Owner:        spec.Owner,
+		Status:       spec.Status,
+		Params:       spec.Params,
+		CacheControl: spec.CacheControl,
+		Private:      spec.Private,
+		Preview:      spec.Preview,
+		MaxClicks:    spec.MaxClicks,
+		ActiveFrom:   spec.ActiveFrom,
+		ActiveUntil:  spec.ActiveUntil,
+		Disabled:     spec.Disabled,
+	}
+}
+
+// changedFields returns the YAML names of the fields in which want differs
+// from have. An empty owner in want matches any.
+func changedFields(want, have linkSpec) []string {
+	if want.Owner == "" {
+		want.Owner = have.Owner
+	}
+	var fields []string
+	wv, hv := reflect.ValueOf(want), reflect.ValueOf(have)
+	for i := 0; i < wv.NumField(); i++ {
+		if !reflect.DeepEqual(wv.Field(i).Interface(), hv.Field(i).Interface()) {
+			name := strings.Split(wv.Type().Field(i).Tag.Get("yaml"), ",")[0]
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// change is a step of the plan of urlshort apply.
+type change struct {
+	op       byte // '+' creates, '~' updates and '-' deletes
+	shortcut string
+	spec     linkSpec
+	fields   []string
+	current  *link
+}
+
+// plan returns the changes making the links on the server match specs.
+func plan(specs map[string]linkSpec, current []link) []change {
+	have := make(map[string]*link, len(current))
+	for i := range current {
+		have[current[i].Shortcut] = &current[i]
+	}
+	var changes []change
+	for shortcut, spec := range specs {
+		l := have[shortcut]
+		if l == nil {
+			changes = append(changes, change{op: '+', shortcut: shortcut, spec: spec})
+		} else if fields := changedFields(spec, specOf(*l)); len(fields) > 0 {
+			changes = append(changes, change{op: '~', shortcut: shortcut, spec: spec, fields: fields, current: l})
+		}
+	}
+	for shortcut, l := range have {
+		if _, ok := specs[shortcut]; !ok {
+			changes = append(changes, change{op: '-', shortcut: shortcut, current: l})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].shortcut < changes[j].shortcut })
+	return changes
+}
+
+// String describes c for the plan.
+func (c change) String() string {
+	switch c.op {
+	case '+':
+		return fmt.Sprintf("+ %s -> %s", c.shortcut, c.spec.link(c.shortcut).target())
+	case '~':
+		return fmt.Sprintf("~ %s: %s", c.shortcut, strings.Join(c.fields, ", "))
+	}
+	return fmt.Sprintf("- %s (%s)", c.shortcut, c.current.target())
+}
+
+func cmdApply(c *client, args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only print the plan")
+	tag := fs.String("tag", "", "only manage the links with this tag, leaving the others alone")
+	var pos []string
+	for len(args) > 0 {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		pos = append(pos, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(pos) != 1 {
+		return fmt.Errorf("usage: urlshort apply <file.yaml> [-dry-run] [-tag TAG]")
+	}
+	specs, err := loadLinkFile(pos[0])
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	if *tag != "" {
+		*tag = strings.ToLower(strings.TrimSpace(*tag))
+		q.Set("tag", *tag)
+		// Links without the tag would be created again on every run.
+		for shortcut, spec := range specs {
+			if !hasTag(spec.Tags, *tag) {
+				return fmt.Errorf("%s: link %q lacks the tag %q managed with -tag", pos[0], shortcut, *tag)
+			}
+		}
+	}
+	current, _, err := c.list(q, "")
+	if err != nil {
+		return err
+	}
+
+	changes := plan(specs, current)
+	counts := map[byte]int{}
+	for _, ch := range changes {
+		fmt.Println(ch)
+		counts[ch.op]++
+	}
+	fmt.Printf("plan: %d to create, %d to update, %d to delete.\n", counts['+'], counts['~'], counts['-'])
+	if *dryRun || len(changes) == 0 {
+		return nil
+	}
+
+	for _, ch := range changes {
+		var err error
+		switch ch.op {
+		case '+':
+			_, err = c.add(ch.spec.link(ch.shortcut))
+		case '~':
+			l := ch.spec.link(ch.shortcut)
+			// Passwords are never returned; keep the current one.
+			l.Protected = ch.current.Protected
+			if l.Owner == "" {
+				l.Owner = ch.current.Owner
+			}
+			_, err = c.replace(l)
+		case '-':
+			err = c.remove(ch.shortcut)
+		}
+		if err != nil {
+			return fmt.Errorf("applying %q: %w", ch.shortcut, err)
+		}
+	}
+	fmt.Printf("applied %d changes.\n", len(changes))
+	return nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
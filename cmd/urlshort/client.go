@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// link mirrors the JSON of /api/links.
+type link struct {
+	Shortcut     string     `json:"shortcut"`
+	URL          string     `json:"url,omitempty"`
+	Type         string     `json:"type,omitempty"`
+	Content      string     `json:"content,omitempty"`
+	TTL          string     `json:"ttl,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	ActiveFrom   *time.Time `json:"active_from,omitempty"`
+	ActiveUntil  *time.Time `json:"active_until,omitempty"`
+	Status       int        `json:"status,omitempty"`
+	Private      bool       `json:"private,omitempty"`
+	Preview      bool       `json:"preview,omitempty"`
+	Params       string     `json:"params,omitempty"`
+	Owner        string     `json:"owner,omitempty"`
+	Password     string     `json:"password,omitempty"`
+	Protected    bool       `json:"protected,omitempty"`
+	CacheControl string     `json:"cache_control,omitempty"`
+	Description  string     `json:"description,omitempty"`
+	Tags         []string   `json:"tags,omitempty"`
+	MaxClicks    int64      `json:"max_clicks,omitempty"`
+	Disabled     bool       `json:"disabled,omitempty"`
+	Unapproved   bool       `json:"unapproved,omitempty"`
+	Hits         int64      `json:"hits,omitempty"`
+}
+
+// target is where l leads, or its type for links showing content.
+func (l link) target() string {
+	if l.Type != "" {
+		return "(" + l.Type + ")"
+	}
+	return l.URL
+}
+
+type stats struct {
+	Shortcut     string           `json:"shortcut"`
+	Total        int64            `json:"total"`
+	PerDay       map[string]int64 `json:"per_day"`
+	TopReferrers []struct {
+		Referrer string `json:"referrer"`
+		Hits     int64  `json:"hits"`
+	} `json:"top_referrers"`
+	Destinations []struct {
+		URL   string  `json:"url"`
+		Hits  int64   `json:"hits"`
+		Share float64 `json:"share"`
+	} `json:"destinations"`
+}
+
+// version mirrors the entries of /api/links/{shortcut}/history.
+type version struct {
+	Version int    `json:"version"`
+	Time    string `json:"time"`
+	Actor   string `json:"actor"`
+	Action  string `json:"action"`
+	Link    *link  `json:"link"`
+}
+
+// client calls the REST API of a server.
+type client struct {
+	server string
+	token  string
+	http   http.Client
+}
+
+// do sends a request with an optional JSON body and decodes the JSON
+// response into out unless it is nil.
+func (c *client) do(method, path string, in, out interface{}) error {
+	resp, err := c.send(method, path, in, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send sends a request with an optional JSON body and extra headers,
+// turning error responses into errors. 304 Not Modified is not one.
+func (c *client) send(method, path string, in interface{}, header http.Header) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotModified {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		var e struct {
+			Error struct{ Code, Message string }
+		}
+		if json.Unmarshal(msg, &e) == nil && e.Error.Message != "" {
+			return nil, fmt.Errorf("%s %s: %s (%s)", method, path, e.Error.Message, e.Error.Code)
+		}
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// linkPath escapes each segment of a shortcut for use in a URL path.
+func linkPath(shortcut string) string {
+	segments := strings.Split(strings.Trim(shortcut, "/"), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return "/api/links/" + strings.Join(segments, "/")
+}
+
+func (c *client) add(l link) (*link, error) {
+	var out link
+	if err := c.do(http.MethodPost, "/api/links", l, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// replace overwrites every field of the link l.Shortcut with those of l.
+func (c *client) replace(l link) (*link, error) {
+	var out link
+	if err := c.do(http.MethodPut, linkPath(l.Shortcut), l, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// list returns the links matching q and the ETag of the list. Given the
+// ETag of an earlier list, it returns nil links if nothing changed.
+func (c *client) list(q url.Values, etag string) ([]link, string, error) {
+	path := "/api/links"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	header := http.Header{}
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	resp, err := c.send(http.MethodGet, path, nil, header)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	}
+	var out []link
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, "", err
+	}
+	return out, resp.Header.Get("ETag"), nil
+}
+
+func (c *client) search(query string) ([]link, error) {
+	var out struct {
+		Results []link `json:"results"`
+	}
+	if err := c.do(http.MethodGet, "/api/search?q="+url.QueryEscape(query), nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Results, nil
+}
+
+func (c *client) remove(shortcut string) error {
+	return c.do(http.MethodDelete, linkPath(shortcut), nil, nil)
+}
+
+func (c *client) restore(shortcut string) (*link, error) {
+	var out link
+	if err := c.do(http.MethodPost, linkPath(shortcut)+"/restore", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *client) disable(shortcut string) (*link, error) {
+	var out link
+	if err := c.do(http.MethodPost, linkPath(shortcut)+"/disable", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *client) approve(shortcut string) (*link, error) {
+	var out link
+	if err := c.do(http.MethodPost, linkPath(shortcut)+"/approve", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *client) stats(shortcut string) (*stats, error) {
+	var out stats
+	if err := c.do(http.MethodGet, linkPath(shortcut)+"/stats", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *client) history(shortcut string) ([]version, error) {
+	var out []version
+	if err := c.do(http.MethodGet, linkPath(shortcut)+"/history", nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *client) rollback(shortcut string, v int) (*link, error) {
+	var out link
+	in := struct {
+		Version int `json:"version"`
+	}{v}
+	if err := c.do(http.MethodPost, linkPath(shortcut)+"/rollback", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
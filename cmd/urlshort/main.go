@@ -0,0 +1,420 @@
+// Command urlshort manages links of a url-shortener server through its REST
+// API.
+//
+//	urlshort add go/docs https://example.com/docs [-ttl 24h | -until 2024-06-01T18:00:00Z] [-from 2024-06-01T09:00:00Z] [-status 301] [-params utm_source=golink] [-password PASSWORD] [-cache POLICY] [-type TYPE] [-description TEXT] [-tags TAG,...] [-max-clicks N]
+//	urlshort ls [-tag oncall] [-deleted | -unapproved] [-sort -hits] [-watch 30s]
+//	urlshort search oncall
+//	urlshort rm go/docs
+//	urlshort restore go/docs
+//	urlshort disable go/docs
+//	urlshort approve go/docs
+//	urlshort stats go/docs
+//	urlshort history go/docs
+//	urlshort rollback go/docs 3
+//	urlshort apply links.yaml [-dry-run] [-tag oncall]
+//
+// The server and API token are read from ~/.urlshort.yaml:
+//
+//	server: https://go.example.com
+//	token: s3cr3t
+//
+// and can be overridden with URLSHORT_SERVER and URLSHORT_TOKEN or the
+// -server and -token flags.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type config struct {
+	Server string `yaml:"server"`
+	Token  string `yaml:"token"`
+}
+
+// loadConfig reads ~/.urlshort.yaml, which may be missing.
+func loadConfig() (*config, error) {
+	cfg := &config{}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return cfg, nil
+	}
+	path := filepath.Join(home, ".urlshort.yaml")
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: urlshort [-server URL] [-token TOKEN] <command> [arguments]
+
+commands:
+  add <shortcut> <url> [-ttl DURATION | -until TIME] [-from TIME] [-status CODE] [-params QUERY] [-password PASSWORD] [-cache POLICY] [-type TYPE] [-description TEXT] [-tags TAG,...] [-max-clicks N]
+                         create a link; use "" as shortcut for a random one
+  ls [-tag TAG] [-deleted | -unapproved] [-sort FIELD] [-watch INTERVAL]
+                         list links, optionally only those with a tag, those in the trash
+                         or those awaiting approval; -watch lists them again when they change
+  search <query>         find links by shortcut, tags, description or URL
+  rm <shortcut>          delete a link; deleting it again from the trash is for good
+  restore <shortcut>     take a deleted link out of the trash
+  disable <shortcut>     make a link answer 410 Gone right away
+  approve <shortcut>     let a link awaiting approval resolve (admins only)
+  stats <shortcut>       show click statistics of a link
+  history <shortcut>     show the past versions of a link
+  rollback <shortcut> <version>
+                         make a past version of a link current again
+  apply <file.yaml> [-dry-run] [-tag TAG]
+                         create, update and delete links to match a file of declared links,
+                         optionally only those with a tag; -dry-run only prints the plan
+`)
+	os.Exit(2)
+}
+
+func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		fatalf("failed to load config: %v", err)
+	}
+	if v := os.Getenv("URLSHORT_SERVER"); v != "" {
+		cfg.Server = v
+	}
+	if v := os.Getenv("URLSHORT_TOKEN"); v != "" {
+		cfg.Token = v
+	}
+
+	flag.StringVar(&cfg.Server, "server", cfg.Server, "base URL of the url-shortener server")
+	flag.StringVar(&cfg.Token, "token", cfg.Token, "API token")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+	}
+	if cfg.Server == "" {
+		fatalf("no server configured, set server in ~/.urlshort.yaml or URLSHORT_SERVER")
+	}
+	c := &client{
+		server: strings.TrimSuffix(cfg.Server, "/"),
+		token:  cfg.Token,
+		http:   http.Client{Timeout: 30 * time.Second},
+	}
+
+	args := flag.Args()
+	switch args[0] {
+	case "add":
+		err = cmdAdd(c, args[1:])
+	case "ls", "list":
+		err = cmdList(c, args[1:])
+	case "search":
+		err = cmdSearch(c, args[1:])
+	case "rm", "delete":
+		err = cmdRemove(c, args[1:])
+	case "restore":
+		err = cmdRestore(c, args[1:])
+	case "disable":
+		err = cmdDisable(c, args[1:])
+	case "approve":
+		err = cmdApprove(c, args[1:])
+	case "stats":
+		err = cmdStats(c, args[1:])
+	case "history":
+		err = cmdHistory(c, args[1:])
+	case "rollback":
+		err = cmdRollback(c, args[1:])
+	case "apply":
+		err = cmdApply(c, args[1:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "urlshort: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+func cmdAdd(c *client, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	ttl := fs.String("ttl", "", "expire the link after this duration, e.g. 24h")
+	from := fs.String("from", "", "only resolve the link from this RFC 3339 time")
+	until := fs.String("until", "", "expire the link at this RFC 3339 time")
+	status := fs.Int("status", 0, "redirect status code (301, 302, 303, 307 or 308)")
+	params := fs.String("params", "", "query parameters added to every redirect, e.g. utm_source=golink")
+	password := fs.String("password", "", "password visitors must enter before being redirected")
+	cache := fs.String("cache", "", `Cache-Control of redirects, e.g. "max-age=300" or "1h"`)
+	typ := fs.String("type", "", "text, markdown or snippet to show <url> as content instead of redirecting")
+	desc := fs.String("description", "", "what the link is for, to help find it")
+	tags := fs.String("tags", "", "comma-separated tags grouping related links, e.g. oncall,infra")
+	maxClicks := fs.Int64("max-clicks", 0, "answer 410 Gone once the link was followed this many times")
+	// Allow flags after the positional arguments.
+	var pos []string
+	for len(args) > 0 {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		pos = append(pos, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(pos) != 2 {
+		return fmt.Errorf("usage: urlshort add <shortcut> <url> [-ttl DURATION | -until TIME] [-from TIME] [-status CODE] [-params QUERY] [-password PASSWORD] [-cache POLICY] [-type TYPE] [-description TEXT] [-tags TAG,...] [-max-clicks N]")
+	}
+
+	l := link{Shortcut: pos[0], URL: pos[1], TTL: *ttl, Status: *status, Params: *params, Password: *password, CacheControl: *cache, Description: *desc, MaxClicks: *maxClicks}
+	for _, t := range strings.Split(*tags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			l.Tags = append(l.Tags, t)
+		}
+	}
+	if *typ != "" {
+		l.Type, l.URL, l.Content = *typ, "", pos[1]
+	}
+	for _, f := range []struct {
+		name, value string
+		dst         **time.Time
+	}{{"from", *from, &l.ActiveFrom}, {"until", *until, &l.ActiveUntil}} {
+		if f.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, f.value)
+		if err != nil {
+			return fmt.Errorf("-%s must be a time such as 2024-06-01T09:00:00Z", f.name)
+		}
+		*f.dst = &t
+	}
+	created, err := c.add(l)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s/%s -> %s\n", c.server, created.Shortcut, created.target())
+	if created.Unapproved {
+		fmt.Println("it resolves once an admin approves it")
+	}
+	return nil
+}
+
+func cmdList(c *client, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	tag := fs.String("tag", "", "only list links with this tag")
+	deleted := fs.Bool("deleted", false, "list the links in the trash")
+	unapproved := fs.Bool("unapproved", false, "only list links awaiting approval")
+	sortBy := fs.String("sort", "", "sort by shortcut, url, owner, hits, expires_at or active_from; prefix with - to reverse")
+	watch := fs.Duration("watch", 0, "poll the server at this interval and list the links again when they change")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return fmt.Errorf("usage: urlshort ls [-tag TAG] [-deleted | -unapproved] [-sort FIELD] [-watch INTERVAL]")
+	}
+	q := url.Values{}
+	if *tag != "" {
+		q.Set("tag", *tag)
+	}
+	if *deleted {
+		q.Set("deleted", "true")
+	}
+	if *unapproved {
+		q.Set("unapproved", "true")
+	}
+	if *sortBy != "" {
+		q.Set("sort", *sortBy)
+	}
+
+	// Polls send the ETag of the last list, so the server only sends the
+	// links again once they changed.
+	etag := ""
+	for {
+		links, latest, err := c.list(q, etag)
+		if err != nil {
+			return err
+		}
+		if latest != etag || etag == "" {
+			if etag != "" {
+				fmt.Printf("\n%s\n", time.Now().Format("2006-01-02 15:04:05"))
+			}
+			if err := printLinks(links); err != nil {
+				return err
+			}
+		}
+		if *watch <= 0 {
+			return nil
+		}
+		etag = latest
+		time.Sleep(*watch)
+	}
+}
+
+// printLinks lists links as a table.
+func printLinks(links []link) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SHORTCUT\tURL\tHITS\tEXPIRES\tOWNER\tTAGS")
+	for _, l := range links {
+		expires := ""
+		if l.ExpiresAt != nil {
+			expires = l.ExpiresAt.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", l.Shortcut, l.target(), l.Hits, expires, l.Owner, strings.Join(l.Tags, ","))
+	}
+	return w.Flush()
+}
+
+func cmdSearch(c *client, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: urlshort search <query>")
+	}
+	links, err := c.search(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SHORTCUT\tURL\tDESCRIPTION")
+	for _, l := range links {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", l.Shortcut, l.target(), l.Description)
+	}
+	return w.Flush()
+}
+
+func cmdRemove(c *client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: urlshort rm <shortcut>")
+	}
+	if err := c.remove(args[0]); err != nil {
+		return err
+	}
+	fmt.Printf("deleted %s\n", args[0])
+	return nil
+}
+
+func cmdRestore(c *client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: urlshort restore <shortcut>")
+	}
+	l, err := c.restore(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %s/%s -> %s\n", c.server, l.Shortcut, l.target())
+	return nil
+}
+
+func cmdDisable(c *client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: urlshort disable <shortcut>")
+	}
+	l, err := c.disable(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("disabled %s/%s\n", c.server, l.Shortcut)
+	return nil
+}
+
+func cmdApprove(c *client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: urlshort approve <shortcut>")
+	}
+	l, err := c.approve(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("approved %s/%s -> %s\n", c.server, l.Shortcut, l.target())
+	return nil
+}
+
+func cmdStats(c *client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: urlshort stats <shortcut>")
+	}
+	s, err := c.stats(args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d clicks\n", s.Shortcut, s.Total)
+	if len(s.PerDay) > 0 {
+		days := make([]string, 0, len(s.PerDay))
+		for d := range s.PerDay {
+			days = append(days, d)
+		}
+		sort.Strings(days)
+		fmt.Println("\nper day:")
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, d := range days {
+			fmt.Fprintf(w, "  %s\t%d\n", d, s.PerDay[d])
+		}
+		w.Flush()
+	}
+	if len(s.TopReferrers) > 0 {
+		fmt.Println("\ntop referrers:")
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, r := range s.TopReferrers {
+			fmt.Fprintf(w, "  %s\t%d\n", r.Referrer, r.Hits)
+		}
+		w.Flush()
+	}
+	if len(s.Destinations) > 0 {
+		fmt.Println("\ndestinations:")
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, d := range s.Destinations {
+			fmt.Fprintf(w, "  %s\t%d\t%.1f%%\n", d.URL, d.Hits, d.Share)
+		}
+		w.Flush()
+	}
+	return nil
+}
+
+func cmdHistory(c *client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: urlshort history <shortcut>")
+	}
+	versions, err := c.history(args[0])
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tTIME\tACTOR\tACTION\tTARGET")
+	for _, v := range versions {
+		num, target := "-", ""
+		if v.Link != nil {
+			num, target = strconv.Itoa(v.Version), v.Link.target()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", num, v.Time, v.Actor, v.Action, target)
+	}
+	return w.Flush()
+}
+
+func cmdRollback(c *client, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: urlshort rollback <shortcut> <version>")
+	}
+	v, err := strconv.Atoi(args[1])
+	if err != nil || v < 1 {
+		return fmt.Errorf("version must be a positive number")
+	}
+	l, err := c.rollback(args[0], v)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("rolled back %s/%s to version %d -> %s\n", c.server, l.Shortcut, v, l.target())
+	return nil
+}
@@ -0,0 +1,74 @@
+package httpapi
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// ParseCIDRs parses a comma-separated list of CIDR ranges or single
+// addresses.
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// canViewPrivate reports whether req may resolve private links: it comes
+// from one of PRIVATE_ALLOWED_CIDRS or carries a valid API token.
+func (s *Server) canViewPrivate(req *http.Request) bool {
+	if ip := net.ParseIP(clientIP(req, s.TrustProxy)); ip != nil {
+		for _, n := range s.PrivateNets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	if s.Auth == nil {
+		return false
+	}
+	p, err := s.Auth.authenticate(req)
+	if err != nil {
+		log.Printf("warn: failed to look up API token: %v", err)
+	}
+	return p != nil
+}
+
+// canChangeLinks reports whether req carries credentials with the write
+// scope, or needs none because the API is open, as for /api/reload.
+func (s *Server) canChangeLinks(req *http.Request) bool {
+	if s.Auth == nil || !s.Auth.Enabled() {
+		return true
+	}
+	p, err := s.Auth.authenticate(req)
+	if err != nil {
+		log.Printf("warn: failed to look up API token: %v", err)
+	}
+	return p != nil && p.Scope >= store.ScopeWrite
+}
@@ -0,0 +1,234 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of the access log, see ACCESS_LOG_FORMAT.
+const (
+	// AccessLogCombined is the combined log format of Apache and nginx, as
+	// read by GoAccess and AWStats.
+	AccessLogCombined = "combined"
+	// AccessLogJSON writes a JSON object per request.
+	AccessLogJSON = "json"
+)
+
+// AccessLog writes a line per request for shortcuts, apart from the
+// application log, to standard output or a file rotated by size.
+type AccessLog struct {
+	format string
+	path   string
+	// maxSize and backups bound the file: past maxSize bytes it is renamed
+	// to path.1, path.1 to path.2 and so on up to path.<backups>.
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	out  io.Writer
+	file *os.File
+	size int64
+}
+
+// NewAccessLog returns an access log writing in format (AccessLogCombined
+// if empty) to dest, "stdout" or a file path, see ACCESS_LOG. Files grow to
+// maxSize bytes before they are rotated, keeping backups old files; zero
+// never rotates them.
+func NewAccessLog(dest, format string, maxSize int64, backups int) (*AccessLog, error) {
+	switch format {
+	case "":
+		format = AccessLogCombined
+	case AccessLogCombined, AccessLogJSON:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q, expected %s or %s", format, AccessLogCombined, AccessLogJSON)
+	}
+	l := &AccessLog{format: format, maxSize: maxSize, backups: backups}
+	if dest == "stdout" || dest == "-" {
+		l.out = os.Stdout
+		return l, nil
+	}
+	l.path = dest
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the file of l for appending. l.mu must be held once l is in
+// use.
+func (l *AccessLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.out, l.size = f, f, fi.Size()
+	return nil
+}
+
+// Reopen closes and reopens the file of l, after an external tool such as
+// logrotate moved it. It does nothing for standard output.
+func (l *AccessLog) Reopen() error {
+	if l == nil || l.path == "" {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Close()
+	return l.open()
+}
+
+// rotate moves the file of l to path.1, shifting the older ones, and starts
+// a new one. l.mu must be held.
+func (l *AccessLog) rotate() error {
+	l.file.Close()
+	var err error
+	if l.backups <= 0 {
+		os.Remove(l.path)
+	}
+	for i := l.backups; i > 0; i-- {
+		from := l.path
+		if i > 1 {
+			from = l.path + "." + strconv.Itoa(i-1)
+		}
+		if e := os.Rename(from, l.path+"."+strconv.Itoa(i)); e != nil && !os.IsNotExist(e) && err == nil {
+			err = e
+		}
+	}
+	if e := l.open(); e != nil {
+		// Until Reopen succeeds.
+		l.file, l.out = nil, io.Discard
+		return e
+	}
+	return err
+}
+
+func (l *AccessLog) write(line []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil && l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Printf("warn: failed to rotate access log %s: %v", l.path, err)
+		}
+	}
+	n, err := l.out.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("warn: failed to write access log: %v", err)
+	}
+}
+
+// accessEntry is a request as the access log records it.
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote_addr"`
+	Host      string    `json:"host"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Protocol  string    `json:"protocol"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Duration  float64   `json:"duration_seconds"`
+}
+
+// line returns the line logged for e.
+func (l *AccessLog) line(e accessEntry) []byte {
+	if l.format == AccessLogJSON {
+		b, _ := json.Marshal(e)
+		return append(b, '\n')
+	}
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	return []byte(fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		e.Remote, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, escapeLogField(e.URI), e.Protocol, e.Status, size,
+		escapeLogField(e.Referrer), escapeLogField(e.UserAgent)))
+}
+
+// escapeLogField escapes quotes, backslashes and control characters as
+// Apache does, so that a request can't forge lines or fields.
+func escapeLogField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// accessRecorder remembers the status and size of a response.
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (r *accessRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *accessRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// logAccess writes a line to AccessLog for each request served by next.
+func (s *Server) logAccess(next http.HandlerFunc) http.HandlerFunc {
+	if s.AccessLog == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w}
+		next(rec, req)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.AccessLog.write(s.AccessLog.line(accessEntry{
+			Time:      start,
+			Remote:    clientIP(req, s.TrustProxy),
+			Host:      req.Host,
+			Method:    req.Method,
+			URI:       req.RequestURI,
+			Protocol:  req.Proto,
+			Status:    rec.status,
+			Bytes:     rec.size,
+			Referrer:  req.Referer(),
+			UserAgent: req.UserAgent(),
+			Duration:  time.Since(start).Seconds(),
+		}))
+	}
+}
@@ -0,0 +1,21 @@
+package httpapi
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed web/admin.html
+var adminPage []byte
+
+// serveAdmin handles GET /admin, a static page that manages links through
+// the /api/links endpoints.
+func serveAdmin(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(adminPage)
+}
@@ -0,0 +1,355 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+	"github.com/denizyoldas/url-shorter/resolver"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+type referrerCount struct {
+	Referrer string `json:"referrer"`
+	Hits     int64  `json:"hits"`
+}
+
+type destinationCount struct {
+	URL  string `json:"url"`
+	Hits int64  `json:"hits"`
+	// Share is the percentage of the clicks on variants that went to URL.
+	Share float64 `json:"share"`
+}
+
+type statsResponse struct {
+	Shortcut     string           `json:"shortcut"`
+	Total        int64            `json:"total"`
+	PerDay       map[string]int64 `json:"per_day"`
+	TopReferrers []referrerCount  `json:"top_referrers"`
+	// Destinations is the click distribution of links with variants, such
+	// as A/B splits.
+	Destinations []destinationCount `json:"destinations,omitempty"`
+	// Health is the last dead-link check, see LINK_CHECK_INTERVAL.
+	Health *resolver.LinkHealth `json:"health,omitempty"`
+	// Latency is that of its recent redirects.
+	Latency *resolver.LatencySummary `json:"latency,omitempty"`
+}
+
+// newStatsResponse returns the statistics of shortcut as served by the API.
+func newStatsResponse(shortcut string, ls *store.LinkStats) statsResponse {
+	refs := make([]referrerCount, 0, len(ls.Referrers))
+	for r, n := range ls.Referrers {
+		refs = append(refs, referrerCount{Referrer: r, Hits: n})
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Hits != refs[j].Hits {
+			return refs[i].Hits > refs[j].Hits
+		}
+		return refs[i].Referrer < refs[j].Referrer
+	})
+	if len(refs) > store.TopReferrers {
+		refs = refs[:store.TopReferrers]
+	}
+
+	var dests []destinationCount
+	var followed int64
+	for u, n := range ls.Destinations {
+		dests = append(dests, destinationCount{URL: u, Hits: n})
+		followed += n
+	}
+	for i := range dests {
+		dests[i].Share = math.Round(float64(dests[i].Hits)*1000/float64(followed)) / 10
+	}
+	sort.Slice(dests, func(i, j int) bool {
+		if dests[i].Hits != dests[j].Hits {
+			return dests[i].Hits > dests[j].Hits
+		}
+		return dests[i].URL < dests[j].URL
+	})
+	return statsResponse{Shortcut: shortcut, Total: ls.Total, PerDay: ls.PerDay, TopReferrers: refs, Destinations: dests}
+}
+
+var (
+	clicksExportedTotal = metrics.NewCounterVec("shortener_analytics_exported_total",
+		"Clicks exported to analytics sinks, by sink.", "sink")
+	exportFailuresTotal = metrics.NewCounterVec("shortener_analytics_export_failures_total",
+		"Failed exports of clicks to analytics sinks, by sink.", "sink")
+)
+
+// clickRing is a fixed-size queue of clicks. When it is full the oldest
+// click is overwritten.
+type clickRing struct {
+	// buf holds clicks that have not been flushed yet; head is the index of
+	// the oldest one and n the number of buffered clicks.
+	buf     []store.Click
+	head, n int
+	dropped int64
+}
+
+func (r *clickRing) push(c store.Click) {
+	if r.n == len(r.buf) {
+		r.head = (r.head + 1) % len(r.buf)
+		r.n--
+		r.dropped++
+	}
+	r.buf[(r.head+r.n)%len(r.buf)] = c
+	r.n++
+}
+
+// pending returns a copy of the buffered clicks, oldest first.
+func (r *clickRing) pending() []store.Click {
+	out := make([]store.Click, r.n)
+	for i := range out {
+		out[i] = r.buf[(r.head+i)%len(r.buf)]
+	}
+	return out
+}
+
+// take returns the pending clicks and how many were dropped since the last
+// take.
+func (r *clickRing) take() ([]store.Click, int64) {
+	dropped := r.dropped
+	r.dropped = 0
+	return r.pending(), dropped
+}
+
+// done removes the n clicks of the last take once they were flushed.
+func (r *clickRing) done(n int) {
+	// Clicks recorded while flushing may have pushed some of the flushed
+	// ones out already.
+	flushed := n - int(r.dropped)
+	if flushed > r.n {
+		flushed = r.n
+	}
+	if flushed > 0 {
+		r.head = (r.head + flushed) % len(r.buf)
+		r.n -= flushed
+	}
+}
+
+// analyticsSink is an exporter and the clicks it has yet to receive.
+type analyticsSink struct {
+	sink store.AnalyticsSink
+	ring clickRing
+}
+
+// Analytics buffers clicks in a fixed-size ring and periodically flushes
+// them to the provider when it implements ClickRecorder. For providers that
+// can't store clicks, statistics are kept in memory since process start.
+// Sinks get every click too, each from a ring of its own.
+type Analytics struct {
+	mu    sync.Mutex
+	ring  clickRing
+	stats map[string]*store.LinkStats
+	sinks []*analyticsSink
+
+	recorder store.ClickRecorder
+}
+
+// NewAnalytics returns a buffer of size clicks flushed to recorder, which
+// may be nil.
+func NewAnalytics(size int, recorder store.ClickRecorder) *Analytics {
+	return &Analytics{
+		ring:     clickRing{buf: make([]store.Click, size)},
+		stats:    make(map[string]*store.LinkStats),
+		recorder: recorder,
+	}
+}
+
+// AddSink exports every click recorded from now on to sink, buffering as
+// many as the recorder's buffer while it is unavailable.
+func (a *Analytics) AddSink(sink store.AnalyticsSink) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sinks = append(a.sinks, &analyticsSink{sink: sink, ring: clickRing{buf: make([]store.Click, len(a.ring.buf))}})
+}
+
+// Record adds a click to the buffer. When the buffer is full the oldest
+// unflushed click is overwritten.
+func (a *Analytics) Record(c store.Click) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.ring.push(c)
+	for _, s := range a.sinks {
+		s.ring.push(c)
+	}
+
+	if a.recorder == nil {
+		ls, ok := a.stats[c.Shortcut]
+		if !ok {
+			ls = store.NewLinkStats()
+			a.stats[c.Shortcut] = ls
+		}
+		ls.Add(c)
+	}
+}
+
+// Flush sends buffered clicks to the recorder and the sinks. Clicks are only
+// removed from a buffer once they were accepted. It returns the first error.
+func (a *Analytics) Flush(ctx context.Context) error {
+	var first error
+	if a.recorder != nil {
+		first = a.flush(ctx, &a.ring, "analytics buffer", a.recorder.RecordClicks)
+	}
+	a.mu.Lock()
+	sinks := append([]*analyticsSink{}, a.sinks...)
+	a.mu.Unlock()
+	for _, s := range sinks {
+		name := s.sink.Name()
+		err := a.flush(ctx, &s.ring, "analytics sink "+name, func(ctx context.Context, clicks []store.Click) error {
+			if err := s.sink.ExportClicks(ctx, clicks); err != nil {
+				exportFailuresTotal.Inc(name)
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			clicksExportedTotal.Add(name, float64(len(clicks)))
+			return nil
+		})
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// flush sends the clicks of r to send.
+func (a *Analytics) flush(ctx context.Context, r *clickRing, what string, send func(context.Context, []store.Click) error) error {
+	a.mu.Lock()
+	clicks, dropped := r.take()
+	a.mu.Unlock()
+
+	if dropped > 0 {
+		log.Printf("warn: %s full, dropped %d clicks", what, dropped)
+	}
+	if len(clicks) == 0 {
+		return nil
+	}
+	if err := send(ctx, clicks); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	r.done(len(clicks))
+	a.mu.Unlock()
+	return nil
+}
+
+// Run flushes the buffer every interval until ctx is cancelled.
+func (a *Analytics) Run(ctx context.Context, interval time.Duration) {
+	a.mu.Lock()
+	idle := a.recorder == nil && len(a.sinks) == 0
+	a.mu.Unlock()
+	if idle {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := a.Flush(ctx); err != nil {
+				log.Printf("warn: failed to flush analytics: %v", err)
+			}
+		}
+	}
+}
+
+// Stats returns the statistics of shortcut, including clicks that have not
+// been flushed yet.
+func (a *Analytics) Stats(ctx context.Context, shortcut string) (*store.LinkStats, error) {
+	if a.recorder == nil {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		out := store.NewLinkStats()
+		if ls, ok := a.stats[shortcut]; ok {
+			out.Total = ls.Total
+			for k, v := range ls.PerDay {
+				out.PerDay[k] = v
+			}
+			for k, v := range ls.Referrers {
+				out.Referrers[k] = v
+			}
+			for k, v := range ls.Destinations {
+				out.Destinations[k] = v
+			}
+		}
+		return out, nil
+	}
+
+	ls, err := a.recorder.ClickStats(ctx, shortcut)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.ring.pending() {
+		if c.Shortcut == shortcut {
+			ls.Add(c)
+		}
+	}
+	return ls, nil
+}
+
+// Totals returns the total clicks of each of shortcuts, including clicks that
+// have not been flushed yet.
+func (a *Analytics) Totals(ctx context.Context, shortcuts []string) (map[string]int64, error) {
+	if a.recorder == nil {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		out := make(map[string]int64, len(shortcuts))
+		for _, shortcut := range shortcuts {
+			if ls, ok := a.stats[shortcut]; ok {
+				out[shortcut] = ls.Total
+			}
+		}
+		return out, nil
+	}
+
+	out, err := a.recorder.ClickTotals(ctx, shortcuts)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.ring.pending() {
+		out[c.Shortcut]++
+	}
+	return out, nil
+}
+
+// ClicksSince returns the clicks of each of shortcuts from the UTC day of
+// since on, including clicks that have not been flushed yet.
+func (a *Analytics) ClicksSince(ctx context.Context, shortcuts []string, since time.Time) (map[string]int64, error) {
+	if a.recorder == nil {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		out := make(map[string]int64, len(shortcuts))
+		for _, shortcut := range shortcuts {
+			if ls, ok := a.stats[shortcut]; ok {
+				out[shortcut] = ls.ClicksSince(since)
+			}
+		}
+		return out, nil
+	}
+
+	out, err := a.recorder.ClicksSince(ctx, shortcuts, since)
+	if err != nil {
+		return nil, err
+	}
+	first := store.Day(since)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.ring.pending() {
+		if store.Day(c.Time) >= first {
+			out[c.Shortcut]++
+		}
+	}
+	return out, nil
+}
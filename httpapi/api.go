@@ -0,0 +1,1031 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/denizyoldas/url-shorter/resolver"
+	"github.com/denizyoldas/url-shorter/store"
+	"golang.org/x/net/idna"
+)
+
+// maxRequestBody caps the size of request bodies unless MaxRequestBody is
+// set.
+const maxRequestBody = 1 << 20
+
+var (
+	errCannotCreate = errors.New("provider does not support creating links")
+	errCannotEdit   = errors.New("provider does not support editing links")
+	// errRevisionMismatch is returned when If-Match names another revision
+	// of a link.
+	errRevisionMismatch = errors.New("link was changed since it was read")
+)
+
+// invalidLinkError is returned for requests describing an invalid link.
+type invalidLinkError struct{ error }
+
+func (e invalidLinkError) Unwrap() error { return e.error }
+
+type apiLink struct {
+	// Shortcut is generated when left empty, see SLUG_LENGTH.
+	Shortcut string `json:"shortcut"`
+	URL      string `json:"url,omitempty"`
+	// Type is "text", "markdown" or "snippet" for links that show Content
+	// instead of redirecting to URL.
+	Type    string `json:"type,omitempty"`
+	Content string `json:"content,omitempty"`
+	// TTL optionally makes the link expire after a Go duration such as
+	// "24h". It is an alternative to ExpiresAt.
+	TTL       string     `json:"ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// ActiveFrom and ActiveUntil make an activation window: the link only
+	// resolves from ActiveFrom, and ActiveUntil is another name for
+	// ExpiresAt. Responses only carry ExpiresAt.
+	ActiveFrom  *time.Time `json:"active_from,omitempty"`
+	ActiveUntil *time.Time `json:"active_until,omitempty"`
+	// Status is the redirect status code, 302 when omitted.
+	Status  int  `json:"status,omitempty"`
+	Private bool `json:"private,omitempty"`
+	Preview bool `json:"preview,omitempty"`
+	// Params is a query string added to every redirect, such as
+	// "utm_source=golink".
+	Params string `json:"params,omitempty"`
+	// Owner defaults to the caller; only admins may set someone else.
+	Owner string `json:"owner,omitempty"`
+	// Password is write-only; responses only tell whether the link is
+	// Protected. Updates keep the current password when Protected is set
+	// and Password is empty.
+	Password  string `json:"password,omitempty"`
+	Protected bool   `json:"protected,omitempty"`
+	// CacheControl overrides REDIRECT_CACHE_CONTROL for this link, either
+	// as Cache-Control directives or a duration such as "1h" for max-age.
+	CacheControl string   `json:"cache_control,omitempty"`
+	Description  string   `json:"description,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	// DeletedAt is set on links in the trash and ignored in requests.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Canary    *apiCanary `json:"canary,omitempty"`
+	// MaxClicks is the click budget, after which the link answers 410
+	// Gone; zero means no limit.
+	MaxClicks int64 `json:"max_clicks,omitempty"`
+	// Disabled links answer 410 Gone, see /api/links/{shortcut}/disable.
+	Disabled bool `json:"disabled,omitempty"`
+	// Unapproved links await an admin's approval before they resolve, see
+	// /api/links/{shortcut}/approve. It is ignored in requests other than
+	// imports by admins.
+	Unapproved bool `json:"unapproved,omitempty"`
+}
+
+// apiCanary rolls a new destination out to a share of the visitors, see
+// store.Canary.
+type apiCanary struct {
+	// URL is the new destination. Updates may leave it out to roll out the
+	// url of the link instead, keeping the current one for the others.
+	URL     string `json:"url,omitempty"`
+	Percent int    `json:"percent"`
+	// Bake is how long the canary runs, a Go duration such as "2h". It is an
+	// alternative to Until; with neither it runs until the link changes.
+	Bake  string     `json:"bake,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// canary builds the canary to store for the request.
+func (in *apiCanary) canary(now time.Time) (*store.Canary, error) {
+	u, err := validateURL(in.URL)
+	if err != nil {
+		return nil, err
+	}
+	if in.Percent < 1 || in.Percent > 99 {
+		return nil, errors.New("percent must be between 1 and 99")
+	}
+	c := &store.Canary{URL: u, Percent: in.Percent}
+	switch {
+	case in.Bake != "" && in.Until != nil:
+		return nil, errors.New("bake and until are mutually exclusive")
+	case in.Bake != "":
+		bake, err := time.ParseDuration(in.Bake)
+		if err != nil || bake <= 0 {
+			return nil, errors.New("bake must be a positive duration such as \"2h\"")
+		}
+		c.Until = now.Add(bake).Truncate(time.Second)
+	case in.Until != nil:
+		if !in.Until.After(now) {
+			return nil, errors.New("until must be in the future")
+		}
+		c.Until = *in.Until
+	}
+	return c, nil
+}
+
+// expiry returns the expiry requested by either TTL, ExpiresAt or
+// ActiveUntil.
+func (in *apiLink) expiry(now time.Time) (time.Time, error) {
+	if in.ActiveUntil != nil {
+		if in.ExpiresAt != nil {
+			return time.Time{}, errors.New("expires_at and active_until are mutually exclusive")
+		}
+		if in.TTL != "" {
+			return time.Time{}, errors.New("ttl and active_until are mutually exclusive")
+		}
+		in.ExpiresAt, in.ActiveUntil = in.ActiveUntil, nil
+	}
+	switch {
+	case in.TTL != "" && in.ExpiresAt != nil:
+		return time.Time{}, errors.New("ttl and expires_at are mutually exclusive")
+	case in.TTL != "":
+		ttl, err := time.ParseDuration(in.TTL)
+		if err != nil || ttl <= 0 {
+			return time.Time{}, errors.New("ttl must be a positive duration such as \"24h\"")
+		}
+		return now.Add(ttl), nil
+	case in.ExpiresAt != nil:
+		if !in.ExpiresAt.After(now) {
+			return time.Time{}, errors.New("expires_at must be in the future")
+		}
+		return *in.ExpiresAt, nil
+	}
+	return time.Time{}, nil
+}
+
+// target builds the link to store for the destination or content of in.
+func (in *apiLink) target() (*store.Link, error) {
+	typ, err := store.ParseLinkType(in.Type)
+	if err != nil {
+		return nil, err
+	}
+	if typ == "" {
+		u, err := validateURL(in.URL)
+		if err != nil {
+			return nil, err
+		}
+		return &store.Link{URL: u}, nil
+	}
+	if in.URL != "" {
+		return nil, fmt.Errorf("%s links have content instead of a url", typ)
+	}
+	if strings.TrimSpace(in.Content) == "" {
+		return nil, errors.New("content is required")
+	}
+	return store.NewLink(typ, in.Content)
+}
+
+// link builds the link to store for the request.
+func (in *apiLink) link() (*store.Link, error) {
+	link, err := in.target()
+	if err != nil {
+		return nil, err
+	}
+	if in.Status != 0 && !store.ValidRedirectStatus(in.Status) {
+		return nil, errors.New("status must be one of 301, 302, 303, 307 or 308")
+	}
+	expires, err := in.expiry(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	params, err := store.ParseParams(in.Params)
+	if err != nil {
+		return nil, fmt.Errorf("params are invalid: %w", err)
+	}
+	cacheControl, err := store.ParseCacheControl(in.CacheControl)
+	if err != nil {
+		return nil, fmt.Errorf("cache_control is invalid: %w", err)
+	}
+	desc := strings.TrimSpace(in.Description)
+	if utf8.RuneCountInString(desc) > store.MaxDescriptionLength {
+		return nil, fmt.Errorf("description must be at most %d characters", store.MaxDescriptionLength)
+	}
+	tags := store.ParseTags(strings.Join(in.Tags, ","))
+	if len(tags) > store.MaxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", store.MaxTags)
+	}
+	for _, t := range tags {
+		if utf8.RuneCountInString(t) > store.MaxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", t, store.MaxTagLength)
+		}
+	}
+	if in.ActiveFrom != nil {
+		if !expires.IsZero() && !in.ActiveFrom.Before(expires) {
+			return nil, errors.New("active_from must be before the link expires")
+		}
+		link.ActiveFrom = *in.ActiveFrom
+	}
+	if in.Canary != nil {
+		if link.Type != "" {
+			return nil, fmt.Errorf("%s links can't have a canary", link.Type)
+		}
+		if link.Canary, err = in.Canary.canary(time.Now()); err != nil {
+			return nil, fmt.Errorf("canary is invalid: %w", err)
+		}
+	}
+	if in.MaxClicks < 0 {
+		return nil, errors.New("max_clicks must not be negative")
+	}
+	link.MaxClicks, link.Disabled = in.MaxClicks, in.Disabled
+	link.Expires, link.Status, link.Private, link.Preview = expires, in.Status, in.Private, in.Preview
+	link.Params, link.Password, link.CacheControl, link.Description = params, in.Password, cacheControl, desc
+	link.Tags = tags
+	return link, nil
+}
+
+// linkResponse renders link for API responses.
+func linkResponse(shortcut string, link *store.Link) apiLink {
+	link = link.Settled(time.Now())
+	out := apiLink{
+		Shortcut:     shortcut,
+		URL:          link.URL.String(),
+		Type:         link.Type,
+		Content:      link.Content,
+		Status:       link.Status,
+		Private:      link.Private,
+		Preview:      link.Preview,
+		Params:       store.FormatParams(link.Params),
+		Owner:        link.Owner,
+		Protected:    link.Password != "",
+		CacheControl: link.CacheControl,
+		Description:  link.Description,
+		Tags:         link.Tags,
+		MaxClicks:    link.MaxClicks,
+		Disabled:     link.Disabled,
+		Unapproved:   link.Unapproved,
+	}
+	if !link.Expires.IsZero() {
+		exp := link.Expires.UTC()
+		out.ExpiresAt = &exp
+	}
+	if !link.ActiveFrom.IsZero() {
+		from := link.ActiveFrom.UTC()
+		out.ActiveFrom = &from
+	}
+	if !link.Deleted.IsZero() {
+		deleted := link.Deleted.UTC()
+		out.DeletedAt = &deleted
+	}
+	if c := link.Canary; c != nil {
+		out.Canary = &apiCanary{URL: c.URL.String(), Percent: c.Percent}
+		if !c.Until.IsZero() {
+			until := c.Until.UTC()
+			out.Canary.Until = &until
+		}
+	}
+	return out
+}
+
+// linkRevision is the entity tag of a link, a hash of how the API shows it
+// and of its password.
+func linkRevision(shortcut string, link *store.Link) string {
+	b, _ := json.Marshal(linkResponse(shortcut, link))
+	sum := sha256.Sum256(append(b, link.Password...))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// checkRevision fails with errRevisionMismatch unless the If-Match header of
+// req, if any, names the revision of link, the current value of shortcut.
+func checkRevision(req *http.Request, shortcut string, link *store.Link) error {
+	ifMatch := req.Header.Get("If-Match")
+	if ifMatch == "" {
+		return nil
+	}
+	if link == nil {
+		return errRevisionMismatch
+	}
+	rev := linkRevision(shortcut, link)
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == rev {
+			return nil
+		}
+	}
+	return errRevisionMismatch
+}
+
+// links handles /api/links.
+func (s *Server) links(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		s.listLinks(w, req)
+	case http.MethodPost:
+		s.createLink(w, req)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+	}
+}
+
+type linkListEntry struct {
+	apiLink
+	Hits   int64                `json:"hits"`
+	Health *resolver.LinkHealth `json:"health,omitempty"`
+	// Page is the title and favicon of the destination, see
+	// PAGE_INFO_INTERVAL.
+	Page *resolver.PageInfo `json:"page,omitempty"`
+}
+
+// listLinks handles GET /api/links, returning the links visible to the caller
+// sorted by shortcut or ?sort=, optionally only those of ?owner=, those
+// tagged ?tag=, with ?broken=true those failing the dead-link check or, with
+// ?unapproved=true, those awaiting approval. ?deleted=true lists the links
+// in the trash instead. ?page= and ?per_page= return a page of them, and
+// If-None-Match with the ETag of a previous response skips unchanged ones.
+func (s *Server) listLinks(w http.ResponseWriter, req *http.Request) {
+	all, err := s.Links.All()
+	if req.URL.Query().Get("deleted") == "true" {
+		all, err = s.Links.Deleted()
+	}
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to load links: %v", err)
+		return
+	}
+
+	shortcuts := ownedShortcuts(req, all, req.URL.Query().Get("owner"))
+
+	hits, err := s.Analytics.Totals(req.Context(), shortcuts)
+	if err != nil {
+		log.Printf("warn: failed to load click totals: %v", err)
+	}
+
+	brokenOnly := req.URL.Query().Get("broken") == "true"
+	unapprovedOnly := req.URL.Query().Get("unapproved") == "true"
+	tag := req.URL.Query().Get("tag")
+	out := make([]linkListEntry, 0, len(shortcuts))
+	for _, k := range shortcuts {
+		if tag != "" && !all[k].HasTag(tag) || unapprovedOnly && !all[k].Unapproved {
+			continue
+		}
+		health := s.Checker.Health(k)
+		if brokenOnly && (health == nil || !health.Broken) {
+			continue
+		}
+		out = append(out, linkListEntry{apiLink: linkResponse(k, all[k]), Hits: hits[k], Health: health, Page: s.Pages.Info(all[k])})
+	}
+	if err := sortLinks(out, req.URL.Query().Get("sort")); err != nil {
+		writeError(w, req, http.StatusBadRequest, "%v", err)
+		return
+	}
+	start, end, err := paginate(w, req, len(out))
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, "%v", err)
+		return
+	}
+	writeCachedJSON(w, req, out[start:end])
+}
+
+// createLink handles POST /api/links.
+func (s *Server) createLink(w http.ResponseWriter, req *http.Request) {
+	if _, ok := s.Links.Provider.(store.Writer); !ok {
+		writeError(w, req, http.StatusNotImplemented, "%v", errCannotCreate)
+		return
+	}
+
+	var in apiLink
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, s.maxBody()))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		writeError(w, req, http.StatusBadRequest, "invalid request body: %v", err)
+		return
+	}
+
+	shortcut, link, err := s.create(req, in)
+	var invalid invalidLinkError
+	switch {
+	case errors.As(err, &invalid):
+		writeError(w, req, http.StatusBadRequest, "%v", err)
+	case errors.Is(err, store.ErrLinkExists):
+		writeError(w, req, http.StatusConflict, "shortcut %q already exists", shortcut)
+	case errors.Is(err, errNotOwner), errors.Is(err, errQuotaExceeded):
+		writeError(w, req, http.StatusForbidden, "%v", err)
+	case err != nil:
+		writeError(w, req, http.StatusBadGateway, "failed to create link: %v", err)
+	default:
+		w.Header().Set("ETag", linkRevision(shortcut, link))
+		writeJSON(w, http.StatusCreated, linkResponse(shortcut, link))
+	}
+}
+
+// ownedShortcuts returns the sorted shortcuts of the links in all that req
+// may manage, limited to those of owner unless it is empty.
+func ownedShortcuts(req *http.Request, all store.URLMap, owner string) []string {
+	shortcuts := make([]string, 0, len(all))
+	for k, l := range all {
+		if owns(req, l) && (owner == "" || l.Owner == owner) {
+			shortcuts = append(shortcuts, k)
+		}
+	}
+	sort.Strings(shortcuts)
+	return shortcuts
+}
+
+// create adds the link described by in on behalf of req, generating a
+// shortcut when in has none.
+func (s *Server) create(req *http.Request, in apiLink) (string, *store.Link, error) {
+	writer, ok := s.Links.Provider.(store.Writer)
+	if !ok {
+		return "", nil, errCannotCreate
+	}
+	link, err := in.link()
+	if err != nil {
+		return "", nil, invalidLinkError{err}
+	}
+	if link.Owner, err = ownerOf(req, in.Owner); err != nil {
+		return "", nil, err
+	}
+	if err := s.checkQuota(req, link.Owner, 0); err != nil {
+		return "", nil, err
+	}
+	link.Unapproved = s.needsApproval(req)
+
+	shortcut := store.Norm.Lower(strings.TrimSpace(in.Shortcut))
+	if shortcut == "" {
+		shortcut, err = s.addRandomLink(req.Context(), writer, link)
+	} else if !store.ShortcutPattern.MatchString(shortcut) {
+		return "", nil, invalidLinkError{errors.New("shortcut must be made of letters, digits, '.', '-', '_' and '/'-separated segments")}
+	} else {
+		err = s.addLink(req.Context(), writer, shortcut, link)
+	}
+	if err != nil {
+		return shortcut, nil, err
+	}
+	s.Links.Invalidate()
+	s.audit(req, store.AuditCreate, shortcut, nil, link)
+
+	log.Printf("created shortcut=%q to=%q", shortcut, targetSummary(link))
+	s.awaitApproval(shortcut, link)
+	return shortcut, link, nil
+}
+
+// addLink persists a new shortcut, failing with store.ErrLinkExists when it is
+// already taken, even by an expired link, with resolver.ErrShortcutReserved when
+// it is reserved and with resolver.ErrDestinationRefused when it leads where
+// it may not.
+func (s *Server) addLink(ctx context.Context, writer store.Writer, shortcut string, link *store.Link) error {
+	if w, ok := s.Links.Reserved.Reserved(shortcut); ok {
+		return invalidLinkError{fmt.Errorf("%w by %q", resolver.ErrShortcutReserved, w)}
+	}
+	if err := s.Links.Destinations.CheckLink(link); err != nil {
+		return invalidLinkError{err}
+	}
+	existing, err := s.Links.Get(shortcut)
+	if err != nil {
+		return fmt.Errorf("failed to look up shortcut: %w", err)
+	}
+	if existing != nil {
+		return store.ErrLinkExists
+	}
+
+	err = writer.Add(ctx, shortcut, link)
+	if errors.Is(err, store.ErrLinkExists) {
+		// A link in the trash gives way to the new one.
+		if old, gerr := s.current(ctx, shortcut); gerr == nil && old != nil && !old.Deleted.IsZero() {
+			if editor, ok := writer.(store.Editor); ok {
+				return editor.Update(ctx, shortcut, link)
+			}
+		}
+	}
+	return err
+}
+
+// addRandomLink persists link under a newly generated slug, retrying when the
+// slug is already taken.
+func (s *Server) addRandomLink(ctx context.Context, writer store.Writer, link *store.Link) (string, error) {
+	for i := 0; i < maxSlugAttempts; i++ {
+		slug, err := randomSlug(s.SlugLength)
+		if err != nil {
+			return "", err
+		}
+		err = s.addLink(ctx, writer, slug, link)
+		if errors.Is(err, store.ErrLinkExists) || errors.Is(err, resolver.ErrShortcutReserved) {
+			continue
+		}
+		return slug, err
+	}
+	return "", fmt.Errorf("no free slug of length %d found after %d attempts", s.SlugLength, maxSlugAttempts)
+}
+
+// validateURL checks that the destination is an absolute http(s) URL, or an
+// alias of another shortcut such as go:new.
+func validateURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, errors.New("url is invalid")
+	}
+	if (&store.Link{URL: u}).Alias() != "" {
+		return u, nil
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("url must be an absolute http or https URL, or go:shortcut")
+	}
+	// Internationalized hosts must have a punycode form to redirect to.
+	if h := u.Hostname(); strings.IndexFunc(h, func(r rune) bool { return r >= utf8.RuneSelf }) >= 0 {
+		if _, err := idna.Lookup.ToASCII(h); err != nil {
+			return nil, fmt.Errorf("url host %q is invalid", h)
+		}
+	}
+	return u, nil
+}
+
+// targetSummary describes where link leads for logs and notifications, which
+// should not repeat the content of text links.
+func targetSummary(link *store.Link) string {
+	if link.Type != "" {
+		return "(" + link.Type + ")"
+	}
+	return link.URL.String()
+}
+
+// publicTarget is targetSummary for answers that need no token, which don't
+// tell where password-protected links lead.
+func publicTarget(link *store.Link) string {
+	if link.Password != "" {
+		return ""
+	}
+	return targetSummary(link)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("warn: failed to write response: %v", err)
+	}
+}
+
+type reloadResponse struct {
+	Links    int      `json:"links"`
+	Warnings []string `json:"warnings"`
+}
+
+// reload handles POST /api/reload, refreshing the links right away.
+func (s *Server) reload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	if err := s.Links.Refresh(req.Context()); errors.Is(err, context.DeadlineExceeded) {
+		writeError(w, req, http.StatusGatewayTimeout, "timed out reloading links: %v", err)
+		return
+	} else if errors.Is(err, resolver.ErrBreakerOpen) {
+		if state := s.Links.BreakerState(); state.OpenUntil != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(*state.OpenUntil).Seconds())+1))
+		}
+		writeError(w, req, http.StatusServiceUnavailable, "not reloading links: %v", err)
+		return
+	} else if err != nil {
+		writeError(w, req, http.StatusBadGateway, "failed to reload links: %v", err)
+		return
+	}
+	s.Links.Publish()
+	n, warnings := s.Links.Loaded()
+	if warnings == nil {
+		warnings = []string{}
+	}
+	log.Printf("reloaded %d links", n)
+	writeJSON(w, http.StatusOK, reloadResponse{Links: n, Warnings: warnings})
+}
+
+type lintResponse struct {
+	Links    int               `json:"links"`
+	LoadedAt string            `json:"loaded_at,omitempty"`
+	Issues   []store.LinkIssue `json:"issues"`
+	// More counts the issues left out of Issues.
+	More int `json:"more,omitempty"`
+}
+
+// lint handles GET /api/lint, listing the rows of the link data that were
+// skipped or only partly loaded by the last refresh, with their row numbers
+// when the backend has rows. ?kind= keeps the issues of one kind.
+func (s *Server) lint(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	n, _ := s.Links.Loaded()
+	issues, more, loaded := s.Links.Issues()
+	resp := lintResponse{Links: n, Issues: []store.LinkIssue{}, More: more}
+	if !loaded.IsZero() {
+		resp.LoadedAt = loaded.UTC().Format(time.RFC3339)
+	}
+	kind := req.URL.Query().Get("kind")
+	for _, i := range issues {
+		if kind == "" || i.Kind == kind {
+			resp.Issues = append(resp.Issues, i)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// linkResource handles /api/links/{shortcut} and its sub-resources.
+func (s *Server) linkResource(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/api/links/")
+
+	switch {
+	case strings.HasSuffix(path, "/stats"):
+		s.linkStats(w, req, strings.TrimSuffix(path, "/stats"))
+	case strings.HasSuffix(path, "/qr"):
+		s.linkQR(w, req, strings.TrimSuffix(path, "/qr"))
+	case strings.HasSuffix(path, "/sign"):
+		s.signLink(w, req, store.Norm.Lower(strings.TrimSuffix(path, "/sign")))
+	case strings.HasSuffix(path, "/history"):
+		s.linkHistory(w, req, store.Norm.Lower(strings.TrimSuffix(path, "/history")))
+	case strings.HasSuffix(path, "/rollback"):
+		s.rollbackLink(w, req, store.Norm.Lower(strings.TrimSuffix(path, "/rollback")))
+	case strings.HasSuffix(path, "/restore"):
+		s.restoreLink(w, req, store.Norm.Lower(strings.TrimSuffix(path, "/restore")))
+	case strings.HasSuffix(path, "/disable"):
+		s.disableLink(w, req, store.Norm.Lower(strings.TrimSuffix(path, "/disable")))
+	case strings.HasSuffix(path, "/approve"):
+		s.approveLink(w, req, store.Norm.Lower(strings.TrimSuffix(path, "/approve")))
+	case path == "":
+		writeError(w, req, http.StatusNotFound, "not found")
+	case path == "import":
+		s.importLinks(w, req)
+	case path == "export":
+		s.exportLinks(w, req)
+	case path == "duplicates":
+		s.duplicates(w, req)
+	default:
+		s.link(w, req, store.Norm.Lower(path))
+	}
+}
+
+// link handles GET, PUT, PATCH and DELETE of /api/links/{shortcut}. Changes
+// honor If-Match with the ETag of a previous response.
+func (s *Server) link(w http.ResponseWriter, req *http.Request, shortcut string) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		link, err := s.Links.Get(shortcut)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, "failed to look up shortcut: %v", err)
+			return
+		}
+		if link == nil {
+			writeError(w, req, http.StatusNotFound, "shortcut %q not found", shortcut)
+			return
+		}
+		w.Header().Set("ETag", linkRevision(shortcut, link))
+		writeJSON(w, http.StatusOK, linkResponse(shortcut, link))
+		return
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, PATCH, DELETE")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+
+	if _, ok := s.Links.Provider.(store.Editor); !ok {
+		writeError(w, req, http.StatusNotImplemented, "%v", errCannotEdit)
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		err := s.remove(req, shortcut)
+		if errors.Is(err, store.ErrLinkNotFound) {
+			writeError(w, req, http.StatusNotFound, "shortcut %q not found", shortcut)
+			return
+		} else if errors.Is(err, errNotOwner) || errors.Is(err, store.ErrReadOnly) {
+			writeError(w, req, http.StatusForbidden, "%v", err)
+			return
+		} else if errors.Is(err, errRevisionMismatch) {
+			writeError(w, req, http.StatusPreconditionFailed, "%v", err)
+			return
+		} else if err != nil {
+			writeError(w, req, http.StatusBadGateway, "failed to delete link: %v", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var in apiLink
+	if req.Method == http.MethodPatch {
+		var err error
+		if in, err = s.patched(req, shortcut, http.MaxBytesReader(w, req.Body, s.maxBody())); errors.Is(err, store.ErrLinkNotFound) {
+			writeError(w, req, http.StatusNotFound, "shortcut %q not found", shortcut)
+			return
+		} else if err != nil {
+			writeError(w, req, http.StatusBadRequest, "invalid request body: %v", err)
+			return
+		}
+	} else {
+		dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, s.maxBody()))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&in); err != nil {
+			writeError(w, req, http.StatusBadRequest, "invalid request body: %v", err)
+			return
+		}
+	}
+
+	link, err := s.update(req, shortcut, in)
+	var invalid invalidLinkError
+	switch {
+	case errors.As(err, &invalid):
+		writeError(w, req, http.StatusBadRequest, "%v", err)
+	case errors.Is(err, store.ErrLinkNotFound):
+		writeError(w, req, http.StatusNotFound, "shortcut %q not found", shortcut)
+	case errors.Is(err, errNotOwner), errors.Is(err, store.ErrReadOnly):
+		writeError(w, req, http.StatusForbidden, "%v", err)
+	case errors.Is(err, errRevisionMismatch):
+		writeError(w, req, http.StatusPreconditionFailed, "%v", err)
+	case err != nil:
+		writeError(w, req, http.StatusBadGateway, "failed to update link: %v", err)
+	default:
+		w.Header().Set("ETag", linkRevision(shortcut, link))
+		writeJSON(w, http.StatusOK, linkResponse(shortcut, link))
+	}
+}
+
+// patched applies the JSON merge patch (RFC 7396) in body to the current
+// link of shortcut: fields present replace the current ones and null resets
+// them.
+func (s *Server) patched(req *http.Request, shortcut string, body io.Reader) (apiLink, error) {
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&patch); err != nil {
+		return apiLink{}, err
+	}
+	link, err := s.current(req.Context(), shortcut)
+	if err != nil {
+		return apiLink{}, err
+	}
+	if link == nil || !link.Deleted.IsZero() {
+		return apiLink{}, store.ErrLinkNotFound
+	}
+
+	b, err := json.Marshal(linkResponse(shortcut, link))
+	if err != nil {
+		return apiLink{}, err
+	}
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(b, &merged); err != nil {
+		return apiLink{}, err
+	}
+	// A new ttl or active_until replaces the current expiry.
+	for _, k := range []string{"ttl", "active_until"} {
+		if _, ok := patch[k]; ok {
+			delete(merged, "expires_at")
+		}
+	}
+	// Resetting the password unprotects the link.
+	if v, ok := patch["password"]; ok && string(v) == "null" {
+		delete(merged, "protected")
+	}
+	// The canary is merged in turn, so that a new percent keeps its url.
+	if v, ok := patch["canary"]; ok && string(v) != "null" && merged["canary"] != nil {
+		if v, err = mergeCanary(merged["canary"], v); err != nil {
+			return apiLink{}, err
+		}
+		patch["canary"] = v
+	}
+	for k, v := range patch {
+		if string(v) == "null" {
+			delete(merged, k)
+		} else {
+			merged[k] = v
+		}
+	}
+	if b, err = json.Marshal(merged); err != nil {
+		return apiLink{}, err
+	}
+
+	var in apiLink
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		return apiLink{}, err
+	}
+	return in, nil
+}
+
+// mergeCanary applies the merge patch of a canary to the current one.
+func mergeCanary(current, patch json.RawMessage) (json.RawMessage, error) {
+	var cur, p map[string]json.RawMessage
+	if err := json.Unmarshal(current, &cur); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, fmt.Errorf("canary: %w", err)
+	}
+	if _, ok := p["bake"]; ok {
+		delete(cur, "until")
+	}
+	for k, v := range p {
+		if string(v) == "null" {
+			delete(cur, k)
+		} else {
+			cur[k] = v
+		}
+	}
+	return json.Marshal(cur)
+}
+
+// current returns the link of shortcut straight from the provider when it
+// can read single links, so that If-Match is checked against the latest
+// value, and from the cache otherwise. Links in the trash are returned too.
+func (s *Server) current(ctx context.Context, shortcut string) (*store.Link, error) {
+	if g, ok := s.Links.Provider.(store.Getter); ok {
+		return g.Get(ctx, shortcut)
+	}
+	link, err := s.Links.Get(shortcut)
+	if link == nil && err == nil {
+		link = s.Links.GetDeleted(shortcut)
+	}
+	return link, err
+}
+
+// update replaces the link of shortcut with the one described by in on
+// behalf of req. Omitted fields are reset, except for the owner and, while
+// in.Protected is set, the password.
+func (s *Server) update(req *http.Request, shortcut string, in apiLink) (*store.Link, error) {
+	return s.replace(req, store.AuditUpdate, shortcut, in)
+}
+
+// replace is update, recording the change as action.
+func (s *Server) replace(req *http.Request, action, shortcut string, in apiLink) (*store.Link, error) {
+	editor, ok := s.Links.Provider.(store.Editor)
+	if !ok {
+		return nil, errCannotEdit
+	}
+	if in.Shortcut != "" && store.Norm.Lower(in.Shortcut) != shortcut {
+		return nil, invalidLinkError{errors.New("shortcut in body does not match the URL")}
+	}
+	// A canary without a url rolls out the new url, while the others keep
+	// going to the current one.
+	rollout := in.Canary != nil && in.Canary.URL == ""
+	if rollout {
+		c := *in.Canary
+		c.URL, in.Canary = in.URL, &c
+	}
+	link, err := in.link()
+	if err != nil {
+		return nil, invalidLinkError{err}
+	}
+
+	old, err := s.current(req.Context(), shortcut)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up shortcut: %w", err)
+	}
+	if old != nil && !old.Deleted.IsZero() {
+		return nil, store.ErrLinkNotFound
+	}
+	if rollout {
+		if old == nil || old.Type != "" {
+			return nil, invalidLinkError{errors.New("a canary without a url needs a current destination to roll out from")}
+		}
+		link.URL = old.URL
+	}
+	if old != nil && !owns(req, old) {
+		return nil, errNotOwner
+	}
+	if err := checkRevision(req, shortcut, old); err != nil {
+		return nil, err
+	}
+	if in.Owner == "" && old != nil {
+		link.Owner = old.Owner
+	} else if link.Owner, err = ownerOf(req, in.Owner); err != nil {
+		return nil, err
+	}
+	if in.Password == "" && in.Protected && old != nil {
+		link.Password = old.Password
+	}
+	// Pointing a link elsewhere needs approval again, other edits keep it.
+	moved := old == nil || !sameDestination(old, link)
+	if moved {
+		link.Unapproved = s.needsApproval(req)
+	} else {
+		link.Unapproved = old.Unapproved
+	}
+	if err := s.Links.Destinations.CheckLink(link); err != nil {
+		return nil, invalidLinkError{err}
+	}
+	if err := editor.Update(req.Context(), shortcut, link); err != nil {
+		return nil, err
+	}
+	s.Links.Invalidate()
+	s.audit(req, action, shortcut, old, link)
+
+	log.Printf("updated shortcut=%q to=%q", shortcut, targetSummary(link))
+	if moved {
+		s.awaitApproval(shortcut, link)
+	}
+	return link, nil
+}
+
+// remove deletes shortcut on behalf of req. With a TrashRetention the link
+// moves to the trash first, and only deleting it from there removes it.
+func (s *Server) remove(req *http.Request, shortcut string) error {
+	editor, ok := s.Links.Provider.(store.Editor)
+	if !ok {
+		return errCannotEdit
+	}
+	old, err := s.current(req.Context(), shortcut)
+	if err != nil {
+		return fmt.Errorf("failed to look up shortcut: %w", err)
+	}
+	if old != nil && !owns(req, old) {
+		return errNotOwner
+	}
+	if err := checkRevision(req, shortcut, old); err != nil {
+		return err
+	}
+	if old != nil && old.Deleted.IsZero() && s.TrashRetention > 0 {
+		trashed := *old
+		trashed.Deleted = time.Now().UTC().Truncate(time.Second)
+		err = editor.Update(req.Context(), shortcut, &trashed)
+	} else {
+		err = editor.Delete(req.Context(), shortcut)
+	}
+	if err != nil {
+		return err
+	}
+	s.Links.Invalidate()
+	s.audit(req, store.AuditDelete, shortcut, old, nil)
+	log.Printf("deleted shortcut=%q", shortcut)
+	return nil
+}
+
+// restoreLink handles POST /api/links/{shortcut}/restore, taking a link out
+// of the trash.
+func (s *Server) restoreLink(w http.ResponseWriter, req *http.Request, shortcut string) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	editor, ok := s.Links.Provider.(store.Editor)
+	if !ok {
+		writeError(w, req, http.StatusNotImplemented, "%v", errCannotEdit)
+		return
+	}
+	old, err := s.current(req.Context(), shortcut)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to look up shortcut: %v", err)
+		return
+	}
+	if old == nil || old.Deleted.IsZero() {
+		writeError(w, req, http.StatusNotFound, "shortcut %q is not in the trash", shortcut)
+		return
+	}
+	if !owns(req, old) {
+		writeError(w, req, http.StatusForbidden, "%v", errNotOwner)
+		return
+	}
+	if err := s.checkQuota(req, old.Owner, 0); err != nil {
+		writeError(w, req, http.StatusForbidden, "%v", err)
+		return
+	}
+	restored := *old
+	restored.Deleted = time.Time{}
+	if err := editor.Update(req.Context(), shortcut, &restored); err != nil {
+		writeError(w, req, http.StatusBadGateway, "failed to restore link: %v", err)
+		return
+	}
+	s.Links.Invalidate()
+	s.audit(req, store.AuditRestore, shortcut, old, &restored)
+	log.Printf("restored shortcut=%q", shortcut)
+	w.Header().Set("ETag", linkRevision(shortcut, &restored))
+	writeJSON(w, http.StatusOK, linkResponse(shortcut, &restored))
+}
+
+// linkStats handles GET /api/links/{shortcut}/stats.
+func (s *Server) linkStats(w http.ResponseWriter, req *http.Request, shortcut string) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+
+	shortcut = store.Norm.Lower(shortcut)
+	u, err := s.Links.Get(shortcut)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to look up shortcut: %v", err)
+		return
+	}
+	if u == nil {
+		writeError(w, req, http.StatusNotFound, "shortcut %q not found", shortcut)
+		return
+	}
+
+	stats, err := s.Analytics.Stats(req.Context(), shortcut)
+	if err != nil {
+		writeError(w, req, http.StatusBadGateway, "failed to load stats: %v", err)
+		return
+	}
+	resp := newStatsResponse(shortcut, stats)
+	resp.Health = s.Checker.Health(shortcut)
+	if l, ok := s.Resolver.Latency.Shortcut(shortcut); ok {
+		resp.Latency = &l
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,79 @@
+package httpapi
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// needsApproval reports whether a link req creates, or points elsewhere,
+// must wait for an admin's approval. Requests without a principal, such as
+// those of /new with PUBLIC_NEW_LINKS, are no admin's.
+func (s *Server) needsApproval(req *http.Request) bool {
+	if !s.LinkApproval {
+		return false
+	}
+	p := requestPrincipal(req)
+	return p == nil || p.Scope < store.ScopeAdmin
+}
+
+// sameDestination reports whether a and b lead to the same place, in which
+// case editing a into b keeps it approved.
+func sameDestination(a, b *store.Link) bool {
+	return a.Type == b.Type && a.Target() == b.Target() &&
+		store.FormatCanary(a.Canary) == store.FormatCanary(b.Canary)
+}
+
+// approveLink handles POST /api/links/{shortcut}/approve, letting a link
+// created while LINK_APPROVAL is on resolve. Only admins may approve links.
+func (s *Server) approveLink(w http.ResponseWriter, req *http.Request, shortcut string) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	editor, ok := s.Links.Provider.(store.Editor)
+	if !ok {
+		writeError(w, req, http.StatusNotImplemented, "%v", errCannotEdit)
+		return
+	}
+	if !manageAll(req) {
+		writeError(w, req, http.StatusForbidden, "only admins may approve links")
+		return
+	}
+	old, err := s.current(req.Context(), shortcut)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to look up shortcut: %v", err)
+		return
+	}
+	if old == nil || !old.Deleted.IsZero() {
+		writeError(w, req, http.StatusNotFound, "shortcut %q not found", shortcut)
+		return
+	}
+	if !old.Unapproved {
+		writeJSON(w, http.StatusOK, linkResponse(shortcut, old))
+		return
+	}
+	approved := *old
+	approved.Unapproved = false
+	if err := editor.Update(req.Context(), shortcut, &approved); err != nil {
+		writeError(w, req, http.StatusBadGateway, "failed to approve link: %v", err)
+		return
+	}
+	s.Links.Invalidate()
+	s.audit(req, store.AuditApprove, shortcut, old, &approved)
+	log.Printf("approved shortcut=%q to=%q", shortcut, targetSummary(&approved))
+	w.Header().Set("ETag", linkRevision(shortcut, &approved))
+	writeJSON(w, http.StatusOK, linkResponse(shortcut, &approved))
+}
+
+// awaitApproval tells the admins through the webhooks that the link of
+// shortcut, just created or changed by a non-admin, awaits their approval.
+func (s *Server) awaitApproval(shortcut string, link *store.Link) {
+	if !link.Unapproved {
+		return
+	}
+	log.Printf("shortcut %q awaits approval", shortcut)
+	s.Webhooks.AwaitingApproval(shortcut, link)
+}
@@ -0,0 +1,80 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// maxAuditEntries caps the entries returned by GET /api/audit.
+const maxAuditEntries = 1000
+
+// audit records a change made by req. Failures are logged but don't fail the
+// request, since the change has been made already.
+func (s *Server) audit(req *http.Request, action, shortcut string, before, after *store.Link) {
+	e := store.AuditEntry{
+		Time:     time.Now().UTC(),
+		Actor:    "anonymous",
+		Client:   clientIP(req, s.TrustProxy),
+		Action:   action,
+		Shortcut: shortcut,
+	}
+	if p := requestPrincipal(req); p != nil {
+		e.Actor = p.Name
+	}
+	if before != nil {
+		e.Old, _ = json.Marshal(linkResponse(shortcut, before))
+	}
+	if after != nil {
+		e.New, _ = json.Marshal(linkResponse(shortcut, after))
+	}
+	s.appendAudit(req.Context(), e)
+}
+
+func (s *Server) appendAudit(ctx context.Context, e store.AuditEntry) {
+	if s.AuditLog == nil {
+		return
+	}
+	if err := s.AuditLog.AppendAudit(ctx, e); err != nil {
+		log.Printf("warn: failed to record audit entry for %s of %q by %s: %v", e.Action, e.Shortcut, e.Actor, err)
+	}
+}
+
+// auditTrail handles GET /api/audit?shortcut=&limit=.
+func (s *Server) auditTrail(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	if s.AuditLog == nil {
+		writeError(w, req, http.StatusNotImplemented, "audit log not configured, set AUDIT_LOG_FILE")
+		return
+	}
+
+	q := req.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditEntries {
+			writeError(w, req, http.StatusBadRequest, "limit must be between 1 and %d", maxAuditEntries)
+			return
+		}
+		limit = n
+	}
+
+	entries, err := s.AuditLog.Audit(req.Context(), store.Norm.Lower(q.Get("shortcut")), limit)
+	if err != nil {
+		writeError(w, req, http.StatusBadGateway, "failed to read audit log: %v", err)
+		return
+	}
+	if entries == nil {
+		entries = []store.AuditEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
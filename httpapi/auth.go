@@ -0,0 +1,158 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+type principalKey struct{}
+
+// requestPrincipal returns the caller authenticated by requireScope, or nil
+// when authentication is disabled.
+func requestPrincipal(req *http.Request) *store.Principal {
+	p, _ := req.Context().Value(principalKey{}).(*store.Principal)
+	return p
+}
+
+// hashToken is how tokens are stored, so that a leaked table does not leak
+// usable credentials.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticator validates bearer tokens from API_TOKENS and, when the
+// provider supports it, the provider's token store.
+type Authenticator struct {
+	// tokens maps token hashes to the principals configured in API_TOKENS.
+	tokens map[string]*store.Principal
+	store  store.TokenStore
+	// SSO, if set, also accepts people signed in with Google.
+	SSO *SSO
+}
+
+// NewAuthenticator parses API_TOKENS, a list of token:scopes entries
+// separated by semicolons or whitespace, e.g. "s3cr3t:admin;ci:read,write".
+// A token without scopes gets admin.
+func NewAuthenticator(env string, tokens store.TokenStore) (*Authenticator, error) {
+	a := &Authenticator{tokens: make(map[string]*store.Principal), store: tokens}
+	entries := strings.FieldsFunc(env, func(r rune) bool {
+		return r == ';' || r == ' ' || r == '\n' || r == '\t'
+	})
+	for _, entry := range entries {
+		token, scopes := entry, "admin"
+		if i := strings.LastIndex(entry, ":"); i >= 0 {
+			token, scopes = entry[:i], entry[i+1:]
+		}
+		if token == "" {
+			return nil, fmt.Errorf("API_TOKENS entry %q has an empty token", entry)
+		}
+		sc, err := store.ParseScopes(scopes)
+		if err != nil {
+			return nil, fmt.Errorf("API_TOKENS: %w", err)
+		}
+		hash := hashToken(token)
+		a.tokens[hash] = &store.Principal{Name: "token:" + hash[:8], Scope: sc}
+	}
+	return a, nil
+}
+
+// Enabled reports whether any token source is configured. Without one the
+// API is left open.
+func (a *Authenticator) Enabled() bool {
+	return len(a.tokens) > 0 || a.store != nil || a.SSO != nil
+}
+
+// authenticate returns the principal of the request's credentials, or nil if
+// there are none or they are unknown. The token is read from a bearer
+// Authorization header or, for browsers, the password of basic auth. Without
+// a token the SSO session cookie, if any, is used.
+func (a *Authenticator) authenticate(req *http.Request) (*store.Principal, error) {
+	var token string
+	if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	} else if _, pass, ok := req.BasicAuth(); ok {
+		token = pass
+	}
+	if token == "" {
+		if a.SSO != nil {
+			return a.SSO.authenticate(req), nil
+		}
+		return nil, nil
+	}
+
+	hash := hashToken(token)
+	if p, ok := a.tokens[hash]; ok {
+		return p, nil
+	}
+	if a.store != nil {
+		return a.store.LookupToken(req.Context(), hash)
+	}
+	return nil, nil
+}
+
+// requireScope wraps next so it only serves callers with at least min scope;
+// write is required instead of read for methods other than GET and HEAD.
+// Browsers are asked for basic auth when basic is set, or sent to sign in
+// with SSO when it is configured.
+func (a *Authenticator) requireScope(min store.Scope, basic bool, next http.HandlerFunc) http.HandlerFunc {
+	if !a.Enabled() {
+		return next
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		need := min
+		if need < store.ScopeWrite && req.Method != http.MethodGet && req.Method != http.MethodHead {
+			need = store.ScopeWrite
+		}
+
+		p, err := a.authenticate(req)
+		if err != nil {
+			log.Printf("warn: failed to look up API token: %v", err)
+			writeError(w, req, http.StatusServiceUnavailable, "failed to verify credentials")
+			return
+		}
+		if p == nil {
+			if basic && a.SSO != nil && req.Method == http.MethodGet {
+				http.Redirect(w, req, loginURL(req), http.StatusFound)
+				return
+			}
+			if basic {
+				w.Header().Set("WWW-Authenticate", `Basic realm="url-shortener"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="url-shortener"`)
+			}
+			writeError(w, req, http.StatusUnauthorized, "missing or invalid API token")
+			return
+		}
+		if p.Scope < need {
+			writeError(w, req, http.StatusForbidden, "%s lacks the required scope", p.Name)
+			return
+		}
+		next(w, req.WithContext(context.WithValue(req.Context(), principalKey{}, p)))
+	}
+}
+
+// identify wraps next so it knows the caller when the request carries
+// valid credentials, without requiring any.
+func (a *Authenticator) identify(next http.HandlerFunc) http.HandlerFunc {
+	if !a.Enabled() {
+		return next
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		p, err := a.authenticate(req)
+		if err != nil {
+			log.Printf("warn: failed to look up API token: %v", err)
+		}
+		if p != nil {
+			req = req.WithContext(context.WithValue(req.Context(), principalKey{}, p))
+		}
+		next(w, req)
+	}
+}
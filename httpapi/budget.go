@@ -0,0 +1,164 @@
+package httpapi
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// clickBudgetInterval is how often the totals of links with a click budget
+// are reloaded, to include the clicks served by other replicas.
+const clickBudgetInterval = 30 * time.Second
+
+var budgetRefusalsTotal = metrics.NewCounter("shortener_click_budget_refusals_total",
+	"Requests refused because their link used up its click budget.")
+
+// clickBudgets counts the clicks of links with a click budget, so redirects
+// don't ask the backend for totals every time. Between reloads the clicks
+// served here are added up in memory.
+type clickBudgets struct {
+	mu sync.Mutex
+	m  map[string]*budgetCount
+}
+
+type budgetCount struct {
+	clicks int64
+	loaded time.Time
+	// notified is set once the owner was told the budget is used up.
+	notified bool
+}
+
+// exhausted reports whether shortcut has used up its budget of clicks.
+func (b *clickBudgets) exhausted(ctx context.Context, clicks *Analytics, shortcut string, budget int64) (bool, error) {
+	b.mu.Lock()
+	c := b.m[shortcut]
+	stale := c == nil || time.Since(c.loaded) >= clickBudgetInterval
+	b.mu.Unlock()
+	if stale {
+		totals, err := clicks.Totals(ctx, []string{shortcut})
+		if err != nil {
+			return false, err
+		}
+		b.mu.Lock()
+		if b.m == nil {
+			b.m = make(map[string]*budgetCount)
+		}
+		if c = b.m[shortcut]; c == nil {
+			c = &budgetCount{}
+			b.m[shortcut] = c
+		}
+		c.clicks, c.loaded = totals[shortcut], time.Now()
+		b.mu.Unlock()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return c.clicks >= budget, nil
+}
+
+// clicked counts a click of shortcut, reporting whether it used up the
+// budget of n clicks and the owner has not been told yet.
+func (b *clickBudgets) clicked(shortcut string, budget int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.m[shortcut]
+	if c == nil {
+		return false
+	}
+	c.clicks++
+	if c.clicks < budget || c.notified {
+		return false
+	}
+	c.notified = true
+	return true
+}
+
+// clickBudget returns the click budget of shortcut, whose link as resolved
+// for the visitor is link. Variants share the budget of their shortcut.
+func (s *Server) clickBudget(shortcut string, link *store.Link) int64 {
+	if link.When == nil {
+		return link.MaxClicks
+	}
+	base, err := s.Links.Get(shortcut)
+	if err != nil || base == nil {
+		return link.MaxClicks
+	}
+	return base.MaxClicks
+}
+
+// overBudget answers 410 Gone and returns true when shortcut has used up its
+// budget of n clicks. Failing to load the totals lets the request through.
+func (s *Server) overBudget(w http.ResponseWriter, req *http.Request, shortcut string, budget int64) bool {
+	if budget <= 0 {
+		return false
+	}
+	exhausted, err := s.budgets.exhausted(req.Context(), s.Analytics, shortcut, budget)
+	if err != nil {
+		log.Printf("warn: failed to load the clicks of %q to check its budget: %v", shortcut, err)
+		return false
+	}
+	if !exhausted {
+		return false
+	}
+	budgetRefusalsTotal.Inc()
+	writeError(w, req, http.StatusGone, "shortcut %q has used up its %d clicks", shortcut, budget)
+	return true
+}
+
+// spendBudget counts a click of shortcut towards its budget of n clicks,
+// telling the owner through the webhooks when it is used up.
+func (s *Server) spendBudget(shortcut string, link *store.Link, budget int64) {
+	if budget <= 0 || !s.budgets.clicked(shortcut, budget) {
+		return
+	}
+	log.Printf("warn: shortcut %q used up its %d clicks", shortcut, budget)
+	s.Webhooks.BudgetExhausted(shortcut, link, budget)
+}
+
+// disableLink handles POST /api/links/{shortcut}/disable, making a link
+// answer 410 Gone right away, such as when it is being abused. Editing it
+// with "disabled": false enables it again.
+func (s *Server) disableLink(w http.ResponseWriter, req *http.Request, shortcut string) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	editor, ok := s.Links.Provider.(store.Editor)
+	if !ok {
+		writeError(w, req, http.StatusNotImplemented, "%v", errCannotEdit)
+		return
+	}
+	old, err := s.current(req.Context(), shortcut)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to look up shortcut: %v", err)
+		return
+	}
+	if old == nil || !old.Deleted.IsZero() {
+		writeError(w, req, http.StatusNotFound, "shortcut %q not found", shortcut)
+		return
+	}
+	if !owns(req, old) {
+		writeError(w, req, http.StatusForbidden, "%v", errNotOwner)
+		return
+	}
+	if old.Disabled {
+		writeJSON(w, http.StatusOK, linkResponse(shortcut, old))
+		return
+	}
+	disabled := *old
+	disabled.Disabled = true
+	if err := editor.Update(req.Context(), shortcut, &disabled); err != nil {
+		writeError(w, req, http.StatusBadGateway, "failed to disable link: %v", err)
+		return
+	}
+	s.Links.Invalidate()
+	s.audit(req, store.AuditDisable, shortcut, old, &disabled)
+	log.Printf("disabled shortcut=%q", shortcut)
+	w.Header().Set("ETag", linkRevision(shortcut, &disabled))
+	writeJSON(w, http.StatusOK, linkResponse(shortcut, &disabled))
+}
@@ -0,0 +1,82 @@
+package httpapi
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// setCacheHeaders sets the Cache-Control and Expires of a redirect to link:
+// the link's own policy, else the server default. Private and protected
+// links are never stored, A/B splits only by the visitor's browser, and no
+// cache keeps a redirect past the link's expiry.
+func (s *Server) setCacheHeaders(w http.ResponseWriter, link *store.Link, now time.Time) {
+	cc := link.CacheControl
+	if cc == "" {
+		cc = s.CacheControl
+	}
+	switch {
+	case link.Private || link.Password != "":
+		cc = "private, no-store"
+	case link.Split():
+		cc = privateCacheControl(cc)
+	}
+	if cc == "" {
+		return
+	}
+
+	var directives []string
+	maxAge := -1
+	for _, d := range strings.Split(cc, ", ") {
+		if strings.HasPrefix(d, "max-age=") {
+			maxAge, _ = strconv.Atoi(strings.TrimPrefix(d, "max-age="))
+			if !link.Expires.IsZero() {
+				if left := int(link.Expires.Sub(now) / time.Second); left < maxAge {
+					maxAge = left
+				}
+			}
+			if maxAge < 0 {
+				maxAge = 0
+			}
+			d = "max-age=" + strconv.Itoa(maxAge)
+		} else if d == "no-store" || d == "no-cache" {
+			maxAge = 0
+		}
+		directives = append(directives, d)
+	}
+	w.Header().Set("Cache-Control", strings.Join(directives, ", "))
+	if maxAge >= 0 {
+		// For HTTP/1.0 caches, which ignore Cache-Control.
+		w.Header().Set("Expires", now.Add(time.Duration(maxAge)*time.Second).UTC().Format(http.TimeFormat))
+	}
+}
+
+// privateCacheControl restricts cc to the client's own cache.
+func privateCacheControl(cc string) string {
+	out := []string{"private"}
+	for _, d := range strings.Split(cc, ", ") {
+		switch {
+		case d == "", d == "public", d == "private", strings.HasPrefix(d, "s-maxage="):
+			continue
+		case d == "no-store":
+			return "private, no-store"
+		}
+		out = append(out, d)
+	}
+	return strings.Join(out, ", ")
+}
+
+// temporaryStatus maps permanent redirect statuses to their temporary
+// counterparts, which browsers and CDNs don't keep forever.
+func temporaryStatus(code int) int {
+	switch code {
+	case http.StatusMovedPermanently:
+		return http.StatusFound
+	case http.StatusPermanentRedirect:
+		return http.StatusTemporaryRedirect
+	}
+	return code
+}
@@ -0,0 +1,42 @@
+package httpapi
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CanonicalHost redirects requests that did not arrive on the canonical
+// scheme and host to the same path and query on the canonical URL, so that
+// links shared with a different host variant keep working. Hosts for which
+// keep returns true, such as other short domains, only get the canonical
+// scheme. X-Forwarded-Proto tells the scheme when trustProxy is set.
+func CanonicalHost(scheme, host string, trustProxy bool, keep func(host string) bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		want := host
+		if keep(req.Host) {
+			want = req.Host
+		}
+		if requestScheme(req, trustProxy) == scheme && strings.EqualFold(req.Host, want) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		target := *req.URL
+		target.Scheme = scheme
+		target.Host = want
+		http.Redirect(w, req, target.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// requestScheme returns the scheme the client used. Behind a trusted
+// TLS-terminating proxy that is the X-Forwarded-Proto it sets; otherwise
+// the header is the client's own and ignored.
+func requestScheme(req *http.Request, trustProxy bool) string {
+	if proto := req.Header.Get("X-Forwarded-Proto"); trustProxy && proto != "" {
+		return strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
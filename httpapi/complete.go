@@ -0,0 +1,108 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// defaultCompletions and maxCompletions are the default and largest
+// ?limit= of /api/complete.
+const (
+	defaultCompletions = 8
+	maxCompletions     = 20
+)
+
+// completion is a shortcut offered by /api/complete.
+type completion struct {
+	Shortcut    string `json:"shortcut"`
+	ShortURL    string `json:"short_url"`
+	Target      string `json:"target"`
+	Description string `json:"description,omitempty"`
+	Title       string `json:"title,omitempty"`
+}
+
+type completeResponse struct {
+	Prefix      string       `json:"prefix"`
+	Completions []completion `json:"completions"`
+}
+
+// complete handles /api/complete?prefix=, the shortcuts starting with a
+// prefix, shortest first, for browser extensions suggesting them as the
+// address is typed. It reads a trie built with each refresh, never the
+// backend. Like /api/suggest it needs no token; private links are offered
+// to clients that may resolve them, except to pages of other origins without
+// an Authorization header.
+func (s *Server) complete(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	q := req.URL.Query()
+	limit := defaultCompletions
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxCompletions {
+			writeError(w, req, http.StatusBadRequest, "limit must be between 1 and %d", maxCompletions)
+			return
+		}
+		limit = n
+	}
+	prefix := strings.TrimPrefix(strings.TrimSpace(q.Get("prefix")), "/")
+
+	ns := s.Domains.Namespace(req.Host)
+	base := requestScheme(req, s.TrustProxy) + "://" + req.Host + "/"
+	// Whether private links may be offered is only looked up once one is.
+	checked, private := false, false
+	out := completeResponse{Prefix: prefix, Completions: []completion{}}
+	if prefix != "" {
+		for _, c := range s.Links.Complete(s.Domains.Join(ns, prefix)) {
+			kns, shortcut := s.Domains.Split(c.Shortcut)
+			if kns != ns {
+				continue
+			}
+			if c.Link.Private {
+				if !checked {
+					checked = true
+					private = s.canViewPrivate(req) && (req.Header.Get("Authorization") != "" || sameOrigin(req))
+				}
+				if !private {
+					continue
+				}
+			}
+			e := completion{
+				Shortcut:    shortcut,
+				ShortURL:    base + shortcut,
+				Target:      publicTarget(c.Link),
+				Description: c.Link.Description,
+			}
+			// The title of the page would tell where it leads as well.
+			if p := s.Pages.Info(c.Link); p != nil && c.Link.Password == "" {
+				e.Title = p.Title
+			}
+			out.Completions = append(out.Completions, e)
+			if len(out.Completions) == limit {
+				break
+			}
+		}
+	}
+
+	// Extensions and new tab pages fetch from their own origins.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Add("Vary", "Authorization")
+	w.Header().Set("Cache-Control", "private, max-age=10")
+	writeJSON(w, http.StatusOK, out)
+}
+
+// sameOrigin reports whether req comes from a page of the server itself or
+// from a client that doesn't tell, as opposed to a page of another site.
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
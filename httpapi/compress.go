@@ -0,0 +1,150 @@
+package httpapi
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressMinSize is the smallest response worth compressing; smaller ones
+// are sent as they are.
+const compressMinSize = 1024
+
+// compressibleTypes are the content type prefixes of responses that gzip
+// well. Images such as QR codes are compressed already.
+var compressibleTypes = []string{"text/", "application/json", "application/xml"}
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(io.Discard) }}
+
+// compress wraps h, compressing text responses with gzip for clients that
+// accept it.
+func compress(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if req.Method == http.MethodHead || !acceptsGzip(req.Header.Get("Accept-Encoding")) {
+			h(w, req)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		h(gw, req)
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params := part, ""
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			coding, params = part[:i], part[i+1:]
+		}
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		params = strings.TrimSpace(params)
+		if !strings.HasPrefix(params, "q=") {
+			return true
+		}
+		q, err := strconv.ParseFloat(params[2:], 64)
+		return err == nil && q > 0
+	}
+	return false
+}
+
+// compressible reports whether responses of contentType are worth
+// compressing.
+func compressible(contentType string) bool {
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the first compressMinSize bytes of a
+// response to decide whether to compress it.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	code    int
+	buf     []byte
+	started bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	if !w.started {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < compressMinSize {
+			return len(b), nil
+		}
+		return len(b), w.start()
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// start sends the headers, compressing the response if it is worth it, and
+// then what was held back.
+func (w *gzipResponseWriter) start() error {
+	w.started = true
+	h := w.Header()
+	if len(w.buf) >= compressMinSize && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// Flush sends what was written so far, compressed or not.
+func (w *gzipResponseWriter) Flush() {
+	if !w.started && w.code != 0 {
+		w.start()
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close finishes the response once the handler returned.
+func (w *gzipResponseWriter) close() {
+	if !w.started && w.code != 0 {
+		w.start()
+	}
+	if w.gz != nil {
+		w.gz.Close()
+		w.gz.Reset(io.Discard)
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+	}
+}
@@ -0,0 +1,52 @@
+package httpapi
+
+import (
+	"bytes"
+	_ "embed"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/store"
+	"github.com/yuin/goldmark"
+)
+
+//go:embed web/content.html.tmpl
+var contentTemplateText string
+
+var contentTemplate = template.Must(template.New("content").Parse(contentTemplateText))
+
+// content answers with the text of a text, markdown or snippet link. Clients
+// that don't accept HTML, such as curl, get the text as is.
+func (s *Server) content(w http.ResponseWriter, req *http.Request, shortcut string, link *store.Link) {
+	log.Printf("showing=%q type=%q", req.URL, link.Type)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !strings.Contains(req.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(strings.TrimRight(link.Content, "\n") + "\n"))
+		return
+	}
+
+	data := struct {
+		Shortcut string
+		Text     string
+		Snippet  bool
+		HTML     template.HTML
+	}{Shortcut: shortcut, Text: link.Content, Snippet: link.Type == store.TypeSnippet}
+	if link.Type == store.TypeMarkdown {
+		// Raw HTML in the source is escaped and unsafe link schemes such as
+		// javascript: are dropped, since goldmark runs without WithUnsafe.
+		var buf bytes.Buffer
+		if err := goldmark.Convert([]byte(link.Content), &buf); err != nil {
+			log.Printf("warn: failed to render markdown of %q: %v", shortcut, err)
+		} else {
+			data.HTML = template.HTML(buf.String())
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := contentTemplate.Execute(w, data); err != nil {
+		log.Printf("warn: failed to render content page: %v", err)
+	}
+}
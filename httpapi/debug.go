@@ -0,0 +1,73 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// started is when the process started, for the uptime of /debug/runtime.
+var started = time.Now()
+
+type runtimeResponse struct {
+	Uptime     float64 `json:"uptime_seconds"`
+	GoVersion  string  `json:"go_version"`
+	Goroutines int     `json:"goroutines"`
+	// Links counts the loaded links, including expired ones.
+	Links int `json:"links"`
+	// HeapAlloc and HeapObjects are the live heap, Sys all memory obtained
+	// from the OS.
+	HeapAlloc   uint64  `json:"heap_alloc_bytes"`
+	HeapObjects uint64  `json:"heap_objects"`
+	Sys         uint64  `json:"sys_bytes"`
+	NumGC       uint32  `json:"num_gc"`
+	PauseTotal  float64 `json:"gc_pause_total_seconds"`
+	LastGC      string  `json:"last_gc,omitempty"`
+}
+
+// debugRuntime handles GET /debug/runtime, reporting the memory and
+// goroutines of the process along with the number of links loaded.
+func (s *Server) debugRuntime(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	links, _ := s.Links.Loaded()
+	resp := runtimeResponse{
+		Uptime:      time.Since(started).Seconds(),
+		GoVersion:   runtime.Version(),
+		Goroutines:  runtime.NumGoroutine(),
+		Links:       links,
+		HeapAlloc:   m.HeapAlloc,
+		HeapObjects: m.HeapObjects,
+		Sys:         m.Sys,
+		NumGC:       m.NumGC,
+		PauseTotal:  time.Duration(m.PauseTotalNs).Seconds(),
+	}
+	if m.LastGC > 0 {
+		resp.LastGC = time.Unix(0, int64(m.LastGC)).UTC().Format(time.RFC3339)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// debugPprof serves the profiles of net/http/pprof under /debug/pprof/.
+func debugPprof(w http.ResponseWriter, req *http.Request) {
+	switch strings.TrimPrefix(req.URL.Path, "/debug/pprof/") {
+	case "cmdline":
+		pprof.Cmdline(w, req)
+	case "profile":
+		pprof.Profile(w, req)
+	case "symbol":
+		pprof.Symbol(w, req)
+	case "trace":
+		pprof.Trace(w, req)
+	default:
+		// The index, and named profiles such as heap and goroutine.
+		pprof.Index(w, req)
+	}
+}
@@ -0,0 +1,143 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// trackingParams are query parameters that don't change the page a URL
+// leads to, besides those starting with utm_.
+var trackingParams = map[string]bool{"fbclid": true, "gclid": true, "mc_cid": true, "mc_eid": true}
+
+// destinationKey returns the form URLs leading to the same page share:
+// http and https, the case of the host, default ports, a trailing slash,
+// the order of query parameters and tracking parameters such as utm_source
+// don't tell them apart.
+func destinationKey(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host, port := strings.ToLower(strings.TrimSuffix(u.Hostname(), ".")), u.Port()
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		port = ""
+	}
+	if scheme == "http" {
+		scheme = "https"
+	}
+	var b strings.Builder
+	b.WriteString(scheme + "://" + host)
+	if port != "" {
+		b.WriteString(":" + port)
+	}
+	b.WriteString(strings.TrimSuffix(u.Path, "/"))
+	q := u.Query()
+	for k := range q {
+		if trackingParams[strings.ToLower(k)] || strings.HasPrefix(strings.ToLower(k), "utm_") {
+			delete(q, k)
+		}
+	}
+	if len(q) > 0 {
+		b.WriteString("?" + q.Encode())
+	}
+	if u.Fragment != "" {
+		b.WriteString("#" + u.Fragment)
+	}
+	return b.String()
+}
+
+// duplicateGroup is an entry of GET /api/links/duplicates.
+type duplicateGroup struct {
+	Destination string   `json:"destination"`
+	Shortcuts   []string `json:"shortcuts"`
+}
+
+// duplicateGroups groups the shortcuts of all leading to the same
+// destination, the largest groups first. Only groups of at least min
+// shortcuts are returned.
+func duplicateGroups(all store.URLMap, min int) []duplicateGroup {
+	byKey := make(map[string][]string)
+	for k, l := range all {
+		if l.URL == nil || l.Type != "" {
+			continue
+		}
+		key := destinationKey(l.URL)
+		byKey[key] = append(byKey[key], k)
+	}
+	out := []duplicateGroup{}
+	for _, shortcuts := range byKey {
+		if len(shortcuts) < min {
+			continue
+		}
+		sort.Strings(shortcuts)
+		out = append(out, duplicateGroup{Destination: all[shortcuts[0]].URL.String(), Shortcuts: shortcuts})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if len(out[i].Shortcuts) != len(out[j].Shortcuts) {
+			return len(out[i].Shortcuts) > len(out[j].Shortcuts)
+		}
+		return out[i].Destination < out[j].Destination
+	})
+	return out
+}
+
+// shortcutsTo returns the sorted shortcuts of all leading to u.
+func shortcutsTo(all store.URLMap, u *url.URL) []string {
+	key := destinationKey(u)
+	var out []string
+	for k, l := range all {
+		if l.URL != nil && l.Type == "" && destinationKey(l.URL) == key {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// visibleLinks returns the links the client of req may see: all but the
+// private ones unless it may view those.
+func (s *Server) visibleLinks(req *http.Request) (store.URLMap, error) {
+	all, err := s.Links.All()
+	if err != nil || s.canViewPrivate(req) {
+		return all, err
+	}
+	out := make(store.URLMap, len(all))
+	for k, l := range all {
+		if !l.Private {
+			out[k] = l
+		}
+	}
+	return out, nil
+}
+
+// duplicates handles GET /api/links/duplicates, listing the shortcuts that
+// lead to the same destination. With ?url= it lists those leading to that
+// URL instead, even a single one, to warn before adding another.
+func (s *Server) duplicates(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	all, err := s.visibleLinks(req)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to load links: %v", err)
+		return
+	}
+	raw := req.URL.Query().Get("url")
+	if raw == "" {
+		writeJSON(w, http.StatusOK, duplicateGroups(all, 2))
+		return
+	}
+	u, err := validateURL(raw)
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, "%v", err)
+		return
+	}
+	out := []duplicateGroup{}
+	if shortcuts := shortcutsTo(all, u); len(shortcuts) > 0 {
+		out = append(out, duplicateGroup{Destination: all[shortcuts[0]].URL.String(), Shortcuts: shortcuts})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
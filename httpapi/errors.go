@@ -0,0 +1,78 @@
+package httpapi
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+)
+
+//go:embed web/error.html.tmpl
+var errorTemplateText string
+
+var errorTemplate = template.Must(template.New("error").Parse(errorTemplateText))
+
+// errorCodes are the machine-readable codes of error responses, by status.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "unauthenticated",
+	http.StatusForbidden:             "permission_denied",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "already_exists",
+	http.StatusGone:                  "expired",
+	http.StatusPreconditionFailed:    "precondition_failed",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal",
+	http.StatusNotImplemented:        "not_implemented",
+	http.StatusBadGateway:            "backend_failed",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusGatewayTimeout:        "backend_timeout",
+}
+
+// errorCode returns the code of error responses with status.
+func errorCode(status int) string {
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	return strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+}
+
+// errorResponse is the body of JSON error responses:
+//
+//	{"error": {"code": "not_found", "message": "shortcut \"docs\" not found"}}
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError answers req with status and a message formatted with
+// fmt.Sprintf: a small page for browsers and a JSON errorResponse for
+// everyone else.
+func writeError(w http.ResponseWriter, req *http.Request, status int, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if strings.Contains(req.Header.Get("Accept"), "text/html") {
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		err := errorTemplate.Execute(w, struct {
+			Status         int
+			Title, Message string
+			Code           string
+		}{status, http.StatusText(status), msg, errorCode(status)})
+		if err != nil {
+			log.Printf("warn: failed to render error page: %v", err)
+		}
+		return
+	}
+	writeJSON(w, status, errorResponse{Error: errorDetail{Code: errorCode(status), Message: msg}})
+}
@@ -0,0 +1,252 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/resolver"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// eventLinkClicked is sent to event streams for every click; webhooks only
+// get link.clicks for click thresholds.
+const eventLinkClicked = "link.clicked"
+
+var streamEvents = []string{eventLinkCreated, eventLinkUpdated, eventLinkDeleted, eventLinkClicked}
+
+const (
+	// eventBacklog is how many events are kept for streams reconnecting
+	// with Last-Event-ID.
+	eventBacklog = 1000
+	// eventKeepAlive is how often idle streams get a comment, so proxies
+	// don't close them.
+	eventKeepAlive = 15 * time.Second
+)
+
+// streamEvent is an event encoded for the streams.
+type streamEvent struct {
+	seq  uint64
+	name string
+	data []byte
+}
+
+// Events broadcasts the link changes and clicks seen by this replica to the
+// streams of /api/events/stream. It keeps the last eventBacklog events, so
+// streams that reconnect, such as after StreamTimeout, miss none.
+type Events struct {
+	// epoch tells the event IDs of this process from those of others.
+	epoch string
+
+	mu sync.Mutex
+	// seq is the number of the last event; backlog ends with it.
+	seq     uint64
+	backlog []streamEvent
+	// changed is closed and replaced whenever an event is added.
+	changed chan struct{}
+}
+
+// NewEvents returns an event hub without events.
+func NewEvents() *Events {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return &Events{epoch: hex.EncodeToString(b), changed: make(chan struct{})}
+}
+
+// Run streams the changes of links until ctx is cancelled.
+func (e *Events) Run(ctx context.Context, links *resolver.Cache) {
+	changes, stop := links.Watch()
+	defer func() { stop() }()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case events, ok := <-changes:
+			if !ok {
+				log.Printf("warn: event streams fell behind on link changes, some were not sent")
+				changes, stop = links.Watch()
+				continue
+			}
+			for _, ev := range events {
+				e.linkChanged(ev)
+			}
+		}
+	}
+}
+
+// linkChanged publishes a change found by a refresh, in the body of its
+// webhook.
+func (e *Events) linkChanged(ev resolver.LinkEvent) {
+	link := linkResponse(ev.Shortcut, ev.Link)
+	out := webhookEvent{Time: time.Now().UTC(), Shortcut: ev.Shortcut, Link: &link}
+	switch ev.Type {
+	case resolver.LinkAdded:
+		out.Event, out.Text = eventLinkCreated, fmt.Sprintf("%s was created, leading to %s", ev.Shortcut, targetSummary(ev.Link))
+	case resolver.LinkChanged:
+		out.Event, out.Text = eventLinkUpdated, fmt.Sprintf("%s now leads to %s", ev.Shortcut, targetSummary(ev.Link))
+	case resolver.LinkRemoved:
+		out.Event, out.Text = eventLinkDeleted, fmt.Sprintf("%s was deleted", ev.Shortcut)
+	default:
+		return
+	}
+	out.ID = linkRevision(ev.Shortcut, ev.Link)
+	e.publish(out.Event, out)
+}
+
+// Clicked publishes a click followed on this replica.
+func (e *Events) Clicked(c store.Click) {
+	if e == nil {
+		return
+	}
+	e.publish(eventLinkClicked, c)
+}
+
+func (e *Events) publish(name string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.seq++
+	e.backlog = append(e.backlog, streamEvent{seq: e.seq, name: name, data: data})
+	// Copy the last events over from time to time, rather than reslicing on
+	// every event, which would keep the whole history alive.
+	if len(e.backlog) == 2*eventBacklog {
+		e.backlog = append([]streamEvent(nil), e.backlog[eventBacklog:]...)
+	}
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// id returns the event ID of seq.
+func (e *Events) id(seq uint64) string {
+	return e.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// resume returns the number of the event with ID lastID, where a stream
+// continues, or of the last event when lastID is empty or of another process.
+func (e *Events) resume(lastID string) uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if i := strings.LastIndexByte(lastID, '-'); i > 0 && lastID[:i] == e.epoch {
+		if seq, err := strconv.ParseUint(lastID[i+1:], 10, 64); err == nil && seq <= e.seq {
+			return seq
+		}
+	}
+	return e.seq
+}
+
+// since returns the events after seq, whether some of them were dropped
+// from the backlog already, and a channel closed on the next event.
+func (e *Events) since(seq uint64) (events []streamEvent, lost bool, changed <-chan struct{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	backlog := e.backlog
+	if len(backlog) > eventBacklog {
+		backlog = backlog[len(backlog)-eventBacklog:]
+	}
+	if len(backlog) > 0 && seq+1 < backlog[0].seq {
+		lost = true
+	}
+	for i, ev := range backlog {
+		if ev.seq > seq {
+			events = backlog[i:]
+			break
+		}
+	}
+	return events, lost, e.changed
+}
+
+// eventStream handles GET /api/events/stream, sending link changes and
+// clicks as server-sent events, optionally only those named in ?events=.
+// Streams end after StreamTimeout; browsers reconnect on their own with
+// Last-Event-ID and get the events they missed in between.
+func (s *Server) eventStream(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	if s.Events == nil {
+		writeError(w, req, http.StatusNotImplemented, "event streams are not enabled")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, req, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	var only map[string]bool
+	if v := req.URL.Query().Get("events"); v != "" {
+		only = make(map[string]bool)
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			known := false
+			for _, k := range streamEvents {
+				known = known || k == name
+			}
+			if !known {
+				writeError(w, req, http.StatusBadRequest, "unknown event %q, expected one of %s", name, strings.Join(streamEvents, ", "))
+				return
+			}
+			only[name] = true
+		}
+	}
+
+	seq := s.Events.resume(req.Header.Get("Last-Event-ID"))
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Keep nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: 1000\n\n")
+	flusher.Flush()
+
+	var end <-chan time.Time
+	if s.StreamTimeout > 0 {
+		t := time.NewTimer(s.StreamTimeout)
+		defer t.Stop()
+		end = t.C
+	}
+	ping := time.NewTicker(eventKeepAlive)
+	defer ping.Stop()
+	for {
+		events, lost, changed := s.Events.since(seq)
+		if lost {
+			// The client can't know what it missed; it should reload.
+			fmt.Fprintf(w, "event: lost\ndata: {}\n\n")
+		}
+		skipped := false
+		for _, ev := range events {
+			seq = ev.seq
+			if skipped = only != nil && !only[ev.name]; skipped {
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", s.Events.id(ev.seq), ev.name, ev.data)
+		}
+		if skipped {
+			// An ID alone moves Last-Event-ID past the events left out.
+			fmt.Fprintf(w, "id: %s\n\n", s.Events.id(seq))
+		}
+		flusher.Flush()
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-end:
+			return
+		case <-ping.C:
+			fmt.Fprintf(w, ": ping\n\n")
+		case <-changed:
+		}
+	}
+}
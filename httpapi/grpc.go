@@ -0,0 +1,460 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/tracing"
+	"github.com/denizyoldas/url-shorter/resolver"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// grpcService is the path prefix of the methods of shortener.v1.Shortener.
+const grpcService = "/shortener.v1.Shortener/"
+
+// gRPC status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html.
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcAlreadyExists      = 6
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcAborted            = 10
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+	grpcFailedPrecondition = 9
+)
+
+// grpcError is an error with a gRPC status code.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// grpcMethod is a method of the Shortener service. Unary methods return
+// their response; streaming ones call send for each message instead.
+type grpcMethod struct {
+	scope  store.Scope
+	unary  func(s *Server, req *http.Request, in []byte) ([]byte, error)
+	stream func(s *Server, req *http.Request, in []byte, send func([]byte) error) error
+}
+
+var grpcMethods = map[string]grpcMethod{
+	"GetLink":    {scope: store.ScopeRead, unary: (*Server).grpcGetLink},
+	"ListLinks":  {scope: store.ScopeRead, unary: (*Server).grpcListLinks},
+	"CreateLink": {scope: store.ScopeWrite, unary: (*Server).grpcCreateLink},
+	"UpdateLink": {scope: store.ScopeWrite, unary: (*Server).grpcUpdateLink},
+	"DeleteLink": {scope: store.ScopeWrite, unary: (*Server).grpcDeleteLink},
+	"GetStats":   {scope: store.ScopeRead, unary: (*Server).grpcGetStats},
+	"WatchLinks": {scope: store.ScopeRead, stream: (*Server).grpcWatchLinks},
+}
+
+// grpcHandler serves the Shortener service of
+// proto/shortener/v1/shortener.proto. It implements the gRPC protocol over
+// HTTP/2 directly, without compression support. Streams end when done is
+// closed.
+func (s *Server) grpcHandler(done <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 {
+			writeError(w, req, http.StatusHTTPVersionNotSupported, "gRPC requires HTTP/2")
+			return
+		}
+		if req.Method != http.MethodPost || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+			writeError(w, req, http.StatusUnsupportedMediaType, "expected a gRPC request")
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Accept-Encoding", "identity")
+
+		m, ok := grpcMethods[strings.TrimPrefix(req.URL.Path, grpcService)]
+		if !ok || !strings.HasPrefix(req.URL.Path, grpcService) {
+			writeGRPCStatus(w, false, grpcErrorf(grpcUnimplemented, "unknown method %s", req.URL.Path))
+			return
+		}
+		if !s.allowed("api", req) {
+			writeGRPCStatus(w, false, grpcErrorf(grpcPermissionDenied, "access from your address is not allowed"))
+			return
+		}
+
+		if s.Auth.Enabled() {
+			p, err := s.Auth.authenticate(req)
+			switch {
+			case err != nil:
+				log.Printf("warn: failed to look up API token: %v", err)
+				writeGRPCStatus(w, false, grpcErrorf(grpcUnavailable, "failed to verify credentials"))
+				return
+			case p == nil:
+				writeGRPCStatus(w, false, grpcErrorf(grpcUnauthenticated, "missing or invalid API token"))
+				return
+			case p.Scope < m.scope:
+				writeGRPCStatus(w, false, grpcErrorf(grpcPermissionDenied, "%s lacks the required scope", p.Name))
+				return
+			}
+			req = req.WithContext(context.WithValue(req.Context(), principalKey{}, p))
+		}
+		if m.scope >= store.ScopeWrite && s.Mode.ReadOnly() {
+			writeGRPCStatus(w, false, grpcErrorf(grpcUnavailable, "%v", errReadOnly))
+			return
+		}
+		if d, ok := parseGRPCTimeout(req.Header.Get("Grpc-Timeout")); ok {
+			ctx, cancel := context.WithTimeout(req.Context(), d)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+
+		in, err := readGRPCMessage(req.Body, s.maxBody())
+		if err != nil {
+			writeGRPCStatus(w, false, err)
+			return
+		}
+
+		if m.unary != nil {
+			if s.ProviderTimeout > 0 {
+				ctx, cancel := context.WithTimeout(req.Context(), s.ProviderTimeout)
+				defer cancel()
+				req = req.WithContext(ctx)
+			}
+			out, err := m.unary(s, req, in)
+			if err != nil {
+				writeGRPCStatus(w, false, err)
+				return
+			}
+			w.Write(grpcFrame(out))
+			writeGRPCStatus(w, true, nil)
+			return
+		}
+
+		flusher, _ := w.(http.Flusher)
+		sent := false
+		send := func(msg []byte) error {
+			select {
+			case <-done:
+				return grpcErrorf(grpcUnavailable, "server is shutting down")
+			default:
+			}
+			sent = true
+			if _, err := w.Write(grpcFrame(msg)); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err = m.stream(s, req.WithContext(ctx), in, send)
+		if err == nil && ctx.Err() != nil && req.Context().Err() == nil {
+			err = grpcErrorf(grpcUnavailable, "server is shutting down")
+		}
+		writeGRPCStatus(w, sent, err)
+	}
+}
+
+// GRPCHandler returns the handler of the gRPC service, traced and rate
+// limited like the REST API. Streams end when done is closed.
+func (s *Server) GRPCHandler(done <-chan struct{}) http.Handler {
+	return tracing.Handler(grpcRoute, s.limit(s.grpcHandler(done)))
+}
+
+// grpcRoute names server spans after the called method.
+func grpcRoute(req *http.Request) string {
+	if _, ok := grpcMethods[strings.TrimPrefix(req.URL.Path, grpcService)]; ok {
+		return req.URL.Path
+	}
+	return "unknown method"
+}
+
+// grpcFrame prefixes msg with the uncompressed gRPC message header.
+func grpcFrame(msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// readGRPCMessage reads the single request message of a call, refusing
+// messages larger than limit bytes.
+func readGRPCMessage(r io.Reader, limit int64) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "failed to read request: %v", err)
+	}
+	if hdr[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed requests are not supported")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if int64(n) > limit {
+		return nil, grpcErrorf(grpcResourceExhausted, "request of %d bytes exceeds the limit of %d", n, limit)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "failed to read request: %v", err)
+	}
+	return msg, nil
+}
+
+// writeGRPCStatus ends a call with the status of err. Before any message was
+// written the status goes in the headers (a "trailers-only" response),
+// otherwise in the trailers.
+func writeGRPCStatus(w http.ResponseWriter, wrote bool, err error) {
+	code, msg := grpcStatus(err)
+	prefix := ""
+	if wrote {
+		prefix = http.TrailerPrefix
+	}
+	w.Header().Set(prefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(prefix+"Grpc-Message", grpcEncodeMessage(msg))
+	}
+	if !wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// grpcStatus maps err to a status code and message.
+func grpcStatus(err error) (int, string) {
+	var gerr *grpcError
+	var invalid invalidLinkError
+	switch {
+	case err == nil:
+		return grpcOK, ""
+	case errors.As(err, &gerr):
+		return gerr.code, gerr.msg
+	case errors.As(err, &invalid):
+		return grpcInvalidArgument, err.Error()
+	case errors.Is(err, store.ErrLinkExists):
+		return grpcAlreadyExists, err.Error()
+	case errors.Is(err, store.ErrLinkNotFound):
+		return grpcNotFound, err.Error()
+	case errors.Is(err, errNotOwner):
+		return grpcPermissionDenied, err.Error()
+	case errors.Is(err, errQuotaExceeded):
+		return grpcResourceExhausted, err.Error()
+	case errors.Is(err, errRevisionMismatch):
+		return grpcFailedPrecondition, err.Error()
+	case errors.Is(err, errCannotCreate), errors.Is(err, errCannotEdit):
+		return grpcUnimplemented, err.Error()
+	case errors.Is(err, context.DeadlineExceeded):
+		return grpcDeadlineExceeded, err.Error()
+	}
+	return grpcUnavailable, err.Error()
+}
+
+// grpcEncodeMessage percent-encodes a status message as the protocol
+// requires.
+func grpcEncodeMessage(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseGRPCTimeout parses the grpc-timeout header, such as "100m".
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	unit := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}[v[len(v)-1]]
+	if unit == 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+func (s *Server) grpcGetLink(req *http.Request, in []byte) ([]byte, error) {
+	shortcut, err := unmarshalStringField(in, 1)
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	shortcut = store.Norm.Lower(shortcut)
+	link, err := s.Links.Get(shortcut)
+	if err != nil {
+		return nil, grpcErrorf(grpcUnavailable, "failed to look up shortcut: %v", err)
+	}
+	if link == nil {
+		return nil, grpcErrorf(grpcNotFound, "shortcut %q not found", shortcut)
+	}
+	return marshalLink(linkResponse(shortcut, link), 0), nil
+}
+
+func (s *Server) grpcListLinks(req *http.Request, in []byte) ([]byte, error) {
+	tag, err := unmarshalStringField(in, 1)
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	all, err := s.Links.All()
+	if err != nil {
+		return nil, grpcErrorf(grpcUnavailable, "failed to load links: %v", err)
+	}
+	shortcuts := ownedShortcuts(req, all, "")
+
+	hits, err := s.Analytics.Totals(req.Context(), shortcuts)
+	if err != nil {
+		log.Printf("warn: failed to load click totals: %v", err)
+	}
+	var out []byte
+	for _, k := range shortcuts {
+		if tag != "" && !all[k].HasTag(tag) {
+			continue
+		}
+		out = appendBytesField(out, 1, marshalLink(linkResponse(k, all[k]), hits[k]))
+	}
+	return out, nil
+}
+
+func (s *Server) grpcCreateLink(req *http.Request, in []byte) ([]byte, error) {
+	l, err := unmarshalCreateLink(in)
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	shortcut, link, err := s.create(req, l)
+	if errors.Is(err, store.ErrLinkExists) {
+		return nil, grpcErrorf(grpcAlreadyExists, "shortcut %q already exists", shortcut)
+	} else if err != nil {
+		return nil, err
+	}
+	return marshalLink(linkResponse(shortcut, link), 0), nil
+}
+
+func (s *Server) grpcUpdateLink(req *http.Request, in []byte) ([]byte, error) {
+	l, err := unmarshalUpdateLink(in)
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	shortcut := store.Norm.Lower(strings.TrimSpace(l.Shortcut))
+	if shortcut == "" {
+		return nil, grpcErrorf(grpcInvalidArgument, "link.shortcut is required")
+	}
+	link, err := s.update(req, shortcut, l)
+	if errors.Is(err, store.ErrLinkNotFound) {
+		return nil, grpcErrorf(grpcNotFound, "shortcut %q not found", shortcut)
+	} else if err != nil {
+		return nil, err
+	}
+	return marshalLink(linkResponse(shortcut, link), 0), nil
+}
+
+func (s *Server) grpcDeleteLink(req *http.Request, in []byte) ([]byte, error) {
+	shortcut, err := unmarshalStringField(in, 1)
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	shortcut = store.Norm.Lower(shortcut)
+	err = s.remove(req, shortcut)
+	if errors.Is(err, store.ErrLinkNotFound) {
+		return nil, grpcErrorf(grpcNotFound, "shortcut %q not found", shortcut)
+	} else if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (s *Server) grpcGetStats(req *http.Request, in []byte) ([]byte, error) {
+	shortcut, err := unmarshalStringField(in, 1)
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	shortcut = store.Norm.Lower(shortcut)
+	link, err := s.Links.Get(shortcut)
+	if err != nil {
+		return nil, grpcErrorf(grpcUnavailable, "failed to look up shortcut: %v", err)
+	}
+	if link == nil {
+		return nil, grpcErrorf(grpcNotFound, "shortcut %q not found", shortcut)
+	}
+	stats, err := s.Analytics.Stats(req.Context(), shortcut)
+	if err != nil {
+		return nil, grpcErrorf(grpcUnavailable, "failed to load stats: %v", err)
+	}
+	return marshalStats(newStatsResponse(shortcut, stats)), nil
+}
+
+func (s *Server) grpcWatchLinks(req *http.Request, in []byte, send func([]byte) error) error {
+	initial, err := unmarshalWatchLinks(in)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	// Subscribe before listing so that no change is missed in between.
+	events, stop := s.Links.Watch()
+	defer stop()
+
+	private := s.canViewPrivate(req)
+	sendEvents := func(evs []resolver.LinkEvent) error {
+		for _, e := range evs {
+			if e.Link.Private && !private {
+				continue
+			}
+			if err := send(marshalLinkEvent(e)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if initial {
+		all, err := s.Links.All()
+		if err != nil {
+			return grpcErrorf(grpcUnavailable, "failed to load links: %v", err)
+		}
+		evs := make([]resolver.LinkEvent, 0, len(all))
+		for k, v := range all {
+			evs = append(evs, resolver.LinkEvent{Type: resolver.LinkAdded, Shortcut: k, Link: v})
+		}
+		sort.Slice(evs, func(i, j int) bool { return evs[i].Shortcut < evs[j].Shortcut })
+		if err := sendEvents(evs); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return nil
+		case evs, ok := <-events:
+			if !ok {
+				return grpcErrorf(grpcAborted, "watcher fell behind, restart the watch")
+			}
+			if err := sendEvents(evs); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package httpapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/resolver"
+)
+
+// This file encodes the messages of proto/shortener/v1/shortener.proto in
+// the protobuf wire format by hand, so that the service doesn't depend on
+// the protobuf runtime and generated code. Field numbers must match the
+// .proto file.
+
+const (
+	wireVarint = 0
+	wire64bit  = 1
+	wireBytes  = 2
+	wire32bit  = 5
+)
+
+var errTruncated = errors.New("truncated protobuf message")
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// appendVarintField appends a scalar field, omitting the proto3 default.
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return appendVarint(appendTag(b, field, wireVarint), v)
+}
+
+func appendBoolField(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendVarintField(b, field, 1)
+}
+
+func appendStringField(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendBytesField(b, field, []byte(s))
+}
+
+// appendBytesField appends a length-delimited field such as an embedded
+// message, which is written even when empty.
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(appendTag(b, field, wireBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+// parseProto calls fn for each field of a message. For length-delimited
+// fields data is set, otherwise v holds the value. Unknown fields can simply
+// be ignored by fn.
+func parseProto(b []byte, fn func(field, wireType int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+		field, wireType := int(tag>>3), int(tag&7)
+
+		var v uint64
+		var data []byte
+		switch wireType {
+		case wireVarint:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case wire64bit:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wire32bit:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errTruncated
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", wireType)
+		}
+		if err := fn(field, wireType, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// marshalTimestamp encodes a google.protobuf.Timestamp.
+func marshalTimestamp(t time.Time) []byte {
+	b := appendVarintField(nil, 1, uint64(t.Unix()))
+	return appendVarintField(b, 2, uint64(t.Nanosecond()))
+}
+
+func unmarshalTimestamp(b []byte) (time.Time, error) {
+	var sec, nsec int64
+	err := parseProto(b, func(field, _ int, v uint64, _ []byte) error {
+		switch field {
+		case 1:
+			sec = int64(v)
+		case 2:
+			nsec = int64(int32(v))
+		}
+		return nil
+	})
+	return time.Unix(sec, nsec).UTC(), err
+}
+
+// marshalLink encodes a shortener.v1.Link.
+func marshalLink(l apiLink, hits int64) []byte {
+	b := appendStringField(nil, 1, l.Shortcut)
+	b = appendStringField(b, 2, l.URL)
+	if l.ExpiresAt != nil {
+		b = appendBytesField(b, 3, marshalTimestamp(*l.ExpiresAt))
+	}
+	b = appendVarintField(b, 4, uint64(l.Status))
+	b = appendBoolField(b, 5, l.Private)
+	b = appendBoolField(b, 6, l.Preview)
+	b = appendStringField(b, 7, l.Params)
+	b = appendVarintField(b, 8, uint64(hits))
+	b = appendStringField(b, 9, l.Owner)
+	b = appendBoolField(b, 11, l.Protected)
+	b = appendStringField(b, 12, l.CacheControl)
+	b = appendStringField(b, 13, l.Type)
+	b = appendStringField(b, 14, l.Content)
+	b = appendStringField(b, 15, l.Description)
+	for _, t := range l.Tags {
+		b = appendStringField(b, 16, t)
+	}
+	if l.ActiveFrom != nil {
+		b = appendBytesField(b, 17, marshalTimestamp(*l.ActiveFrom))
+	}
+	b = appendVarintField(b, 18, uint64(l.MaxClicks))
+	b = appendBoolField(b, 19, l.Disabled)
+	b = appendBoolField(b, 20, l.Unapproved)
+	return b
+}
+
+func unmarshalLink(b []byte) (apiLink, error) {
+	var l apiLink
+	err := parseProto(b, func(field, _ int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			l.Shortcut = string(data)
+		case 2:
+			l.URL = string(data)
+		case 3:
+			t, err := unmarshalTimestamp(data)
+			if err != nil {
+				return err
+			}
+			l.ExpiresAt = &t
+		case 4:
+			l.Status = int(int32(v))
+		case 5:
+			l.Private = v != 0
+		case 6:
+			l.Preview = v != 0
+		case 7:
+			l.Params = string(data)
+		case 9:
+			l.Owner = string(data)
+		case 10:
+			l.Password = string(data)
+		case 11:
+			l.Protected = v != 0
+		case 12:
+			l.CacheControl = string(data)
+		case 13:
+			l.Type = string(data)
+		case 14:
+			l.Content = string(data)
+		case 15:
+			l.Description = string(data)
+		case 16:
+			l.Tags = append(l.Tags, string(data))
+		case 17:
+			t, err := unmarshalTimestamp(data)
+			if err != nil {
+				return err
+			}
+			l.ActiveFrom = &t
+		case 18:
+			l.MaxClicks = int64(v)
+		case 19:
+			l.Disabled = v != 0
+		case 20:
+			l.Unapproved = v != 0
+		}
+		return nil
+	})
+	return l, err
+}
+
+// unmarshalStringField returns field of a message whose other fields are
+// ignored, such as GetLinkRequest.
+func unmarshalStringField(b []byte, field int) (string, error) {
+	var s string
+	err := parseProto(b, func(f, _ int, _ uint64, data []byte) error {
+		if f == field {
+			s = string(data)
+		}
+		return nil
+	})
+	return s, err
+}
+
+// unmarshalCreateLink decodes a CreateLinkRequest into the link to create.
+func unmarshalCreateLink(b []byte) (apiLink, error) {
+	var l apiLink
+	var ttl string
+	err := parseProto(b, func(field, _ int, _ uint64, data []byte) error {
+		switch field {
+		case 1:
+			var err error
+			l, err = unmarshalLink(data)
+			return err
+		case 2:
+			ttl = string(data)
+		}
+		return nil
+	})
+	l.TTL = ttl
+	return l, err
+}
+
+// unmarshalUpdateLink decodes an UpdateLinkRequest.
+func unmarshalUpdateLink(b []byte) (apiLink, error) {
+	var l apiLink
+	err := parseProto(b, func(field, _ int, _ uint64, data []byte) error {
+		if field == 1 {
+			var err error
+			l, err = unmarshalLink(data)
+			return err
+		}
+		return nil
+	})
+	return l, err
+}
+
+// unmarshalWatchLinks decodes a WatchLinksRequest.
+func unmarshalWatchLinks(b []byte) (initial bool, err error) {
+	err = parseProto(b, func(field, _ int, v uint64, _ []byte) error {
+		if field == 1 {
+			initial = v != 0
+		}
+		return nil
+	})
+	return initial, err
+}
+
+// marshalStats encodes a shortener.v1.Stats.
+func marshalStats(s statsResponse) []byte {
+	b := appendStringField(nil, 1, s.Shortcut)
+	b = appendVarintField(b, 2, uint64(s.Total))
+	days := make([]string, 0, len(s.PerDay))
+	for d := range s.PerDay {
+		days = append(days, d)
+	}
+	sort.Strings(days)
+	for _, d := range days {
+		// Map entries are messages with the key as field 1 and the value as
+		// field 2.
+		entry := appendStringField(nil, 1, d)
+		b = appendBytesField(b, 3, appendVarintField(entry, 2, uint64(s.PerDay[d])))
+	}
+	for _, r := range s.TopReferrers {
+		ref := appendStringField(nil, 1, r.Referrer)
+		b = appendBytesField(b, 4, appendVarintField(ref, 2, uint64(r.Hits)))
+	}
+	for _, d := range s.Destinations {
+		dest := appendStringField(nil, 1, d.URL)
+		b = appendBytesField(b, 5, appendVarintField(dest, 2, uint64(d.Hits)))
+	}
+	return b
+}
+
+// linkEventTypes maps LinkEvent types to LinkEvent.Type values.
+var linkEventTypes = map[string]uint64{resolver.LinkAdded: 1, resolver.LinkChanged: 2, resolver.LinkRemoved: 3}
+
+// marshalLinkEvent encodes a shortener.v1.LinkEvent.
+func marshalLinkEvent(e resolver.LinkEvent) []byte {
+	b := appendVarintField(nil, 1, linkEventTypes[e.Type])
+	return appendBytesField(b, 2, marshalLink(linkResponse(e.Shortcut, e.Link), 0))
+}
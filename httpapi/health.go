@@ -0,0 +1,35 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/resolver"
+)
+
+// serveHealthz handles GET /healthz. It only reports that the process is
+// serving requests.
+func serveHealthz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz returns the handler of GET /readyz, which fails until links were
+// loaded once and again when refreshes have been failing for longer than
+// maxFailing. While the circuit breaker of the provider is open it says so
+// after "ok".
+func readyz(c *resolver.Cache, maxFailing time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := c.Ready(maxFailing); err != nil {
+			writeError(w, req, http.StatusServiceUnavailable, "not ready: %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+		if b := c.BreakerState(); b.OpenUntil != nil {
+			fmt.Fprintf(w, "provider circuit breaker %s since %d failures, until %s\n",
+				b.State, b.Failures, b.OpenUntil.Format(time.RFC3339))
+		}
+	}
+}
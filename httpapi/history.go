@@ -0,0 +1,139 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// linkVersion is a change in the history of a link. Every change leaving a
+// link behind is a version, numbered from 1 for the oldest; deletions have
+// none.
+type linkVersion struct {
+	Version int      `json:"version,omitempty"`
+	Time    string   `json:"time"`
+	Actor   string   `json:"actor"`
+	Action  string   `json:"action"`
+	Link    *apiLink `json:"link,omitempty"`
+}
+
+// linkVersions returns the history of shortcut from the audit log, newest
+// first. Only the last maxAuditEntries changes are kept track of.
+func (s *Server) linkVersions(ctx context.Context, shortcut string) ([]linkVersion, error) {
+	entries, err := s.AuditLog.Audit(ctx, shortcut, maxAuditEntries)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]linkVersion, len(entries))
+	version := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		v := linkVersion{
+			Time:   e.Time.Format("2006-01-02T15:04:05Z07:00"),
+			Actor:  e.Actor,
+			Action: e.Action,
+		}
+		if len(e.New) > 0 {
+			var l apiLink
+			if err := json.Unmarshal(e.New, &l); err != nil {
+				return nil, fmt.Errorf("invalid audit entry of %s: %w", e.Time, err)
+			}
+			version++
+			v.Version, v.Link = version, &l
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+// linkHistory handles GET /api/links/{shortcut}/history.
+func (s *Server) linkHistory(w http.ResponseWriter, req *http.Request, shortcut string) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	if s.AuditLog == nil {
+		writeError(w, req, http.StatusNotImplemented, "link history needs the audit log, set AUDIT_LOG_FILE")
+		return
+	}
+	versions, err := s.linkVersions(req.Context(), shortcut)
+	if err != nil {
+		writeError(w, req, http.StatusBadGateway, "failed to read audit log: %v", err)
+		return
+	}
+	if len(versions) == 0 {
+		writeError(w, req, http.StatusNotFound, "shortcut %q has no history", shortcut)
+		return
+	}
+	writeJSON(w, http.StatusOK, versions)
+}
+
+// rollbackLink handles POST /api/links/{shortcut}/rollback with a body of
+// {"version": N}, making version N of the link current again. The current
+// owner is kept, and so is the password if version N was protected, since
+// the history holds no passwords.
+func (s *Server) rollbackLink(w http.ResponseWriter, req *http.Request, shortcut string) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	if _, ok := s.Links.Provider.(store.Editor); !ok {
+		writeError(w, req, http.StatusNotImplemented, "%v", errCannotEdit)
+		return
+	}
+	if s.AuditLog == nil {
+		writeError(w, req, http.StatusNotImplemented, "link history needs the audit log, set AUDIT_LOG_FILE")
+		return
+	}
+	var body struct {
+		Version int `json:"version"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, s.maxBody()))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		writeError(w, req, http.StatusBadRequest, "invalid request body: %v", err)
+		return
+	}
+
+	versions, err := s.linkVersions(req.Context(), shortcut)
+	if err != nil {
+		writeError(w, req, http.StatusBadGateway, "failed to read audit log: %v", err)
+		return
+	}
+	var in *apiLink
+	for _, v := range versions {
+		if v.Version == body.Version {
+			in = v.Link
+			break
+		}
+	}
+	if in == nil {
+		writeError(w, req, http.StatusNotFound, "shortcut %q has no version %d", shortcut, body.Version)
+		return
+	}
+	in.Shortcut, in.Owner, in.DeletedAt = shortcut, "", nil
+
+	link, err := s.replace(req, store.AuditRollback, shortcut, *in)
+	var invalid invalidLinkError
+	switch {
+	case errors.As(err, &invalid):
+		writeError(w, req, http.StatusUnprocessableEntity, "version %d can't be restored: %v", body.Version, err)
+	case errors.Is(err, store.ErrLinkNotFound):
+		writeError(w, req, http.StatusNotFound, "shortcut %q not found", shortcut)
+	case errors.Is(err, errNotOwner), errors.Is(err, store.ErrReadOnly):
+		writeError(w, req, http.StatusForbidden, "%v", err)
+	case errors.Is(err, errRevisionMismatch):
+		writeError(w, req, http.StatusPreconditionFailed, "%v", err)
+	case err != nil:
+		writeError(w, req, http.StatusBadGateway, "failed to roll back link: %v", err)
+	default:
+		w.Header().Set("ETag", linkRevision(shortcut, link))
+		writeJSON(w, http.StatusOK, linkResponse(shortcut, link))
+	}
+}
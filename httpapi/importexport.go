@@ -0,0 +1,312 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// maxImportBody caps imports, which are larger than other API requests.
+const maxImportBody = 32 << 20
+
+// csvHeader is the column layout of CSV exports, and of imports that start
+// with a header row. Passwords are never exported. The url column holds the
+// content of text links.
+var csvHeader = []string{"shortcut", "url", "expires_at", "status", "private", "preview", "params", "owner", "password", "type", "description", "tags", "active_from", "canary", "max_clicks", "disabled", "unapproved"}
+
+type importError struct {
+	Shortcut string `json:"shortcut"`
+	Error    string `json:"error"`
+}
+
+type importResult struct {
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Skipped []string      `json:"skipped"`
+	Errors  []importError `json:"errors"`
+}
+
+// exportLinks handles GET /api/links/export?format=json|csv, returning every
+// active link the caller may manage. Like GET /api/links it answers 304 Not
+// Modified to If-None-Match with the ETag of an unchanged export.
+func (s *Server) exportLinks(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+
+	all, err := s.Links.All()
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to load links: %v", err)
+		return
+	}
+	shortcuts := ownedShortcuts(req, all, req.URL.Query().Get("owner"))
+
+	switch req.URL.Query().Get("format") {
+	case "", "json":
+		out := make([]apiLink, 0, len(shortcuts))
+		for _, k := range shortcuts {
+			out = append(out, linkResponse(k, all[k]))
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="links.json"`)
+		writeCachedJSON(w, req, out)
+	case "csv":
+		w.Header().Set("Content-Disposition", `attachment; filename="links.csv"`)
+		var buf bytes.Buffer
+		cw := csv.NewWriter(&buf)
+		cw.Write(csvHeader)
+		for _, k := range shortcuts {
+			l := all[k].Settled(time.Now())
+			cw.Write([]string{
+				k, l.Target(), store.FormatExpiry(l.Expires), store.FormatStatus(l.Status),
+				store.FormatFlag(l.Private, "private"), store.FormatFlag(l.Preview, "preview"), store.FormatParams(l.Params), l.Owner,
+				"", l.Type, l.Description, store.FormatTags(l.Tags), store.FormatExpiry(l.ActiveFrom), store.FormatCanary(l.Canary),
+				store.FormatMaxClicks(l.MaxClicks), store.FormatFlag(l.Disabled, "disabled"), store.FormatFlag(l.Unapproved, "unapproved"),
+			})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			writeError(w, req, http.StatusInternalServerError, "failed to write export: %v", err)
+			return
+		}
+		writeCached(w, req, "text/csv; charset=utf-8", buf.Bytes())
+	default:
+		writeError(w, req, http.StatusBadRequest, "format must be json or csv")
+	}
+}
+
+// importLinks handles POST /api/links/import. The body is either a JSON array
+// of links, as returned by the export, or CSV with the columns of csvHeader
+// (all but shortcut and url optional, header row optional). Existing shortcuts
+// are skipped unless overwrite=true is given.
+func (s *Server) importLinks(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	writer, ok := s.Links.Provider.(store.Writer)
+	if !ok {
+		writeError(w, req, http.StatusNotImplemented, "%v", errCannotCreate)
+		return
+	}
+	overwrite := req.URL.Query().Get("overwrite") == "true"
+	editor, _ := s.Links.Provider.(store.Editor)
+	if overwrite && editor == nil {
+		writeError(w, req, http.StatusNotImplemented, "%v", errCannotEdit)
+		return
+	}
+
+	body := http.MaxBytesReader(w, req.Body, maxImportBody)
+	var in []apiLink
+	var err error
+	ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch ct {
+	case "application/json":
+		err = json.NewDecoder(body).Decode(&in)
+	case "text/csv":
+		in, err = readCSVLinks(body)
+	default:
+		writeError(w, req, http.StatusUnsupportedMediaType, "Content-Type must be application/json or text/csv")
+		return
+	}
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, "invalid request body: %v", err)
+		return
+	}
+
+	res := importResult{Skipped: []string{}, Errors: []importError{}}
+	for _, l := range in {
+		shortcut := store.Norm.Lower(strings.TrimSpace(l.Shortcut))
+		fail := func(err error) {
+			res.Errors = append(res.Errors, importError{Shortcut: l.Shortcut, Error: err.Error()})
+		}
+		if !store.ShortcutPattern.MatchString(shortcut) {
+			fail(errors.New("invalid shortcut"))
+			continue
+		}
+		link, err := l.target()
+		if err != nil {
+			fail(err)
+			continue
+		}
+		// Imports may restore links that have expired already.
+		link.Status, link.Private, link.Preview = l.Status, l.Private, l.Preview
+		if l.MaxClicks < 0 {
+			fail(errors.New("max_clicks must not be negative"))
+			continue
+		}
+		link.MaxClicks, link.Disabled = l.MaxClicks, l.Disabled
+		// Admins may import links awaiting approval, the links of others
+		// await it anyway.
+		link.Unapproved = l.Unapproved && manageAll(req) || s.needsApproval(req)
+		if l.ExpiresAt != nil {
+			link.Expires = *l.ExpiresAt
+		}
+		if l.ActiveFrom != nil {
+			link.ActiveFrom = *l.ActiveFrom
+		}
+		if l.Canary != nil {
+			if link.Type != "" {
+				fail(fmt.Errorf("%s links can't have a canary", link.Type))
+				continue
+			}
+			if link.Canary, err = l.Canary.canary(time.Now()); err != nil {
+				fail(fmt.Errorf("invalid canary: %w", err))
+				continue
+			}
+		}
+		if link.Status != 0 && !store.ValidRedirectStatus(link.Status) {
+			fail(fmt.Errorf("invalid status %d", link.Status))
+			continue
+		}
+		if link.Params, err = store.ParseParams(l.Params); err != nil {
+			fail(fmt.Errorf("invalid params: %w", err))
+			continue
+		}
+		if link.Owner, err = ownerOf(req, l.Owner); err != nil {
+			fail(err)
+			continue
+		}
+		if err := s.checkQuota(req, link.Owner, res.Created); err != nil {
+			fail(err)
+			continue
+		}
+
+		err = s.addLink(req.Context(), writer, shortcut, link)
+		switch {
+		case errors.Is(err, store.ErrLinkExists) && overwrite:
+			old, _ := s.Links.Get(shortcut)
+			if old != nil && !owns(req, old) {
+				fail(errNotOwner)
+				continue
+			}
+			if err := editor.Update(req.Context(), shortcut, link); err != nil {
+				fail(err)
+				continue
+			}
+			s.audit(req, store.AuditUpdate, shortcut, old, link)
+			s.awaitApproval(shortcut, link)
+			res.Updated++
+		case errors.Is(err, store.ErrLinkExists):
+			res.Skipped = append(res.Skipped, shortcut)
+		case err != nil:
+			fail(err)
+		default:
+			s.audit(req, store.AuditCreate, shortcut, nil, link)
+			s.awaitApproval(shortcut, link)
+			res.Created++
+		}
+	}
+	if res.Created > 0 || res.Updated > 0 {
+		s.Links.Invalidate()
+	}
+
+	log.Printf("imported links: %d created, %d updated, %d skipped, %d failed",
+		res.Created, res.Updated, len(res.Skipped), len(res.Errors))
+	writeJSON(w, http.StatusOK, res)
+}
+
+// readCSVLinks parses CSV rows of shortcut, url and optional expires_at,
+// status, private, preview, params and owner columns. A first row starting with "shortcut"
+// is skipped.
+func readCSVLinks(r io.Reader) ([]apiLink, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	var out []apiLink
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return out, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if line == 1 && strings.EqualFold(strings.TrimSpace(rec[0]), "shortcut") {
+			continue
+		}
+		if len(rec) < 2 {
+			return nil, fmt.Errorf("line %d: expected at least shortcut and url", line)
+		}
+
+		l := apiLink{Shortcut: rec[0], URL: rec[1]}
+		if len(rec) > 2 && strings.TrimSpace(rec[2]) != "" {
+			t, err := store.ParseExpiry(strings.TrimSpace(rec[2]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			l.ExpiresAt = &t
+		}
+		if len(rec) > 3 && strings.TrimSpace(rec[3]) != "" {
+			if l.Status, err = strconv.Atoi(strings.TrimSpace(rec[3])); err != nil {
+				return nil, fmt.Errorf("line %d: invalid status %q", line, rec[3])
+			}
+		}
+		if len(rec) > 4 {
+			l.Private = store.ParseFlag(rec[4], "private")
+		}
+		if len(rec) > 5 {
+			l.Preview = store.ParseFlag(rec[5], "preview")
+		}
+		if len(rec) > 6 {
+			l.Params = strings.TrimSpace(rec[6])
+		}
+		if len(rec) > 7 {
+			l.Owner = strings.TrimSpace(rec[7])
+		}
+		if len(rec) > 8 {
+			l.Password = strings.TrimSpace(rec[8])
+		}
+		if len(rec) > 9 && strings.TrimSpace(rec[9]) != "" {
+			l.Type, l.URL, l.Content = strings.TrimSpace(rec[9]), "", rec[1]
+		}
+		if len(rec) > 10 {
+			l.Description = strings.TrimSpace(rec[10])
+		}
+		if len(rec) > 11 {
+			l.Tags = store.ParseTags(rec[11])
+		}
+		if len(rec) > 12 && strings.TrimSpace(rec[12]) != "" {
+			t, err := store.ParseExpiry(strings.TrimSpace(rec[12]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			l.ActiveFrom = &t
+		}
+		if len(rec) > 13 && strings.TrimSpace(rec[13]) != "" {
+			c, err := store.ParseCanary(rec[13])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: canary: %w", line, err)
+			}
+			l.Canary = &apiCanary{URL: c.URL.String(), Percent: c.Percent}
+			if !c.Until.IsZero() {
+				l.Canary.Until = &c.Until
+			}
+		}
+		if len(rec) > 14 {
+			if l.MaxClicks, err = store.ParseMaxClicks(rec[14]); err != nil {
+				return nil, fmt.Errorf("line %d: max_clicks: %w", line, err)
+			}
+		}
+		if len(rec) > 15 {
+			l.Disabled = store.ParseFlag(rec[15], "disabled")
+		}
+		if len(rec) > 16 {
+			l.Unapproved = store.ParseFlag(rec[16], "unapproved")
+		}
+		out = append(out, l)
+	}
+}
@@ -0,0 +1,93 @@
+package httpapi
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+)
+
+var ipBlockedTotal = metrics.NewCounterVec("shortener_ip_blocked_total",
+	"Requests rejected by the IP allow and deny lists, by routes: site or api.", "routes")
+
+// IPAccess decides which client addresses may use a group of routes: none
+// in Deny, and when Allow is not empty only those in it.
+type IPAccess struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// NewIPAccess parses comma-separated allow and deny lists of CIDR ranges or
+// addresses, see ParseCIDRs. It returns nil when both are empty.
+func NewIPAccess(allow, deny string) (*IPAccess, error) {
+	a := &IPAccess{}
+	var err error
+	if a.Allow, err = ParseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if a.Deny, err = ParseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	if len(a.Allow) == 0 && len(a.Deny) == 0 {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// Allows reports whether ip may connect. Addresses that can't be parsed,
+// such as those of Unix socket peers without X-Forwarded-For, are only
+// allowed without an allow list.
+func (a *IPAccess) Allows(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if ip == nil {
+		return len(a.Allow) == 0
+	}
+	for _, n := range a.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, n := range a.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// access returns the access list of routes, site or api.
+func (s *Server) access(routes string) *IPAccess {
+	if routes == "api" {
+		return s.APIAccess
+	}
+	return s.Access
+}
+
+// allowed reports whether the client of req may use routes, counting
+// rejections.
+func (s *Server) allowed(routes string, req *http.Request) bool {
+	a := s.access(routes)
+	if a == nil || a.Allows(net.ParseIP(clientIP(req, s.TrustProxy))) {
+		return true
+	}
+	ipBlockedTotal.Inc(routes)
+	return false
+}
+
+// restrict wraps h, answering 403 Forbidden to clients that may not use
+// routes. Bodies are limited too, see sized.
+func (s *Server) restrict(routes string, h http.HandlerFunc) http.HandlerFunc {
+	h = s.sized(h)
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !s.allowed(routes, req) {
+			writeError(w, req, http.StatusForbidden, "access from your address is not allowed")
+			return
+		}
+		h(w, req)
+	}
+}
@@ -0,0 +1,56 @@
+package httpapi
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/denizyoldas/url-shorter/resolver"
+)
+
+const (
+	defaultSlowestLimit = 10
+	maxSlowestLimit     = 100
+)
+
+type latencyResponse struct {
+	SLO float64 `json:"slo_seconds"`
+	// Lookups breaks resolutions down into those served from the cache and
+	// those that waited for a refresh.
+	Lookups map[string]resolver.LatencySummary `json:"lookups"`
+	// Slowest are the shortcuts with the highest p99, slowest first.
+	Slowest []shortcutLatency `json:"slowest"`
+}
+
+type shortcutLatency struct {
+	Shortcut string `json:"shortcut"`
+	resolver.LatencySummary
+}
+
+// latencyStats handles GET /api/stats/latency, summarizing the latency of
+// recent redirects against LATENCY_SLO. ?limit= caps the slowest shortcuts
+// listed.
+func (s *Server) latencyStats(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	limit := defaultSlowestLimit
+	if v := req.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxSlowestLimit {
+			writeError(w, req, http.StatusBadRequest, "limit must be between 0 and %d", maxSlowestLimit)
+			return
+		}
+		limit = n
+	}
+
+	l := s.Resolver.Latency
+	resp := latencyResponse{SLO: l.SLO.Seconds(), Lookups: l.Kinds(), Slowest: []shortcutLatency{}}
+	for _, shortcut := range l.Slowest(limit) {
+		if sum, ok := l.Shortcut(shortcut); ok {
+			resp.Slowest = append(resp.Slowest, shortcutLatency{Shortcut: shortcut, LatencySummary: sum})
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
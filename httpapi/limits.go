@@ -0,0 +1,34 @@
+package httpapi
+
+import (
+	"net/http"
+	"strings"
+)
+
+// maxBody returns the largest request body accepted, see MaxRequestBody.
+func (s *Server) maxBody() int64 {
+	if s.MaxRequestBody > 0 {
+		return s.MaxRequestBody
+	}
+	return maxRequestBody
+}
+
+// sized wraps h, answering 413 Request Entity Too Large to requests whose
+// body is larger than MaxRequestBody, or maxImportBody for imports. Bodies
+// sent without a Content-Length fail to read past the limit instead.
+func (s *Server) sized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		limit := s.maxBody()
+		if strings.HasSuffix(req.URL.Path, "/import") && limit < maxImportBody {
+			limit = maxImportBody
+		}
+		if req.ContentLength > limit {
+			writeError(w, req, http.StatusRequestEntityTooLarge, "request body of %d bytes exceeds the limit of %d", req.ContentLength, limit)
+			return
+		}
+		if req.Body != nil {
+			req.Body = http.MaxBytesReader(w, req.Body, limit)
+		}
+		h(w, req)
+	}
+}
@@ -0,0 +1,197 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/env"
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+)
+
+var maintenanceResponsesTotal = metrics.NewCounter("shortener_maintenance_responses_total",
+	"Redirects answered with the maintenance page.")
+
+// errReadOnly is returned for changes to links while read-only mode is on.
+var errReadOnly = errors.New("links are read-only for now, please try again later")
+
+// defaultMaintenanceMessage is shown in maintenance mode unless
+// MAINTENANCE_MESSAGE or POST /api/mode gives another.
+const defaultMaintenanceMessage = "Go links are down for maintenance and will be back shortly."
+
+// Mode holds the switches operators flip at runtime, such as during backend
+// migrations or incidents: maintenance mode answers redirects with a status
+// page, and read-only mode refuses changes to links. A nil Mode is neither.
+type Mode struct {
+	mu          sync.RWMutex
+	maintenance bool
+	readOnly    bool
+	message     string
+	changed     time.Time
+
+	// Page, if set, is served to browsers in maintenance mode instead of
+	// the built-in status page, see MAINTENANCE_PAGE.
+	Page []byte
+	// RetryAfter is sent with maintenance responses so that crawlers and
+	// clients come back later, see MAINTENANCE_RETRY_AFTER.
+	RetryAfter time.Duration
+}
+
+// NewMode reads the mode to start in from MAINTENANCE_MODE, READ_ONLY,
+// MAINTENANCE_MESSAGE, MAINTENANCE_PAGE and MAINTENANCE_RETRY_AFTER.
+func NewMode() (*Mode, error) {
+	m := &Mode{
+		maintenance: env.Bool("MAINTENANCE_MODE", false),
+		readOnly:    env.Bool("READ_ONLY", false),
+		message:     os.Getenv("MAINTENANCE_MESSAGE"),
+		RetryAfter:  env.Duration("MAINTENANCE_RETRY_AFTER", 5*time.Minute),
+		changed:     time.Now(),
+	}
+	if f := os.Getenv("MAINTENANCE_PAGE"); f != "" {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MAINTENANCE_PAGE: %w", err)
+		}
+		m.Page = b
+	}
+	return m, nil
+}
+
+// Maintenance reports whether redirects are answered with the status page.
+func (m *Mode) Maintenance() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.maintenance
+}
+
+// ReadOnly reports whether changes to links are refused.
+func (m *Mode) ReadOnly() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.readOnly
+}
+
+// modeState is the body of GET /api/mode, and with its fields optional the
+// body of POST /api/mode.
+type modeState struct {
+	Maintenance *bool      `json:"maintenance"`
+	ReadOnly    *bool      `json:"read_only"`
+	Message     *string    `json:"message"`
+	Since       *time.Time `json:"since,omitempty"`
+}
+
+func (m *Mode) state() modeState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	maintenance, readOnly, message, since := m.maintenance, m.readOnly, m.message, m.changed.UTC()
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	return modeState{Maintenance: &maintenance, ReadOnly: &readOnly, Message: &message, Since: &since}
+}
+
+// set applies the fields of in that are set and returns what changed.
+func (m *Mode) set(in modeState) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var changes []string
+	if in.Maintenance != nil && *in.Maintenance != m.maintenance {
+		m.maintenance = *in.Maintenance
+		changes = append(changes, "maintenance="+strconv.FormatBool(m.maintenance))
+	}
+	if in.ReadOnly != nil && *in.ReadOnly != m.readOnly {
+		m.readOnly = *in.ReadOnly
+		changes = append(changes, "read_only="+strconv.FormatBool(m.readOnly))
+	}
+	if in.Message != nil && *in.Message != m.message {
+		m.message = *in.Message
+		changes = append(changes, fmt.Sprintf("message=%q", m.message))
+	}
+	if len(changes) > 0 {
+		m.changed = time.Now()
+	}
+	return changes
+}
+
+// serveMaintenance answers req with the maintenance status page.
+func (m *Mode) serveMaintenance(w http.ResponseWriter, req *http.Request) {
+	maintenanceResponsesTotal.Inc()
+	h := w.Header()
+	// CDNs must not keep serving the page once maintenance is over.
+	h.Set("Cache-Control", "no-store")
+	m.setRetryAfter(h)
+	if len(m.Page) > 0 && strings.Contains(req.Header.Get("Accept"), "text/html") {
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(m.Page)
+		return
+	}
+	writeError(w, req, http.StatusServiceUnavailable, "%s", *m.state().Message)
+}
+
+func (m *Mode) setRetryAfter(h http.Header) {
+	if m.RetryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(int(m.RetryAfter.Seconds())))
+	}
+}
+
+// writable refuses requests that may change links while read-only mode is
+// on. Signing links changes nothing, so it stays available.
+func (s *Server) writable(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if s.Mode.ReadOnly() && !strings.HasSuffix(req.URL.Path, "/sign") {
+				s.Mode.setRetryAfter(w.Header())
+				writeError(w, req, http.StatusServiceUnavailable, "%v", errReadOnly)
+				return
+			}
+		}
+		h(w, req)
+	}
+}
+
+// mode handles GET and POST /api/mode.
+func (s *Server) mode(w http.ResponseWriter, req *http.Request) {
+	if s.Mode == nil {
+		writeError(w, req, http.StatusNotImplemented, "runtime modes are not enabled")
+		return
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		var in modeState
+		dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, s.maxBody()))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&in); err != nil {
+			writeError(w, req, http.StatusBadRequest, "invalid request body: %v", err)
+			return
+		}
+		if changes := s.Mode.set(in); len(changes) > 0 {
+			actor := "anonymous"
+			if p := requestPrincipal(req); p != nil {
+				actor = p.Name
+			}
+			log.Printf("mode changed by %s: %s", actor, strings.Join(changes, " "))
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Mode.state())
+}
@@ -0,0 +1,128 @@
+package httpapi
+
+import (
+	_ "embed"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+//go:embed web/new.html.tmpl
+var newLinkTemplateText string
+
+var newLinkTemplate = template.Must(template.New("new").Parse(newLinkTemplateText))
+
+// newLinkForm is what the /new page shows.
+type newLinkForm struct {
+	Shortcut, URL, Description string
+	Error                      string
+	// Existing is set when Shortcut is taken.
+	Existing bool
+	// Duplicates are the shortcuts already leading to URL, to confirm
+	// another one is wanted.
+	Duplicates []string
+	// Unapproved is set once Shortcut was created to await approval, see
+	// LINK_APPROVAL.
+	Unapproved bool
+}
+
+// newLink handles /new, a form to claim a shortcut on the spot: the 404 page
+// links to it with ?shortcut= filled in. GET shows the form and POST creates
+// the link, asking to confirm when other shortcuts already lead to the URL,
+// then shows where it leads.
+func (s *Server) newLink(w http.ResponseWriter, req *http.Request) {
+	if _, ok := s.Links.Provider.(store.Writer); !ok {
+		writeError(w, req, http.StatusNotImplemented, "%v", errCannotCreate)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		form := newLinkForm{
+			Shortcut: strings.TrimSpace(req.URL.Query().Get("shortcut")),
+			URL:      strings.TrimSpace(req.URL.Query().Get("url")),
+		}
+		if form.Shortcut != "" {
+			if l, err := s.Links.Get(store.Norm.Lower(form.Shortcut)); err == nil && l != nil {
+				form.Existing = true
+			}
+		}
+		s.writeNewLinkForm(w, http.StatusOK, form)
+	case http.MethodPost:
+		s.claimLink(w, req)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+	}
+}
+
+// claimLink creates the link posted from the /new form.
+func (s *Server) claimLink(w http.ResponseWriter, req *http.Request) {
+	// Session cookies would otherwise let other sites create links.
+	if crossOrigin(req) {
+		writeError(w, req, http.StatusForbidden, "cross-origin form submissions are not allowed")
+		return
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, s.maxBody())
+	if err := req.ParseForm(); err != nil {
+		writeError(w, req, http.StatusBadRequest, "invalid form: %v", err)
+		return
+	}
+	form := newLinkForm{
+		Shortcut:    strings.TrimSpace(req.PostForm.Get("shortcut")),
+		URL:         strings.TrimSpace(req.PostForm.Get("url")),
+		Description: strings.TrimSpace(req.PostForm.Get("description")),
+	}
+	if req.PostForm.Get("confirm") == "" {
+		if form.Duplicates = s.duplicatesOf(req, form.URL); len(form.Duplicates) > 0 {
+			s.writeNewLinkForm(w, http.StatusOK, form)
+			return
+		}
+	}
+
+	shortcut, link, err := s.create(req, apiLink{Shortcut: form.Shortcut, URL: form.URL, Description: form.Description})
+	var invalid invalidLinkError
+	switch {
+	case errors.As(err, &invalid):
+		form.Error = err.Error()
+		s.writeNewLinkForm(w, http.StatusBadRequest, form)
+	case errors.Is(err, store.ErrLinkExists):
+		form.Existing = true
+		s.writeNewLinkForm(w, http.StatusConflict, form)
+	case errors.Is(err, errNotOwner), errors.Is(err, errQuotaExceeded):
+		form.Error = err.Error()
+		s.writeNewLinkForm(w, http.StatusForbidden, form)
+	case err != nil:
+		writeError(w, req, http.StatusBadGateway, "failed to create link: %v", err)
+	case link.Unapproved:
+		s.writeNewLinkForm(w, http.StatusCreated, newLinkForm{Shortcut: shortcut, URL: form.URL, Unapproved: true})
+	default:
+		http.Redirect(w, req, "/"+shortcut+"+", http.StatusSeeOther)
+	}
+}
+
+// duplicatesOf returns the sorted shortcuts the client of req may see whose
+// link leads to rawURL, see destinationKey.
+func (s *Server) duplicatesOf(req *http.Request, rawURL string) []string {
+	u, err := validateURL(rawURL)
+	if err != nil {
+		return nil
+	}
+	all, err := s.visibleLinks(req)
+	if err != nil {
+		return nil
+	}
+	return shortcutsTo(all, u)
+}
+
+func (s *Server) writeNewLinkForm(w http.ResponseWriter, status int, form newLinkForm) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := newLinkTemplate.Execute(w, form); err != nil {
+		log.Printf("warn: failed to render new link page: %v", err)
+	}
+}
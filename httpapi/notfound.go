@@ -0,0 +1,182 @@
+package httpapi
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// maxSuggestions is the number of similar shortcuts offered on the 404 page.
+const maxSuggestions = 5
+
+//go:embed web/notfound.html.tmpl
+var notFoundTemplateText string
+
+var notFoundTemplate = template.Must(template.New("notfound").Parse(notFoundTemplateText))
+
+// notFound answers a request for a shortcut that does not exist in namespace
+// ns. With FALLBACK_URL set it redirects there; otherwise browsers get an
+// HTML page suggesting similar shortcuts and other clients a JSON error.
+func (s *Server) notFound(w http.ResponseWriter, req *http.Request, ns, shortcut string) {
+	if s.FallbackURL != "" {
+		to := strings.ReplaceAll(s.FallbackURL, "{path}", url.QueryEscape(shortcut))
+		log.Printf("unknown shortcut=%q, falling back to=%q", shortcut, to)
+		http.Redirect(w, req, to, http.StatusFound)
+		return
+	}
+
+	if !strings.Contains(req.Header.Get("Accept"), "text/html") {
+		writeError(w, req, http.StatusNotFound, "shortcut %q not found", shortcut)
+		return
+	}
+
+	// Crawlers get the page without the work of finding suggestions.
+	var similar []string
+	if all, err := s.Links.All(); err == nil && !isBot(req.UserAgent()) {
+		all = s.Domains.Scope(all, ns)
+		private := s.canViewPrivate(req)
+		for k, v := range all {
+			if v.Private && !private || v.Unapproved {
+				delete(all, k)
+			}
+		}
+		similar = suggestions(shortcut, all, maxSuggestions)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	err := notFoundTemplate.Execute(w, struct {
+		Shortcut    string
+		Suggestions []string
+		CreateURL   string
+	}{
+		Shortcut:    shortcut,
+		Suggestions: similar,
+		CreateURL:   "/new?shortcut=" + url.QueryEscape(s.Domains.Join(ns, shortcut)),
+	})
+	if err != nil {
+		log.Printf("warn: failed to render 404 page: %v", err)
+	}
+}
+
+// ParseFallbackURL validates FALLBACK_URL, an absolute http(s) URL or a path
+// on this server, in which {path} stands for the requested shortcut.
+func ParseFallbackURL(raw string) (string, error) {
+	u, err := url.Parse(strings.ReplaceAll(raw, "{path}", "x"))
+	if err != nil {
+		return "", fmt.Errorf("invalid FALLBACK_URL: %w", err)
+	}
+	if u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/") {
+		return raw, nil
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("FALLBACK_URL %q must be an http(s) URL or an absolute path", raw)
+	}
+	return raw, nil
+}
+
+// maxSuggestQuery bounds the runes of a query compared with every shortcut
+// by suggestions, which public pages run for any path.
+const maxSuggestQuery = 64
+
+// suggestions returns up to n shortcuts similar to query: those sharing a
+// prefix with it first, then those within a small edit distance.
+func suggestions(query string, all store.URLMap, n int) []string {
+	query = store.Norm.Lower(query)
+	if query == "" {
+		return nil
+	}
+	if r := []rune(query); len(r) > maxSuggestQuery {
+		query = string(r[:maxSuggestQuery])
+	}
+	maxDist := len(query) / 3
+	if maxDist < 2 {
+		maxDist = 2
+	}
+
+	type candidate struct {
+		shortcut string
+		score    int
+	}
+	var found []candidate
+	for k := range all {
+		switch {
+		case strings.HasPrefix(k, query) || strings.HasPrefix(query, k):
+			found = append(found, candidate{k, 0})
+		default:
+			if d := levenshtein(query, k, maxDist); d <= maxDist {
+				found = append(found, candidate{k, d})
+			}
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].score != found[j].score {
+			return found[i].score < found[j].score
+		}
+		return found[i].shortcut < found[j].shortcut
+	})
+	if len(found) > n {
+		found = found[:n]
+	}
+
+	out := make([]string, len(found))
+	for i, c := range found {
+		out[i] = c.shortcut
+	}
+	return out
+}
+
+// levenshtein returns the edit distance between a and b, counting runes, or
+// max+1 as soon as it is known to exceed max.
+func levenshtein(a, b string, max int) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > max || -d > max {
+		return max + 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		lowest := i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if cur[j] < lowest {
+				lowest = cur[j]
+			}
+		}
+		// Distances never shrink from one row to the next.
+		if lowest > max {
+			return max + 1
+		}
+		prev, cur = cur, prev
+	}
+	if prev[len(rb)] > max {
+		return max + 1
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,119 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// maxOmniboxSuggestions is the number of shortcuts returned by /api/suggest.
+const maxOmniboxSuggestions = 10
+
+// minFuzzySuggest is the query length from which /api/suggest also offers
+// misspelled matches.
+const minFuzzySuggest = 4
+
+// openSearchDescription is an OpenSearch 1.1 description document.
+type openSearchDescription struct {
+	XMLName       xml.Name        `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName     string          `xml:"ShortName"`
+	Description   string          `xml:"Description"`
+	InputEncoding string          `xml:"InputEncoding"`
+	URLs          []openSearchURL `xml:"Url"`
+}
+
+type openSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Method   string `xml:"method,attr,omitempty"`
+	Rel      string `xml:"rel,attr,omitempty"`
+	Template string `xml:"template,attr"`
+}
+
+// serveOpenSearch handles /opensearch.xml, letting browsers add the server
+// as a search engine under the OPENSEARCH_NAME keyword (default "go") with
+// suggestions from /api/suggest.
+func (s *Server) serveOpenSearch(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	name := os.Getenv("OPENSEARCH_NAME")
+	if name == "" {
+		name = "go"
+	}
+
+	// With CANONICAL_URL set, requests only get here on the canonical host.
+	base := requestScheme(req, s.TrustProxy) + "://" + req.Host
+	doc := openSearchDescription{
+		ShortName:     name,
+		Description:   "Short links on " + req.Host,
+		InputEncoding: "UTF-8",
+		URLs: []openSearchURL{
+			{Type: "text/html", Method: "get", Template: base + "/{searchTerms}"},
+			{Type: "application/x-suggestions+json", Rel: "suggestions", Template: base + "/api/suggest?q={searchTerms}"},
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/opensearchdescription+xml")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		log.Printf("warn: failed to write OpenSearch description: %v", err)
+	}
+}
+
+// suggest handles /api/suggest?q=, answering in the OpenSearch suggestions
+// format: the query, matching shortcuts, their destinations and their short
+// URLs. Like the 404 page it needs no token, so private links are only
+// offered to clients that may resolve them.
+func (s *Server) suggest(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	q := strings.TrimSpace(req.URL.Query().Get("q"))
+
+	all, err := s.Links.All()
+	if err != nil {
+		writeError(w, req, http.StatusServiceUnavailable, "failed to load links: %v", err)
+		return
+	}
+	all = s.Domains.Scope(all, s.Domains.Namespace(req.Host))
+	private := s.canViewPrivate(req)
+	for k, l := range all {
+		if store.IsPatternKey(k) || (l.Private && !private) || l.Unapproved {
+			delete(all, k)
+		}
+	}
+
+	base := requestScheme(req, s.TrustProxy) + "://" + req.Host + "/"
+	key := store.Norm.Canonical(q)
+	shortcuts := []string{}
+	for _, k := range suggestions(key, all, maxOmniboxSuggestions) {
+		// Short queries are within the edit distance of nearly everything,
+		// which makes for noisy completions; only offer prefix matches.
+		if len([]rune(key)) >= minFuzzySuggest || strings.HasPrefix(k, strings.ToLower(key)) {
+			shortcuts = append(shortcuts, k)
+		}
+	}
+	descriptions := make([]string, len(shortcuts))
+	urls := make([]string, len(shortcuts))
+	for i, k := range shortcuts {
+		descriptions[i] = publicTarget(all[k])
+		urls[i] = base + k
+	}
+
+	w.Header().Set("Content-Type", "application/x-suggestions+json")
+	if err := json.NewEncoder(w).Encode([]interface{}{q, shortcuts, descriptions, urls}); err != nil {
+		log.Printf("warn: failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+var (
+	errNotOwner      = errors.New("link is owned by someone else")
+	errQuotaExceeded = errors.New("link quota exceeded")
+)
+
+// manageAll reports whether req may see and change every link: either
+// authentication is disabled or the caller has the admin scope.
+func manageAll(req *http.Request) bool {
+	p := requestPrincipal(req)
+	return p == nil || p.Scope >= store.ScopeAdmin
+}
+
+// owns reports whether req may change link. Links without an owner can only
+// be changed by admins, who may assign one.
+func owns(req *http.Request, link *store.Link) bool {
+	if manageAll(req) {
+		return true
+	}
+	return link.Owner != "" && link.Owner == requestPrincipal(req).Name
+}
+
+// ownerOf returns the owner to record for a link created or updated by req,
+// given the owner requested in the body. Only admins may pick someone else.
+func ownerOf(req *http.Request, requested string) (string, error) {
+	p := requestPrincipal(req)
+	switch {
+	case p == nil:
+		return requested, nil
+	case requested == "" || requested == p.Name:
+		return p.Name, nil
+	case p.Scope >= store.ScopeAdmin:
+		return requested, nil
+	}
+	return "", errNotOwner
+}
+
+// checkQuota fails with errQuotaExceeded when owner already has LINK_QUOTA
+// links, counting pending ones created but not loaded yet. Admins and links
+// without an owner are not limited.
+func (s *Server) checkQuota(req *http.Request, owner string, pending int) error {
+	if s.LinkQuota <= 0 || owner == "" {
+		return nil
+	}
+	if p := requestPrincipal(req); p != nil && p.Scope >= store.ScopeAdmin {
+		return nil
+	}
+	all, err := s.Links.All()
+	if err != nil {
+		return fmt.Errorf("failed to count links: %w", err)
+	}
+	n := pending
+	for _, l := range all {
+		if l.Owner == owner {
+			n++
+		}
+	}
+	if n >= s.LinkQuota {
+		return fmt.Errorf("%w: %s owns %d of %d links", errQuotaExceeded, owner, n, s.LinkQuota)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package httpapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPerPage bounds ?per_page= of GET /api/links.
+const maxPerPage = 1000
+
+// linkSorts are the orders GET /api/links takes in ?sort=, each comparing two
+// entries; a leading "-" reverses them. Ties are broken by shortcut.
+var linkSorts = map[string]func(a, b *linkListEntry) int{
+	"shortcut":    func(a, b *linkListEntry) int { return 0 },
+	"url":         func(a, b *linkListEntry) int { return strings.Compare(a.URL, b.URL) },
+	"owner":       func(a, b *linkListEntry) int { return strings.Compare(a.Owner, b.Owner) },
+	"hits":        func(a, b *linkListEntry) int { return compareInt64(a.Hits, b.Hits) },
+	"expires_at":  func(a, b *linkListEntry) int { return compareTimes(a.ExpiresAt, b.ExpiresAt) },
+	"active_from": func(a, b *linkListEntry) int { return compareTimes(a.ActiveFrom, b.ActiveFrom) },
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareTimes orders times, with unset ones last.
+func compareTimes(a, b *time.Time) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	case a.Before(*b):
+		return -1
+	case a.After(*b):
+		return 1
+	}
+	return 0
+}
+
+// sortLinks sorts entries by ?sort=, such as "-hits", defaulting to the
+// shortcut.
+func sortLinks(entries []linkListEntry, by string) error {
+	desc := strings.HasPrefix(by, "-")
+	field := strings.TrimPrefix(by, "-")
+	if field == "" {
+		field = "shortcut"
+	}
+	cmp, ok := linkSorts[field]
+	if !ok {
+		fields := make([]string, 0, len(linkSorts))
+		for f := range linkSorts {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		return fmt.Errorf("sort must be one of %s, optionally prefixed with -", strings.Join(fields, ", "))
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		c := cmp(&entries[i], &entries[j])
+		if c == 0 {
+			c = strings.Compare(entries[i].Shortcut, entries[j].Shortcut)
+		}
+		if desc {
+			return c > 0
+		}
+		return c < 0
+	})
+	return nil
+}
+
+// paginate returns the bounds of the page of n items asked for by ?page= and
+// ?per_page=, setting X-Total-Count and a Link header with the first,
+// previous, next and last pages. Without ?per_page= every item is returned.
+func paginate(w http.ResponseWriter, req *http.Request, n int) (int, int, error) {
+	q := req.URL.Query()
+	w.Header().Set("X-Total-Count", strconv.Itoa(n))
+	if q.Get("per_page") == "" && q.Get("page") == "" {
+		return 0, n, nil
+	}
+	perPage, page := 100, 1
+	if v := q.Get("per_page"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 || p > maxPerPage {
+			return 0, 0, fmt.Errorf("per_page must be between 1 and %d", maxPerPage)
+		}
+		perPage = p
+	}
+	if v := q.Get("page"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 {
+			return 0, 0, errors.New("page must be a positive number")
+		}
+		page = p
+	}
+	last := (n + perPage - 1) / perPage
+	if last == 0 {
+		last = 1
+	}
+
+	link := func(p int, rel string) string {
+		u := url.URL{Path: req.URL.Path}
+		v := req.URL.Query()
+		v.Set("page", strconv.Itoa(p))
+		v.Set("per_page", strconv.Itoa(perPage))
+		u.RawQuery = v.Encode()
+		return fmt.Sprintf("<%s>; rel=%q", u.String(), rel)
+	}
+	links := []string{link(1, "first")}
+	if page > 1 {
+		links = append(links, link(page-1, "prev"))
+	}
+	if page < last {
+		links = append(links, link(page+1, "next"))
+	}
+	links = append(links, link(last, "last"))
+	w.Header().Set("Link", strings.Join(links, ", "))
+
+	start := (page - 1) * perPage
+	if start > n {
+		start = n
+	}
+	end := start + perPage
+	if end > n {
+		end = n
+	}
+	return start, end, nil
+}
+
+// writeCachedJSON is writeJSON for 200 responses with a weak ETag, answering
+// 304 Not Modified when If-None-Match names it already, so clients polling
+// the API only download changes.
+func writeCachedJSON(w http.ResponseWriter, req *http.Request, v interface{}) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to encode response: %v", err)
+		return
+	}
+	writeCached(w, req, "application/json", buf.Bytes())
+}
+
+// writeCached writes body as contentType with a weak ETag, or 304 Not
+// Modified when If-None-Match names it.
+func writeCached(w http.ResponseWriter, req *http.Request, contentType string, body []byte) {
+	sum := sha256.Sum256(body)
+	etag := `W/"` + hex.EncodeToString(sum[:12]) + `"`
+	w.Header().Set("ETag", etag)
+	// Caches must check back, as links change at any time.
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatches(req.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write(body); err != nil {
+		log.Printf("warn: failed to write response: %v", err)
+	}
+}
+
+// etagMatches reports whether the If-None-Match header ifNoneMatch names
+// etag, comparing weakly.
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package httpapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+//go:embed web/password.html.tmpl
+var passwordTemplateText string
+
+var passwordTemplate = template.Must(template.New("password").Parse(passwordTemplateText))
+
+// defaultUnlockTTL is how long a correct password unlocks a link when
+// Server.UnlockTTL is zero.
+const defaultUnlockTTL = time.Hour
+
+// unlockCookie names the cookie unlocking shortcut. Cookies are per link
+// rather than per path since patterns match many paths.
+func unlockCookie(shortcut string) string {
+	sum := sha256.Sum256([]byte(shortcut))
+	return "unlock_" + hex.EncodeToString(sum[:6])
+}
+
+// unlockMAC signs an unlock of shortcut until expires. The password is part
+// of the message so that changing it locks the link again, and the prefix
+// keeps unlocks apart from the other messages signed with the same key,
+// such as sessions of a shortcut named "session".
+func unlockMAC(key []byte, shortcut, password string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("unlock\n" + shortcut + "\n" + password + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// unlocked reports whether req may follow the password-protected link of
+// shortcut. It carries a valid unlock cookie or, in a POST from the password
+// form, the password; the latter also sets the cookie. Otherwise the form is
+// written to w.
+func (s *Server) unlocked(w http.ResponseWriter, req *http.Request, shortcut string, link *store.Link) bool {
+	if len(s.SigningKey) > 0 {
+		if c, err := req.Cookie(unlockCookie(shortcut)); err == nil {
+			if i := strings.IndexByte(c.Value, '.'); i > 0 {
+				expires, err := strconv.ParseInt(c.Value[:i], 10, 64)
+				want := unlockMAC(s.SigningKey, shortcut, link.Password, expires)
+				if err == nil && time.Now().Unix() < expires && hmac.Equal([]byte(c.Value[i+1:]), []byte(want)) {
+					return true
+				}
+			}
+		}
+	}
+
+	wrong := false
+	if req.Method == http.MethodPost {
+		if err := req.ParseForm(); err != nil {
+			writeError(w, req, http.StatusBadRequest, "invalid form: %v", err)
+			return false
+		}
+		given := req.PostFormValue("password")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(link.Password)) == 1 {
+			s.setUnlockCookie(w, req, shortcut, link)
+			return true
+		}
+		log.Printf("wrong password for shortcut=%q", shortcut)
+		wrong = true
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if !strings.Contains(req.Header.Get("Accept"), "text/html") {
+		writeError(w, req, http.StatusUnauthorized, "shortcut %q requires a password, POST it as the password form field", shortcut)
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	err := passwordTemplate.Execute(w, struct {
+		Shortcut string
+		Wrong    bool
+	}{
+		Shortcut: shortcut,
+		Wrong:    wrong,
+	})
+	if err != nil {
+		log.Printf("warn: failed to render password page: %v", err)
+	}
+	return false
+}
+
+// setUnlockCookie remembers that req entered the password of shortcut. Without
+// a signing key nothing is remembered and the password is asked every time.
+func (s *Server) setUnlockCookie(w http.ResponseWriter, req *http.Request, shortcut string, link *store.Link) {
+	if len(s.SigningKey) == 0 {
+		return
+	}
+	ttl := s.UnlockTTL
+	if ttl <= 0 {
+		ttl = defaultUnlockTTL
+	}
+	expires := time.Now().Add(ttl).Unix()
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlockCookie(shortcut),
+		Value:    strconv.FormatInt(expires, 10) + "." + unlockMAC(s.SigningKey, shortcut, link.Password, expires),
+		Path:     "/",
+		MaxAge:   int(ttl / time.Second),
+		Secure:   requestScheme(req, s.TrustProxy) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
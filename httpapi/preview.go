@@ -0,0 +1,71 @@
+package httpapi
+
+import (
+	_ "embed"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+//go:embed web/preview.html.tmpl
+var previewTemplateText string
+
+var previewTemplate = template.Must(template.New("preview").Parse(previewTemplateText))
+
+// previewDetails are the details of a link the preview page shows for the
+// "+" suffix command.
+type previewDetails struct {
+	Description string
+	Owner       string
+	Tags        []string
+	Expires     string
+	// Clicks is only shown to those who may see private links, as the
+	// stats API needs a token.
+	Clicks *int64
+}
+
+// preview answers with an interstitial page showing where shortcut leads
+// instead of redirecting, with the details of link if details is set.
+// Clients that don't accept HTML get the destination as plain text.
+func (s *Server) preview(w http.ResponseWriter, req *http.Request, shortcut string, link *store.Link, to *url.URL, details bool) {
+	log.Printf("previewing=%q to=%q", req.URL, to.String())
+	if !strings.Contains(req.Header.Get("Accept"), "text/html") {
+		plainDestination(w, to)
+		return
+	}
+
+	var d *previewDetails
+	if details {
+		d = &previewDetails{Description: link.Description, Owner: link.Owner, Tags: link.Tags}
+		if !link.Expires.IsZero() {
+			d.Expires = link.Expires.UTC().Format("2006-01-02 15:04 MST")
+		}
+		if s.canViewPrivate(req) {
+			if stats, err := s.Analytics.Stats(req.Context(), shortcut); err != nil {
+				log.Printf("warn: failed to load stats of %q for its preview: %v", shortcut, err)
+			} else {
+				d.Clicks = &stats.Total
+			}
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := previewTemplate.Execute(w, struct {
+		Shortcut string
+		Host     string
+		URL      string
+		Details  *previewDetails
+	}{
+		Shortcut: shortcut,
+		Host:     to.Hostname(),
+		URL:      to.String(),
+		Details:  d,
+	})
+	if err != nil {
+		log.Printf("warn: failed to render preview page: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/store"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 2048
+)
+
+// qrLevels maps the level query parameter to error-correction levels.
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// linkQR handles GET /api/links/{shortcut}/qr, rendering the short URL as a
+// QR code. Query parameters: size in pixels, level (L, M, Q or H) and format
+// (png or svg).
+func (s *Server) linkQR(w http.ResponseWriter, req *http.Request, shortcut string) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+
+	shortcut = store.Norm.Lower(shortcut)
+	link, err := s.Links.Get(shortcut)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to look up shortcut: %v", err)
+		return
+	}
+	if link == nil {
+		writeError(w, req, http.StatusNotFound, "shortcut %q not found", shortcut)
+		return
+	}
+
+	q := req.URL.Query()
+	size := defaultQRSize
+	if v := q.Get("size"); v != "" {
+		size, err = strconv.Atoi(v)
+		if err != nil || size < minQRSize || size > maxQRSize {
+			writeError(w, req, http.StatusBadRequest, "size must be between %d and %d", minQRSize, maxQRSize)
+			return
+		}
+	}
+	level := qrcode.Medium
+	if v := q.Get("level"); v != "" {
+		var ok bool
+		if level, ok = qrLevels[strings.ToUpper(v)]; !ok {
+			writeError(w, req, http.StatusBadRequest, "level must be one of L, M, Q or H")
+			return
+		}
+	}
+
+	code, err := qrcode.New(s.shortURL(req, shortcut), level)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to encode QR code: %v", err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	switch strings.ToLower(q.Get("format")) {
+	case "", "png":
+		png, err := code.PNG(size)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, "failed to render QR code: %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	case "svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(qrSVG(code.Bitmap(), size))
+	default:
+		writeError(w, req, http.StatusBadRequest, "format must be png or svg")
+	}
+}
+
+// qrSVG renders a QR bitmap, including its quiet zone, as an SVG image of
+// size pixels with one path for all dark modules.
+func qrSVG(bitmap [][]bool, size int) []byte {
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+
+	n := len(bitmap)
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		size, size, n, n, path.String()))
+}
+
+// shortURL returns the URL of shortcut as requested through req, on the host
+// of its namespace.
+func (s *Server) shortURL(req *http.Request, shortcut string) string {
+	// With CANONICAL_URL set, requests only get here on the canonical host
+	// or one of DOMAINS.
+	host, path := req.Host, shortcut
+	if ns, rest := s.Domains.Split(shortcut); ns != "" {
+		host, path = s.Domains.Host(ns), rest
+	}
+	return requestScheme(req, s.TrustProxy) + "://" + host + "/" + path
+}
@@ -0,0 +1,126 @@
+package httpapi
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+)
+
+var rateLimitedTotal = metrics.NewCounter("shortener_rate_limited_total",
+	"Requests rejected by the per-client rate limiter.")
+
+// bucket is a token bucket that refills continuously.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter applies a token bucket of rate tokens per second and the given
+// burst to each client IP.
+type RateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	// trustProxy makes clientIP honour X-Forwarded-For.
+	trustProxy bool
+}
+
+// NewRateLimiter returns a limiter allowing each client rate requests per
+// second in bursts of up to burst.
+func NewRateLimiter(rate float64, burst int, trustProxy bool) *RateLimiter {
+	return &RateLimiter{
+		rate:       rate,
+		burst:      float64(burst),
+		buckets:    make(map[string]*bucket),
+		trustProxy: trustProxy,
+	}
+}
+
+// allow takes a token from key's bucket. When the bucket is empty it returns
+// false and how long until the next token is available.
+func (l *RateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// prune drops buckets that have refilled completely, as they are identical
+// to a new one.
+func (l *RateLimiter) prune(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Run prunes idle buckets every minute until ctx is cancelled.
+func (l *RateLimiter) Run(ctx context.Context) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			l.prune(now)
+		}
+	}
+}
+
+// Limit wraps next, answering 429 Too Many Requests with a Retry-After header
+// to clients that exceeded their rate.
+func (l *RateLimiter) Limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ok, wait := l.allow(clientIP(req, l.trustProxy), time.Now())
+		if !ok {
+			rateLimitedTotal.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, req, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next(w, req)
+	}
+}
+
+// clientIP returns the address the request came from. Behind a trusted proxy
+// that sets X-Forwarded-For, that is the right-most entry, the one the proxy
+// appended: the entries before it are whatever the client sent.
+func clientIP(req *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if fwd := req.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			last := fwd[len(fwd)-1]
+			if ip := strings.TrimSpace(last[strings.LastIndex(last, ",")+1:]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,204 @@
+package httpapi
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+	"github.com/denizyoldas/url-shorter/internal/tracing"
+	"github.com/denizyoldas/url-shorter/resolver"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+var (
+	redirectsTotal = metrics.NewCounterVec("shortener_redirects_total",
+		"Redirects served, by shortcut.", "shortcut")
+	notFoundTotal = metrics.NewCounter("shortener_not_found_total",
+		"Requests for shortcuts that do not exist.")
+	staleFailuresTotal = metrics.NewCounter("shortener_stale_failures_total",
+		"Redirects refused because the links are staler than the stale policy allows.")
+	canaryRedirectsTotal = metrics.NewCounterVec("shortener_canary_redirects_total",
+		"Redirects of links with a canary to the canary's destination, by shortcut.", "shortcut")
+	stableRedirectsTotal = metrics.NewCounterVec("shortener_canary_stable_redirects_total",
+		"Redirects of links with a canary to their current destination, by shortcut.", "shortcut")
+)
+
+func (s *Server) redirect(w http.ResponseWriter, req *http.Request) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		// Only the password form posts, see below.
+	default:
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	if s.Mode.Maintenance() {
+		s.Mode.serveMaintenance(w, req)
+		return
+	}
+
+	// Appending "+" to a shortcut shows where it leads instead of going
+	// there; see SuffixCommands for the others.
+	target, cmd := s.suffixCommand(req.URL)
+	preview := s.PreviewAll || cmd == suffixDetails
+	if cmd == suffixReload && s.canChangeLinks(req) {
+		// Reloads query the provider, so they are left to those who may
+		// change links; everyone else is redirected from the cache.
+		if err := s.Links.Refresh(req.Context()); err != nil {
+			log.Printf("warn: failed to reload links for %q: %v", req.URL, err)
+		}
+	}
+	// Signed links carry their signature in the query, which mustn't reach
+	// the destination.
+	target, signature := signedParams(target)
+
+	if s.Links.Stale() {
+		w.Header().Set("X-Cache", "stale")
+	}
+	_, sp := tracing.Start(req.Context(), "cache.lookup", tracing.Internal)
+	ns := s.Domains.Namespace(req.Host)
+	visitor := s.visitor(req)
+	shortcut, link, redirTo, err := s.Resolver.ResolveFor(target, ns, visitor)
+	sp.SetAttr("shortcut", shortcut)
+	sp.SetAttr("found", redirTo != nil)
+	if errors.Is(err, store.ErrLinkExpired) || errors.Is(err, store.ErrLinkPending) {
+		sp.End(nil)
+	} else {
+		sp.End(err)
+	}
+	s.Shadow.Compare(target, ns, visitor, shortcut, link, redirTo, err)
+	signed := link != nil && s.signedAccess(signature, shortcut)
+	if link != nil && link.Private && !signed && !s.canViewPrivate(req) {
+		writeError(w, req, http.StatusForbidden, "shortcut %q is private", shortcut)
+		return
+	}
+	if errors.Is(err, store.ErrLinkDisabled) {
+		writeError(w, req, http.StatusGone, "shortcut %q is disabled", shortcut)
+		return
+	} else if errors.Is(err, store.ErrLinkExpired) {
+		writeError(w, req, http.StatusGone, "shortcut %q has expired", shortcut)
+		return
+	} else if errors.Is(err, store.ErrLinkPending) {
+		// Until its window opens, or an admin approves it, the shortcut is
+		// treated as unknown.
+	} else if errors.Is(err, resolver.ErrAliasLoop) {
+		writeError(w, req, http.StatusLoopDetected, "shortcut %q is an alias loop", shortcut)
+		return
+	} else if errors.Is(err, resolver.ErrStale) {
+		staleFailuresTotal.Inc()
+		writeError(w, req, http.StatusServiceUnavailable, "links are temporarily unavailable")
+		return
+	} else if err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to find redirect: %v", err)
+		return
+	}
+
+	if req.Method == http.MethodPost && (link == nil || link.Password == "") {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+
+	// Crawlers stay out of logs, analytics and the hits of links.
+	bot := isBot(req.UserAgent())
+	if bot {
+		botRequestsTotal.Inc()
+	}
+	// HEAD requests, such as from link checkers, are answered like GET
+	// without a body, and aren't clicks either.
+	counted := !bot && req.Method != http.MethodHead
+
+	if redirTo == nil {
+		notFoundTotal.Inc()
+		s.notFound(w, req, ns, strings.Trim(resolver.DecodePath(target.Path), "/"))
+		return
+	}
+
+	budget := s.clickBudget(shortcut, link)
+	if s.overBudget(w, req, shortcut, budget) {
+		return
+	}
+
+	if link.Password != "" && !signed && !s.unlocked(w, req, shortcut, link) {
+		return
+	}
+
+	// Text links show their content either way.
+	if cmd == suffixPlain && link.Type == "" {
+		plainDestination(w, redirTo)
+		return
+	}
+	if (preview || link.Preview) && link.Type == "" {
+		s.preview(w, req, shortcut, link, redirTo, cmd == suffixDetails)
+		return
+	}
+	// One-time links are spent by the visit they grant, not by link
+	// checkers, crawlers or previews before it.
+	if signed && counted && !s.spendSigned(signature, shortcut) {
+		writeError(w, req, http.StatusForbidden, "one-time link of shortcut %q was already used", shortcut)
+		return
+	}
+
+	click := store.Click{
+		Shortcut:  shortcut,
+		Time:      time.Now(),
+		Referrer:  req.Referer(),
+		UserAgent: req.UserAgent(),
+	}
+	if link.When != nil || len(link.Variants) > 0 || link.Canary != nil {
+		// The destination depends on who asks.
+		vary := "User-Agent, Accept-Language"
+		if s.CountryHeader != "" {
+			vary += ", " + s.CountryHeader
+		}
+		if link.Split() {
+			vary += ", Cookie"
+			s.setVisitorCookie(w, req, visitor)
+		}
+		w.Header().Set("Vary", vary)
+		click.Destination = targetSummary(link)
+	}
+	s.setCacheHeaders(w, link, click.Time)
+	if link.Type != "" {
+		w.Header().Add("Vary", "Accept")
+		s.content(w, req, shortcut, link)
+		if counted {
+			s.Analytics.Record(click)
+			s.Webhooks.Clicked(shortcut)
+			s.Events.Clicked(click)
+			s.spendBudget(shortcut, link, budget)
+		}
+		return
+	}
+	status := link.RedirectStatus()
+	if !s.PermanentRedirects {
+		status = temporaryStatus(status)
+	}
+	if req.Method == http.MethodPost {
+		// 307 and 308 would repeat the POST, password included, at the
+		// destination.
+		status = http.StatusSeeOther
+	}
+	http.Redirect(w, req, redirTo.String(), status)
+	if !counted {
+		return
+	}
+	log.Printf("redirecting=%q to=%q", req.URL, redirTo.String())
+	redirectsTotal.Inc(shortcut)
+	if link.OnCanary() {
+		canaryRedirectsTotal.Inc(shortcut)
+	} else if link.Canary != nil {
+		stableRedirectsTotal.Inc(shortcut)
+	}
+	s.Analytics.Record(click)
+	s.Webhooks.Clicked(shortcut)
+	s.Events.Clicked(click)
+	s.spendBudget(shortcut, link, budget)
+}
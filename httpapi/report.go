@@ -0,0 +1,271 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/mail"
+	"net/smtp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+//go:embed web/report.txt.tmpl
+var reportTemplateText string
+
+var reportTemplate = template.Must(template.New("report").Parse(reportTemplateText))
+
+var (
+	reportsSentTotal = metrics.NewCounter("shortener_reports_sent_total",
+		"Link reports emailed to owners.")
+	reportFailuresTotal = metrics.NewCounter("shortener_report_failures_total",
+		"Link reports that could not be emailed.")
+)
+
+// Reporter emails the owner of links a summary of them every period: their
+// clicks, broken destinations, links expiring soon and links nobody followed
+// in a long time, so the link table stays healthy without audits. See
+// REPORT_INTERVAL.
+type Reporter struct {
+	srv *Server
+	// Base is the URL links are shown under, such as https://go.example.com.
+	Base string
+	// From is the sender, see REPORT_FROM.
+	From string
+	// Domain completes owners that are not email addresses, such as API
+	// token names, see REPORT_EMAIL_DOMAIN. Without it they get no report.
+	Domain string
+	// ExpiringWithin is how soon links must expire to be listed, see
+	// REPORT_EXPIRING_WITHIN.
+	ExpiringWithin time.Duration
+	// UnusedMonths is how many months links must not have been followed to
+	// be listed, see REPORT_UNUSED_MONTHS.
+	UnusedMonths int
+
+	// send delivers msg to the recipient to.
+	send func(to string, msg []byte) error
+}
+
+// NewReporter returns a reporter sending mail for the links of srv through
+// the SMTP server at addr, such as smtp.example.com:587, signing in with
+// username and password unless username is empty.
+func NewReporter(srv *Server, addr, username, password, from string) (*Reporter, error) {
+	if addr == "" || from == "" {
+		return nil, errors.New("an SMTP server and a sender are required")
+	}
+	var auth smtp.Auth
+	if username != "" {
+		host := addr
+		if i := strings.LastIndexByte(addr, ':'); i >= 0 {
+			host = addr[:i]
+		}
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &Reporter{
+		srv:            srv,
+		From:           from,
+		ExpiringWithin: 14 * 24 * time.Hour,
+		UnusedMonths:   6,
+		send: func(to string, msg []byte) error {
+			return smtp.SendMail(addr, auth, from, []string{to}, msg)
+		},
+	}, nil
+}
+
+// Run sends the reports every period until ctx is done. The first ones go
+// out a period after the start, so restarts don't send them again; run it on
+// a single replica.
+func (r *Reporter) Run(ctx context.Context, period time.Duration) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := r.SendAll(ctx, period); err != nil {
+				log.Printf("warn: failed to send link reports: %v", err)
+			}
+		}
+	}
+}
+
+// reportEntry is a link listed in a report.
+type reportEntry struct {
+	Shortcut string
+	Target   string
+	Clicks   int64
+	Problem  string
+	Expires  string
+}
+
+// linkReport is the report of one owner.
+type linkReport struct {
+	Owner     string
+	Base      string
+	Period    string
+	UnusedFor string
+	Links     []string
+	Clicked   []reportEntry
+	Broken    []reportEntry
+	Expiring  []reportEntry
+	Unused    []reportEntry
+}
+
+// recipient returns the address of owner, or "" if it has none.
+func (r *Reporter) recipient(owner string) string {
+	to := owner
+	if !strings.Contains(owner, "@") {
+		if owner == "" || r.Domain == "" {
+			return ""
+		}
+		to = owner + "@" + r.Domain
+	}
+	// Owners come from imports too; keep them out of the headers unless
+	// they are plain addresses.
+	if a, err := mail.ParseAddress(to); err != nil || a.Address != to {
+		return ""
+	}
+	return to
+}
+
+// ownerReports returns the report of every owner with an address over the
+// last period, by address.
+func (r *Reporter) ownerReports(ctx context.Context, period time.Duration, now time.Time) (map[string]*linkReport, error) {
+	all, err := r.srv.Links.All()
+	if err != nil {
+		return nil, err
+	}
+	shortcuts := make([]string, 0, len(all))
+	for k := range all {
+		shortcuts = append(shortcuts, k)
+	}
+	sort.Strings(shortcuts)
+	recent, err := r.srv.Analytics.ClicksSince(ctx, shortcuts, now.Add(-period))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load clicks: %w", err)
+	}
+	unusedSince := now.AddDate(0, -r.UnusedMonths, 0)
+	sinceUnused, err := r.srv.Analytics.ClicksSince(ctx, shortcuts, unusedSince)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load clicks: %w", err)
+	}
+
+	reports := make(map[string]*linkReport)
+	for _, k := range shortcuts {
+		link := all[k]
+		to := r.recipient(link.Owner)
+		if to == "" {
+			continue
+		}
+		rep := reports[to]
+		if rep == nil {
+			rep = &linkReport{
+				Owner:     link.Owner,
+				Base:      strings.TrimSuffix(r.Base, "/"),
+				Period:    describePeriod(period),
+				UnusedFor: fmt.Sprintf("%d months", r.UnusedMonths),
+			}
+			reports[to] = rep
+		}
+		rep.Links = append(rep.Links, k)
+		e := reportEntry{Shortcut: k, Target: targetSummary(link), Clicks: recent[k]}
+		if e.Clicks > 0 {
+			rep.Clicked = append(rep.Clicked, e)
+		}
+		if h := r.srv.Checker.Health(k); h != nil && h.Broken {
+			e.Problem = h.Error
+			if e.Problem == "" {
+				e.Problem = fmt.Sprintf("HTTP %d", h.Status)
+			}
+			rep.Broken = append(rep.Broken, e)
+		}
+		if !link.Expires.IsZero() && link.Expires.After(now) && link.Expires.Sub(now) <= r.ExpiringWithin {
+			e.Expires = link.Expires.UTC().Format("2006-01-02 15:04 MST")
+			rep.Expiring = append(rep.Expiring, e)
+		}
+		if r.UnusedMonths > 0 && sinceUnused[k] == 0 && !r.createdSince(ctx, k, unusedSince) {
+			rep.Unused = append(rep.Unused, e)
+		}
+	}
+	for _, rep := range reports {
+		sort.SliceStable(rep.Clicked, func(i, j int) bool { return rep.Clicked[i].Clicks > rep.Clicked[j].Clicks })
+	}
+	return reports, nil
+}
+
+// createdSince reports whether the audit log shows shortcut was created
+// after t. Without an audit log links count as old.
+func (r *Reporter) createdSince(ctx context.Context, shortcut string, t time.Time) bool {
+	if r.srv.AuditLog == nil {
+		return false
+	}
+	entries, err := r.srv.AuditLog.Audit(ctx, shortcut, maxAuditEntries)
+	if err != nil || len(entries) == 0 {
+		return false
+	}
+	first := entries[len(entries)-1]
+	return first.Action == store.AuditCreate && first.Time.After(t)
+}
+
+// describePeriod renders d for reports, such as "week" or "3 days".
+func describePeriod(d time.Duration) string {
+	day := 24 * time.Hour
+	switch {
+	case d == 7*day:
+		return "week"
+	case d == day:
+		return "day"
+	case d%day == 0:
+		return fmt.Sprintf("%d days", d/day)
+	}
+	return d.String()
+}
+
+// SendAll emails every owner the report of their links over the last
+// period.
+func (r *Reporter) SendAll(ctx context.Context, period time.Duration) error {
+	now := time.Now()
+	reports, err := r.ownerReports(ctx, period, now)
+	if err != nil {
+		return err
+	}
+	sent, failed := 0, 0
+	for to, rep := range reports {
+		var body bytes.Buffer
+		if err := reportTemplate.Execute(&body, rep); err != nil {
+			return err
+		}
+		subject := fmt.Sprintf("Your links on %s", strings.TrimPrefix(strings.TrimPrefix(rep.Base, "https://"), "http://"))
+		if len(rep.Broken) > 0 {
+			subject += fmt.Sprintf(": %d broken", len(rep.Broken))
+		}
+		var msg bytes.Buffer
+		fmt.Fprintf(&msg, "From: %s\r\n", r.From)
+		fmt.Fprintf(&msg, "To: %s\r\n", to)
+		fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+		fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+		fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+		fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		msg.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+		if err := r.send(to, msg.Bytes()); err != nil {
+			log.Printf("warn: failed to email the link report of %s: %v", rep.Owner, err)
+			reportFailuresTotal.Inc()
+			failed++
+			continue
+		}
+		reportsSentTotal.Inc()
+		sent++
+	}
+	log.Printf("emailed %d link reports, %d failed", sent, failed)
+	return nil
+}
@@ -0,0 +1,47 @@
+package httpapi
+
+import (
+	_ "embed"
+	"io"
+	"net/http"
+	"regexp"
+
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+)
+
+// DefaultRobotsTxt keeps crawlers away from every link.
+const DefaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+//go:embed web/favicon.ico
+var favicon []byte
+
+var botRequestsTotal = metrics.NewCounter("shortener_bot_requests_total",
+	"Redirect requests from crawlers and link previewers, left out of logs and analytics.")
+
+// botPattern matches the User-Agents of crawlers, link previewers and
+// monitoring tools.
+var botPattern = regexp.MustCompile(`(?i)bot\b|bot/|crawl|spider|slurp|facebookexternalhit|embedly|preview|whatsapp|headlesschrome|uptime|pingdom`)
+
+// isBot reports whether ua is that of a crawler rather than a person.
+func isBot(ua string) bool {
+	return botPattern.MatchString(ua)
+}
+
+// serveRobots handles GET /robots.txt with RobotsTxt, see ROBOTS_TXT_FILE.
+func (s *Server) serveRobots(w http.ResponseWriter, req *http.Request) {
+	body := s.RobotsTxt
+	if body == "" {
+		body = DefaultRobotsTxt
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	io.WriteString(w, body)
+}
+
+// serveFavicon handles GET /favicon.ico, which browsers ask for on every
+// page and would otherwise look up as a shortcut.
+func serveFavicon(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "image/x-icon")
+	w.Header().Set("Cache-Control", "public, max-age=604800")
+	w.Write(favicon)
+}
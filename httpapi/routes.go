@@ -0,0 +1,87 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// Register adds the routes of the REST API, the admin page and redirects to
+// mux. Health checks, metrics, robots.txt, the favicon and Slack commands
+// skip the IP access lists. Requests for shortcuts go to the access log.
+// The API and admin page are compressed for clients that accept it.
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/", s.logAccess(s.restrict("site", s.limit(s.redirect))))
+	mux.HandleFunc("/metrics", metrics.Serve)
+	mux.HandleFunc("/robots.txt", s.serveRobots)
+	mux.HandleFunc("/favicon.ico", serveFavicon)
+	mux.HandleFunc("/healthz", serveHealthz)
+	mux.HandleFunc("/readyz", readyz(s.Links, s.ReadyMaxFailing))
+	mux.HandleFunc("/admin", s.restrict("api", compress(s.Auth.requireScope(store.ScopeWrite, true, serveAdmin))))
+	if s.PublicNewLinks {
+		mux.HandleFunc("/new", s.restrict("site", s.limit(s.upstream(s.Auth.identify(s.writable(s.newLink))))))
+	} else {
+		mux.HandleFunc("/new", s.restrict("api", s.limit(s.upstream(s.Auth.requireScope(store.ScopeWrite, true, s.writable(s.newLink))))))
+	}
+	mux.HandleFunc("/api/links", s.restrict("api", compress(s.limit(s.upstream(s.Auth.requireScope(store.ScopeRead, false, s.writable(s.links)))))))
+	mux.HandleFunc("/api/links/", s.restrict("api", compress(s.limit(s.upstream(s.Auth.requireScope(store.ScopeRead, false, s.writable(s.linkResource)))))))
+	mux.HandleFunc("/api/reload", s.restrict("api", compress(s.limit(s.upstream(s.Auth.requireScope(store.ScopeWrite, false, s.reload))))))
+	mux.HandleFunc("/status", s.restrict("api", compress(s.Auth.requireScope(store.ScopeRead, true, s.status))))
+	mux.HandleFunc("/api/lint", s.restrict("api", compress(s.limit(s.Auth.requireScope(store.ScopeRead, false, s.lint)))))
+	mux.HandleFunc("/api/mode", s.restrict("api", compress(s.limit(s.Auth.requireScope(store.ScopeAdmin, false, s.mode)))))
+	// Not compressed: events must reach the client as they happen.
+	mux.HandleFunc("/api/events/stream", s.restrict("api", s.limit(s.Auth.requireScope(store.ScopeAdmin, false, s.eventStream))))
+	mux.HandleFunc("/api/snapshots", s.restrict("api", compress(s.limit(s.upstream(s.Auth.requireScope(store.ScopeAdmin, false, s.writable(s.snapshots)))))))
+	mux.HandleFunc("/api/snapshots/", s.restrict("api", compress(s.limit(s.upstream(s.Auth.requireScope(store.ScopeAdmin, false, s.writable(s.snapshotResource)))))))
+	mux.HandleFunc("/api/audit", s.restrict("api", compress(s.limit(s.upstream(s.Auth.requireScope(store.ScopeAdmin, false, s.auditTrail))))))
+	mux.HandleFunc("/api/stats/top", s.restrict("api", compress(s.limit(s.upstream(s.Auth.requireScope(store.ScopeRead, false, s.topStats))))))
+	mux.HandleFunc("/api/stats/latency", s.restrict("api", compress(s.limit(s.Auth.requireScope(store.ScopeRead, false, s.latencyStats)))))
+	mux.HandleFunc("/api/search", s.restrict("api", compress(s.limit(s.Auth.requireScope(store.ScopeRead, false, s.search)))))
+	// Browsers ask for suggestions while typing go links, like redirects.
+	mux.HandleFunc("/api/suggest", s.restrict("site", s.limit(s.suggest)))
+	mux.HandleFunc("/api/complete", s.restrict("site", s.limit(s.complete)))
+	mux.HandleFunc("/popular", s.restrict("site", compress(s.limit(s.upstream(s.popular)))))
+	mux.HandleFunc("/opensearch.xml", s.restrict("site", s.serveOpenSearch))
+	mux.HandleFunc("/tools", s.restrict("site", compress(s.limit(s.tools))))
+	mux.HandleFunc("/tools/proxy.pac", s.restrict("site", s.limit(s.proxyPAC)))
+	if s.Auth.SSO != nil {
+		mux.HandleFunc("/auth/login", s.restrict("api", s.Auth.SSO.login))
+		mux.HandleFunc("/auth/callback", s.restrict("api", s.Auth.SSO.callback))
+		mux.HandleFunc("/auth/logout", s.Auth.SSO.logout)
+	}
+	if s.Tenants != nil {
+		mux.HandleFunc("/api/tenants", s.restrict("api", compress(s.limit(s.Auth.requireScope(store.ScopeAdmin, false, s.tenantsAPI)))))
+		mux.HandleFunc("/api/tenants/", s.restrict("api", compress(s.limit(s.Auth.requireScope(store.ScopeAdmin, false, s.tenantResource)))))
+	}
+	if s.SlackSecret != "" {
+		mux.HandleFunc("/slack/command", s.limit(s.upstream(s.slackCommand(s.SlackSecret))))
+	}
+	if s.DebugEndpoints {
+		// Not compressed: profiles are gzipped already.
+		mux.HandleFunc("/debug/pprof/", s.restrict("api", s.Auth.requireScope(store.ScopeAdmin, false, debugPprof)))
+		mux.HandleFunc("/debug/runtime", s.restrict("api", s.Auth.requireScope(store.ScopeAdmin, false, s.debugRuntime)))
+	}
+}
+
+// limit applies the per-client rate limit when a limiter is set.
+func (s *Server) limit(h http.HandlerFunc) http.HandlerFunc {
+	if s.Limiter == nil {
+		return h
+	}
+	return s.Limiter.Limit(h)
+}
+
+// upstream bounds the backend calls made for a request by ProviderTimeout.
+// Calls also end when the client disconnects, with the request context.
+func (s *Server) upstream(h http.HandlerFunc) http.HandlerFunc {
+	if s.ProviderTimeout <= 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), s.ProviderTimeout)
+		defer cancel()
+		h(w, req.WithContext(ctx))
+	}
+}
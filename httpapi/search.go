@@ -0,0 +1,195 @@
+package httpapi
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/resolver"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// Fields /api/search looks in, see ?fields=.
+var searchFields = []string{"shortcut", "tags", "description", "title", "url"}
+
+type searchResult struct {
+	apiLink
+	Score int `json:"score"`
+	// Matched lists the fields the query was found in.
+	Matched []string `json:"matched"`
+	// Page is the title and favicon of the destination, see
+	// PAGE_INFO_INTERVAL.
+	Page *resolver.PageInfo `json:"page,omitempty"`
+}
+
+type searchResponse struct {
+	Query   string         `json:"query"`
+	Results []searchResult `json:"results"`
+}
+
+// search handles GET /api/search?q=, finding links whose shortcut, tags,
+// description, destination title or URL match every word of the query, best
+// matches first. Shortcuts
+// also match with a few typos. ?fields= limits the search to a
+// comma-separated list of fields and ?limit= caps the results.
+func (s *Server) search(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	query := req.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	terms := strings.Fields(strings.ToLower(q))
+	if len(terms) == 0 {
+		writeError(w, req, http.StatusBadRequest, "q is required")
+		return
+	}
+	limit := defaultSearchLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			writeError(w, req, http.StatusBadRequest, "limit must be between 1 and %d", maxSearchLimit)
+			return
+		}
+		limit = n
+	}
+	fields := make(map[string]bool)
+	for _, f := range strings.Split(query.Get("fields"), ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		known := false
+		for _, k := range searchFields {
+			known = known || k == f
+		}
+		if !known {
+			writeError(w, req, http.StatusBadRequest, "unknown field %q, expected %s", f, strings.Join(searchFields, ", "))
+			return
+		}
+		fields[f] = true
+	}
+	if len(fields) == 0 {
+		for _, f := range searchFields {
+			fields[f] = true
+		}
+	}
+
+	all, err := s.Links.All()
+	if err != nil {
+		writeError(w, req, http.StatusServiceUnavailable, "failed to load links: %v", err)
+		return
+	}
+	private := s.canViewPrivate(req)
+	results := []searchResult{}
+	for k, l := range all {
+		if l.Private && !private {
+			continue
+		}
+		page := s.Pages.Info(l)
+		if score, matched := matchLink(terms, fields, k, l, page); score > 0 {
+			results = append(results, searchResult{apiLink: linkResponse(k, l), Score: score, Matched: matched, Page: page})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Shortcut < results[j].Shortcut
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	writeJSON(w, http.StatusOK, searchResponse{Query: q, Results: results})
+}
+
+// matchLink scores link of shortcut, whose destination is page if known,
+// against lowercase terms in fields, or returns 0 unless every term matches.
+// Each term counts for the field it matches best: the shortcut first, then
+// the tags, the description, the title of the destination and the URL.
+func matchLink(terms []string, fields map[string]bool, shortcut string, link *store.Link, page *resolver.PageInfo) (int, []string) {
+	desc := strings.ToLower(link.Description)
+	title := ""
+	if page != nil {
+		title = strings.ToLower(page.Title)
+	}
+	target := strings.ToLower(link.Target())
+	score := 0
+	found := make(map[string]bool)
+	for _, t := range terms {
+		best, field := 0, ""
+		if fields["shortcut"] {
+			best = matchShortcut(t, shortcut)
+			field = "shortcut"
+		}
+		if fields["tags"] && best < 40 && matchTag(t, link.Tags) {
+			best, field = 40, "tags"
+		}
+		if fields["description"] && best < 30 && strings.Contains(desc, t) {
+			best, field = 30, "description"
+		}
+		if fields["title"] && best < 25 && strings.Contains(title, t) {
+			best, field = 25, "title"
+		}
+		if fields["url"] && best < 20 && strings.Contains(target, t) {
+			best, field = 20, "url"
+		}
+		if best == 0 {
+			return 0, nil
+		}
+		score += best
+		found[field] = true
+	}
+	var matched []string
+	for _, f := range searchFields {
+		if found[f] {
+			matched = append(matched, f)
+		}
+	}
+	return score, matched
+}
+
+// matchTag reports whether term is one of tags or the start of one.
+func matchTag(term string, tags []string) bool {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchShortcut scores how well term matches shortcut: whole, as a prefix,
+// as a substring, or as a segment within a small edit distance.
+func matchShortcut(term, shortcut string) int {
+	key := strings.ToLower(store.Norm.Canonical(term))
+	switch {
+	case shortcut == key:
+		return 100
+	case strings.HasPrefix(shortcut, key):
+		return 80
+	case strings.Contains(shortcut, key):
+		return 60
+	}
+	// Short terms are within the edit distance of nearly everything.
+	if len([]rune(key)) < minFuzzySuggest {
+		return 0
+	}
+	maxDist := len([]rune(key)) / 4
+	if maxDist < 1 {
+		maxDist = 1
+	}
+	best := 0
+	for _, seg := range strings.FieldsFunc(shortcut, func(r rune) bool { return r == '/' || r == '-' || r == '_' }) {
+		if d := levenshtein(key, seg, maxDist); d <= maxDist && 40-10*d > best {
+			best = 40 - 10*d
+		}
+	}
+	return best
+}
@@ -0,0 +1,144 @@
+// Package httpapi serves redirects, the REST and gRPC APIs and the admin page
+// of the shortener.
+package httpapi
+
+import (
+	"net"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/resolver"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// Server serves redirects, the REST and gRPC APIs and the admin page for the
+// links of a cache. Links and Resolver are required; the other fields are
+// optional.
+type Server struct {
+	Links     *resolver.Cache
+	Resolver  *resolver.Resolver
+	Analytics *Analytics
+	// SlugLength is the length of random shortcuts, see SLUG_LENGTH.
+	SlugLength int
+	// LinkQuota caps the links a non-admin may own, see LINK_QUOTA.
+	LinkQuota int
+	// PreviewAll shows the preview page for every link, see PREVIEW_MODE.
+	PreviewAll bool
+	// SuffixCommands are the commands appended to shortcuts that are
+	// enabled, such as "+-!", see SUFFIX_COMMANDS and ParseSuffixCommands.
+	// Empty enables only "+".
+	SuffixCommands string
+	// FallbackURL is where unknown shortcuts redirect to, see FALLBACK_URL.
+	FallbackURL string
+	// RobotsTxt is served as /robots.txt, see ROBOTS_TXT_FILE; it defaults
+	// to DefaultRobotsTxt.
+	RobotsTxt string
+	// PublicNewLinks lets anyone claim missing shortcuts on the /new page,
+	// see PUBLIC_NEW_LINKS. Otherwise it needs write access like the admin
+	// page.
+	PublicNewLinks bool
+	// LinkApproval holds the links non-admins create, or point elsewhere,
+	// until an admin approves them, see LINK_APPROVAL.
+	LinkApproval bool
+
+	// Auth and PrivateNets decide who may resolve private links.
+	Auth        *Authenticator
+	PrivateNets []*net.IPNet
+	TrustProxy  bool
+	// Domains routes hosts to link namespaces, see DOMAINS.
+	Domains *resolver.Domains
+	// GeoIP and CountryHeader locate visitors for links with country
+	// variants, see GEOIP_DATABASE and GEOIP_COUNTRY_HEADER.
+	GeoIP         *GeoIP
+	CountryHeader string
+	// StickySplits keeps visitors on the same side of A/B splits with a
+	// cookie, see STICKY_SPLITS.
+	StickySplits bool
+	// CacheControl is the Cache-Control of redirects to links without one
+	// of their own, see REDIRECT_CACHE_CONTROL.
+	CacheControl string
+	// PermanentRedirects allows links to redirect with 301 and 308. Without
+	// it they get 302 and 307, since browsers and CDNs keep permanent
+	// redirects forever.
+	PermanentRedirects bool
+
+	// TrashRetention is how long deleted links stay in the trash, where
+	// they can be restored, see TRASH_RETENTION. Zero deletes links right
+	// away.
+	TrashRetention time.Duration
+	// MaxRequestBody caps the bodies of requests other than imports, see
+	// MAX_REQUEST_BODY. Zero means 1 MiB.
+	MaxRequestBody int64
+	// SnapshotDir, if set, keeps the snapshots of the whole link table
+	// taken and restored through /api/snapshots, see SNAPSHOT_DIR.
+	SnapshotDir string
+
+	// AccessLog, if set, logs every request for a shortcut, see
+	// ACCESS_LOG.
+	AccessLog *AccessLog
+	// AuditLog, if set, records every change to a link.
+	AuditLog store.AuditLog
+	// Checker, if set, finds links whose destination is gone.
+	Checker *resolver.LinkChecker
+	// Pages, if set, knows the titles and favicons of destinations, see
+	// PAGE_INFO_INTERVAL.
+	Pages *resolver.PageFetcher
+	// Access and APIAccess, if set, restrict which client addresses may
+	// use redirects and the API and admin page, see ALLOWED_CIDRS and
+	// API_ALLOWED_CIDRS.
+	Access    *IPAccess
+	APIAccess *IPAccess
+	// Limiter, if set, rate limits each client, see RATE_LIMIT_RPS.
+	Limiter *RateLimiter
+	// Webhooks, if set, are told about clicks, see WEBHOOK_URLS.
+	Webhooks *Webhooks
+	// Shadow, if set, repeats lookups against a second backend, see
+	// SHADOW_PROVIDER.
+	Shadow *resolver.Shadow
+
+	// Events, if set, streams link changes and clicks to admins through
+	// /api/events/stream. StreamTimeout ends the streams before the write
+	// timeout of the server does; clients reconnect and resume.
+	Events        *Events
+	StreamTimeout time.Duration
+
+	// Tenants, if set, are served apart from these links and managed
+	// through /api/tenants, see TENANTS_FILE.
+	Tenants *Tenants
+
+	// Mode, if set, switches maintenance and read-only mode at runtime,
+	// see MAINTENANCE_MODE, READ_ONLY and /api/mode.
+	Mode *Mode
+
+	// ProviderTimeout bounds the backend calls of API requests, see
+	// PROVIDER_TIMEOUT.
+	ProviderTimeout time.Duration
+
+	// ReadyMaxFailing is how long refreshes may fail before /readyz does.
+	ReadyMaxFailing time.Duration
+	// GoHostnames are the hostnames the PAC file of /tools sends to the
+	// server, see GO_HOSTNAMES; PACProxy is the proxy it names, such as
+	// "PROXY s.example.com:80", see PAC_PROXY. By default the PAC file
+	// sends go to the host it was fetched from.
+	GoHostnames []string
+	PACProxy    string
+	// SlackSecret enables /slack/command, see SLACK_SIGNING_SECRET.
+	SlackSecret string
+	// DebugEndpoints serves /debug/pprof/ and /debug/runtime to admins, see
+	// DEBUG_ENDPOINTS.
+	DebugEndpoints bool
+	// Version and Commit identify the build, and Backend names the
+	// provider, on the /status page.
+	Version, Commit string
+	Backend         string
+
+	// SigningKey signs the cookies that unlock password-protected links for
+	// UnlockTTL, see SIGNING_KEY and UNLOCK_TTL, and signed links. Without a
+	// key the password is asked on every visit and links can't be signed.
+	SigningKey []byte
+	UnlockTTL  time.Duration
+
+	// spent holds the one-time signed links already followed.
+	spent spentNonces
+	// budgets counts the clicks of links with a click budget.
+	budgets clickBudgets
+}
@@ -0,0 +1,2017 @@
+package httpapi
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/denizyoldas/url-shorter/resolver"
+	"github.com/denizyoldas/url-shorter/store"
+	"github.com/denizyoldas/url-shorter/store/storetest"
+)
+
+const testToken = "s3cr3t"
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testServer serves the links of p with testToken as the only admin token.
+type testServer struct {
+	*httptest.Server
+	t     testing.TB
+	srv   *Server
+	cache *resolver.Cache
+}
+
+// newTestServer serves the links of p, applying configure to the server
+// before its routes are registered.
+func newTestServer(t testing.TB, p *storetest.Provider, configure ...func(*Server)) *testServer {
+	t.Helper()
+	cache := resolver.NewCache(p, resolver.NewScheduler(time.Minute, time.Minute), nil)
+	auth, err := NewAuthenticator(testToken+":admin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Links:      cache,
+		Resolver:   resolver.NewResolver(cache, nil),
+		Analytics:  NewAnalytics(16, nil),
+		SlugLength: 6,
+		Auth:       auth,
+		SigningKey: []byte("test key"),
+
+		StickySplits: true,
+	}
+	for _, c := range configure {
+		c(s)
+	}
+	mux := http.NewServeMux()
+	s.Register(mux)
+	ts := &testServer{Server: httptest.NewServer(mux), t: t, srv: s, cache: cache}
+	t.Cleanup(ts.Close)
+	ts.refresh()
+	return ts
+}
+
+// refresh reloads the links, as Run would after a change.
+func (ts *testServer) refresh() {
+	ts.t.Helper()
+	if err := ts.cache.Refresh(context.Background()); err != nil {
+		ts.t.Fatalf("Refresh: %v", err)
+	}
+}
+
+// do sends a request with the given body and headers without following
+// redirects. A token of "" sends no Authorization header.
+func (ts *testServer) do(method, path, token, body string, header ...string) *http.Response {
+	ts.t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, r)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestRedirect(t *testing.T) {
+	p := storetest.New(map[string]string{
+		"go":   "https://go.dev/",
+		"docs": "https://docs.example.com/",
+	})
+	expired := storetest.Link("https://old.example.com/")
+	expired.Expires = time.Now().Add(-time.Hour)
+	p.Set("old", expired)
+	scheduled := storetest.Link("https://stream.example.com/")
+	scheduled.ActiveFrom = time.Now().Add(time.Hour)
+	p.Set("allhands", scheduled)
+	private := storetest.Link("https://hr.example.com/")
+	private.Private = true
+	p.Set("hr", private)
+	moved := storetest.Link("https://new.example.com/")
+	moved.Status = http.StatusMovedPermanently
+	p.Set("moved", moved)
+	ts := newTestServer(t, p)
+
+	tests := []struct {
+		path     string
+		token    string
+		status   int
+		location string
+	}{
+		{path: "/go", status: http.StatusFound, location: "https://go.dev/"},
+		{path: "/docs/a/b?x=1", status: http.StatusFound, location: "https://docs.example.com/a/b?x=1"},
+		// Permanent redirects are downgraded unless PermanentRedirects is set.
+		{path: "/moved", status: http.StatusFound, location: "https://new.example.com/"},
+		{path: "/missing", status: http.StatusNotFound},
+		{path: "/old", status: http.StatusGone},
+		// Links are unknown until their activation window opens.
+		{path: "/allhands", status: http.StatusNotFound},
+		{path: "/hr", status: http.StatusForbidden},
+		{path: "/hr", token: testToken, status: http.StatusFound, location: "https://hr.example.com/"},
+		{path: "/go+", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp := ts.do(http.MethodGet, tt.path, tt.token, "")
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s: status = %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+		if got := resp.Header.Get("Location"); got != tt.location {
+			t.Errorf("GET %s: Location = %q, want %q", tt.path, got, tt.location)
+		}
+	}
+}
+
+func TestSuffixCommands(t *testing.T) {
+	p := storetest.New(map[string]string{
+		"go":     "https://go.dev/",
+		"minus-": "https://minus.example.com/",
+	})
+	ts := newTestServer(t, p, func(s *Server) {
+		s.SuffixCommands = "+-!"
+		s.Auth, _ = NewAuthenticator(testToken+":admin;reader:read", nil)
+	})
+
+	resp := ts.do(http.MethodGet, "/go+", "", "", "Accept", "text/html")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "https://go.dev/") || strings.Contains(string(body), "Clicks") {
+		t.Errorf("GET /go+: status = %d, body = %s", resp.StatusCode, body)
+	}
+	resp = ts.do(http.MethodGet, "/go+", testToken, "", "Accept", "text/html")
+	if body, _ := io.ReadAll(resp.Body); !strings.Contains(string(body), "Clicks") {
+		t.Errorf("GET /go+ with a token: body = %s, want the clicks", body)
+	}
+
+	resp = ts.do(http.MethodGet, "/go-", "", "")
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "https://go.dev/\n" {
+		t.Errorf("GET /go-: status = %d, body = %q", resp.StatusCode, body)
+	}
+	// A shortcut ending in '-' wins over the command.
+	if resp := ts.do(http.MethodGet, "/minus-", "", ""); resp.Header.Get("Location") != "https://minus.example.com/" {
+		t.Errorf("GET /minus-: Location = %q", resp.Header.Get("Location"))
+	}
+
+	p.Set("go", storetest.Link("https://go.dev/doc/"))
+	if resp := ts.do(http.MethodGet, "/go!", "", ""); resp.Header.Get("Location") != "https://go.dev/" {
+		t.Errorf("GET /go! without a token: Location = %q, want the cached destination", resp.Header.Get("Location"))
+	}
+	if resp := ts.do(http.MethodGet, "/go!", "reader", ""); resp.Header.Get("Location") != "https://go.dev/" {
+		t.Errorf("GET /go! with a read token: Location = %q, want the cached destination", resp.Header.Get("Location"))
+	}
+	if resp := ts.do(http.MethodGet, "/go!", testToken, ""); resp.Header.Get("Location") != "https://go.dev/doc/" {
+		t.Errorf("GET /go!: Location = %q, want the reloaded destination", resp.Header.Get("Location"))
+	}
+
+	ts.srv.SuffixCommands = "none"
+	if resp := ts.do(http.MethodGet, "/go+", "", ""); resp.StatusCode == http.StatusOK {
+		t.Errorf("GET /go+ with suffix commands disabled: status = %d, want no preview", resp.StatusCode)
+	}
+
+	if _, err := ParseSuffixCommands("+?"); err == nil {
+		t.Error(`ParseSuffixCommands("+?") succeeded`)
+	}
+	if got, err := ParseSuffixCommands("+, !, +"); err != nil || got != "+!" {
+		t.Errorf(`ParseSuffixCommands("+, !, +") = %q, %v`, got, err)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	p := storetest.New(map[string]string{"go": "https://go.dev/"})
+	ts := newTestServer(t, p, func(s *Server) { s.MaxRequestBody = 64 })
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete, http.MethodPost} {
+		resp := ts.do(method, "/go", "", "")
+		if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, HEAD" {
+			t.Errorf("%s /go: status = %d, Allow = %q, want 405", method, resp.StatusCode, resp.Header.Get("Allow"))
+		}
+	}
+
+	resp := ts.do(http.MethodHead, "/go", "", "")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "https://go.dev/" || len(body) != 0 {
+		t.Errorf("HEAD /go: status = %d, Location = %q, %d bytes", resp.StatusCode, resp.Header.Get("Location"), len(body))
+	}
+	if stats, err := ts.srv.Analytics.Stats(context.Background(), "go"); err != nil || stats.Total != 0 {
+		t.Errorf("clicks after HEAD = %v, %v, want none", stats, err)
+	}
+
+	large := strings.Repeat("x", 100)
+	if resp := ts.do(http.MethodGet, "/go", "", large); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("GET /go with a large body: status = %d, want 413", resp.StatusCode)
+	}
+	create := `{"shortcut":"fresh","url":"https://new.example.com/","description":"` + large + `"}`
+	if resp := ts.do(http.MethodPost, "/api/links", testToken, create); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST /api/links with a large body: status = %d, want 413", resp.StatusCode)
+	}
+	// gRPC messages are framed, so their limit is checked on the frame.
+	frame := append([]byte{0, 0, 0, 0, byte(len(large))}, large...)
+	_, err := readGRPCMessage(bytes.NewReader(frame), ts.srv.maxBody())
+	if code, _ := grpcStatus(err); code != grpcResourceExhausted {
+		t.Errorf("gRPC message of %d bytes: %v, want RESOURCE_EXHAUSTED", len(large), err)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	accessLog, err := NewAccessLog(path, "", 150, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := storetest.New(map[string]string{"go": "https://go.dev/"})
+	ts := newTestServer(t, p, func(s *Server) { s.AccessLog = accessLog })
+
+	ts.do(http.MethodGet, "/go?q=1", "", "", "Referer", `https://ref.example.com/"x`, "User-Agent", "test-agent")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := string(b)
+	for _, want := range []string{`127.0.0.1 - - [`, `] "GET /go?q=1 HTTP/1.1" 302 `, ` "https://ref.example.com/\"x" "test-agent"` + "\n"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("access log %q lacks %q", line, want)
+		}
+	}
+
+	// Each line is over half the size limit, so every new one rotates.
+	ts.do(http.MethodGet, "/missing", "", "")
+	ts.do(http.MethodGet, "/go", "", "")
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if b, err := os.ReadFile(name); err != nil || strings.Count(string(b), "\n") != 1 {
+			t.Errorf("%s = %q, %v, want a line", filepath.Base(name), b, err)
+		}
+	}
+	if b, _ := os.ReadFile(path + ".1"); !strings.Contains(string(b), `"GET /missing HTTP/1.1" 404 `) {
+		t.Errorf("access.log.1 = %q, want the 404", b)
+	}
+
+	jsonLog, err := NewAccessLog(filepath.Join(t.TempDir(), "access.json"), AccessLogJSON, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e accessEntry
+	if err := json.Unmarshal(jsonLog.line(accessEntry{Method: "GET", URI: "/go", Status: 302}), &e); err != nil || e.URI != "/go" || e.Status != 302 {
+		t.Errorf("JSON line = %+v, %v", e, err)
+	}
+}
+
+func TestCreateLink(t *testing.T) {
+	p := storetest.New(map[string]string{"taken": "https://x.example.com/"})
+	ts := newTestServer(t, p)
+	reserved, err := resolver.NewReservedWords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.cache.Reserved = reserved
+	if ts.cache.Destinations, err = resolver.NewDestinationPolicy(nil, "s.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		body   string
+		status int
+	}{
+		{name: "no token", body: `{"shortcut":"fresh","url":"https://new.example.com/"}`, status: http.StatusUnauthorized},
+		{name: "wrong token", token: "nope", body: `{"shortcut":"fresh","url":"https://new.example.com/"}`, status: http.StatusUnauthorized},
+		{name: "created", token: testToken, body: `{"shortcut":"Fresh","url":"https://new.example.com/"}`, status: http.StatusCreated},
+		{name: "random slug", token: testToken, body: `{"url":"https://new.example.com/"}`, status: http.StatusCreated},
+		{name: "taken", token: testToken, body: `{"shortcut":"taken","url":"https://y.example.com/"}`, status: http.StatusConflict},
+		{name: "invalid URL", token: testToken, body: `{"shortcut":"bad","url":"ftp://x"}`, status: http.StatusBadRequest},
+		{name: "invalid shortcut", token: testToken, body: `{"shortcut":"a b","url":"https://x.example.com/"}`, status: http.StatusBadRequest},
+		{name: "unknown field", token: testToken, body: `{"shortcut":"u","url":"https://x.example.com/","colour":"red"}`, status: http.StatusBadRequest},
+		{name: "window", token: testToken, body: `{"shortcut":"allhands","url":"https://x.example.com/","active_from":"2030-01-01T09:00:00Z","active_until":"2030-01-01T10:00:00Z"}`, status: http.StatusCreated},
+		{name: "empty window", token: testToken, body: `{"shortcut":"w","url":"https://x.example.com/","active_from":"2030-01-01T10:00:00Z","active_until":"2030-01-01T09:00:00Z"}`, status: http.StatusBadRequest},
+		{name: "expires twice", token: testToken, body: `{"shortcut":"w","url":"https://x.example.com/","expires_at":"2030-01-01T10:00:00Z","active_until":"2030-01-01T10:00:00Z"}`, status: http.StatusBadRequest},
+		{name: "reserved", token: testToken, body: `{"shortcut":"api","url":"https://x.example.com/"}`, status: http.StatusBadRequest},
+		{name: "loop", token: testToken, body: `{"shortcut":"loop","url":"https://S.example.com/other"}`, status: http.StatusBadRequest},
+		{name: "text", token: testToken, body: `{"shortcut":"wifi","type":"text","content":"Guest / hunter2"}`, status: http.StatusCreated},
+		{name: "text without content", token: testToken, body: `{"shortcut":"empty","type":"text"}`, status: http.StatusBadRequest},
+		{name: "text with url", token: testToken, body: `{"shortcut":"both","type":"text","content":"x","url":"https://x.example.com/"}`, status: http.StatusBadRequest},
+		{name: "unknown type", token: testToken, body: `{"shortcut":"pdf","type":"pdf","content":"x"}`, status: http.StatusBadRequest},
+		{name: "unicode", token: testToken, body: `{"shortcut":"Çay/日本語","url":"https://bücher.example/"}`, status: http.StatusCreated},
+		{name: "invalid IDN host", token: testToken, body: `{"shortcut":"idn","url":"https://a\u200db.example/"}`, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		resp := ts.do(http.MethodPost, "/api/links", tt.token, tt.body)
+		if resp.StatusCode != tt.status {
+			b, _ := io.ReadAll(resp.Body)
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, resp.StatusCode, tt.status, b)
+		}
+	}
+
+	ts.refresh()
+	if resp := ts.do(http.MethodGet, "/fresh", "", ""); resp.Header.Get("Location") != "https://new.example.com/" {
+		t.Errorf("created link redirects to %q", resp.Header.Get("Location"))
+	}
+	if resp := ts.do(http.MethodGet, "/%C3%A7ay/%E6%97%A5%E6%9C%AC%E8%AA%9E", "", ""); resp.Header.Get("Location") != "https://xn--bcher-kva.example/" {
+		t.Errorf("unicode link redirects to %q", resp.Header.Get("Location"))
+	}
+}
+
+func TestMode(t *testing.T) {
+	p := storetest.New(map[string]string{"go": "https://go.dev/"})
+	ts := newTestServer(t, p, func(s *Server) { s.Mode = &Mode{RetryAfter: time.Minute} })
+	create := `{"shortcut":"fresh","url":"https://new.example.com/"}`
+
+	if resp := ts.do(http.MethodPost, "/api/mode", "", `{"maintenance":true}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous POST /api/mode: status = %d", resp.StatusCode)
+	}
+
+	ts.do(http.MethodPost, "/api/mode", testToken, `{"read_only":true}`)
+	if resp := ts.do(http.MethodPost, "/api/links", testToken, create); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "60" {
+		t.Errorf("read-only create: status = %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if resp := ts.do(http.MethodDelete, "/api/links/go", testToken, ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("read-only delete: status = %d", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodGet, "/api/links/go", testToken, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("read-only get: status = %d", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodGet, "/go", "", ""); resp.StatusCode != http.StatusFound {
+		t.Errorf("read-only redirect: status = %d", resp.StatusCode)
+	}
+
+	ts.do(http.MethodPost, "/api/mode", testToken, `{"maintenance":true,"message":"Moving to Postgres"}`)
+	resp := ts.do(http.MethodGet, "/go", "", "", "Accept", "text/html")
+	if b, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(b), "Moving to Postgres") ||
+		resp.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("maintenance redirect: status = %d, Cache-Control %q: %s", resp.StatusCode, resp.Header.Get("Cache-Control"), b)
+	}
+
+	resp = ts.do(http.MethodPost, "/api/mode", testToken, `{"maintenance":false,"read_only":false}`)
+	var state struct {
+		Maintenance bool
+		ReadOnly    bool `json:"read_only"`
+		Message     string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil || state.Maintenance || state.ReadOnly || state.Message != "Moving to Postgres" {
+		t.Errorf("mode = %+v, %v", state, err)
+	}
+	if resp := ts.do(http.MethodGet, "/go", "", ""); resp.StatusCode != http.StatusFound {
+		t.Errorf("redirect after maintenance: status = %d", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodPost, "/api/links", testToken, create); resp.StatusCode != http.StatusCreated {
+		t.Errorf("create after read-only: status = %d", resp.StatusCode)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	p := storetest.New(map[string]string{
+		"docs":     "https://Docs.example.com/",
+		"doc":      "http://docs.example.com:80?utm_source=wiki",
+		"manual":   "https://docs.example.com/#top",
+		"go":       "https://go.dev/",
+		"golang":   "https://go.dev",
+		"gopher":   "https://go.dev/?b=2&a=1",
+		"gopher2":  "https://go.dev/?a=1&b=2",
+		"secret":   "https://go.dev/",
+		"unrelate": "https://other.example.com/",
+	})
+	secret := storetest.Link("https://go.dev/")
+	secret.Private = true
+	p.Set("secret", secret)
+	ts := newTestServer(t, p)
+
+	var got []duplicateGroup
+	resp := ts.do(http.MethodGet, "/api/links/duplicates", testToken, "")
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := []duplicateGroup{
+		{Destination: "https://go.dev/", Shortcuts: []string{"go", "golang", "secret"}},
+		{Destination: "http://docs.example.com:80?utm_source=wiki", Shortcuts: []string{"doc", "docs"}},
+		{Destination: "https://go.dev/?b=2&a=1", Shortcuts: []string{"gopher", "gopher2"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("duplicates = %+v, want %+v", got, want)
+	}
+
+	resp = ts.do(http.MethodGet, "/api/links/duplicates?url="+url.QueryEscape("https://other.example.com"), testToken, "")
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil || len(got) != 1 || !reflect.DeepEqual(got[0].Shortcuts, []string{"unrelate"}) {
+		t.Errorf("duplicates of other.example.com = %+v, %v", got, err)
+	}
+}
+
+func TestNewLinkPage(t *testing.T) {
+	p := storetest.New(map[string]string{"taken": "https://x.example.com/"})
+	ts := newTestServer(t, p, func(s *Server) { s.PublicNewLinks = true })
+	form := "application/x-www-form-urlencoded"
+
+	resp := ts.do(http.MethodGet, "/new?shortcut=taken", "", "")
+	if b, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || !strings.Contains(string(b), "is taken already") {
+		t.Errorf("GET taken: status = %d, body %s", resp.StatusCode, b)
+	}
+	resp = ts.do(http.MethodPost, "/new", "", "shortcut=mine&url=https://x.example.com/", "Content-Type", form)
+	if b, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || !strings.Contains(string(b), "Create anyway") {
+		t.Errorf("duplicate URL: status = %d, want a confirmation: %s", resp.StatusCode, b)
+	}
+	resp = ts.do(http.MethodPost, "/new", "", "shortcut=mine&url=https://x.example.com/&confirm=true", "Content-Type", form)
+	if loc := resp.Header.Get("Location"); resp.StatusCode != http.StatusSeeOther || loc != "/mine+" {
+		t.Errorf("confirmed: status = %d, Location = %q", resp.StatusCode, loc)
+	}
+	if l, _ := p.Get(context.Background(), "mine"); l == nil {
+		t.Error("mine was not created")
+	}
+	resp = ts.do(http.MethodPost, "/new", "", "shortcut=taken&url=https://y.example.com/", "Content-Type", form)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("taken: status = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	resp = ts.do(http.MethodPost, "/new", "", "shortcut=evil&url=https://evil.example.com/",
+		"Content-Type", form, "Origin", "https://evil.example.com")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("cross-origin: status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	ts = newTestServer(t, p)
+	if resp := ts.do(http.MethodGet, "/new", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without PUBLIC_NEW_LINKS: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestContentLink(t *testing.T) {
+	p := storetest.New(nil)
+	for k, typ := range map[string]string{"wifi": store.TypeText, "howto": store.TypeMarkdown, "cmd": store.TypeSnippet} {
+		l, err := store.NewLink(typ, "Step 1 <script>alert(1)</script>\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Set(k, l)
+	}
+	ts := newTestServer(t, p)
+
+	resp := ts.do(http.MethodGet, "/wifi/ignored", "", "")
+	if b, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(b) != "Step 1 <script>alert(1)</script>\n" {
+		t.Errorf("plain text: %d %q", resp.StatusCode, b)
+	}
+	for _, path := range []string{"/wifi", "/howto", "/cmd", "/cmd+"} {
+		resp := ts.do(http.MethodGet, path, "", "", "Accept", "text/html")
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(b), "Step 1") || strings.Contains(string(b), "<script>") {
+			t.Errorf("GET %s: %d, want the escaped content:\n%s", path, resp.StatusCode, b)
+		}
+	}
+}
+
+func TestUpdateLinkRevision(t *testing.T) {
+	p := storetest.New(map[string]string{"go": "https://go.dev/"})
+	ts := newTestServer(t, p)
+
+	resp := ts.do(http.MethodGet, "/api/links/go", testToken, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET: status = %d", resp.StatusCode)
+	}
+	etag := resp.Header.Get("ETag")
+	var got apiLink
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Shortcut != "go" || got.URL != "https://go.dev/" {
+		t.Errorf("GET = %+v", got)
+	}
+
+	body := `{"url":"https://golang.org/"}`
+	if resp := ts.do(http.MethodPut, "/api/links/go", testToken, body, "If-Match", `"stale"`); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PUT with a stale If-Match: status = %d", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodPut, "/api/links/go", testToken, body, "If-Match", etag); resp.StatusCode != http.StatusOK {
+		t.Errorf("PUT with the current If-Match: status = %d", resp.StatusCode)
+	}
+	// The revision moved on with the update.
+	if resp := ts.do(http.MethodPatch, "/api/links/go", testToken, `{"private":true}`, "If-Match", etag); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PATCH with the old If-Match: status = %d", resp.StatusCode)
+	}
+
+	if resp := ts.do(http.MethodDelete, "/api/links/go", testToken, ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE: status = %d", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodDelete, "/api/links/go", testToken, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second DELETE: status = %d", resp.StatusCode)
+	}
+}
+
+func TestPasswordProtected(t *testing.T) {
+	p := storetest.New(nil)
+	secret := storetest.Link("https://docs.example.com/secret")
+	secret.Password = "hunter2"
+	p.Set("secret", secret)
+	ts := newTestServer(t, p)
+
+	form := "application/x-www-form-urlencoded"
+	if resp := ts.do(http.MethodGet, "/secret", "", "", "Accept", "text/html"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET: status = %d, want the password form", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodPost, "/secret", "", "password=nope", "Content-Type", form); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("POST with a wrong password: status = %d", resp.StatusCode)
+	}
+
+	resp := ts.do(http.MethodPost, "/secret", "", "password=hunter2", "Content-Type", form)
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "https://docs.example.com/secret" {
+		t.Fatalf("POST with the password: status = %d, Location = %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	cookies := resp.Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got cookies %v, want an unlock cookie", cookies)
+	}
+	cookie := cookies[0].Name + "=" + cookies[0].Value
+	if resp := ts.do(http.MethodGet, "/secret", "", "", "Cookie", cookie); resp.StatusCode != http.StatusFound {
+		t.Errorf("GET with the cookie: status = %d", resp.StatusCode)
+	}
+	// X-Forwarded-Proto only counts from a trusted proxy.
+	for _, trust := range []bool{false, true} {
+		ts.srv.TrustProxy = trust
+		resp := ts.do(http.MethodPost, "/secret", "", "password=hunter2", "Content-Type", form, "X-Forwarded-Proto", "https")
+		if c := resp.Cookies(); len(c) != 1 || c[0].Secure != trust {
+			t.Errorf("POST over https with TrustProxy %v: cookies %v, want Secure %v", trust, c, trust)
+		}
+	}
+	ts.srv.TrustProxy = false
+	forged := cookies[0].Name + "=" + strings.Replace(cookies[0].Value, ".", ".0", 1)
+	if resp := ts.do(http.MethodGet, "/secret", "", "", "Cookie", forged); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET with a forged cookie: status = %d", resp.StatusCode)
+	}
+
+	// A new password locks the link again.
+	secret2 := storetest.Link("https://docs.example.com/secret")
+	secret2.Password = "correct horse"
+	p.Set("secret", secret2)
+	ts.refresh()
+	if resp := ts.do(http.MethodGet, "/secret", "", "", "Cookie", cookie); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET with a cookie of the old password: status = %d", resp.StatusCode)
+	}
+
+	// The API hides the password but keeps it across updates.
+	resp = ts.do(http.MethodGet, "/api/links/secret", testToken, "")
+	var got map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got["password"]; ok || got["protected"] != true {
+		t.Errorf("GET /api/links/secret = %v", got)
+	}
+	if resp := ts.do(http.MethodPatch, "/api/links/secret", testToken, `{"preview":true}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PATCH: status = %d", resp.StatusCode)
+	}
+	if l, _ := p.Get(context.Background(), "secret"); l.Password != "correct horse" {
+		t.Errorf("password after PATCH = %q", l.Password)
+	}
+	if resp := ts.do(http.MethodPatch, "/api/links/secret", testToken, `{"password":null}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PATCH: status = %d", resp.StatusCode)
+	}
+	if l, _ := p.Get(context.Background(), "secret"); l.Password != "" {
+		t.Errorf("password after resetting it = %q", l.Password)
+	}
+}
+
+func TestSignedLinks(t *testing.T) {
+	p := storetest.New(nil)
+	secret := storetest.Link("https://docs.example.com/secret")
+	secret.Private = true
+	secret.Password = "hunter2"
+	p.Set("secret", secret)
+	ts := newTestServer(t, p)
+	ts.refresh()
+
+	sign := func(body string) string {
+		t.Helper()
+		resp := ts.do(http.MethodPost, "/api/links/secret/sign", testToken, body)
+		var out signResponse
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("sign %s: status = %d, err = %v", body, resp.StatusCode, err)
+		}
+		u, err := url.Parse(out.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.RequestURI()
+	}
+
+	if resp := ts.do(http.MethodGet, "/secret", "", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("unsigned: status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	path := sign(`{"ttl":"1h"}`)
+	for i := 0; i < 2; i++ {
+		resp := ts.do(http.MethodGet, path+"&lang=de", "", "")
+		if loc := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || loc != "https://docs.example.com/secret?lang=de" {
+			t.Errorf("signed visit %d: status = %d, Location = %q", i, resp.StatusCode, loc)
+		}
+	}
+	if resp := ts.do(http.MethodGet, strings.Replace(path, "exp=", "exp=1", 1), "", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("tampered expiry: status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	once := sign(`{"once":true}`)
+	// Link checkers, crawlers and previews don't spend it.
+	if resp := ts.do(http.MethodHead, once, "", ""); resp.StatusCode != http.StatusFound {
+		t.Errorf("one-time link HEAD: status = %d", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodGet, once, "", "", "User-Agent", "Slackbot-LinkExpanding 1.0"); resp.StatusCode != http.StatusFound {
+		t.Errorf("one-time link unfurled: status = %d", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodGet, strings.Replace(once, "?", "+?", 1), "", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("one-time link previewed: status = %d", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodGet, once, "", ""); resp.StatusCode != http.StatusFound {
+		t.Errorf("one-time link: status = %d", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodGet, once, "", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("one-time link followed again: status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	for _, body := range []string{`{"ttl":"-1h"}`, `{"ttl":"1000h"}`, `{"ttl":"1h","expires_at":"2030-01-01T00:00:00Z"}`} {
+		if resp := ts.do(http.MethodPost, "/api/links/secret/sign", testToken, body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("sign %s: status = %d, want %d", body, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+	if resp := ts.do(http.MethodPost, "/api/links/secret/sign", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("sign without a token: status = %d", resp.StatusCode)
+	}
+}
+
+func TestVisitor(t *testing.T) {
+	tests := []struct {
+		ua, lang string
+		devices  []string
+		language string
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148", "de-DE,de;q=0.9,en;q=0.8", []string{"ios", "mobile"}, "de"},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) Mobile Safari/537.36", "en;q=0.5, fr-CA", []string{"android", "mobile"}, "fr"},
+		{"Mozilla/5.0 (X11; Linux x86_64) Firefox/125.0", "*", []string{"desktop"}, ""},
+		{"", "", nil, ""},
+	}
+	s := &Server{CountryHeader: "CF-IPCountry"}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/app", nil)
+		req.Header.Set("User-Agent", tt.ua)
+		req.Header.Set("Accept-Language", tt.lang)
+		req.Header.Set("CF-IPCountry", "de")
+		v := s.visitor(req)
+		if strings.Join(v.Devices, ",") != strings.Join(tt.devices, ",") || v.Language != tt.language || v.Country != "DE" {
+			t.Errorf("visitor(%q, %q) = %+v", tt.ua, tt.lang, v)
+		}
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+	p := storetest.New(map[string]string{"go": "https://go.dev/"})
+	own := storetest.Link("https://own.example.com/")
+	own.CacheControl = "public, max-age=86400"
+	p.Set("own", own)
+	soon := storetest.Link("https://soon.example.com/")
+	soon.CacheControl = "public, max-age=86400"
+	soon.Expires = time.Now().Add(10 * time.Minute)
+	p.Set("soon", soon)
+	private := storetest.Link("https://hr.example.com/")
+	private.Private = true
+	p.Set("hr", private)
+	split := storetest.Link("https://example.com/a")
+	b := storetest.Link("https://example.com/b")
+	b.When = &store.Condition{Weight: 50}
+	split.Variants = []*store.Link{b}
+	p.Set("lp", split)
+	ts := newTestServer(t, p)
+	ts.srv.CacheControl = "public, max-age=60, s-maxage=300"
+
+	tests := []struct {
+		path, token, want string
+	}{
+		{path: "/go", want: "public, max-age=60, s-maxage=300"},
+		{path: "/own", want: "public, max-age=86400"},
+		{path: "/hr", token: testToken, want: "private, no-store"},
+		{path: "/lp", want: "private, max-age=60"},
+	}
+	for _, tt := range tests {
+		resp := ts.do(http.MethodGet, tt.path, tt.token, "")
+		if got := resp.Header.Get("Cache-Control"); got != tt.want {
+			t.Errorf("GET %s: Cache-Control = %q, want %q", tt.path, got, tt.want)
+		}
+		if resp.Header.Get("Expires") == "" {
+			t.Errorf("GET %s: no Expires", tt.path)
+		}
+	}
+
+	// Caches don't keep a link past its expiry.
+	resp := ts.do(http.MethodGet, "/soon", "", "")
+	var maxAge int
+	if _, err := fmt.Sscanf(resp.Header.Get("Cache-Control"), "public, max-age=%d", &maxAge); err != nil || maxAge > 600 || maxAge < 590 {
+		t.Errorf("Cache-Control = %q, want a max-age up to the expiry", resp.Header.Get("Cache-Control"))
+	}
+
+	p.Set("moved", &store.Link{URL: own.URL, Status: http.StatusPermanentRedirect})
+	ts.refresh()
+	ts.srv.PermanentRedirects = true
+	if resp := ts.do(http.MethodGet, "/moved", "", ""); resp.StatusCode != http.StatusPermanentRedirect {
+		t.Errorf("PermanentRedirects: status = %d, want 308", resp.StatusCode)
+	}
+}
+
+func TestSplitRedirect(t *testing.T) {
+	p := storetest.New(nil)
+	lp := storetest.Link("https://example.com/a")
+	b := storetest.Link("https://example.com/b")
+	b.When = &store.Condition{Weight: 50}
+	lp.Variants = []*store.Link{b}
+	p.Set("lp", lp)
+	ts := newTestServer(t, p)
+
+	// A returning visitor keeps their destination.
+	resp := ts.do(http.MethodGet, "/lp", "", "")
+	var cookie string
+	for _, c := range resp.Cookies() {
+		if c.Name == visitorCookie {
+			cookie = c.Name + "=" + c.Value
+		}
+	}
+	if cookie == "" {
+		t.Fatal("no visitor cookie on a split link")
+	}
+	first := resp.Header.Get("Location")
+	for i := 0; i < 5; i++ {
+		resp := ts.do(http.MethodGet, "/lp", "", "", "Cookie", cookie)
+		if got := resp.Header.Get("Location"); got != first {
+			t.Fatalf("returning visitor went to %s, then %s", first, got)
+		}
+		if len(resp.Cookies()) > 0 {
+			t.Errorf("visitor cookie set again: %v", resp.Cookies())
+		}
+	}
+	for i := 0; i < 40; i++ {
+		ts.do(http.MethodGet, "/lp", "", "")
+	}
+
+	resp = ts.do(http.MethodGet, "/api/links/lp/stats", testToken, "")
+	var stats statsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Destinations) != 2 {
+		t.Fatalf("destinations = %+v, want both sides of the split", stats.Destinations)
+	}
+	if d := stats.Destinations; d[0].Hits+d[1].Hits != stats.Total || math.Abs(d[0].Share+d[1].Share-100) > 0.01 {
+		t.Errorf("destinations = %+v don't add up to the %d clicks", d, stats.Total)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	p := storetest.New(map[string]string{
+		"go":       "https://go.dev/",
+		"golf":     "https://golf.example.com/",
+		"jira/*":   "https://jira.example.com/{1}",
+		"calendar": "https://cal.example.com/",
+	})
+	private := storetest.Link("https://hr.example.com/")
+	private.Private = true
+	p.Set("gossip", private)
+	protected := storetest.Link("https://golden.example.com/handshake")
+	protected.Password = "hunter2"
+	p.Set("gold", protected)
+	ts := newTestServer(t, p)
+
+	resp := ts.do(http.MethodGet, "/api/suggest?q=go", "", "")
+	var got []interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 || got[0] != "go" {
+		t.Fatalf("suggest = %v", got)
+	}
+	shortcuts, _ := got[1].([]interface{})
+	want := map[interface{}]bool{"go": true, "golf": true, "gold": true}
+	if len(shortcuts) != len(want) {
+		t.Errorf("suggested %v, want go, golf and gold", shortcuts)
+	}
+	// Password-protected links are suggested without their destination.
+	if descriptions := fmt.Sprint(got[2]); strings.Contains(descriptions, "golden.example.com") {
+		t.Errorf("descriptions %s reveal the destination of gold", descriptions)
+	}
+	for _, s := range shortcuts {
+		if !want[s] {
+			t.Errorf("unexpected suggestion %v", s)
+		}
+	}
+}
+
+func TestSuggestionsBounded(t *testing.T) {
+	for _, tt := range []struct {
+		a, b      string
+		max, want int
+	}{
+		{"kitten", "sitting", 5, 3},
+		{"kitten", "sitting", 2, 3},
+		{strings.Repeat("a", 10000), "a", 2, 3},
+		{"abcdef", "ghijkl", 2, 3},
+	} {
+		if got := levenshtein(tt.a, tt.b, tt.max); got != tt.want {
+			t.Errorf("levenshtein(%.10q, %q, %d) = %d, want %d", tt.a, tt.b, tt.max, got, tt.want)
+		}
+	}
+
+	// Long paths are compared by their first runes only.
+	all := store.URLMap{"calendar": storetest.Link("https://cal.example.com/")}
+	if got := suggestions("calendr"+strings.Repeat("x", 100000), all, 5); len(got) != 0 {
+		t.Errorf("suggestions for a long query = %q", got)
+	}
+	if got := suggestions("calendr", all, 5); len(got) != 1 {
+		t.Errorf("suggestions for calendr = %q, want calendar", got)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	p := storetest.New(map[string]string{
+		"oncall":      "https://pager.example.com/schedule",
+		"oncall-docs": "https://wiki.example.com/oncall",
+		"calendar":    "https://cal.example.com/",
+		"vpn":         "https://it.example.com/vpn-setup",
+	})
+	runbook := storetest.Link("https://wiki.example.com/runbooks")
+	runbook.Description = "Incident runbooks for the on-call rotation"
+	runbook.Tags = []string{"oncall", "sre"}
+	p.Set("runbooks", runbook)
+	ts := newTestServer(t, p)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"oncall", []string{"oncall", "oncall-docs", "runbooks"}},
+		{"sre&fields=tags", []string{"runbooks"}},
+		{"calender", []string{"calendar"}},
+		{"incident rotation", []string{"runbooks"}},
+		{"wiki", []string{"oncall-docs", "runbooks"}},
+		{"wiki&fields=shortcut,description", nil},
+		{"vpn setup", []string{"vpn"}},
+	}
+	for _, tt := range tests {
+		resp := ts.do(http.MethodGet, "/api/search?q="+strings.ReplaceAll(tt.query, " ", "+"), testToken, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("search %q: status = %d", tt.query, resp.StatusCode)
+			continue
+		}
+		var got searchResponse
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		var shortcuts []string
+		for _, r := range got.Results {
+			shortcuts = append(shortcuts, r.Shortcut)
+		}
+		if !reflect.DeepEqual(shortcuts, tt.want) {
+			t.Errorf("search %q = %q, want %q", tt.query, shortcuts, tt.want)
+		}
+	}
+
+	if resp := ts.do(http.MethodGet, "/api/search?q=", testToken, ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("empty query: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestComplete(t *testing.T) {
+	p := storetest.New(map[string]string{
+		"docs":   "https://docs.example.com/",
+		"doc":    "https://doc.example.com/",
+		"dogs":   "https://dogs.example.com/",
+		"go":     "https://go.dev/",
+		"do/*":   "https://do.example.com/{1}",
+		"design": "https://design.example.com/",
+	})
+	private := storetest.Link("https://hr.example.com/dossier")
+	private.Private = true
+	p.Set("dossier", private)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	ts := newTestServer(t, p, func(s *Server) { s.PrivateNets = []*net.IPNet{loopback} })
+
+	complete := func(query string, header ...string) []string {
+		t.Helper()
+		resp := ts.do(http.MethodGet, "/api/complete?"+query, "", "", header...)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET ?%s: status = %d", query, resp.StatusCode)
+		}
+		var got completeResponse
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		shortcuts := []string{}
+		for _, c := range got.Completions {
+			shortcuts = append(shortcuts, c.Shortcut)
+		}
+		return shortcuts
+	}
+	for _, tt := range []struct {
+		query  string
+		header []string
+		want   []string
+	}{
+		{"prefix=DO", nil, []string{"doc", "docs", "dogs", "dossier"}},
+		{"prefix=do&limit=2", nil, []string{"doc", "docs"}},
+		{"prefix=doc", nil, []string{"doc", "docs"}},
+		{"prefix=x", nil, []string{}},
+		{"prefix=", nil, []string{}},
+		// Pages of other sites don't learn private shortcuts.
+		{"prefix=do", []string{"Origin", "https://evil.example"}, []string{"doc", "docs", "dogs"}},
+	} {
+		if got := complete(tt.query, tt.header...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GET ?%s = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+	if resp := ts.do(http.MethodGet, "/api/complete?prefix=do&limit=100", "", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("limit=100: status = %d, want 400", resp.StatusCode)
+	}
+
+	// Password-protected links are completed without their destination.
+	protected := storetest.Link("https://vault.example.com/door")
+	protected.Password = "hunter2"
+	p.Set("door", protected)
+	ts.refresh()
+	var got completeResponse
+	if err := json.NewDecoder(ts.do(http.MethodGet, "/api/complete?prefix=doo", "", "").Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Completions) != 1 || got.Completions[0].Shortcut != "door" || got.Completions[0].Target != "" {
+		t.Errorf("completions = %+v, want door without its target", got.Completions)
+	}
+}
+
+func TestListLinksByTag(t *testing.T) {
+	p := storetest.New(map[string]string{"vpn": "https://it.example.com/vpn"})
+	ts := newTestServer(t, p)
+
+	body := `{"shortcut": "pager", "url": "https://pager.example.com/", "tags": ["OnCall", " sre ", "oncall"]}`
+	if resp := ts.do(http.MethodPost, "/api/links", testToken, body); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST: status = %d", resp.StatusCode)
+	}
+	ts.refresh()
+	resp := ts.do(http.MethodGet, "/api/links?tag=oncall", testToken, "")
+	var got []linkListEntry
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Shortcut != "pager" {
+		t.Fatalf("GET ?tag=oncall = %+v, want only pager", got)
+	}
+	if want := []string{"oncall", "sre"}; !reflect.DeepEqual(got[0].Tags, want) {
+		t.Errorf("tags = %q, want %q", got[0].Tags, want)
+	}
+}
+
+func TestListLinksPagination(t *testing.T) {
+	ts := newTestServer(t, storetest.New(map[string]string{
+		"a": "https://a.example.com/",
+		"b": "https://b.example.com/",
+		"c": "https://c.example.com/",
+		"d": "https://d.example.com/",
+		"e": "https://e.example.com/",
+	}))
+
+	resp := ts.do(http.MethodGet, "/api/links?sort=-shortcut&per_page=2&page=2", testToken, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	var got []linkListEntry
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Shortcut != "c" || got[1].Shortcut != "b" {
+		t.Fatalf("page 2 = %+v, want c and b", got)
+	}
+	if total := resp.Header.Get("X-Total-Count"); total != "5" {
+		t.Errorf("X-Total-Count = %q, want 5", total)
+	}
+	link := resp.Header.Get("Link")
+	for _, want := range []string{`page=1&per_page=2&sort=-shortcut>; rel="prev"`, `page=3&per_page=2&sort=-shortcut>; rel="next"`, `rel="last"`} {
+		if !strings.Contains(link, want) {
+			t.Errorf("Link = %q, want %s", link, want)
+		}
+	}
+
+	// Unchanged lists and exports are not sent again.
+	for _, path := range []string{"/api/links", "/api/links/export", "/api/links/export?format=csv"} {
+		resp := ts.do(http.MethodGet, path, testToken, "")
+		etag := resp.Header.Get("ETag")
+		if resp.StatusCode != http.StatusOK || etag == "" {
+			t.Fatalf("GET %s: status = %d, ETag = %q", path, resp.StatusCode, etag)
+		}
+		if resp := ts.do(http.MethodGet, path, testToken, "", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+			t.Errorf("GET %s with If-None-Match: status = %d, want 304", path, resp.StatusCode)
+		}
+	}
+	etag := ts.do(http.MethodGet, "/api/links", testToken, "").Header.Get("ETag")
+	if resp := ts.do(http.MethodPost, "/api/links", testToken, `{"shortcut": "f", "url": "https://f.example.com/"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST: status = %d", resp.StatusCode)
+	}
+	ts.refresh()
+	if resp := ts.do(http.MethodGet, "/api/links", testToken, "", "If-None-Match", etag); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET after a change: status = %d, want 200", resp.StatusCode)
+	}
+
+	for _, q := range []string{"sort=clicks", "per_page=0", "per_page=5000", "page=-1"} {
+		if resp := ts.do(http.MethodGet, "/api/links?"+q, testToken, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET ?%s: status = %d, want 400", q, resp.StatusCode)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	links := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		links[fmt.Sprintf("link%d", i)] = fmt.Sprintf("https://example.com/docs/%d", i)
+	}
+	ts := newTestServer(t, storetest.New(links))
+
+	resp := ts.do(http.MethodGet, "/api/links", testToken, "", "Accept-Encoding", "br;q=1.0, gzip;q=0.8")
+	if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []linkListEntry
+	if err := json.NewDecoder(zr).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 100 {
+		t.Errorf("got %d links, want 100", len(got))
+	}
+
+	// Small responses and clients refusing gzip get plain responses.
+	for _, tt := range []struct{ path, accept string }{
+		{"/api/links/link1", "gzip"},
+		{"/api/links", "gzip;q=0"},
+	} {
+		resp := ts.do(http.MethodGet, tt.path, testToken, "", "Accept-Encoding", tt.accept)
+		if got := resp.Header.Get("Content-Encoding"); got != "" {
+			t.Errorf("GET %s with %q: Content-Encoding = %q, want none", tt.path, tt.accept, got)
+		}
+		if got := resp.Header.Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("GET %s: Vary = %q, want Accept-Encoding", tt.path, got)
+		}
+	}
+}
+
+func TestIPAccess(t *testing.T) {
+	p := storetest.New(map[string]string{"go": "https://go.dev/"})
+	ts := newTestServer(t, p)
+	ts.srv.TrustProxy = true
+	var err error
+	if ts.srv.Access, err = NewIPAccess("", "203.0.113.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if ts.srv.APIAccess, err = NewIPAccess("10.0.0.0/8", "10.0.0.66"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		client string
+		status int
+	}{
+		{"/go", "198.51.100.7", http.StatusFound},
+		{"/go", "203.0.113.9", http.StatusForbidden},
+		// Only the entry appended by the proxy counts.
+		{"/go", "198.51.100.7, 203.0.113.9", http.StatusForbidden},
+		{"/api/links", "10.1.2.3", http.StatusOK},
+		{"/api/links", "10.1.2.3, 198.51.100.7", http.StatusForbidden},
+		{"/api/links", "10.0.0.66", http.StatusForbidden},
+		{"/api/links", "198.51.100.7", http.StatusForbidden},
+		{"/healthz", "203.0.113.9", http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp := ts.do(http.MethodGet, tt.path, testToken, "", "X-Forwarded-For", tt.client)
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s from %s: status = %d, want %d", tt.path, tt.client, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestSSO(t *testing.T) {
+	var idToken string
+	google := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("code") != "c0de" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "a", "token_type": "Bearer", "expires_in": 3600, "id_token": idToken})
+	}))
+	defer google.Close()
+	sso, err := NewSSO("client", "secret", "example.com", "boss@example.com", store.ScopeWrite, []byte("test key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sso.Endpoint = oauth2.Endpoint{AuthURL: google.URL + "/auth", TokenURL: google.URL + "/token"}
+	p := storetest.New(nil)
+	ts := newTestServer(t, p, func(s *Server) { s.Auth.SSO = sso })
+
+	resp := ts.do(http.MethodGet, "/admin", "", "")
+	if loc := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || loc != "/auth/login?next=%2Fadmin" {
+		t.Fatalf("GET /admin: %d to %q, want a redirect to sign in", resp.StatusCode, loc)
+	}
+
+	// signIn returns the session cookie of signing in as email.
+	signIn := func(email string) (string, int) {
+		claims, _ := json.Marshal(map[string]interface{}{
+			"iss": "https://accounts.google.com", "aud": "client", "exp": time.Now().Add(time.Hour).Unix(),
+			"email": email, "email_verified": true,
+		})
+		idToken = "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+		resp := ts.do(http.MethodGet, "/auth/login?next=/admin", "", "")
+		loc, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil || !strings.HasPrefix(loc.String(), google.URL+"/auth?") {
+			t.Fatalf("login redirects to %q", loc)
+		}
+		state := resp.Cookies()[0]
+		resp = ts.do(http.MethodGet, "/auth/callback?code=c0de&state="+loc.Query().Get("state"), "", "", "Cookie", state.Name+"="+state.Value)
+		for _, c := range resp.Cookies() {
+			if c.Name == sessionCookie && c.Value != "" {
+				return c.Name + "=" + c.Value, resp.StatusCode
+			}
+		}
+		return "", resp.StatusCode
+	}
+
+	if _, status := signIn("eve@evil.example"); status != http.StatusForbidden {
+		t.Errorf("sign-in from another domain: status = %d, want 403", status)
+	}
+	session, status := signIn("Ann@example.com")
+	if status != http.StatusFound || session == "" {
+		t.Fatalf("sign-in: status = %d, session %q", status, session)
+	}
+	if resp := ts.do(http.MethodGet, "/admin", "", "", "Cookie", session); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /admin signed in: status = %d", resp.StatusCode)
+	}
+	body := `{"shortcut":"ann","url":"https://ann.example.com/"}`
+	if resp := ts.do(http.MethodPost, "/api/links", "", body, "Cookie", session, "Origin", "https://evil.example"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("cross-site POST: status = %d, want 401", resp.StatusCode)
+	}
+	resp = ts.do(http.MethodPost, "/api/links", "", body, "Cookie", session, "Origin", ts.URL)
+	var created apiLink
+	json.NewDecoder(resp.Body).Decode(&created)
+	if resp.StatusCode != http.StatusCreated || created.Owner != "ann@example.com" {
+		t.Errorf("POST signed in: status = %d, owner %q", resp.StatusCode, created.Owner)
+	}
+	if resp := ts.do(http.MethodGet, "/api/audit", "", "", "Cookie", session); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET /api/audit as non-admin: status = %d, want 403", resp.StatusCode)
+	}
+
+	// The unlock cookie of a link named session, with the admin's address
+	// as its password, is signed with the same key but isn't a session.
+	lure := storetest.Link("https://example.com/")
+	lure.Password = "boss@example.com"
+	p.Set("session", lure)
+	ts.refresh()
+	resp = ts.do(http.MethodPost, "/session", "", "password=boss@example.com", "Content-Type", "application/x-www-form-urlencoded")
+	var unlock string
+	for _, c := range resp.Cookies() {
+		if strings.HasPrefix(c.Name, "unlock_") {
+			unlock = c.Value
+		}
+	}
+	if unlock == "" {
+		t.Fatalf("POST /session: status = %d, want an unlock cookie", resp.StatusCode)
+	}
+	forged := sessionCookie + "=" + base64.RawURLEncoding.EncodeToString([]byte("boss@example.com")) + "." + unlock
+	if resp := ts.do(http.MethodGet, "/api/audit", "", "", "Cookie", forged); resp.StatusCode == http.StatusOK {
+		t.Errorf("GET /api/audit with an unlock cookie as session: status = %d", resp.StatusCode)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	p := storetest.New(map[string]string{"go": "https://go.dev/"})
+	ts := newTestServer(t, p, func(s *Server) { s.TrashRetention = time.Hour })
+
+	if resp := ts.do(http.MethodDelete, "/api/links/go", testToken, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE: status = %d", resp.StatusCode)
+	}
+	ts.refresh()
+	if resp := ts.do(http.MethodGet, "/go", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /go after delete: status = %d, want 404", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodPatch, "/api/links/go", testToken, `{"description":"x"}`); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("PATCH deleted link: status = %d, want 404", resp.StatusCode)
+	}
+	var trash []linkListEntry
+	json.NewDecoder(ts.do(http.MethodGet, "/api/links?deleted=true", testToken, "").Body).Decode(&trash)
+	if len(trash) != 1 || trash[0].Shortcut != "go" || trash[0].DeletedAt == nil {
+		t.Fatalf("trash = %+v, want go", trash)
+	}
+
+	if resp := ts.do(http.MethodPost, "/api/links/go/restore", testToken, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("restore: status = %d", resp.StatusCode)
+	}
+	ts.refresh()
+	if resp := ts.do(http.MethodGet, "/go", "", ""); resp.Header.Get("Location") != "https://go.dev/" {
+		t.Errorf("GET /go after restore: %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp := ts.do(http.MethodPost, "/api/links/go/restore", testToken, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("restoring a live link: status = %d, want 404", resp.StatusCode)
+	}
+
+	// A new link takes the shortcut of one in the trash, and deleting from
+	// the trash is for good.
+	ts.do(http.MethodDelete, "/api/links/go", testToken, "")
+	ts.refresh()
+	if resp := ts.do(http.MethodPost, "/api/links", testToken, `{"shortcut":"go","url":"https://golang.org/"}`); resp.StatusCode != http.StatusCreated {
+		t.Errorf("re-creating a deleted shortcut: status = %d", resp.StatusCode)
+	}
+	ts.do(http.MethodDelete, "/api/links/go", testToken, "")
+	ts.refresh()
+	if resp := ts.do(http.MethodDelete, "/api/links/go", testToken, ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE from the trash: status = %d", resp.StatusCode)
+	}
+	if l, _ := p.Get(context.Background(), "go"); l != nil {
+		t.Errorf("link still stored after deleting it from the trash: %+v", l)
+	}
+}
+
+func TestClickBudgetAndDisable(t *testing.T) {
+	p := storetest.New(map[string]string{"spam": "https://spam.example.com/"})
+	promo := storetest.Link("https://promo.example.com/")
+	promo.MaxClicks = 2
+	p.Set("promo", promo)
+	ts := newTestServer(t, p)
+
+	for i, want := range []int{http.StatusFound, http.StatusFound, http.StatusGone} {
+		if resp := ts.do(http.MethodGet, "/promo", "", ""); resp.StatusCode != want {
+			t.Errorf("GET /promo #%d: status = %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+
+	if resp := ts.do(http.MethodPost, "/api/links/spam/disable", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("disable without a token: status = %d, want 401", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodPost, "/api/links/spam/disable", testToken, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("disable: status = %d", resp.StatusCode)
+	}
+	ts.refresh()
+	if resp := ts.do(http.MethodGet, "/spam", "", ""); resp.StatusCode != http.StatusGone {
+		t.Errorf("GET disabled link: status = %d, want 410", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodPatch, "/api/links/spam", testToken, `{"disabled":false}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("enable: status = %d", resp.StatusCode)
+	}
+	ts.refresh()
+	if resp := ts.do(http.MethodGet, "/spam", "", ""); resp.Header.Get("Location") != "https://spam.example.com/" {
+		t.Errorf("GET enabled link: %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+func TestLinkApproval(t *testing.T) {
+	p := storetest.New(nil)
+	ts := newTestServer(t, p, func(s *Server) {
+		s.LinkApproval = true
+		s.Auth, _ = NewAuthenticator(testToken+":admin;writer:read,write", nil)
+	})
+
+	resp := ts.do(http.MethodPost, "/api/links", "writer", `{"shortcut":"draft","url":"https://draft.example.com/"}`)
+	var created apiLink
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || resp.StatusCode != http.StatusCreated || !created.Unapproved {
+		t.Fatalf("create as writer: status %d, %+v, %v", resp.StatusCode, created, err)
+	}
+	ts.do(http.MethodPost, "/api/links", testToken, `{"shortcut":"admin","url":"https://admin.example.com/"}`)
+	ts.refresh()
+	if resp := ts.do(http.MethodGet, "/draft", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET unapproved link: status = %d, want 404", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodGet, "/admin", "", ""); resp.StatusCode != http.StatusFound {
+		t.Errorf("GET link created by an admin: status = %d, want 302", resp.StatusCode)
+	}
+
+	var pending []linkListEntry
+	resp = ts.do(http.MethodGet, "/api/links?unapproved=true", testToken, "")
+	if err := json.NewDecoder(resp.Body).Decode(&pending); err != nil || len(pending) != 1 || pending[0].Shortcut != "draft" {
+		t.Fatalf("GET unapproved links = %+v, %v", pending, err)
+	}
+
+	if resp := ts.do(http.MethodPost, "/api/links/draft/approve", "writer", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("approve as writer: status = %d, want 403", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodPost, "/api/links/draft/approve", testToken, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("approve: status = %d", resp.StatusCode)
+	}
+	ts.refresh()
+	if resp := ts.do(http.MethodGet, "/draft", "", ""); resp.Header.Get("Location") != "https://draft.example.com/" {
+		t.Errorf("GET approved link: %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	// Describing the link keeps it approved, pointing it elsewhere does not.
+	ts.do(http.MethodPatch, "/api/links/draft", "writer", `{"description":"drafts"}`)
+	ts.refresh()
+	if resp := ts.do(http.MethodGet, "/draft", "", ""); resp.StatusCode != http.StatusFound {
+		t.Errorf("GET described link: status = %d, want 302", resp.StatusCode)
+	}
+	ts.do(http.MethodPatch, "/api/links/draft", "writer", `{"url":"https://elsewhere.example.com/"}`)
+	ts.refresh()
+	if resp := ts.do(http.MethodGet, "/draft", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET link pointed elsewhere: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestLinkHistory(t *testing.T) {
+	t.Setenv("AUDIT_LOG_FILE", filepath.Join(t.TempDir(), "audit.jsonl"))
+	p := storetest.New(nil)
+	ts := newTestServer(t, p, func(s *Server) { s.AuditLog = store.NewAuditLog(p) })
+
+	ts.do(http.MethodPost, "/api/links", testToken, `{"shortcut":"docs","url":"https://docs.example.com/"}`)
+	ts.do(http.MethodPut, "/api/links/docs", testToken, `{"url":"https://wrong.example.com/"}`)
+	ts.do(http.MethodDelete, "/api/links/docs", testToken, "")
+	ts.do(http.MethodPost, "/api/links", testToken, `{"shortcut":"docs","url":"https://wronger.example.com/"}`)
+
+	history := func() []linkVersion {
+		t.Helper()
+		var got []linkVersion
+		resp := ts.do(http.MethodGet, "/api/links/docs/history", testToken, "")
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET history: status %d, %v", resp.StatusCode, err)
+		}
+		return got
+	}
+	got := history()
+	if len(got) != 4 || got[0].Version != 3 || got[1].Version != 0 || got[1].Action != store.AuditDelete ||
+		got[3].Version != 1 || got[3].Link.URL != "https://docs.example.com/" {
+		t.Fatalf("history = %+v", got)
+	}
+
+	resp := ts.do(http.MethodPost, "/api/links/docs/rollback", testToken, `{"version":1}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("rollback: status = %d", resp.StatusCode)
+	}
+	ts.refresh()
+	if resp := ts.do(http.MethodGet, "/docs", "", ""); resp.Header.Get("Location") != "https://docs.example.com/" {
+		t.Errorf("GET /docs after rollback: %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if got := history(); got[0].Version != 4 || got[0].Action != store.AuditRollback {
+		t.Errorf("latest version = %+v, want a rollback", got[0])
+	}
+
+	for body, want := range map[string]int{`{"version":9}`: http.StatusNotFound, `{"ver":1}`: http.StatusBadRequest} {
+		if resp := ts.do(http.MethodPost, "/api/links/docs/rollback", testToken, body); resp.StatusCode != want {
+			t.Errorf("rollback %s: status = %d, want %d", body, resp.StatusCode, want)
+		}
+	}
+	if resp := ts.do(http.MethodGet, "/api/links/nope/history", testToken, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("history of unknown shortcut: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	p := storetest.New(map[string]string{"docs": "https://docs.example.com/", "wiki": "https://wiki.example.com/"})
+	dir := t.TempDir()
+	ts := newTestServer(t, p, func(s *Server) { s.SnapshotDir = dir })
+
+	var taken snapshotInfo
+	resp := ts.do(http.MethodPost, "/api/snapshots", testToken, `{"note":"before cleanup"}`)
+	if err := json.NewDecoder(resp.Body).Decode(&taken); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /api/snapshots: status %d, %v", resp.StatusCode, err)
+	}
+	if taken.Links != 2 || taken.Note != "before cleanup" {
+		t.Errorf("snapshot = %+v", taken)
+	}
+
+	ts.do(http.MethodDelete, "/api/links/wiki", testToken, "")
+	ts.do(http.MethodPut, "/api/links/docs", testToken, `{"url":"https://wrong.example.com/"}`)
+	ts.do(http.MethodPost, "/api/links", testToken, `{"shortcut":"spam","url":"https://spam.example.com/"}`)
+
+	var res restoreResult
+	resp = ts.do(http.MethodPost, "/api/snapshots/"+taken.ID+"/restore", testToken, "")
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("restore: status %d, %v", resp.StatusCode, err)
+	}
+	if res.Created != 1 || res.Updated != 1 || res.Deleted != 1 || res.Atomic || res.Undo == "" {
+		t.Errorf("restore = %+v", res)
+	}
+	ts.refresh()
+	for path, want := range map[string]string{"/docs": "https://docs.example.com/", "/wiki": "https://wiki.example.com/", "/spam": ""} {
+		if resp := ts.do(http.MethodGet, path, "", ""); resp.Header.Get("Location") != want {
+			t.Errorf("GET %s after restore: %d to %q, want %q", path, resp.StatusCode, resp.Header.Get("Location"), want)
+		}
+	}
+
+	var list []snapshotInfo
+	resp = ts.do(http.MethodGet, "/api/snapshots", testToken, "")
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil || len(list) != 2 || list[0].ID != res.Undo || list[0].Links != 2 {
+		t.Errorf("GET /api/snapshots = %+v, %v", list, err)
+	}
+	if resp := ts.do(http.MethodGet, "/api/snapshots/"+taken.ID, testToken, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET snapshot: status = %d", resp.StatusCode)
+	}
+	for _, path := range []string{"/api/snapshots/20000101T000000.000Z", "/api/snapshots/latest"} {
+		if resp := ts.do(http.MethodGet, path, testToken, ""); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: status = %d, want 404", path, resp.StatusCode)
+		}
+	}
+	if resp := ts.do(http.MethodPost, "/api/snapshots", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("POST /api/snapshots without a token: status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	p := storetest.New(map[string]string{"docs": "https://docs.example.com/", "wiki": "https://wiki.example.com/"})
+	ts := newTestServer(t, p, func(s *Server) { s.Events = NewEvents() })
+
+	type event struct{ id, name, data string }
+	open := func(header ...string) func() event {
+		t.Helper()
+		resp := ts.do(http.MethodGet, "/api/events/stream?events=link.clicked", testToken, "", header...)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("GET /api/events/stream: status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		r := bufio.NewReader(resp.Body)
+		// next returns the next event with a name.
+		return func() event {
+			t.Helper()
+			var ev event
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					t.Fatalf("reading events: %v", err)
+				}
+				line = strings.TrimSuffix(line, "\n")
+				switch {
+				case line == "" && ev.name != "":
+					return ev
+				case line == "":
+					ev = event{}
+				case strings.HasPrefix(line, "id: "):
+					ev.id = strings.TrimPrefix(line, "id: ")
+				case strings.HasPrefix(line, "event: "):
+					ev.name = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "data: "):
+					ev.data = strings.TrimPrefix(line, "data: ")
+				}
+			}
+		}
+	}
+
+	next := open()
+	ts.do(http.MethodGet, "/docs", "", "")
+	first := next()
+	if first.name != eventLinkClicked || first.id == "" || !strings.Contains(first.data, `"shortcut":"docs"`) {
+		t.Fatalf("event = %+v, want a click of docs", first)
+	}
+
+	// A reconnecting stream gets the events it missed.
+	ts.do(http.MethodGet, "/wiki", "", "")
+	if ev := open("Last-Event-ID", first.id)(); !strings.Contains(ev.data, `"shortcut":"wiki"`) {
+		t.Errorf("event after reconnecting = %+v, want a click of wiki", ev)
+	}
+
+	if resp := ts.do(http.MethodGet, "/api/events/stream?events=link.nope", testToken, ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown event: status = %d, want 400", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodGet, "/api/events/stream", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without a token: status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestCanary(t *testing.T) {
+	p := storetest.New(map[string]string{"docs": "https://old.example.com/"})
+	ts := newTestServer(t, p)
+
+	patch := func(body string) apiLink {
+		t.Helper()
+		var got apiLink
+		resp := ts.do(http.MethodPatch, "/api/links/docs", testToken, body)
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("PATCH %s: status %d, %v", body, resp.StatusCode, err)
+		}
+		ts.refresh()
+		return got
+	}
+
+	// A new url with a canary goes to its share of the visitors only.
+	got := patch(`{"url":"https://new.example.com/","canary":{"percent":30,"bake":"1h"}}`)
+	if got.URL != "https://old.example.com/" || got.Canary == nil || got.Canary.URL != "https://new.example.com/" ||
+		got.Canary.Percent != 30 || got.Canary.Until == nil {
+		t.Fatalf("rollout = %+v, canary %+v", got, got.Canary)
+	}
+	hits := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		resp := ts.do(http.MethodGet, "/docs", "", "", "Cookie", fmt.Sprintf("%s=v%d", visitorCookie, i))
+		hits[resp.Header.Get("Location")]++
+	}
+	if n := hits["https://new.example.com/"]; n < 90-40 || n > 90+40 || n+hits["https://old.example.com/"] != 300 {
+		t.Errorf("redirects = %v, want about 30%% to the canary", hits)
+	}
+
+	// Patching the percentage keeps the canary's url and bake.
+	if got := patch(`{"canary":{"percent":50}}`); got.Canary == nil || got.Canary.URL != "https://new.example.com/" ||
+		got.Canary.Percent != 50 || got.Canary.Until == nil {
+		t.Errorf("after raising the percentage: canary %+v", got.Canary)
+	}
+	if got := patch(`{"canary":null}`); got.Canary != nil || got.URL != "https://old.example.com/" {
+		t.Errorf("after aborting: %+v, canary %+v", got, got.Canary)
+	}
+
+	for _, body := range []string{`{"canary":{"url":"https://new.example.com/","percent":100}}`, `{"canary":{"percent":10,"bake":"1h","until":"2999-01-01T00:00:00Z"}}`} {
+		if resp := ts.do(http.MethodPatch, "/api/links/docs", testToken, body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("PATCH %s: status = %d, want 400", body, resp.StatusCode)
+		}
+	}
+}
+
+// fakeSink collects exported clicks, failing while fail is set.
+type fakeSink struct {
+	fail   bool
+	clicks []store.Click
+}
+
+func (s *fakeSink) Name() string { return "fake" }
+
+func (s *fakeSink) ExportClicks(ctx context.Context, clicks []store.Click) error {
+	if s.fail {
+		return errors.New("warehouse down")
+	}
+	s.clicks = append(s.clicks, clicks...)
+	return nil
+}
+
+func TestAnalyticsSinks(t *testing.T) {
+	p := storetest.New(map[string]string{"go": "https://go.dev/"})
+	sink := &fakeSink{fail: true}
+	ts := newTestServer(t, p, func(s *Server) { s.Analytics.AddSink(sink) })
+
+	for i := 0; i < 3; i++ {
+		ts.do(http.MethodGet, "/go", "", "")
+	}
+	ts.do(http.MethodGet, "/go", "", "", "User-Agent", "Googlebot/2.1")
+	if err := ts.srv.Analytics.Flush(context.Background()); err == nil {
+		t.Fatal("Flush succeeded with a failing sink")
+	}
+	sink.fail = false
+	if err := ts.srv.Analytics.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if len(sink.clicks) != 3 || sink.clicks[0].Shortcut != "go" {
+		t.Errorf("exported %+v, want the 3 clicks of visitors", sink.clicks)
+	}
+	if err := ts.srv.Analytics.Flush(context.Background()); err != nil || len(sink.clicks) != 3 {
+		t.Errorf("second Flush: %v, exported %d clicks, want none again", err, len(sink.clicks))
+	}
+}
+
+func TestCrawlers(t *testing.T) {
+	ts := newTestServer(t, storetest.New(map[string]string{"go": "https://go.dev/"}))
+
+	resp := ts.do(http.MethodGet, "/robots.txt", "", "")
+	if b, _ := io.ReadAll(resp.Body); string(b) != DefaultRobotsTxt {
+		t.Errorf("robots.txt = %q, want %q", b, DefaultRobotsTxt)
+	}
+	if resp := ts.do(http.MethodGet, "/favicon.ico", "", ""); resp.Header.Get("Content-Type") != "image/x-icon" {
+		t.Errorf("favicon: Content-Type = %q", resp.Header.Get("Content-Type"))
+	}
+
+	ua := "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	if resp := ts.do(http.MethodGet, "/go", "", "", "User-Agent", ua); resp.StatusCode != http.StatusFound {
+		t.Errorf("crawler: status = %d, want the redirect", resp.StatusCode)
+	}
+	ts.do(http.MethodGet, "/go", "", "", "User-Agent", "Mozilla/5.0 (X11; Linux x86_64) Firefox/126.0")
+	stats, err := ts.srv.Analytics.Stats(context.Background(), "go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 1 {
+		t.Errorf("clicks = %d, want only the person's", stats.Total)
+	}
+}
+
+func TestDebugEndpoints(t *testing.T) {
+	p := storetest.New(map[string]string{"go": "https://go.dev/"})
+	ts := newTestServer(t, p, func(s *Server) { s.DebugEndpoints = true })
+
+	if resp := ts.do(http.MethodGet, "/debug/runtime", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /debug/runtime without a token: status = %d, want 401", resp.StatusCode)
+	}
+	resp := ts.do(http.MethodGet, "/debug/runtime", testToken, "")
+	var rt runtimeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rt); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /debug/runtime: status = %d, %v", resp.StatusCode, err)
+	}
+	if rt.Goroutines == 0 || rt.Links != 1 || rt.HeapAlloc == 0 {
+		t.Errorf("runtime = %+v", rt)
+	}
+	if resp := ts.do(http.MethodGet, "/debug/pprof/goroutine?debug=1", testToken, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /debug/pprof/goroutine: status = %d", resp.StatusCode)
+	}
+
+	// Without the flag they are just shortcuts.
+	ts = newTestServer(t, p)
+	if resp := ts.do(http.MethodGet, "/debug/runtime", testToken, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /debug/runtime when disabled: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	p := storetest.New(map[string]string{"go": "https://go.dev/"})
+	ts := newTestServer(t, p, func(s *Server) {
+		s.Version, s.Commit, s.Backend = "v1.2.3", "abc1234", "sheets"
+	})
+	p.Fail(errors.New("sheet unreachable"))
+	if err := ts.cache.Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh succeeded with a failing provider")
+	}
+
+	if resp := ts.do(http.MethodGet, "/status", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /status without a token: status = %d, want 401", resp.StatusCode)
+	}
+	resp := ts.do(http.MethodGet, "/status", testToken, "")
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("GET /status: status = %d, Cache-Control = %q", resp.StatusCode, resp.Header.Get("Cache-Control"))
+	}
+	page := string(b)
+	for _, want := range []string{"v1.2.3", "abc1234", "<td>sheets</td>", "<td>1</td>", "failing: sheet unreachable", "<td>1m0s</td>"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("status page lacks %q:\n%s", want, page)
+		}
+	}
+}
+
+func TestLint(t *testing.T) {
+	p := storetest.New(map[string]string{"go": "https://go.dev/", "admin": "https://x.example.com/"})
+	ts := newTestServer(t, p)
+	reserved, err := resolver.NewReservedWords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.cache.Reserved = reserved
+	ts.refresh()
+
+	if resp := ts.do(http.MethodGet, "/api/lint", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /api/lint without a token: status = %d, want 401", resp.StatusCode)
+	}
+	resp := ts.do(http.MethodGet, "/api/lint", testToken, "")
+	var got lintResponse
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /api/lint: status = %d, %v", resp.StatusCode, err)
+	}
+	if got.Links != 1 || len(got.Issues) != 1 || got.LoadedAt == "" {
+		t.Fatalf("lint = %+v, want one issue", got)
+	}
+	if i := got.Issues[0]; i.Kind != store.IssueReserved || i.Shortcut != "admin" || !i.Skipped {
+		t.Errorf("issue = %+v, want admin reserved", i)
+	}
+
+	resp = ts.do(http.MethodGet, "/api/lint?kind=duplicate", testToken, "")
+	got = lintResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil || len(got.Issues) != 0 {
+		t.Errorf("GET /api/lint?kind=duplicate = %+v, %v, want no issues", got, err)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	dir := t.TempDir()
+	links := filepath.Join(dir, "acme.yaml")
+	if err := os.WriteFile(links, []byte("docs: https://docs.acme.example/\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	file := filepath.Join(dir, "tenants.json")
+
+	p := storetest.New(map[string]string{"docs": "https://docs.example.com/"})
+	ts := newTestServer(t, p, func(s *Server) {
+		var err error
+		if s.Tenants, err = NewTenants(ctx, file, s); err != nil {
+			t.Fatal(err)
+		}
+	})
+	front := httptest.NewServer(ts.srv.Tenants.Handler(ts.Config.Handler))
+	t.Cleanup(front.Close)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(host, path, token string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, front.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if host != "" {
+			req.Host = host
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	body := `{"name":"acme","prefix":"acme","hosts":["go.acme.test"],"provider":"file","settings":{"LINKS_FILE":"` + links + `"},"tokens":"acme-token:admin"}`
+	if resp := ts.do(http.MethodPost, "/api/tenants", "", body); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("POST /api/tenants without a token: status = %d, want 401", resp.StatusCode)
+	}
+	resp := ts.do(http.MethodPost, "/api/tenants", testToken, body)
+	var created tenantResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /api/tenants: status = %d, %v", resp.StatusCode, err)
+	}
+	if created.Links != 1 || created.Tokens != 1 || !reflect.DeepEqual(created.Settings, []string{"LINKS_FILE"}) {
+		t.Errorf("created = %+v", created)
+	}
+	if resp := ts.do(http.MethodPost, "/api/tenants", testToken, body); resp.StatusCode != http.StatusConflict {
+		t.Errorf("POST /api/tenants again: status = %d, want 409", resp.StatusCode)
+	}
+	if b, err := os.ReadFile(file); err != nil || !strings.Contains(string(b), "acme-token") {
+		t.Errorf("tenants file = %s, %v", b, err)
+	}
+
+	for _, tt := range []struct{ host, path, location string }{
+		{"", "/docs", "https://docs.example.com/"},
+		{"", "/acme/docs", "https://docs.acme.example/"},
+		{"go.acme.test", "/docs", "https://docs.acme.example/"},
+	} {
+		resp := get(tt.host, tt.path, "")
+		if got := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || got != tt.location {
+			t.Errorf("GET %s%s: status = %d, Location %q, want %q", tt.host, tt.path, resp.StatusCode, got, tt.location)
+		}
+	}
+	// Tokens only work for their own links.
+	if resp := get("", "/acme/api/links", testToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /acme/api/links with the default token: status = %d, want 401", resp.StatusCode)
+	}
+	if resp := get("", "/acme/api/links", "acme-token"); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /acme/api/links with its token: status = %d", resp.StatusCode)
+	}
+	if resp := get("", "/api/links", "acme-token"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /api/links with the tenant token: status = %d, want 401", resp.StatusCode)
+	}
+
+	// Signatures of a tenant don't open the links of the others.
+	if key := ts.srv.Tenants.running["acme"].srv.SigningKey; len(key) == 0 || bytes.Equal(key, ts.srv.SigningKey) {
+		t.Errorf("tenant signing key = %x, want one derived from the root key", key)
+	}
+
+	// Restarting serves the tenants of the file.
+	again, err := NewTenants(ctx, file, ts.srv)
+	if err != nil || !again.Serves("go.acme.test:443") {
+		t.Errorf("reloaded tenants serve go.acme.test: %v", err)
+	}
+
+	if resp := ts.do(http.MethodDelete, "/api/tenants/acme", testToken, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE /api/tenants/acme: status = %d", resp.StatusCode)
+	}
+	if resp := get("", "/acme/docs", ""); resp.StatusCode == http.StatusFound {
+		t.Errorf("GET /acme/docs after deleting the tenant still redirects to %s", resp.Header.Get("Location"))
+	}
+}
+
+func TestHealth(t *testing.T) {
+	p := storetest.New(nil)
+	ts := newTestServer(t, p)
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if resp := ts.do(http.MethodGet, path, "", ""); resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: status = %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestProviderErrors(t *testing.T) {
+	p := storetest.New(map[string]string{"go": "https://go.dev/"})
+	ts := newTestServer(t, p)
+	p.Fail(store.ErrRateLimited)
+
+	// Redirects keep working from the cache while the provider is down.
+	if resp := ts.do(http.MethodGet, "/go", "", ""); resp.StatusCode != http.StatusFound {
+		t.Errorf("GET /go: status = %d", resp.StatusCode)
+	}
+	if resp := ts.do(http.MethodDelete, "/api/links/go", testToken, ""); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("DELETE: status = %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	ts := newTestServer(t, storetest.New(nil))
+
+	resp := ts.do(http.MethodGet, "/api/links/missing", testToken, "")
+	var e errorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotFound || e.Error.Code != "not_found" || e.Error.Message == "" {
+		t.Errorf("GET /api/links/missing: status = %d, error = %+v", resp.StatusCode, e.Error)
+	}
+
+	resp = ts.do(http.MethodGet, "/api/links/missing", "", "", "Accept", "text/html")
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("browser: status = %d, Content-Type = %q, want an HTML 401 page", resp.StatusCode, ct)
+	}
+}
+
+func TestTopLinks(t *testing.T) {
+	ts := newTestServer(t, storetest.New(map[string]string{
+		"go": "https://go.dev/", "docs": "https://example.com/docs", "old": "https://example.com/old",
+	}))
+	for _, path := range []string{"/go", "/go", "/docs"} {
+		ts.do(http.MethodGet, path, "", "")
+	}
+	ts.srv.Analytics.Record(store.Click{Shortcut: "old", Time: time.Now().AddDate(0, 0, -10)})
+
+	top := func(query string) []string {
+		t.Helper()
+		var resp topResponse
+		if err := json.NewDecoder(ts.do(http.MethodGet, "/api/stats/top"+query, testToken, "").Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, l := range resp.Links {
+			out = append(out, fmt.Sprintf("%s:%d", l.Shortcut, l.Clicks))
+		}
+		return out
+	}
+	if got, want := top(""), []string{"go:2", "docs:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("top links = %q, want %q", got, want)
+	}
+	if got, want := top("?window=30d&limit=1"), []string{"go:2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("top link over 30 days = %q, want %q", got, want)
+	}
+	if got, want := top("?order=least"), []string{"old:0", "docs:1", "go:2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("least clicked = %q, want %q", got, want)
+	}
+	if resp := ts.do(http.MethodGet, "/api/stats/top?window=1w", testToken, ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid window: status = %d", resp.StatusCode)
+	}
+
+	resp := ts.do(http.MethodGet, "/popular", "", "")
+	if b, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || !strings.Contains(string(b), `<a href="/go">go</a>`) {
+		t.Errorf("GET /popular: status = %d, body %s", resp.StatusCode, b)
+	}
+}
+
+func TestBrowserTools(t *testing.T) {
+	p := storetest.New(map[string]string{"docs": "https://docs.example.com/"})
+	ts := newTestServer(t, p, func(s *Server) { s.GoHostnames = []string{"go", "links"} })
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := ts.do(http.MethodGet, "/tools/proxy.pac", "", "")
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ns-proxy-autoconfig" {
+		t.Fatalf("GET /tools/proxy.pac: status = %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{`host == "go" || host == "links"`, `return "PROXY ` + u.Host + `";`, `return "DIRECT";`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("PAC file lacks %s:\n%s", want, b)
+		}
+	}
+
+	// Browsers following the PAC file send the server absolute URLs.
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(u)},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err = client.Get("http://go/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "https://docs.example.com/" {
+		t.Errorf("GET http://go/docs through the proxy: status = %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp = ts.do(http.MethodGet, "/tools", "", "")
+	b, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(b), ts.URL+"/tools/proxy.pac") || !strings.Contains(string(b), `href="javascript:`) {
+		t.Errorf("GET /tools: status = %d, body %s", resp.StatusCode, b)
+	}
+
+	resp = ts.do(http.MethodGet, "/new?url=https%3A%2F%2Fpage.example.com%2F", testToken, "")
+	if b, _ := io.ReadAll(resp.Body); !strings.Contains(string(b), `value="https://page.example.com/"`) {
+		t.Errorf("GET /new?url= does not fill in the URL: %s", b)
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	ts := newTestServer(t, storetest.New(map[string]string{"go": "https://go.dev/"}))
+	ts.do(http.MethodGet, "/go", "", "")
+
+	var resp latencyResponse
+	if err := json.NewDecoder(ts.do(http.MethodGet, "/api/stats/latency", testToken, "").Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Lookups[resolver.LookupCache].Count != 1 || len(resp.Slowest) != 1 || resp.Slowest[0].Shortcut != "go" {
+		t.Errorf("latency = %+v, want one cached lookup of go", resp)
+	}
+	if r := ts.do(http.MethodGet, "/api/stats/latency?limit=x", testToken, ""); r.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid limit: status = %d", r.StatusCode)
+	}
+}
+
+func BenchmarkRedirect(b *testing.B) {
+	links := make(map[string]string)
+	for i := 0; i < 10000; i++ {
+		links[fmt.Sprintf("link%d", i)] = fmt.Sprintf("https://example.com/%d", i)
+	}
+	links["jira/*"] = "https://jira.example.com/browse/{1}"
+	ts := newTestServer(b, storetest.New(links))
+	h := ts.Config.Handler
+
+	for _, path := range []string{"/link42", "/link42/a/b?x=1", "/jira/ABC-1", "/missing"} {
+		b.Run(path, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+				}
+			})
+		})
+	}
+}
+
+func TestReporter(t *testing.T) {
+	ts := newTestServer(t, storetest.New(nil))
+	for _, body := range []string{
+		`{"shortcut": "docs", "url": "https://docs.example.com/", "owner": "alice"}`,
+		`{"shortcut": "launch", "url": "https://launch.example.com/", "owner": "alice", "ttl": "48h"}`,
+		`{"shortcut": "wiki", "url": "https://wiki.example.com/", "owner": "bob@other.example"}`,
+	} {
+		if resp := ts.do(http.MethodPost, "/api/links", testToken, body); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("POST %s: status = %d", body, resp.StatusCode)
+		}
+	}
+	ts.refresh()
+	ts.srv.Analytics.Record(store.Click{Shortcut: "docs", Time: time.Now()})
+
+	r, err := NewReporter(ts.srv, "localhost:25", "", "", "links@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Base, r.Domain = "https://go.example.com", "example.com"
+	sent := make(map[string]string)
+	r.send = func(to string, msg []byte) error {
+		sent[to] = string(msg)
+		return nil
+	}
+	if err := r.SendAll(context.Background(), 7*24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 || sent["alice@example.com"] == "" || sent["bob@other.example"] == "" {
+		t.Fatalf("sent reports to %v, want alice@example.com and bob@other.example", reflect.ValueOf(sent).MapKeys())
+	}
+	alice := sent["alice@example.com"]
+	for _, want := range []string{
+		"To: alice@example.com\r\n",
+		"your 2 links on https://go.example.com did over the last week",
+		"https://go.example.com/docs  1\r\n",
+		"Expiring soon:\r\n  https://go.example.com/launch on ",
+		"Not followed in 6 months; consider deleting them:\r\n  https://go.example.com/launch -> https://launch.example.com/\r\n\r\n",
+	} {
+		if !strings.Contains(alice, want) {
+			t.Errorf("report of alice lacks %q:\n%s", want, alice)
+		}
+	}
+	if strings.Contains(sent["bob@other.example"], "docs") {
+		t.Errorf("report of bob lists the links of alice:\n%s", sent["bob@other.example"])
+	}
+
+	if to := r.recipient("eve\r\nBcc: all@example.com"); to != "" {
+		t.Errorf("recipient of an owner with a header = %q, want none", to)
+	}
+}
@@ -0,0 +1,236 @@
+package httpapi
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSignedTTL is how long signed links last unless asked otherwise.
+	defaultSignedTTL = 24 * time.Hour
+	maxSignedTTL     = 30 * 24 * time.Hour
+)
+
+// Query parameters of signed links.
+const (
+	sigParam  = "sig"
+	expParam  = "exp"
+	onceParam = "once"
+)
+
+type signRequest struct {
+	// TTL is a Go duration such as "1h"; an alternative to ExpiresAt.
+	TTL       string     `json:"ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Once makes the link work for a single visit.
+	Once bool `json:"once,omitempty"`
+}
+
+type signResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Once      bool      `json:"once,omitempty"`
+}
+
+// linkSignature signs access to shortcut until expires, for a single visit
+// when nonce is set.
+func linkSignature(key []byte, shortcut string, expires int64, nonce string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("signed link\n" + shortcut + "\n" + strconv.FormatInt(expires, 10) + "\n" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// spentNonces remembers the one-time links already followed until they
+// expire. It is kept in memory, so each replica lets such a link through
+// once.
+type spentNonces struct {
+	mu sync.Mutex
+	m  map[string]int64
+}
+
+// used reports whether nonce was spent already.
+func (n *spentNonces) used(nonce string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.m[nonce]
+	return ok
+}
+
+// spend marks nonce, valid until expires, as used, reporting false if it
+// already was.
+func (n *spentNonces) spend(nonce string, expires int64, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.m == nil {
+		n.m = make(map[string]int64)
+	}
+	if _, ok := n.m[nonce]; ok {
+		return false
+	}
+	for k, exp := range n.m {
+		if exp < now.Unix() {
+			delete(n.m, k)
+		}
+	}
+	n.m[nonce] = expires
+	return true
+}
+
+// signedParams removes the parameters of a signed link from the query of u,
+// returning them, or nil if u is not signed.
+func signedParams(u *url.URL) (*url.URL, url.Values) {
+	q := u.Query()
+	if q.Get(sigParam) == "" {
+		return u, nil
+	}
+	params := url.Values{}
+	for _, k := range []string{sigParam, expParam, onceParam} {
+		params.Set(k, q.Get(k))
+		q.Del(k)
+	}
+	stripped := *u
+	stripped.RawQuery = q.Encode()
+	return &stripped, params
+}
+
+// signedAccess reports whether params sign a visit of shortcut that is still
+// valid. One-time links are only checked here; the visit they grant spends
+// them, see spendSigned.
+func (s *Server) signedAccess(params url.Values, shortcut string) bool {
+	if params == nil || len(s.SigningKey) == 0 {
+		return false
+	}
+	now := time.Now()
+	expires, err := strconv.ParseInt(params.Get(expParam), 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return false
+	}
+	nonce := params.Get(onceParam)
+	want := linkSignature(s.SigningKey, shortcut, expires, nonce)
+	if !hmac.Equal([]byte(params.Get(sigParam)), []byte(want)) {
+		return false
+	}
+	if nonce != "" && s.spent.used(nonce) {
+		log.Printf("one-time link of shortcut=%q used again", shortcut)
+		return false
+	}
+	return true
+}
+
+// spendSigned spends the one-time link signed by params, which signedAccess
+// accepted, reporting false if another visit spent it in the meantime.
+func (s *Server) spendSigned(params url.Values, shortcut string) bool {
+	nonce := params.Get(onceParam)
+	if nonce == "" {
+		return true
+	}
+	expires, _ := strconv.ParseInt(params.Get(expParam), 10, 64)
+	if !s.spent.spend(nonce, expires, time.Now()) {
+		log.Printf("one-time link of shortcut=%q used again", shortcut)
+		return false
+	}
+	return true
+}
+
+// signLink handles POST /api/links/{shortcut}/sign, returning a URL of the
+// shortcut that is followed without credentials, password or private
+// network until it expires, or only once.
+func (s *Server) signLink(w http.ResponseWriter, req *http.Request, shortcut string) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	if len(s.SigningKey) == 0 {
+		writeError(w, req, http.StatusNotImplemented, "signed links need SIGNING_KEY")
+		return
+	}
+	var in signRequest
+	if req.ContentLength != 0 {
+		dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, s.maxBody()))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&in); err != nil {
+			writeError(w, req, http.StatusBadRequest, "invalid request body: %v", err)
+			return
+		}
+	}
+
+	link, err := s.Links.Get(shortcut)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to look up shortcut: %v", err)
+		return
+	}
+	if link == nil {
+		writeError(w, req, http.StatusNotFound, "shortcut %q not found", shortcut)
+		return
+	}
+	if !owns(req, link) {
+		writeError(w, req, http.StatusForbidden, "%v", errNotOwner)
+		return
+	}
+
+	now := time.Now()
+	expires, err := in.expiry(now)
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, "%v", err)
+		return
+	}
+	var nonce string
+	if in.Once {
+		b := make([]byte, 12)
+		if _, err := rand.Read(b); err != nil {
+			writeError(w, req, http.StatusInternalServerError, "failed to sign link: %v", err)
+			return
+		}
+		nonce = hex.EncodeToString(b)
+	}
+
+	q := url.Values{}
+	q.Set(expParam, strconv.FormatInt(expires.Unix(), 10))
+	if nonce != "" {
+		q.Set(onceParam, nonce)
+	}
+	q.Set(sigParam, linkSignature(s.SigningKey, shortcut, expires.Unix(), nonce))
+	log.Printf("signed shortcut=%q until=%s once=%t", shortcut, expires.UTC().Format(time.RFC3339), in.Once)
+	writeJSON(w, http.StatusOK, signResponse{
+		URL:       s.shortURL(req, shortcut) + "?" + q.Encode(),
+		ExpiresAt: expires.UTC(),
+		Once:      in.Once,
+	})
+}
+
+// expiry returns when a link signed now as asked by in expires.
+func (in *signRequest) expiry(now time.Time) (time.Time, error) {
+	switch {
+	case in.TTL != "" && in.ExpiresAt != nil:
+		return time.Time{}, errors.New("set either ttl or expires_at, not both")
+	case in.ExpiresAt != nil:
+		if !in.ExpiresAt.After(now) {
+			return time.Time{}, errors.New("expires_at must be in the future")
+		}
+		if in.ExpiresAt.Sub(now) > maxSignedTTL {
+			return time.Time{}, errors.New("signed links last at most 720h")
+		}
+		return in.ExpiresAt.Truncate(time.Second), nil
+	case in.TTL != "":
+		ttl, err := time.ParseDuration(in.TTL)
+		if err != nil || ttl <= 0 {
+			return time.Time{}, errors.New("ttl must be a positive duration such as 1h")
+		}
+		if ttl > maxSignedTTL {
+			return time.Time{}, errors.New("signed links last at most 720h")
+		}
+		return now.Add(ttl).Truncate(time.Second), nil
+	}
+	return now.Add(defaultSignedTTL).Truncate(time.Second), nil
+}
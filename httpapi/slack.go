@@ -0,0 +1,183 @@
+package httpapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/resolver"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// slackMaxSkew is how old a signed Slack request may be before it is
+// rejected as a possible replay.
+const slackMaxSkew = 5 * time.Minute
+
+type slackResponse struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+// slackCommand returns the handler of POST /slack/command, implementing a
+// Slack slash command such as /golink:
+//
+//	/golink foo                  shows where foo points to
+//	/golink add foo https://...  creates foo
+func (s *Server) slackCommand(signingSecret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, s.maxBody()))
+		if err != nil {
+			writeError(w, req, http.StatusBadRequest, "failed to read body: %v", err)
+			return
+		}
+		if err := verifySlackSignature(req.Header, body, signingSecret, time.Now()); err != nil {
+			writeError(w, req, http.StatusUnauthorized, "%v", err)
+			return
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			writeError(w, req, http.StatusBadRequest, "invalid form body: %v", err)
+			return
+		}
+
+		text := s.runSlackCommand(req, form.Get("command"), strings.Fields(form.Get("text")), form.Get("user_name"))
+		writeJSON(w, http.StatusOK, slackResponse{ResponseType: "ephemeral", Text: text})
+	}
+}
+
+// verifySlackSignature checks the X-Slack-Signature header, see
+// https://api.slack.com/authentication/verifying-requests-from-slack.
+func verifySlackSignature(h http.Header, body []byte, secret string, now time.Time) error {
+	ts, err := strconv.ParseInt(h.Get("X-Slack-Request-Timestamp"), 10, 64)
+	if err != nil {
+		return errors.New("missing request timestamp")
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > slackMaxSkew || d < -slackMaxSkew {
+		return errors.New("request timestamp too old")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%d:", ts)
+	mac.Write(body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(want), []byte(h.Get("X-Slack-Signature"))) {
+		return errors.New("invalid request signature")
+	}
+	return nil
+}
+
+// runSlackCommand executes a slash command and returns the reply text.
+func (s *Server) runSlackCommand(req *http.Request, command string, args []string, user string) string {
+	if command == "" {
+		command = "/golink"
+	}
+	usage := fmt.Sprintf("Usage: `%[1]s <shortcut>` or `%[1]s add <shortcut> <url>`", command)
+	base := requestScheme(req, s.TrustProxy) + "://" + req.Host + "/"
+
+	switch {
+	case len(args) == 0 || args[0] == "help":
+		return usage
+
+	case args[0] == "add":
+		if len(args) != 3 {
+			return usage
+		}
+		writer, ok := s.Links.Provider.(store.Writer)
+		if !ok {
+			return "This shortener does not support creating links."
+		}
+		if s.Mode.ReadOnly() {
+			return "Links are read-only for now, please try again later."
+		}
+		shortcut := store.Norm.Lower(args[1])
+		if !store.ShortcutPattern.MatchString(shortcut) {
+			return fmt.Sprintf("`%s` is not a valid shortcut.", shortcut)
+		}
+		u, err := validateURL(unwrapSlackLink(args[2]))
+		if err != nil {
+			return fmt.Sprintf("Cannot add `%s`: %v.", shortcut, err)
+		}
+		// Slack users are no admins, so their links await approval.
+		link := &store.Link{URL: u, Owner: "slack:" + user, Unapproved: s.LinkApproval}
+		if err := s.checkQuota(req, link.Owner, 0); errors.Is(err, errQuotaExceeded) {
+			return fmt.Sprintf("You already own %d links, the most allowed.", s.LinkQuota)
+		} else if err != nil {
+			log.Printf("warn: slack: %v", err)
+			return "Links are not available right now, please try again later."
+		}
+		err = s.addLink(req.Context(), writer, shortcut, link)
+		if errors.Is(err, store.ErrLinkExists) {
+			return fmt.Sprintf("<%s%s|%s> already exists.", base, shortcut, shortcut)
+		} else if errors.Is(err, resolver.ErrShortcutReserved) {
+			return fmt.Sprintf("`%s` is reserved and can't be used.", shortcut)
+		} else if errors.Is(err, resolver.ErrDestinationRefused) {
+			return fmt.Sprintf("Cannot add `%s`: %v.", shortcut, err)
+		} else if err != nil {
+			log.Printf("warn: slack: failed to create %q: %v", shortcut, err)
+			return fmt.Sprintf("Failed to create `%s`, please try again later.", shortcut)
+		}
+		s.Links.Invalidate()
+		created, _ := json.Marshal(linkResponse(shortcut, link))
+		s.appendAudit(req.Context(), store.AuditEntry{
+			Time:     time.Now().UTC(),
+			Actor:    "slack:" + user,
+			Action:   store.AuditCreate,
+			Shortcut: shortcut,
+			New:      created,
+		})
+		log.Printf("created shortcut=%q to=%q via slack by %q", shortcut, u.String(), user)
+		if link.Unapproved {
+			s.awaitApproval(shortcut, link)
+			return fmt.Sprintf("Created `%s` → %s, it works once an admin approves it.", shortcut, u.String())
+		}
+		return fmt.Sprintf("Created <%s%s|%s> → %s", base, shortcut, shortcut, u.String())
+
+	case len(args) == 1:
+		shortcut := store.Norm.Lower(args[0])
+		link, err := s.Links.Get(shortcut)
+		switch {
+		case err != nil:
+			return "Links are not available right now, please try again later."
+		case link == nil:
+			return fmt.Sprintf("`%s` does not exist. Create it with `%s add %s <url>`.", shortcut, command, shortcut)
+		case link.Expired(time.Now()):
+			return fmt.Sprintf("`%s` expired on %s.", shortcut, link.Expires.UTC().Format("2006-01-02 15:04 MST"))
+		case link.Password != "":
+			return fmt.Sprintf("<%s%s|%s> is password protected.", base, shortcut, shortcut)
+		case link.Unapproved:
+			return fmt.Sprintf("`%s` will lead to %s once an admin approves it.", shortcut, targetSummary(link))
+		case link.Pending(time.Now()):
+			return fmt.Sprintf("`%s` will lead to %s from %s.", shortcut, targetSummary(link), link.ActiveFrom.UTC().Format("2006-01-02 15:04 MST"))
+		}
+		return fmt.Sprintf("<%s%s|%s> → %s", base, shortcut, shortcut, targetSummary(link))
+	}
+	return usage
+}
+
+// unwrapSlackLink strips the <url> or <url|label> markup Slack adds around
+// URLs in command text.
+func unwrapSlackLink(s string) string {
+	if strings.HasPrefix(s, "<") && strings.HasSuffix(s, ">") {
+		s = s[1 : len(s)-1]
+		if i := strings.IndexByte(s, '|'); i >= 0 {
+			s = s[:i]
+		}
+	}
+	return s
+}
@@ -0,0 +1,28 @@
+package httpapi
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+// slugAlphabet is base62 without the upper-case letters: shortcuts are
+// matched case-insensitively, so mixed-case slugs would collide once
+// lower-cased.
+const slugAlphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// maxSlugAttempts bounds the retries when a generated slug is already taken.
+const maxSlugAttempts = 10
+
+// randomSlug returns n characters drawn uniformly from slugAlphabet.
+func randomSlug(n int) (string, error) {
+	max := big.NewInt(int64(len(slugAlphabet)))
+	b := make([]byte, n)
+	for i := range b {
+		v, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = slugAlphabet[v.Int64()]
+	}
+	return string(b), nil
+}
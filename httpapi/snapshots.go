@@ -0,0 +1,342 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// snapshotIDFormat names snapshots by when they were taken, so they sort in
+// that order.
+const snapshotIDFormat = "20060102T150405.000Z"
+
+var snapshotIDPattern = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}\.[0-9]{3}Z$`)
+
+// snapshot is the whole link table at a point in time, as kept in a file of
+// SnapshotDir. Links are encoded with store.EncodeLink, passwords included,
+// so restores bring back exactly what was there.
+type snapshot struct {
+	ID    string            `json:"id"`
+	Time  time.Time         `json:"time"`
+	Actor string            `json:"actor"`
+	Note  string            `json:"note,omitempty"`
+	Links map[string]string `json:"links"`
+}
+
+// snapshotInfo describes a snapshot in API responses.
+type snapshotInfo struct {
+	ID    string    `json:"id"`
+	Time  time.Time `json:"time"`
+	Actor string    `json:"actor"`
+	Note  string    `json:"note,omitempty"`
+	Links int       `json:"links"`
+}
+
+func (sn *snapshot) info() snapshotInfo {
+	return snapshotInfo{ID: sn.ID, Time: sn.Time, Actor: sn.Actor, Note: sn.Note, Links: len(sn.Links)}
+}
+
+type restoreResult struct {
+	Snapshot string `json:"snapshot"`
+	Created  int    `json:"created"`
+	Updated  int    `json:"updated"`
+	Deleted  int    `json:"deleted"`
+	// Undo is the snapshot taken right before the restore.
+	Undo string `json:"undo"`
+	// Atomic is false for backends that changed the links one at a time.
+	Atomic bool `json:"atomic"`
+}
+
+var errNoSnapshots = errors.New("snapshots are not enabled, set SNAPSHOT_DIR")
+
+// snapshots handles GET /api/snapshots, listing the snapshots newest first,
+// and POST /api/snapshots, taking one with an optional {"note": "..."}.
+func (s *Server) snapshots(w http.ResponseWriter, req *http.Request) {
+	if s.SnapshotDir == "" {
+		writeError(w, req, http.StatusNotImplemented, "%v", errNoSnapshots)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		list, err := s.listSnapshots()
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, "failed to list snapshots: %v", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		var body struct {
+			Note string `json:"note"`
+		}
+		dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, s.maxBody()))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&body); err != nil && err != io.EOF {
+			writeError(w, req, http.StatusBadRequest, "invalid request body: %v", err)
+			return
+		}
+		sn, err := s.takeSnapshot(req, strings.TrimSpace(body.Note))
+		if err != nil {
+			writeError(w, req, http.StatusBadGateway, "failed to take snapshot: %v", err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, sn.info())
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+	}
+}
+
+// snapshotResource handles GET /api/snapshots/{id}, returning a snapshot
+// with its links, and POST /api/snapshots/{id}/restore.
+func (s *Server) snapshotResource(w http.ResponseWriter, req *http.Request) {
+	if s.SnapshotDir == "" {
+		writeError(w, req, http.StatusNotImplemented, "%v", errNoSnapshots)
+		return
+	}
+	id := strings.TrimPrefix(req.URL.Path, "/api/snapshots/")
+	restore := strings.HasSuffix(id, "/restore")
+	id = strings.TrimSuffix(id, "/restore")
+	if !snapshotIDPattern.MatchString(id) {
+		writeError(w, req, http.StatusNotFound, "snapshot %q not found", id)
+		return
+	}
+	sn, err := s.loadSnapshot(id)
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, req, http.StatusNotFound, "snapshot %q not found", id)
+		return
+	} else if err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to read snapshot: %v", err)
+		return
+	}
+
+	if restore {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+			return
+		}
+		s.restoreSnapshot(w, req, sn)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	m := store.DecodeLinks(req.Context(), sn.Links)
+	shortcuts := make([]string, 0, len(m))
+	for k := range m {
+		shortcuts = append(shortcuts, k)
+	}
+	sort.Strings(shortcuts)
+	out := struct {
+		snapshotInfo
+		Links []apiLink `json:"links"`
+	}{snapshotInfo: sn.info(), Links: make([]apiLink, 0, len(m))}
+	for _, k := range shortcuts {
+		out.Links = append(out.Links, linkResponse(k, m[k]))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// takeSnapshot stores the links of the backend, rather than of the cache,
+// so links changed since the last refresh are included.
+func (s *Server) takeSnapshot(req *http.Request, note string) (*snapshot, error) {
+	m, err := s.Links.Provider.Query(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load links: %w", err)
+	}
+	sn := &snapshot{
+		Time:  time.Now().UTC(),
+		Actor: "anonymous",
+		Note:  note,
+		Links: make(map[string]string, len(m)),
+	}
+	if p := requestPrincipal(req); p != nil {
+		sn.Actor = p.Name
+	}
+	for k, link := range m {
+		sn.Links[k] = store.EncodeLink(link)
+	}
+	if err := s.saveSnapshot(sn); err != nil {
+		return nil, err
+	}
+	log.Printf("%s took snapshot %s of %d links", sn.Actor, sn.ID, len(sn.Links))
+	return sn, nil
+}
+
+// saveSnapshot writes sn under a new ID. Snapshots are never overwritten:
+// the file appears complete under its name or not at all.
+func (s *Server) saveSnapshot(sn *snapshot) error {
+	if err := os.MkdirAll(s.SnapshotDir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.SnapshotDir, ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	for t := sn.Time; ; t = t.Add(time.Millisecond) {
+		sn.ID = t.Format(snapshotIDFormat)
+		if err := tmp.Truncate(0); err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := json.NewEncoder(tmp).Encode(sn); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+		// Link fails when the name is taken, unlike Rename.
+		err := os.Link(tmp.Name(), s.snapshotPath(sn.ID))
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		tmp.Close()
+		return err
+	}
+}
+
+func (s *Server) snapshotPath(id string) string {
+	return filepath.Join(s.SnapshotDir, id+".json")
+}
+
+func (s *Server) loadSnapshot(id string) (*snapshot, error) {
+	b, err := os.ReadFile(s.snapshotPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var sn snapshot
+	if err := json.Unmarshal(b, &sn); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", id, err)
+	}
+	return &sn, nil
+}
+
+// listSnapshots returns the snapshots of SnapshotDir, newest first.
+func (s *Server) listSnapshots() ([]snapshotInfo, error) {
+	entries, err := os.ReadDir(s.SnapshotDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []snapshotInfo{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	out := []snapshotInfo{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		id := strings.TrimSuffix(entries[i].Name(), ".json")
+		if !snapshotIDPattern.MatchString(id) {
+			continue
+		}
+		sn, err := s.loadSnapshot(id)
+		if err != nil {
+			log.Printf("warn: %v", err)
+			continue
+		}
+		out = append(out, sn.info())
+	}
+	return out, nil
+}
+
+// restoreSnapshot makes the links of sn the whole link table, after taking
+// a snapshot of the current one to undo the restore. Backends implementing
+// store.Replacer do so atomically; others have their links created, updated
+// and deleted one at a time, and a failure leaves the table partly restored.
+func (s *Server) restoreSnapshot(w http.ResponseWriter, req *http.Request, sn *snapshot) {
+	replacer, atomic := s.Links.Provider.(store.Replacer)
+	writer, _ := s.Links.Provider.(store.Writer)
+	editor, _ := s.Links.Provider.(store.Editor)
+	if !atomic && (writer == nil || editor == nil) {
+		writeError(w, req, http.StatusNotImplemented, "%v", errCannotEdit)
+		return
+	}
+
+	links := store.DecodeLinks(req.Context(), sn.Links)
+	undo, err := s.takeSnapshot(req, "before restoring "+sn.ID)
+	if err != nil {
+		writeError(w, req, http.StatusBadGateway, "failed to take snapshot: %v", err)
+		return
+	}
+	current := store.DecodeLinks(req.Context(), undo.Links)
+
+	res := restoreResult{Snapshot: sn.ID, Undo: undo.ID, Atomic: atomic}
+	if atomic {
+		err = replacer.Replace(req.Context(), links)
+	} else {
+		err = applySnapshot(req.Context(), writer, editor, current, links)
+	}
+	if err != nil {
+		writeError(w, req, http.StatusBadGateway, "failed to restore snapshot %s, snapshot %s holds the links from before: %v", sn.ID, undo.ID, err)
+		s.Links.Invalidate()
+		return
+	}
+
+	for k, before := range current {
+		if links[k] == nil {
+			s.audit(req, store.AuditRollback, k, before, nil)
+			res.Deleted++
+		}
+	}
+	for k, after := range links {
+		before := current[k]
+		switch {
+		case before == nil:
+			res.Created++
+		case store.EncodeLink(before) != store.EncodeLink(after):
+			res.Updated++
+		default:
+			continue
+		}
+		s.audit(req, store.AuditRollback, k, before, after)
+	}
+	s.Links.Invalidate()
+
+	log.Printf("restored snapshot %s: %d created, %d updated, %d deleted", sn.ID, res.Created, res.Updated, res.Deleted)
+	writeJSON(w, http.StatusOK, res)
+}
+
+// applySnapshot turns the links of current into those of links one at a
+// time, stopping at the first failure.
+func applySnapshot(ctx context.Context, writer store.Writer, editor store.Editor, current, links store.URLMap) error {
+	for k := range current {
+		if links[k] != nil {
+			continue
+		}
+		if err := editor.Delete(ctx, k); err != nil && !errors.Is(err, store.ErrLinkNotFound) {
+			return fmt.Errorf("failed to delete %s: %w", k, err)
+		}
+	}
+	for k, link := range links {
+		before := current[k]
+		var err error
+		switch {
+		case before == nil:
+			err = writer.Add(ctx, k, link)
+		case store.EncodeLink(before) != store.EncodeLink(link):
+			err = editor.Update(ctx, k, link)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", k, err)
+		}
+	}
+	return nil
+}
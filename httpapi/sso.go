@@ -0,0 +1,331 @@
+package httpapi
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+const (
+	sessionCookie  = "session"
+	ssoStateCookie = "sso_state"
+	// defaultSessionTTL is how long a sign-in lasts when SSO.SessionTTL is
+	// zero.
+	defaultSessionTTL = 12 * time.Hour
+)
+
+// SSO signs people in with Google OpenID Connect, for the admin page and the
+// API. Sessions are kept in a cookie signed with the server's signing key and
+// hold only the email address; the scope is decided on every request.
+type SSO struct {
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the /auth/callback URL registered with Google. Empty
+	// derives it from the request.
+	RedirectURL string
+	// Domains are the email domains allowed to sign in, see
+	// ALLOWED_EMAIL_DOMAINS.
+	Domains []string
+	// Admins get the admin scope, everyone else Scope.
+	Admins map[string]bool
+	Scope  store.Scope
+	// SessionTTL is how long a sign-in lasts.
+	SessionTTL time.Duration
+	// Endpoint is Google's unless overridden in tests.
+	Endpoint oauth2.Endpoint
+	// TrustProxy takes the scheme of requests from X-Forwarded-Proto, for
+	// the callback URL and the Secure flag of cookies.
+	TrustProxy bool
+
+	key []byte
+}
+
+// NewSSO signs in people with an email address in one of the
+// comma-separated domains using the OAuth client clientID, giving them
+// scope, or admin for the comma-separated admins. Sessions are signed with
+// key.
+func NewSSO(clientID, clientSecret, domains, admins string, scope store.Scope, key []byte) (*SSO, error) {
+	if clientID == "" || clientSecret == "" {
+		return nil, errors.New("both a client ID and secret are required")
+	}
+	if len(key) == 0 {
+		return nil, errors.New("a signing key is required")
+	}
+	s := &SSO{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Admins:       make(map[string]bool),
+		Scope:        scope,
+		Endpoint:     google.Endpoint,
+		key:          key,
+	}
+	for _, d := range strings.Split(domains, ",") {
+		if d = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "@")); d != "" {
+			s.Domains = append(s.Domains, d)
+		}
+	}
+	if len(s.Domains) == 0 {
+		return nil, errors.New("at least one allowed email domain is required")
+	}
+	for _, a := range strings.Split(admins, ",") {
+		if a = strings.ToLower(strings.TrimSpace(a)); a != "" {
+			s.Admins[a] = true
+		}
+	}
+	return s, nil
+}
+
+// config returns the OAuth configuration for req.
+func (s *SSO) config(req *http.Request) *oauth2.Config {
+	redirect := s.RedirectURL
+	if redirect == "" {
+		redirect = requestScheme(req, s.TrustProxy) + "://" + req.Host + "/auth/callback"
+	}
+	return &oauth2.Config{
+		ClientID:     s.ClientID,
+		ClientSecret: s.ClientSecret,
+		Endpoint:     s.Endpoint,
+		RedirectURL:  redirect,
+		Scopes:       []string{"openid", "email"},
+	}
+}
+
+// allowedEmail reports whether email belongs to one of the allowed domains.
+func (s *SSO) allowedEmail(email string) bool {
+	i := strings.LastIndexByte(email, '@')
+	if i < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[i+1:])
+	for _, d := range s.Domains {
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+// principal returns who signed in as email.
+func (s *SSO) principal(email string) *store.Principal {
+	if s.Admins[email] {
+		return &store.Principal{Name: email, Scope: store.ScopeAdmin}
+	}
+	return &store.Principal{Name: email, Scope: s.Scope}
+}
+
+// sessionMAC signs a session of email until expires.
+func (s *SSO) sessionMAC(email string, expires int64) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte("session\n" + email + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authenticate returns the principal of the session cookie of req, or nil
+// without a valid one. Changes must come from pages of this server.
+func (s *SSO) authenticate(req *http.Request) *store.Principal {
+	c, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead && crossOrigin(req) {
+		return nil
+	}
+	parts := strings.SplitN(c.Value, ".", 3)
+	if len(parts) != 3 {
+		return nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil
+	}
+	email := string(b)
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= expires || !hmac.Equal([]byte(parts[2]), []byte(s.sessionMAC(email, expires))) {
+		return nil
+	}
+	// The allowed domains may have changed since the sign-in.
+	if !s.allowedEmail(email) {
+		return nil
+	}
+	return s.principal(email)
+}
+
+// crossOrigin reports whether req was sent by a page of another site,
+// which mustn't act with the session of the visitor.
+func crossOrigin(req *http.Request) bool {
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return true
+	}
+	if origin := req.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err != nil || !strings.EqualFold(u.Host, req.Host)
+	}
+	return false
+}
+
+// localPath returns next if it is a path on this server, or "/admin".
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/admin"
+	}
+	return next
+}
+
+// login handles GET /auth/login?next=, sending the browser to Google.
+func (s *SSO) login(w http.ResponseWriter, req *http.Request) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to start sign-in: %v", err)
+		return
+	}
+	state := hex.EncodeToString(b)
+	next := localPath(req.URL.Query().Get("next"))
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoStateCookie,
+		Value:    state + "." + base64.RawURLEncoding.EncodeToString([]byte(next)),
+		Path:     "/auth/",
+		MaxAge:   600,
+		Secure:   requestScheme(req, s.TrustProxy) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, req, s.config(req).AuthCodeURL(state, oauth2.SetAuthURLParam("prompt", "select_account")), http.StatusFound)
+}
+
+// callback handles GET /auth/callback, where Google sends the browser back
+// with a code to exchange for the ID token naming who signed in.
+func (s *SSO) callback(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	c, err := req.Cookie(ssoStateCookie)
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, "sign-in expired, please try again")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: ssoStateCookie, Path: "/auth/", MaxAge: -1})
+	state, encodedNext := c.Value, ""
+	if i := strings.IndexByte(c.Value, '.'); i >= 0 {
+		state, encodedNext = c.Value[:i], c.Value[i+1:]
+	}
+	query := req.URL.Query()
+	if state == "" || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		writeError(w, req, http.StatusBadRequest, "sign-in state mismatch, please try again")
+		return
+	}
+	if e := query.Get("error"); e != "" {
+		writeError(w, req, http.StatusForbidden, "sign-in failed: %s", e)
+		return
+	}
+
+	tok, err := s.config(req).Exchange(req.Context(), query.Get("code"))
+	if err != nil {
+		log.Printf("warn: failed to exchange sign-in code: %v", err)
+		writeError(w, req, http.StatusBadGateway, "failed to complete sign-in")
+		return
+	}
+	rawIDToken, _ := tok.Extra("id_token").(string)
+	email, err := s.verifyIDToken(rawIDToken, time.Now())
+	if err != nil {
+		log.Printf("warn: rejected sign-in: %v", err)
+		writeError(w, req, http.StatusForbidden, "%v", err)
+		return
+	}
+
+	ttl := s.SessionTTL
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	expires := time.Now().Add(ttl).Unix()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(email)) + "." + strconv.FormatInt(expires, 10) + "." + s.sessionMAC(email, expires),
+		Path:     "/",
+		MaxAge:   int(ttl / time.Second),
+		Secure:   requestScheme(req, s.TrustProxy) == "https",
+		HttpOnly: true,
+		// Lax keeps other sites from sending writes with the session.
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Printf("%s signed in", email)
+	next, _ := base64.RawURLEncoding.DecodeString(encodedNext)
+	http.Redirect(w, req, localPath(string(next)), http.StatusFound)
+}
+
+// logout handles /auth/logout, ending the session.
+func (s *SSO) logout(w http.ResponseWriter, req *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   requestScheme(req, s.TrustProxy) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, "/", http.StatusFound)
+}
+
+// idTokenClaims are the claims of a Google ID token used for sign-in.
+type idTokenClaims struct {
+	Issuer        string `json:"iss"`
+	Audience      string `json:"aud"`
+	Expires       int64  `json:"exp"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// verifyIDToken returns the email address of an ID token received from
+// Google's token endpoint. Its signature isn't checked: it came straight
+// from Google over TLS, which OpenID Connect accepts in place of one.
+func (s *SSO) verifyIDToken(raw string, now time.Time) (string, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return "", errors.New("sign-in returned no valid ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid ID token: %w", err)
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("invalid ID token: %w", err)
+	}
+	switch {
+	case claims.Issuer != "https://accounts.google.com" && claims.Issuer != "accounts.google.com":
+		return "", fmt.Errorf("ID token issued by %q", claims.Issuer)
+	case claims.Audience != s.ClientID:
+		return "", errors.New("ID token is for another client")
+	case now.Unix() >= claims.Expires:
+		return "", errors.New("ID token expired")
+	case claims.Email == "" || !claims.EmailVerified:
+		return "", errors.New("your Google account has no verified email address")
+	}
+	email := strings.ToLower(claims.Email)
+	if !s.allowedEmail(email) {
+		return "", fmt.Errorf("%s may not sign in, use an address of %s", email, strings.Join(s.Domains, " or "))
+	}
+	return email, nil
+}
+
+// loginURL returns where to sign in before returning to req.
+func loginURL(req *http.Request) string {
+	return "/auth/login?next=" + url.QueryEscape(req.URL.RequestURI())
+}
@@ -0,0 +1,94 @@
+package httpapi
+
+import (
+	_ "embed"
+	"html/template"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/resolver"
+)
+
+//go:embed web/status.html.tmpl
+var statusTemplateText string
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"since": func(t time.Time) time.Duration { return time.Since(t).Round(time.Second) },
+	"utc":   func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05 MST") },
+}).Parse(statusTemplateText))
+
+// statusPage is what the /status page shows.
+type statusPage struct {
+	Version, Commit, GoVersion string
+	Started                    time.Time
+	Backend                    string
+	Mode                       string
+	// Links counts the loaded links, including expired ones, and Issues
+	// the problems found in them.
+	Links, Issues int
+	// LastRefresh is when the links were last loaded, and RefreshError why
+	// the refreshes since failed.
+	LastRefresh  time.Time
+	RefreshError string
+	Interval     time.Duration
+	Breaker      resolver.BreakerState
+	Failures     []resolver.RefreshFailure
+}
+
+// buildVersion returns the version of the build, as set by Version or
+// else by the Go module it was built from.
+func (s *Server) buildVersion() string {
+	if s.Version != "" {
+		return s.Version
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+	return "unknown"
+}
+
+// status handles GET /status, a page summing up the health of the server
+// for on-call engineers: its build, uptime, links, refreshes and their
+// recent failures.
+func (s *Server) status(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	links, _ := s.Links.Loaded()
+	issues, dropped, _ := s.Links.Issues()
+	last, err := s.Links.LastRefresh()
+	page := statusPage{
+		Version:     s.buildVersion(),
+		Commit:      s.Commit,
+		GoVersion:   runtime.Version(),
+		Started:     started,
+		Backend:     s.Backend,
+		Mode:        "normal",
+		Links:       links,
+		Issues:      len(issues) + dropped,
+		LastRefresh: last,
+		Interval:    s.Links.RefreshInterval(),
+		Breaker:     s.Links.BreakerState(),
+		Failures:    s.Links.RecentFailures(),
+	}
+	switch {
+	case s.Mode.Maintenance():
+		page.Mode = "maintenance"
+	case s.Mode.ReadOnly():
+		page.Mode = "read-only"
+	}
+	if err != nil {
+		page.RefreshError = err.Error()
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, page); err != nil {
+		log.Printf("warn: failed to render status page: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/resolver"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// Suffix commands appended to a shortcut, such as /go+, see SUFFIX_COMMANDS.
+const (
+	// suffixDetails shows the preview page with the details of the link.
+	suffixDetails = '+'
+	// suffixPlain answers with the destination as plain text, to copy it.
+	suffixPlain = '-'
+	// suffixReload reloads the links before redirecting, for links that
+	// were just changed.
+	suffixReload = '!'
+)
+
+const suffixCommands = "+-!"
+
+// ParseSuffixCommands parses SUFFIX_COMMANDS, the suffix commands enabled,
+// such as "+-!" or "+,!". It defaults to "+"; "none" disables them all.
+func ParseSuffixCommands(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	switch s {
+	case "":
+		return "+", nil
+	case "none":
+		return s, nil
+	}
+	var out []byte
+	for _, c := range []byte(s) {
+		switch {
+		case c == ',' || c == ' ':
+		case strings.IndexByte(suffixCommands, c) < 0:
+			return "", fmt.Errorf("unknown suffix command %q, expected %q or none", c, suffixCommands)
+		case strings.IndexByte(string(out), c) < 0:
+			out = append(out, c)
+		}
+	}
+	return string(out), nil
+}
+
+// suffixCommand splits the suffix command enabled by SuffixCommands off the
+// path of u, such as "+" of /go+, returning u unchanged and 0 if there is
+// none.
+func (s *Server) suffixCommand(u *url.URL) (*url.URL, byte) {
+	enabled := s.SuffixCommands
+	if enabled == "" {
+		enabled = "+"
+	}
+	p := u.Path
+	if p == "" || strings.IndexByte(suffixCommands, p[len(p)-1]) < 0 || strings.IndexByte(enabled, p[len(p)-1]) < 0 {
+		return u, 0
+	}
+	c := p[len(p)-1]
+	if c == suffixPlain {
+		// Shortcuts may end in '-' themselves.
+		shortcut := store.Norm.Lower(strings.Trim(resolver.DecodePath(p), "/"))
+		if link, err := s.Links.Get(shortcut); err == nil && link != nil {
+			return u, 0
+		}
+	}
+	t := *u
+	t.Path, t.RawPath = p[:len(p)-1], ""
+	return &t, c
+}
+
+// plainDestination answers with where a link leads as plain text, for
+// copying it into places that don't follow redirects.
+func plainDestination(w http.ResponseWriter, to *url.URL) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(to.String() + "\n"))
+}
@@ -0,0 +1,491 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/resolver"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// Tenants are refreshed and count clicks like the default links do with the
+// default settings.
+const (
+	tenantRefreshMin   = 5 * time.Second
+	tenantRefreshMax   = 5 * time.Minute
+	tenantClicksBuffer = 10000
+	tenantFlushEvery   = 10 * time.Second
+)
+
+var (
+	errTenantExists   = errors.New("tenant already exists")
+	errTenantNotFound = errors.New("tenant not found")
+)
+
+// TenantConfig describes a tenant, as stored in TENANTS_FILE and posted to
+// /api/tenants.
+type TenantConfig struct {
+	Name string `json:"name"`
+	// Hosts are the hosts the tenant answers on. Prefix, if set, also
+	// serves it under /{prefix}/ on the other hosts.
+	Hosts  []string `json:"hosts,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+	// Provider names the backend, configured from Settings alone, keyed
+	// like the environment variables, such as GOOGLE_SHEET_ID.
+	Provider string            `json:"provider"`
+	Settings map[string]string `json:"settings,omitempty"`
+	// Tokens are the API tokens of the tenant, in the format of API_TOKENS.
+	Tokens string `json:"tokens"`
+}
+
+// validate checks c and normalizes its hosts and prefix.
+func (c *TenantConfig) validate() error {
+	if c.Name == "" || strings.Trim(c.Name, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+		return fmt.Errorf("name %q must be lower-case letters, digits and dashes", c.Name)
+	}
+	c.Prefix = strings.ToLower(strings.Trim(c.Prefix, "/"))
+	if strings.ContainsAny(c.Prefix, "/ ") {
+		return fmt.Errorf("prefix %q must be a single path segment", c.Prefix)
+	}
+	for i, h := range c.Hosts {
+		c.Hosts[i] = tenantHost(h)
+		if c.Hosts[i] == "" {
+			return errors.New("hosts must not be empty")
+		}
+	}
+	if len(c.Hosts) == 0 && c.Prefix == "" {
+		return errors.New("a tenant needs hosts or a prefix")
+	}
+	if c.Provider == "" {
+		return errors.New("provider is required")
+	}
+	if strings.TrimSpace(c.Tokens) == "" {
+		return errors.New("tokens are required, the API of a tenant is never open")
+	}
+	return nil
+}
+
+// tenantHost lower-cases host and drops its port.
+func tenantHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+}
+
+// tenant is a running tenant.
+type tenant struct {
+	config  TenantConfig
+	srv     *Server
+	handler http.Handler
+	stop    context.CancelFunc
+}
+
+// Tenants serve other sets of links from the same deployment, each with its
+// own backend, tokens and click counts, so it can be shared by several
+// companies of a group. Requests on the hosts of a tenant, or under its
+// prefix, are served by a Server of its own; the others by the default one.
+// Admins of the default links manage tenants through /api/tenants, and they
+// are kept in TENANTS_FILE. A nil Tenants serves no tenant.
+type Tenants struct {
+	path string
+	// root is the default Server, whose settings tenants share, such as
+	// the redirect cache policy and the signing key.
+	root *Server
+	// ctx bounds the background work of tenants.
+	ctx context.Context
+
+	mu      sync.RWMutex
+	running map[string]*tenant
+}
+
+// NewTenants starts the tenants listed in the JSON file at path, if it
+// exists, until ctx is done. root must be fully configured.
+func NewTenants(ctx context.Context, path string, root *Server) (*Tenants, error) {
+	t := &Tenants{path: path, root: root, ctx: ctx, running: make(map[string]*tenant)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read tenants: %w", err)
+	}
+	var configs []TenantConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("invalid tenants file %s: %w", path, err)
+	}
+	for _, c := range configs {
+		if err := t.add(c); err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", c.Name, err)
+		}
+		log.Printf("Serving tenant %q", c.Name)
+	}
+	return t, nil
+}
+
+// add validates and starts a tenant.
+func (t *Tenants) add(c TenantConfig) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if _, ok := t.root.Links.Reserved.Reserved(c.Prefix); ok && c.Prefix != "" {
+		return fmt.Errorf("prefix %q is reserved", c.Prefix)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.running[c.Name]; ok {
+		return errTenantExists
+	}
+	for _, other := range t.running {
+		if c.Prefix != "" && c.Prefix == other.config.Prefix {
+			return fmt.Errorf("%w: prefix %q is served by tenant %q", errTenantExists, c.Prefix, other.config.Name)
+		}
+		for _, h := range c.Hosts {
+			for _, oh := range other.config.Hosts {
+				if h == oh {
+					return fmt.Errorf("%w: host %q is served by tenant %q", errTenantExists, h, other.config.Name)
+				}
+			}
+		}
+	}
+	tn, err := t.start(c)
+	if err != nil {
+		return err
+	}
+	t.running[c.Name] = tn
+	return nil
+}
+
+// start builds the Server of a tenant and starts refreshing its links.
+func (t *Tenants) start(c TenantConfig) (*tenant, error) {
+	provider, err := store.NewProviderWith(c.Provider, c.Settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure provider: %w", err)
+	}
+	tokens, _ := provider.(store.TokenStore)
+	auth, err := NewAuthenticator(c.Tokens, tokens)
+	if err != nil {
+		return nil, err
+	}
+	root := t.root
+	cache := resolver.NewCache(provider, resolver.NewScheduler(tenantRefreshMin, tenantRefreshMax), nil)
+	if cache.Reserved, err = resolver.NewReservedWords(); err != nil {
+		return nil, err
+	}
+	cache.Destinations = root.Links.Destinations
+	cache.ServeStale, cache.MaxStale = root.Links.ServeStale, root.Links.MaxStale
+	cache.Timeout = root.Links.Timeout
+	cache.BloomMinLinks = root.Links.BloomMinLinks
+	if b := root.Links.Breaker; b != nil {
+		cache.Breaker = resolver.NewBreaker(b.Failures, b.Cooldown)
+	}
+	res := resolver.NewResolver(cache, nil)
+	res.NoPrefixFallback, res.MaxFallbackDepth = root.Resolver.NoPrefixFallback, root.Resolver.MaxFallbackDepth
+	recorder, _ := provider.(store.ClickRecorder)
+	srv := &Server{
+		Links:              cache,
+		Resolver:           res,
+		Analytics:          NewAnalytics(tenantClicksBuffer, recorder),
+		Auth:               auth,
+		AuditLog:           store.NewAuditLog(provider),
+		AccessLog:          root.AccessLog,
+		SlugLength:         root.SlugLength,
+		LinkQuota:          root.LinkQuota,
+		LinkApproval:       root.LinkApproval,
+		PreviewAll:         root.PreviewAll,
+		SuffixCommands:     root.SuffixCommands,
+		MaxRequestBody:     root.MaxRequestBody,
+		RobotsTxt:          root.RobotsTxt,
+		PrivateNets:        root.PrivateNets,
+		TrustProxy:         root.TrustProxy,
+		Access:             root.Access,
+		APIAccess:          root.APIAccess,
+		Limiter:            root.Limiter,
+		GeoIP:              root.GeoIP,
+		CountryHeader:      root.CountryHeader,
+		StickySplits:       root.StickySplits,
+		CacheControl:       root.CacheControl,
+		PermanentRedirects: root.PermanentRedirects,
+		TrashRetention:     root.TrashRetention,
+		Mode:               root.Mode,
+		ProviderTimeout:    root.ProviderTimeout,
+		ReadyMaxFailing:    root.ReadyMaxFailing,
+		SigningKey:         tenantKey(root.SigningKey, c.Name),
+		UnlockTTL:          root.UnlockTTL,
+		Version:            root.Version,
+		Commit:             root.Commit,
+		Backend:            c.Provider,
+	}
+	ctx, stop := context.WithCancel(t.ctx)
+	go cache.Run(ctx)
+	go srv.Analytics.Run(ctx, tenantFlushEvery)
+	if srv.TrashRetention > 0 {
+		go cache.RunPurge(ctx, srv.TrashRetention)
+	}
+
+	mux := http.NewServeMux()
+	srv.Register(mux)
+	tn := &tenant{config: c, srv: srv, handler: mux, stop: stop}
+	return tn, nil
+}
+
+// tenantKey derives the signing key of the tenant name from key, so that
+// links signed and passwords unlocked for one tenant don't open the links of
+// the same name of the others or of the root server.
+func tenantKey(key []byte, name string) []byte {
+	if len(key) == 0 {
+		return nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("tenant\n" + name))
+	return mac.Sum(nil)
+}
+
+// Serves reports whether host belongs to a tenant.
+func (t *Tenants) Serves(host string) bool {
+	if t == nil {
+		return false
+	}
+	host = tenantHost(host)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, tn := range t.running {
+		for _, h := range tn.config.Hosts {
+			if h == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Handler routes the requests for tenants to them and the others to next.
+func (t *Tenants) Handler(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := tenantHost(req.Host)
+		segment := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)[0]
+		t.mu.RLock()
+		var byHost, byPrefix *tenant
+		for _, tn := range t.running {
+			for _, h := range tn.config.Hosts {
+				if h == host {
+					byHost = tn
+				}
+			}
+			if tn.config.Prefix != "" && strings.EqualFold(tn.config.Prefix, segment) {
+				byPrefix = tn
+			}
+		}
+		t.mu.RUnlock()
+		switch {
+		case byHost != nil:
+			byHost.handler.ServeHTTP(w, req)
+		case byPrefix != nil && req.URL.Path == "/"+segment:
+			http.Redirect(w, req, req.URL.Path+"/", http.StatusMovedPermanently)
+		case byPrefix != nil:
+			http.StripPrefix("/"+segment, byPrefix.handler).ServeHTTP(w, req)
+		default:
+			next.ServeHTTP(w, req)
+		}
+	})
+}
+
+// Flush writes the buffered clicks of every tenant.
+func (t *Tenants) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var errs []string
+	for name, tn := range t.running {
+		if err := tn.srv.Analytics.Flush(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// remove stops a tenant.
+func (t *Tenants) remove(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tn, ok := t.running[name]
+	if !ok {
+		return errTenantNotFound
+	}
+	delete(t.running, name)
+	tn.stop()
+	return nil
+}
+
+// save writes the configuration of the running tenants to the file, through
+// a temporary file so that a crash leaves the previous version.
+func (t *Tenants) save() error {
+	t.mu.RLock()
+	configs := make([]TenantConfig, 0, len(t.running))
+	for _, tn := range t.running {
+		configs = append(configs, tn.config)
+	}
+	t.mu.RUnlock()
+	sort.Slice(configs, func(i, j int) bool { return configs[i].Name < configs[j].Name })
+	b, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(t.path), ".tenants-*")
+	if err != nil {
+		return fmt.Errorf("unable to save tenants: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to save tenants: %w", err)
+	}
+	// Tokens and backend credentials are in there.
+	if err := f.Chmod(0o600); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to save tenants: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to save tenants: %w", err)
+	}
+	if err := os.Rename(f.Name(), t.path); err != nil {
+		return fmt.Errorf("unable to save tenants: %w", err)
+	}
+	return nil
+}
+
+// tenantResponse describes a tenant without its secrets: only the names of
+// its settings and the number of its tokens.
+type tenantResponse struct {
+	Name     string   `json:"name"`
+	Hosts    []string `json:"hosts,omitempty"`
+	Prefix   string   `json:"prefix,omitempty"`
+	Provider string   `json:"provider"`
+	Settings []string `json:"settings"`
+	Tokens   int      `json:"tokens"`
+	Links    int      `json:"links"`
+}
+
+func (tn *tenant) response() tenantResponse {
+	c := tn.config
+	settings := make([]string, 0, len(c.Settings))
+	for k := range c.Settings {
+		settings = append(settings, k)
+	}
+	sort.Strings(settings)
+	links, _ := tn.srv.Links.Loaded()
+	return tenantResponse{
+		Name:     c.Name,
+		Hosts:    c.Hosts,
+		Prefix:   c.Prefix,
+		Provider: c.Provider,
+		Settings: settings,
+		Tokens:   len(strings.Fields(strings.NewReplacer(";", " ").Replace(c.Tokens))),
+		Links:    links,
+	}
+}
+
+// tenantsAPI handles /api/tenants: GET lists the tenants and POST starts a
+// new one, answering once its links were loaded or the provider failed.
+func (s *Server) tenantsAPI(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		s.Tenants.mu.RLock()
+		out := make([]tenantResponse, 0, len(s.Tenants.running))
+		for _, tn := range s.Tenants.running {
+			out = append(out, tn.response())
+		}
+		s.Tenants.mu.RUnlock()
+		sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodPost:
+		var c TenantConfig
+		dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, s.maxBody()))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&c); err != nil {
+			writeError(w, req, http.StatusBadRequest, "invalid request body: %v", err)
+			return
+		}
+		if c.Prefix != "" {
+			// The prefix would hide the default links under it.
+			if l, err := s.Links.Get(strings.ToLower(strings.Trim(c.Prefix, "/"))); err == nil && l != nil {
+				writeError(w, req, http.StatusConflict, "prefix %q is a shortcut", c.Prefix)
+				return
+			}
+		}
+		if err := s.Tenants.add(c); errors.Is(err, errTenantExists) {
+			writeError(w, req, http.StatusConflict, "%v", err)
+			return
+		} else if err != nil {
+			writeError(w, req, http.StatusBadRequest, "invalid tenant: %v", err)
+			return
+		}
+		if err := s.Tenants.save(); err != nil {
+			s.Tenants.remove(c.Name)
+			writeError(w, req, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		s.Tenants.mu.RLock()
+		tn := s.Tenants.running[c.Name]
+		s.Tenants.mu.RUnlock()
+		if err := tn.srv.Links.Refresh(req.Context()); err != nil {
+			log.Printf("warn: tenant %q: failed to load links: %v", c.Name, err)
+		}
+		log.Printf("added tenant %q", c.Name)
+		writeJSON(w, http.StatusCreated, tn.response())
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+	}
+}
+
+// tenantResource handles /api/tenants/{name}: GET describes the tenant and
+// DELETE stops serving it. Its links stay in its backend.
+func (s *Server) tenantResource(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/api/tenants/")
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		s.Tenants.mu.RLock()
+		tn := s.Tenants.running[name]
+		s.Tenants.mu.RUnlock()
+		if tn == nil {
+			writeError(w, req, http.StatusNotFound, "tenant %q not found", name)
+			return
+		}
+		writeJSON(w, http.StatusOK, tn.response())
+	case http.MethodDelete:
+		if err := s.Tenants.remove(name); err != nil {
+			writeError(w, req, http.StatusNotFound, "tenant %q not found", name)
+			return
+		}
+		if err := s.Tenants.save(); err != nil {
+			writeError(w, req, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		log.Printf("removed tenant %q", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+	}
+}
@@ -0,0 +1,125 @@
+package httpapi
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//go:embed web/tools.html.tmpl
+var toolsTemplateText string
+
+var toolsTemplate = template.Must(template.New("tools").Parse(toolsTemplateText))
+
+// ParseGoHostnames parses GO_HOSTNAMES, the comma-separated hostnames such as
+// "go" that the PAC file of /tools sends to the server. It defaults to "go".
+func ParseGoHostnames(s string) ([]string, error) {
+	var hosts []string
+	for _, h := range strings.Split(s, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h == "" {
+			continue
+		}
+		if strings.Trim(h, "abcdefghijklmnopqrstuvwxyz0123456789-.") != "" {
+			return nil, fmt.Errorf("%q is not a hostname", h)
+		}
+		hosts = append(hosts, h)
+	}
+	if len(hosts) == 0 {
+		hosts = []string{"go"}
+	}
+	return hosts, nil
+}
+
+// pacProxy is the proxy the PAC file names: PACProxy, or the host the file
+// was fetched from.
+func (s *Server) pacProxy(req *http.Request) string {
+	if s.PACProxy != "" {
+		return s.PACProxy
+	}
+	scheme, port := requestScheme(req, s.TrustProxy), "80"
+	if scheme == "https" {
+		port = "443"
+	}
+	host := req.Host
+	if h, p, err := net.SplitHostPort(req.Host); err == nil {
+		host, port = h, p
+	}
+	if scheme == "https" {
+		return "HTTPS " + net.JoinHostPort(host, port)
+	}
+	return "PROXY " + net.JoinHostPort(host, port)
+}
+
+// goHostnames returns GoHostnames, defaulting to "go".
+func (s *Server) goHostnames() []string {
+	if len(s.GoHostnames) == 0 {
+		return []string{"go"}
+	}
+	return s.GoHostnames
+}
+
+// proxyPAC handles GET /tools/proxy.pac, a proxy auto-config file sending
+// requests for the go hostnames to the server, so http://go/docs works
+// without a DNS entry for go. The server answers those requests like any
+// other, since Go's server accepts absolute request URLs.
+func (s *Server) proxyPAC(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	hosts := s.goHostnames()
+	conds := make([]string, len(hosts))
+	for i, h := range hosts {
+		conds[i] = "host == " + strconv.Quote(h)
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	fmt.Fprintf(w, "// Sends %s links to the shortener at %s.\n", strings.Join(hosts, "/, ")+"/", req.Host)
+	fmt.Fprintf(w, "function FindProxyForURL(url, host) {\n")
+	fmt.Fprintf(w, "  if (%s) {\n", strings.Join(conds, " || "))
+	fmt.Fprintf(w, "    return %s;\n", strconv.Quote(s.pacProxy(req)))
+	fmt.Fprintf(w, "  }\n")
+	fmt.Fprintf(w, "  return \"DIRECT\";\n")
+	fmt.Fprintf(w, "}\n")
+}
+
+// tools handles GET /tools, a page explaining how to reach the shortener as
+// go/ from a browser: the PAC file, bookmarklets and the search engine.
+func (s *Server) tools(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	// With CANONICAL_URL set, requests only get here on the canonical host.
+	base := requestScheme(req, s.TrustProxy) + "://" + req.Host
+	quoted := strconv.Quote(base)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := toolsTemplate.Execute(w, struct {
+		Base     string
+		Hostname string
+		PAC      string
+		Proxy    string
+		GoLink   template.URL
+		Shorten  template.URL
+	}{
+		Base:     base,
+		Hostname: s.goHostnames()[0],
+		PAC:      base + "/tools/proxy.pac",
+		Proxy:    s.pacProxy(req),
+		// Bookmarklets are trusted javascript: URLs built from the base,
+		// which is quoted as a string literal.
+		GoLink:  template.URL(`javascript:(function(){var s=prompt("Shortcut");if(s)location.href=` + quoted + `+"/"+encodeURI(s)})()`),
+		Shorten: template.URL(`javascript:location.href=` + quoted + `+"/new?url="+encodeURIComponent(location.href)`),
+	})
+	if err != nil {
+		log.Printf("warn: failed to render tools page: %v", err)
+	}
+}
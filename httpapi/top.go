@@ -0,0 +1,191 @@
+package httpapi
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+//go:embed web/popular.html.tmpl
+var popularTemplateText string
+
+var popularTemplate = template.Must(template.New("popular").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}).Parse(popularTemplateText))
+
+const (
+	defaultTopWindow = "7d"
+	maxTopWindowDays = 365
+	defaultTopLimit  = 50
+	maxTopLimit      = 500
+)
+
+// popularWindows are the windows the /popular page links to.
+var popularWindows = []string{"1d", "7d", "30d", "90d"}
+
+type topLink struct {
+	Shortcut    string `json:"shortcut"`
+	URL         string `json:"url,omitempty"`
+	Description string `json:"description,omitempty"`
+	Clicks      int64  `json:"clicks"`
+}
+
+type topResponse struct {
+	Window string    `json:"window"`
+	Since  time.Time `json:"since"`
+	Links  []topLink `json:"links"`
+}
+
+// parseWindow parses a window of whole days such as "7d", returning the
+// start of the first day counted.
+func parseWindow(v string, now time.Time) (time.Time, error) {
+	days, err := strconv.Atoi(strings.TrimSuffix(v, "d"))
+	if err != nil || !strings.HasSuffix(v, "d") || days < 1 || days > maxTopWindowDays {
+		return time.Time{}, fmt.Errorf("window must be a number of days between 1d and %dd", maxTopWindowDays)
+	}
+	return now.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-days), nil
+}
+
+// topLinks ranks the links of all by their clicks since, most clicked first,
+// or least clicked first when least is set, which also lists links without
+// clicks. Private links are left out unless req may see them.
+func (s *Server) topLinks(req *http.Request, all store.URLMap, since time.Time, limit int, least bool) ([]topLink, error) {
+	private := s.canViewPrivate(req)
+	shortcuts := make([]string, 0, len(all))
+	for k, l := range all {
+		if private || !l.Private {
+			shortcuts = append(shortcuts, k)
+		}
+	}
+	clicks, err := s.Analytics.ClicksSince(req.Context(), shortcuts, since)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]topLink, 0, len(shortcuts))
+	for _, k := range shortcuts {
+		if clicks[k] == 0 && !least {
+			continue
+		}
+		l := all[k]
+		t := topLink{Shortcut: k, Description: l.Description, Clicks: clicks[k]}
+		if l.URL != nil {
+			t.URL = l.URL.String()
+		}
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Clicks != out[j].Clicks {
+			return (out[i].Clicks > out[j].Clicks) != least
+		}
+		return out[i].Shortcut < out[j].Shortcut
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// topStats handles GET /api/stats/top, listing the most clicked links over
+// ?window= days (default 7d), up to ?limit=. ?order=least lists the least
+// clicked first instead, including links nobody clicked, to find those to
+// prune.
+func (s *Server) topStats(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, req, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	query := req.URL.Query()
+	window := query.Get("window")
+	if window == "" {
+		window = defaultTopWindow
+	}
+	since, err := parseWindow(window, time.Now())
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, "%v", err)
+		return
+	}
+	limit := defaultTopLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTopLimit {
+			writeError(w, req, http.StatusBadRequest, "limit must be between 1 and %d", maxTopLimit)
+			return
+		}
+		limit = n
+	}
+	var least bool
+	switch order := query.Get("order"); order {
+	case "", "most":
+	case "least":
+		least = true
+	default:
+		writeError(w, req, http.StatusBadRequest, "order must be most or least")
+		return
+	}
+
+	all, err := s.Links.All()
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to load links: %v", err)
+		return
+	}
+	links, err := s.topLinks(req, all, since, limit, least)
+	if err != nil {
+		writeError(w, req, http.StatusBadGateway, "failed to load clicks: %v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, topResponse{Window: window, Since: since, Links: links})
+}
+
+// popular handles GET /popular, a leaderboard of the most clicked links of
+// the namespace of the host over ?window= days.
+func (s *Server) popular(w http.ResponseWriter, req *http.Request) {
+	window := req.URL.Query().Get("window")
+	if window == "" {
+		window = defaultTopWindow
+	}
+	since, err := parseWindow(window, time.Now())
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, "%v", err)
+		return
+	}
+	all, err := s.Links.All()
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, "failed to load links: %v", err)
+		return
+	}
+	// Clicks are counted by full shortcut, so scope after ranking.
+	ns := s.Domains.Namespace(req.Host)
+	for k := range all {
+		if kns, _ := s.Domains.Split(k); kns != ns {
+			delete(all, k)
+		}
+	}
+	links, err := s.topLinks(req, all, since, defaultTopLimit, false)
+	if err != nil {
+		writeError(w, req, http.StatusBadGateway, "failed to load clicks: %v", err)
+		return
+	}
+	for i := range links {
+		_, links[i].Shortcut = s.Domains.Split(links[i].Shortcut)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = popularTemplate.Execute(w, struct {
+		Window  string
+		Windows []string
+		Links   []topLink
+	}{window, popularWindows, links})
+	if err != nil {
+		log.Printf("warn: failed to render popular page: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package httpapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/store"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP finds the country of client addresses in a MaxMind database such as
+// GeoLite2-Country.
+type GeoIP struct {
+	db *maxminddb.Reader
+}
+
+// OpenGeoIP opens the database at path.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoIP database: %w", err)
+	}
+	return &GeoIP{db: db}, nil
+}
+
+// Country returns the ISO code of the country of ip, or "" when unknown.
+func (g *GeoIP) Country(ip net.IP) string {
+	if g == nil || ip == nil {
+		return ""
+	}
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := g.db.Lookup(ip, &rec); err != nil {
+		log.Printf("warn: GeoIP lookup of %s failed: %v", ip, err)
+		return ""
+	}
+	return rec.Country.ISOCode
+}
+
+// visitorCookie holds the ID of a visitor when StickySplits is on.
+const visitorCookie = "shortener_visitor"
+
+// RequestVisitor describes the client of req as far as its headers tell:
+// its device classes and preferred language.
+func RequestVisitor(req *http.Request) store.Visitor {
+	return store.Visitor{
+		Devices:  deviceClasses(req.UserAgent()),
+		Language: preferredLanguage(req.Header.Get("Accept-Language")),
+	}
+}
+
+// visitor describes the client of req for choosing among link variants. The
+// country comes from the CountryHeader set by a CDN or proxy, else from the
+// GeoIP database. With StickySplits, clients without a visitor cookie get a
+// new ID, see setVisitorCookie.
+func (s *Server) visitor(req *http.Request) store.Visitor {
+	v := RequestVisitor(req)
+	if s.StickySplits {
+		if c, err := req.Cookie(visitorCookie); err == nil && c.Value != "" {
+			v.ID = c.Value
+		} else {
+			var b [12]byte
+			if _, err := rand.Read(b[:]); err == nil {
+				v.ID = hex.EncodeToString(b[:])
+			}
+		}
+	}
+	if s.CountryHeader != "" {
+		v.Country = strings.ToUpper(strings.TrimSpace(req.Header.Get(s.CountryHeader)))
+	}
+	if v.Country == "" && s.GeoIP != nil {
+		v.Country = s.GeoIP.Country(net.ParseIP(clientIP(req, s.TrustProxy)))
+	}
+	return v
+}
+
+// setVisitorCookie stores the ID of v unless req already sent it.
+func (s *Server) setVisitorCookie(w http.ResponseWriter, req *http.Request, v store.Visitor) {
+	if v.ID == "" {
+		return
+	}
+	if c, err := req.Cookie(visitorCookie); err == nil && c.Value == v.ID {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     visitorCookie,
+		Value:    v.ID,
+		Path:     "/",
+		MaxAge:   int(365 * 24 * time.Hour / time.Second),
+		Secure:   requestScheme(req, s.TrustProxy) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// deviceClasses classifies a User-Agent, roughly: phones and tablets are
+// mobile, everything else desktop.
+func deviceClasses(ua string) []string {
+	switch {
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"), strings.Contains(ua, "iPod"):
+		return []string{store.DeviceIOS, store.DeviceMobile}
+	case strings.Contains(ua, "Android"):
+		return []string{store.DeviceAndroid, store.DeviceMobile}
+	case strings.Contains(ua, "Mobile"):
+		return []string{store.DeviceMobile}
+	case ua == "":
+		return nil
+	}
+	return []string{store.DeviceDesktop}
+}
+
+// preferredLanguage returns the primary subtag of the language of an
+// Accept-Language header with the highest weight.
+func preferredLanguage(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			if f = strings.TrimSpace(f); strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = strings.SplitN(tag, "-", 2)[0], q
+		}
+	}
+	return best
+}
@@ -0,0 +1,387 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+	"github.com/denizyoldas/url-shorter/resolver"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// Webhook events.
+const (
+	eventLinkCreated = "link.created"
+	eventLinkUpdated = "link.updated"
+	eventLinkDeleted = "link.deleted"
+	eventLinkClicks  = "link.clicks"
+	eventLinkBudget  = "link.budget_exhausted"
+	eventLinkPending = "link.awaiting_approval"
+)
+
+var webhookEvents = []string{eventLinkCreated, eventLinkUpdated, eventLinkDeleted, eventLinkClicks, eventLinkBudget, eventLinkPending}
+
+const (
+	// webhookQueueSize is the number of events an endpoint may have pending
+	// before new ones are dropped.
+	webhookQueueSize = 1000
+	// webhookClickInterval is how often click counts are compared with the
+	// thresholds.
+	webhookClickInterval = 30 * time.Second
+	webhookMaxBackoff    = 5 * time.Minute
+)
+
+var webhookDeliveriesTotal = metrics.NewCounterVec("shortener_webhook_deliveries_total",
+	"Webhook deliveries, by result: ok, failed or dropped.", "result")
+
+// webhookEvent is the JSON body of a webhook.
+type webhookEvent struct {
+	// ID is the same for an event seen by several replicas, so receivers
+	// can drop duplicates.
+	ID       string    `json:"id"`
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Shortcut string    `json:"shortcut"`
+	Link     *apiLink  `json:"link,omitempty"`
+	Clicks   int64     `json:"clicks,omitempty"`
+	// Text summarizes the event for chat webhooks such as Slack's.
+	Text string `json:"text"`
+}
+
+// webhookEndpoint is a receiver and its queue of encoded events.
+type webhookEndpoint struct {
+	url   string
+	queue chan webhookDelivery
+}
+
+type webhookDelivery struct {
+	id, event string
+	body      []byte
+}
+
+// Webhooks posts link events to the configured endpoints: links created,
+// updated and deleted, whether through the API or the provider, links
+// reaching click thresholds and links using up their click budget.
+type Webhooks struct {
+	endpoints []*webhookEndpoint
+	secret    []byte
+	events    map[string]bool
+	client    *http.Client
+
+	// ClickThresholds are the totals at which link.clicks fires, ascending.
+	ClickThresholds []int64
+	// MaxAttempts bounds the deliveries of an event to an endpoint.
+	MaxAttempts int
+
+	mu sync.Mutex
+	// clicks counts the clicks of each shortcut since the last check.
+	clicks map[string]int64
+}
+
+// NewWebhooks returns webhooks posting events to urls, separated by commas
+// or whitespace. events limits them to a comma-separated list of event
+// names; empty means all. Bodies are signed with secret, if set.
+func NewWebhooks(urls, events, secret string) (*Webhooks, error) {
+	w := &Webhooks{
+		secret:      []byte(secret),
+		events:      make(map[string]bool),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: 5,
+		clicks:      make(map[string]int64),
+	}
+	for _, raw := range strings.FieldsFunc(urls, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	}) {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook URL %q, expected http(s)://host/path", raw)
+		}
+		w.endpoints = append(w.endpoints, &webhookEndpoint{url: raw, queue: make(chan webhookDelivery, webhookQueueSize)})
+	}
+	for _, e := range strings.Split(events, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		known := false
+		for _, k := range webhookEvents {
+			known = known || k == e
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown webhook event %q, expected one of %s", e, strings.Join(webhookEvents, ", "))
+		}
+		w.events[e] = true
+	}
+	if len(w.events) == 0 {
+		for _, e := range webhookEvents {
+			w.events[e] = true
+		}
+	}
+	return w, nil
+}
+
+// ParseClickThresholds parses a comma-separated list of click totals.
+func ParseClickThresholds(s string) ([]int64, error) {
+	var out []int64
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(f, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid click threshold %q", f)
+		}
+		out = append(out, n)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out, nil
+}
+
+// Clicked counts a click of shortcut towards the click thresholds.
+func (w *Webhooks) Clicked(shortcut string) {
+	if w == nil || len(w.ClickThresholds) == 0 || !w.events[eventLinkClicks] {
+		return
+	}
+	w.mu.Lock()
+	w.clicks[shortcut]++
+	w.mu.Unlock()
+}
+
+// Run delivers the changes of links and the thresholds reached according to
+// clicks until ctx is cancelled.
+func (w *Webhooks) Run(ctx context.Context, links *resolver.Cache, clicks *Analytics) {
+	for _, ep := range w.endpoints {
+		go w.deliverAll(ctx, ep)
+	}
+
+	changes, stop := links.Watch()
+	defer func() { stop() }()
+	t := time.NewTicker(webhookClickInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case events, ok := <-changes:
+			if !ok {
+				log.Printf("warn: webhooks fell behind on link changes, some were not sent")
+				changes, stop = links.Watch()
+				continue
+			}
+			for _, e := range events {
+				w.linkChanged(e)
+			}
+		case <-t.C:
+			w.checkClicks(ctx, clicks)
+		}
+	}
+}
+
+// linkChanged sends the webhook of a change found by a refresh.
+func (w *Webhooks) linkChanged(e resolver.LinkEvent) {
+	link := linkResponse(e.Shortcut, e.Link)
+	ev := webhookEvent{Shortcut: e.Shortcut, Link: &link}
+	switch e.Type {
+	case resolver.LinkAdded:
+		ev.Event, ev.Text = eventLinkCreated, fmt.Sprintf("%s was created, leading to %s", e.Shortcut, targetSummary(e.Link))
+	case resolver.LinkChanged:
+		ev.Event, ev.Text = eventLinkUpdated, fmt.Sprintf("%s now leads to %s", e.Shortcut, targetSummary(e.Link))
+	case resolver.LinkRemoved:
+		ev.Event, ev.Text = eventLinkDeleted, fmt.Sprintf("%s was deleted", e.Shortcut)
+	default:
+		return
+	}
+	w.send(ev, linkRevision(e.Shortcut, e.Link))
+}
+
+// checkClicks sends link.clicks for each threshold crossed by the clicks
+// counted since the last check.
+func (w *Webhooks) checkClicks(ctx context.Context, clicks *Analytics) {
+	w.mu.Lock()
+	counted := w.clicks
+	w.clicks = make(map[string]int64)
+	w.mu.Unlock()
+	if len(counted) == 0 {
+		return
+	}
+
+	shortcuts := make([]string, 0, len(counted))
+	for k := range counted {
+		shortcuts = append(shortcuts, k)
+	}
+	sort.Strings(shortcuts)
+	totals, err := clicks.Totals(ctx, shortcuts)
+	if err != nil {
+		log.Printf("warn: failed to load click totals for webhooks: %v", err)
+		return
+	}
+	for _, k := range shortcuts {
+		total := totals[k]
+		prev := total - counted[k]
+		for _, n := range w.ClickThresholds {
+			if prev < n && n <= total {
+				w.send(webhookEvent{
+					Event:    eventLinkClicks,
+					Shortcut: k,
+					Clicks:   n,
+					Text:     fmt.Sprintf("%s reached %d clicks", k, n),
+				}, strconv.FormatInt(n, 10))
+			}
+		}
+	}
+}
+
+// BudgetExhausted sends link.budget_exhausted for shortcut, whose link used
+// up its budget of clicks, so that its owner learns it is gone.
+func (w *Webhooks) BudgetExhausted(shortcut string, link *store.Link, budget int64) {
+	if w == nil {
+		return
+	}
+	text := fmt.Sprintf("%s used up its %d clicks and now answers 410 Gone", shortcut, budget)
+	if link.Owner != "" {
+		text += ", owned by " + link.Owner
+	}
+	l := linkResponse(shortcut, link)
+	w.send(webhookEvent{
+		Event:    eventLinkBudget,
+		Shortcut: shortcut,
+		Link:     &l,
+		Clicks:   budget,
+		Text:     text,
+	}, strconv.FormatInt(budget, 10))
+}
+
+// AwaitingApproval sends link.awaiting_approval for shortcut, whose link
+// needs an admin to approve it before it resolves, see LINK_APPROVAL.
+func (w *Webhooks) AwaitingApproval(shortcut string, link *store.Link) {
+	if w == nil {
+		return
+	}
+	text := fmt.Sprintf("%s, leading to %s, awaits approval", shortcut, targetSummary(link))
+	if link.Owner != "" {
+		text += ", asked for by " + link.Owner
+	}
+	l := linkResponse(shortcut, link)
+	w.send(webhookEvent{
+		Event:    eventLinkPending,
+		Shortcut: shortcut,
+		Link:     &l,
+		Text:     text,
+	}, targetSummary(link))
+}
+
+// send queues ev for every endpoint. The ID is derived from the event, the
+// shortcut and key, which tells this occurrence of the event apart.
+func (w *Webhooks) send(ev webhookEvent, key string) {
+	if !w.events[ev.Event] {
+		return
+	}
+	sum := sha256.Sum256([]byte(ev.Event + "\n" + ev.Shortcut + "\n" + key))
+	ev.ID = hex.EncodeToString(sum[:12])
+	ev.Time = time.Now().UTC()
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("warn: failed to encode webhook: %v", err)
+		return
+	}
+	for _, ep := range w.endpoints {
+		select {
+		case ep.queue <- webhookDelivery{id: ev.ID, event: ev.Event, body: body}:
+		default:
+			webhookDeliveriesTotal.Inc("dropped")
+			log.Printf("warn: webhook queue of %s is full, dropping %s of %q", ep.url, ev.Event, ev.Shortcut)
+		}
+	}
+}
+
+// deliverAll posts the events queued for ep in order until ctx is
+// cancelled.
+func (w *Webhooks) deliverAll(ctx context.Context, ep *webhookEndpoint) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d := <-ep.queue:
+			w.deliver(ctx, ep.url, d)
+		}
+	}
+}
+
+// errPermanent marks deliveries that retrying won't fix.
+var errPermanent = errors.New("not retrying")
+
+// deliver posts d to endpoint, retrying with exponential backoff and jitter
+// on network errors, 429 and 5xx responses.
+func (w *Webhooks) deliver(ctx context.Context, endpoint string, d webhookDelivery) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := w.post(ctx, endpoint, d)
+		if err == nil {
+			webhookDeliveriesTotal.Inc("ok")
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if attempt >= w.MaxAttempts || errors.Is(err, errPermanent) {
+			webhookDeliveriesTotal.Inc("failed")
+			log.Printf("warn: giving up on webhook %s %s after %d attempts: %v", d.event, d.id, attempt, err)
+			return
+		}
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sleep):
+		}
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+func (w *Webhooks) post(ctx context.Context, endpoint string, d webhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(d.body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "url-shortener-webhooks")
+	req.Header.Set("X-Shortener-Event", d.event)
+	req.Header.Set("X-Shortener-Delivery", d.id)
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(d.body)
+		req.Header.Set("X-Shortener-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("%s answered %s", endpoint, resp.Status)
+	default:
+		return fmt.Errorf("%w: %s answered %s", errPermanent, endpoint, resp.Status)
+	}
+}
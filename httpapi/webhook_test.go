@@ -0,0 +1,138 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/resolver"
+	"github.com/denizyoldas/url-shorter/store"
+	"github.com/denizyoldas/url-shorter/store/storetest"
+)
+
+// webhookReceiver records the events posted to it, failing the first fail
+// deliveries with 503.
+type webhookReceiver struct {
+	t      *testing.T
+	mu     sync.Mutex
+	fail   int
+	events chan webhookEvent
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	mac := hmac.New(sha256.New, []byte("hook secret"))
+	mac.Write(body)
+	if got, want := req.Header.Get("X-Shortener-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		r.t.Errorf("signature = %q, want %q", got, want)
+	}
+
+	r.mu.Lock()
+	fail := r.fail > 0
+	r.fail--
+	r.mu.Unlock()
+	if fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var ev webhookEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		r.t.Errorf("invalid body %s: %v", body, err)
+	}
+	r.events <- ev
+}
+
+func (r *webhookReceiver) next() webhookEvent {
+	r.t.Helper()
+	select {
+	case ev := <-r.events:
+		return ev
+	case <-time.After(5 * time.Second):
+		r.t.Fatal("no webhook received")
+		return webhookEvent{}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	recv := &webhookReceiver{t: t, fail: 1, events: make(chan webhookEvent, 10)}
+	ts := httptest.NewServer(recv)
+	defer ts.Close()
+
+	hooks, err := NewWebhooks(ts.URL, "", "hook secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks.ClickThresholds = []int64{2, 3}
+
+	p := storetest.New(map[string]string{"go": "https://go.dev/"})
+	cache := resolver.NewCache(p, resolver.NewScheduler(time.Minute, time.Minute), nil)
+	if err := cache.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	clicks := NewAnalytics(16, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hooks.Run(ctx, cache, clicks)
+	// Let Run subscribe before the links change.
+	time.Sleep(50 * time.Millisecond)
+
+	p.Set("docs", storetest.Link("https://docs.example.com/"))
+	p.Delete(ctx, "go")
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// The first delivery failed and was retried.
+	if ev := recv.next(); ev.Event != eventLinkCreated || ev.Shortcut != "docs" || ev.Link == nil || ev.Link.URL != "https://docs.example.com/" {
+		t.Errorf("first event = %+v", ev)
+	}
+	if ev := recv.next(); ev.Event != eventLinkDeleted || ev.Shortcut != "go" || ev.ID == "" {
+		t.Errorf("second event = %+v", ev)
+	}
+
+	// Three clicks cross both thresholds in one check.
+	for i := 0; i < 3; i++ {
+		clicks.Record(store.Click{Shortcut: "docs", Time: time.Now()})
+		hooks.Clicked("docs")
+	}
+	hooks.checkClicks(ctx, clicks)
+	for _, want := range []int64{2, 3} {
+		if ev := recv.next(); ev.Event != eventLinkClicks || ev.Clicks != want {
+			t.Errorf("event = %+v, want %d clicks", ev, want)
+		}
+	}
+	// Further clicks cross none.
+	clicks.Record(store.Click{Shortcut: "docs", Time: time.Now()})
+	hooks.Clicked("docs")
+	hooks.checkClicks(ctx, clicks)
+	select {
+	case ev := <-recv.events:
+		t.Errorf("unexpected event %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNewWebhooks(t *testing.T) {
+	w, err := NewWebhooks("https://a.example.com/hook, https://b.example.com/hook", "link.created,link.deleted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(w.endpoints) != 2 || !w.events[eventLinkCreated] || w.events[eventLinkUpdated] {
+		t.Errorf("endpoints %d, events %v", len(w.endpoints), w.events)
+	}
+	for _, bad := range [][2]string{{"ftp://a.example.com", ""}, {"https://a.example.com", "link.renamed"}} {
+		if _, err := NewWebhooks(bad[0], bad[1], ""); err == nil {
+			t.Errorf("NewWebhooks(%q, %q) succeeded", bad[0], bad[1])
+		}
+	}
+	if got, err := ParseClickThresholds("1000, 100"); err != nil || len(got) != 2 || got[0] != 100 {
+		t.Errorf("ParseClickThresholds = %v, %v", got, err)
+	}
+}
@@ -0,0 +1,167 @@
+package env
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Kind is the type of the value of a setting.
+type Kind int
+
+const (
+	StringKind Kind = iota
+	BoolKind
+	IntKind
+	FloatKind
+	DurationKind
+)
+
+// Settings are the known settings by name, such as REFRESH_MAX_INTERVAL.
+type Settings map[string]Kind
+
+// has reports whether key names a setting, also when it is prefixed with
+// the name of a source of PROVIDERS, such as TEAM_SHEET_NAME.
+func (s Settings) has(key string) bool {
+	if _, ok := s[key]; ok {
+		return true
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] != '_' {
+			continue
+		}
+		if _, ok := s[key[i+1:]]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadFile sets the settings of the YAML file at path as environment
+// variables, except those set in the environment already, which override
+// the file. Keys are the names of known settings in any case, such as
+// refresh_max_interval: 10m; lists are joined with commas.
+func LoadFile(path string, known Settings) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make(map[string]string, len(doc))
+	var problems []string
+	for _, k := range keys {
+		name := strings.ToUpper(strings.TrimSpace(k))
+		if !known.has(name) {
+			problems = append(problems, fmt.Sprintf("unknown setting %q", k))
+			continue
+		}
+		if _, dup := values[name]; dup {
+			problems = append(problems, fmt.Sprintf("%s is set twice", name))
+			continue
+		}
+		v, err := settingValue(doc[k])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid %s: %v", name, err))
+			continue
+		}
+		values[name] = v
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	for name, v := range values {
+		if _, set := os.LookupEnv(name); set || v == "" {
+			continue
+		}
+		if err := os.Setenv(name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settingValue renders a value of a settings file as an environment
+// variable would hold it.
+func settingValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := settingValue(item)
+			if err != nil {
+				return "", err
+			}
+			if _, nested := item.([]interface{}); nested {
+				return "", errors.New("lists can't be nested")
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", errors.New("expected a value or a list of values")
+}
+
+// Validate checks the values of the known settings in the environment
+// against their kind, returning every problem rather than the first, so a
+// deployment can be fixed in one go. Ranges are checked where the settings
+// are read.
+func Validate(known Settings) []error {
+	names := make([]string, 0, len(known))
+	for name := range known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		var ok bool
+		var want string
+		switch known[name] {
+		case StringKind:
+			ok = true
+		case BoolKind:
+			_, err := strconv.ParseBool(v)
+			ok, want = err == nil, "true or false"
+		case IntKind:
+			_, err := strconv.Atoi(v)
+			ok, want = err == nil, "an integer"
+		case FloatKind:
+			f, err := strconv.ParseFloat(v, 64)
+			ok, want = err == nil && !math.IsInf(f, 0) && !math.IsNaN(f), "a number"
+		case DurationKind:
+			_, err := time.ParseDuration(v)
+			ok, want = err == nil, `a duration such as "30s"`
+		}
+		if !ok {
+			errs = append(errs, fmt.Errorf("invalid %s %q, expected %s", name, v, want))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,87 @@
+package env
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testSettings = Settings{
+	"TEST_NAME":     StringKind,
+	"TEST_ENABLED":  BoolKind,
+	"TEST_COUNT":    IntKind,
+	"TEST_INTERVAL": DurationKind,
+}
+
+func loadTestFile(t *testing.T, yaml string) error {
+	t.Helper()
+	for name := range testSettings {
+		os.Unsetenv(name)
+	}
+	t.Cleanup(func() {
+		for name := range testSettings {
+			os.Unsetenv(name)
+		}
+	})
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadFile(path, testSettings)
+}
+
+func TestLoadFile(t *testing.T) {
+	os.Setenv("TEST_COUNT", "7")
+	err := loadTestFile(t, "test_name: [a, b]\ntest_enabled: true\ntest_interval: 2m\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"TEST_NAME":     "a,b",
+		"TEST_ENABLED":  "true",
+		"TEST_INTERVAL": "2m",
+	} {
+		if got := os.Getenv(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if errs := Validate(testSettings); len(errs) > 0 {
+		t.Errorf("Validate = %v, want no errors", errs)
+	}
+}
+
+func TestLoadFileUnknownKeys(t *testing.T) {
+	err := loadTestFile(t, "test_name: a\ntest_colour: blue\nTEST_NAME: b\n")
+	if err == nil {
+		t.Fatal("LoadFile accepted an unknown setting")
+	}
+	for _, want := range []string{`unknown setting "test_colour"`, "TEST_NAME is set twice"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadFile error %q doesn't mention %s", err, want)
+		}
+	}
+	if v := os.Getenv("TEST_NAME"); v != "" {
+		t.Errorf("LoadFile set TEST_NAME = %q despite the errors", v)
+	}
+}
+
+func TestLoadFileKinds(t *testing.T) {
+	err := loadTestFile(t, "test_enabled: maybe\ntest_count: 1.5\ntest_interval: 10\ntest_name: {a: b}\n")
+	if err == nil || !strings.Contains(err.Error(), "invalid TEST_NAME") {
+		t.Fatalf("LoadFile error = %v, want one about the map in TEST_NAME", err)
+	}
+
+	if err := loadTestFile(t, "test_enabled: maybe\ntest_count: 1.5\ntest_interval: 10\n"); err != nil {
+		t.Fatal(err)
+	}
+	errs := Validate(testSettings)
+	if len(errs) != 3 {
+		t.Fatalf("Validate = %v, want 3 errors", errs)
+	}
+	for i, want := range []string{"TEST_COUNT", "TEST_ENABLED", "TEST_INTERVAL"} {
+		if !strings.Contains(errs[i].Error(), want) {
+			t.Errorf("error %d = %q, want one about %s", i, errs[i], want)
+		}
+	}
+}
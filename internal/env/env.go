@@ -0,0 +1,81 @@
+// Package env reads configuration from environment variables.
+package env
+
+import (
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Duration returns the duration in the environment variable name, or def
+// when it is unset. Invalid or non-positive values are fatal.
+func Duration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("invalid %s %q, expected a positive duration such as \"30s\"", name, v)
+	}
+	return d
+}
+
+// DurationOrZero is Duration for settings where zero turns something off,
+// such as WARM_TIMEOUT: "0" and "0s" return zero, negative values are
+// fatal.
+func DurationOrZero(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Fatalf("invalid %s %q, expected a duration such as \"30s\", or 0 to turn it off", name, v)
+	}
+	return d
+}
+
+// Int returns the integer in the environment variable name, or def when
+// it is unset. Values outside [min, max] are fatal.
+func Int(name string, def, min, max int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min || n > max {
+		log.Fatalf("invalid %s %q, expected an integer between %d and %d", name, v, min, max)
+	}
+	return n
+}
+
+// Float returns the non-negative number in the environment variable name,
+// or def when it is unset. Invalid values are fatal.
+func Float(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		log.Fatalf("invalid %s %q, expected a non-negative number", name, v)
+	}
+	return f
+}
+
+// Bool returns the boolean in the environment variable name, or def when
+// it is unset. Invalid values are fatal.
+func Bool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("invalid %s %q, expected true or false", name, v)
+	}
+	return b
+}
@@ -0,0 +1,25 @@
+package env
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDurationOrZero(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", time.Minute},
+		{"0", 0},
+		{"0s", 0},
+		{"90s", 90 * time.Second},
+	} {
+		os.Setenv("TEST_TIMEOUT", tt.value)
+		if got := DurationOrZero("TEST_TIMEOUT", time.Minute); got != tt.want {
+			t.Errorf("DurationOrZero with %q = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+	os.Unsetenv("TEST_TIMEOUT")
+}
@@ -0,0 +1,315 @@
+// Package metrics implements the small subset of the Prometheus text
+// exposition format the service needs, to avoid depending on the full client
+// library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+// registry holds every metric in registration order.
+var registry struct {
+	sync.Mutex
+	collectors []collector
+}
+
+func register(c collector) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.collectors = append(registry.collectors, c)
+}
+
+// Serve handles GET /metrics.
+func Serve(w http.ResponseWriter, req *http.Request) {
+	registry.Lock()
+	collectors := append([]collector(nil), registry.collectors...)
+	registry.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// atomicFloat is a float64 updated without locks, so that metrics on the
+// redirect path don't make requests wait on each other.
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		if atomic.CompareAndSwapUint64(&f.bits, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+type Counter struct {
+	name, help string
+	v          atomicFloat
+}
+
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc() { c.Add(1) }
+
+func (c *Counter) Add(v float64) {
+	c.v.add(v)
+}
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.v.load()))
+}
+
+// CounterVec is a Counter partitioned by the value of a single label. Label
+// values seen before are counted without locking.
+type CounterVec struct {
+	name, help, label string
+	v                 sync.Map // label value -> *atomicFloat
+}
+
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{name: name, help: help, label: label}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(value string) {
+	c.Add(value, 1)
+}
+
+func (c *CounterVec) Add(value string, n float64) {
+	v, ok := c.v.Load(value)
+	if !ok {
+		v, _ = c.v.LoadOrStore(value, new(atomicFloat))
+	}
+	v.(*atomicFloat).add(n)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	counts := make(map[string]float64)
+	var values []string
+	c.v.Range(func(k, v interface{}) bool {
+		values = append(values, k.(string))
+		counts[k.(string)] = v.(*atomicFloat).load()
+		return true
+	})
+	sort.Strings(values)
+	for _, k := range values {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", c.name, c.label, labelEscaper.Replace(k), formatFloat(counts[k]))
+	}
+}
+
+type Gauge struct {
+	sync.Mutex
+	name, help string
+	v          float64
+	fn         func() float64
+}
+
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	register(g)
+	return g
+}
+
+// NewGaugeFunc registers a Gauge whose value is computed at scrape time.
+func NewGaugeFunc(name, help string, fn func() float64) *Gauge {
+	g := &Gauge{name: name, help: help, fn: fn}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64) {
+	g.Lock()
+	g.v = v
+	g.Unlock()
+}
+
+func (g *Gauge) write(w io.Writer) {
+	v := g.value()
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(v))
+}
+
+func (g *Gauge) value() float64 {
+	if g.fn != nil {
+		return g.fn()
+	}
+	g.Lock()
+	defer g.Unlock()
+	return g.v
+}
+
+type Histogram struct {
+	sync.Mutex
+	name, help string
+	buckets    []float64
+	counts     []uint64
+	sum        float64
+	count      uint64
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// Window keeps the last observations of a value to compute its quantiles,
+// which histograms with fixed buckets only approximate.
+type Window struct {
+	sync.Mutex
+	obs   []float64
+	next  int
+	sum   float64
+	count uint64
+}
+
+// NewWindow returns a Window of the last size observations.
+func NewWindow(size int) *Window {
+	return &Window{obs: make([]float64, 0, size)}
+}
+
+func (w *Window) Observe(v float64) {
+	w.Lock()
+	defer w.Unlock()
+	if len(w.obs) < cap(w.obs) {
+		w.obs = append(w.obs, v)
+	} else {
+		w.obs[w.next] = v
+		w.next = (w.next + 1) % len(w.obs)
+	}
+	w.sum += v
+	w.count++
+}
+
+// Quantiles returns the given quantiles of the observations in the window,
+// NaN while it is empty, and the sum and count of all observations.
+func (w *Window) Quantiles(qs ...float64) (values []float64, sum float64, count uint64) {
+	w.Lock()
+	sorted := append([]float64(nil), w.obs...)
+	sum, count = w.sum, w.count
+	w.Unlock()
+
+	sort.Float64s(sorted)
+	values = make([]float64, len(qs))
+	for i, q := range qs {
+		if len(sorted) == 0 {
+			values[i] = math.NaN()
+			continue
+		}
+		values[i] = sorted[int(q*float64(len(sorted)-1)+0.5)]
+	}
+	return values, sum, count
+}
+
+// SummaryVec reports the quantiles of the recent observations of a value,
+// partitioned by the value of a single label.
+type SummaryVec struct {
+	name, help, label string
+	quantiles         []float64
+	size              int
+	v                 sync.Map // label value -> *Window
+}
+
+// NewSummaryVec reports quantiles over the last size observations of each
+// label value.
+func NewSummaryVec(name, help, label string, quantiles []float64, size int) *SummaryVec {
+	s := &SummaryVec{name: name, help: help, label: label, quantiles: quantiles, size: size}
+	register(s)
+	return s
+}
+
+func (s *SummaryVec) Observe(value string, v float64) {
+	w, ok := s.v.Load(value)
+	if !ok {
+		w, _ = s.v.LoadOrStore(value, NewWindow(s.size))
+	}
+	w.(*Window).Observe(v)
+}
+
+func (s *SummaryVec) write(w io.Writer) {
+	writeHeader(w, s.name, s.help, "summary")
+	windows := make(map[string]*Window)
+	var values []string
+	s.v.Range(func(k, v interface{}) bool {
+		values = append(values, k.(string))
+		windows[k.(string)] = v.(*Window)
+		return true
+	})
+	sort.Strings(values)
+	for _, k := range values {
+		label := fmt.Sprintf("%s=\"%s\"", s.label, labelEscaper.Replace(k))
+		qs, sum, count := windows[k].Quantiles(s.quantiles...)
+		for i, q := range s.quantiles {
+			fmt.Fprintf(w, "%s{%s,quantile=\"%s\"} %s\n", s.name, label, formatFloat(q), formatFloat(qs[i]))
+		}
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", s.name, label, formatFloat(sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", s.name, label, count)
+	}
+}
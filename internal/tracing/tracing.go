@@ -0,0 +1,496 @@
+// Package tracing implements the part of OpenTelemetry tracing the service
+// needs: W3C trace context propagation and span export over OTLP/HTTP with
+// JSON encoding, to avoid depending on the full SDK.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/env"
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+)
+
+// Span kinds as defined by OTLP.
+const (
+	Internal = 1
+	Server   = 2
+	Client   = 3
+)
+
+var spansDroppedTotal = metrics.NewCounter("shortener_trace_spans_dropped_total",
+	"Finished spans dropped because the export queue was full.")
+
+// Default exports the spans of sampled traces; nil disables tracing.
+var Default *Tracer
+
+// spanContext identifies a span across process boundaries.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+type spanContextKey struct{}
+
+type spanKey struct{}
+
+type spanAttr struct {
+	key   string
+	value interface{}
+}
+
+type spanEvent struct {
+	name string
+	time time.Time
+}
+
+// Span is an operation within a trace. A nil Span, returned when tracing is
+// disabled, ignores every call.
+type Span struct {
+	spanContext
+	parent [8]byte
+	name   string
+	kind   int
+	start  time.Time
+
+	mu     sync.Mutex
+	attrs  []spanAttr
+	events []spanEvent
+	err    string
+	end    time.Time
+}
+
+// Start starts a span as a child of the span or remote parent in ctx and
+// returns a context holding it.
+func Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if Default == nil {
+		return ctx, nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now()}
+	if parent, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		s.traceID, s.parent, s.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = Default.sample(s.traceID)
+	}
+	rand.Read(s.spanID[:])
+	ctx = context.WithValue(ctx, spanContextKey{}, s.spanContext)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// FromContext returns the current span of ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// SetAttr records an attribute; value is a string, bool, int, int64 or
+// float64.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, spanAttr{key, value})
+	s.mu.Unlock()
+}
+
+// AddEvent records that something happened at the current time.
+func (s *Span) AddEvent(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.events = append(s.events, spanEvent{name, time.Now()})
+	s.mu.Unlock()
+}
+
+// End finishes the span, marking it failed when err is not nil, and queues
+// it for export.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.sampled {
+		Default.enqueue(s)
+	}
+}
+
+// parseTraceparent parses a W3C traceparent header such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseTraceparent(v string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil || sc.traceID == [16]byte{} {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.sampled = flags&1 == 1
+	return sc, true
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses such as gRPC streams working.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Handler wraps next in a server span named after the route returned by
+// route, continuing the trace of an incoming traceparent header.
+func Handler(route func(*http.Request) string, next http.Handler) http.Handler {
+	if Default == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		if sc, ok := parseTraceparent(req.Header.Get("Traceparent")); ok {
+			ctx = context.WithValue(ctx, spanContextKey{}, sc)
+		}
+		ctx, sp := Start(ctx, req.Method+" "+route(req), Server)
+		sp.SetAttr("http.method", req.Method)
+		sp.SetAttr("http.target", req.URL.RequestURI())
+		sp.SetAttr("http.user_agent", req.UserAgent())
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		sp.SetAttr("http.status_code", rec.status)
+		var err error
+		if rec.status >= 500 {
+			err = fmt.Errorf("%d %s", rec.status, http.StatusText(rec.status))
+		}
+		sp.End(err)
+	})
+}
+
+// WithClientTrace makes HTTP requests sent with the returned context record
+// DNS, connection and TLS timings as events of sp.
+func WithClientTrace(ctx context.Context, sp *Span) context.Context {
+	if sp == nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { sp.AddEvent("dns.start") },
+		DNSDone:              func(httptrace.DNSDoneInfo) { sp.AddEvent("dns.done") },
+		ConnectStart:         func(string, string) { sp.AddEvent("connect.start") },
+		ConnectDone:          func(string, string, error) { sp.AddEvent("connect.done") },
+		TLSHandshakeStart:    func() { sp.AddEvent("tls.start") },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { sp.AddEvent("tls.done") },
+		GotConn:              func(i httptrace.GotConnInfo) { sp.SetAttr("http.conn_reused", i.Reused) },
+		GotFirstResponseByte: func() { sp.AddEvent("first_response_byte") },
+	})
+}
+
+// Tracer batches finished spans and exports them over OTLP/HTTP.
+type Tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	// ratio of new traces that are sampled; continued traces follow their
+	// parent.
+	ratio  float64
+	client *http.Client
+	queue  chan *Span
+}
+
+const (
+	traceQueueSize = 2048
+	traceBatchSize = 512
+)
+
+// NewTracer configures tracing from the standard OTEL_* variables, returning
+// nil when no OTLP endpoint is set.
+func NewTracer() (*Tracer, error) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil, nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	t := &Tracer{
+		endpoint: endpoint,
+		headers:  make(map[string]string),
+		service:  os.Getenv("OTEL_SERVICE_NAME"),
+		ratio:    env.Float("OTEL_TRACES_SAMPLER_ARG", 1),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *Span, traceQueueSize),
+	}
+	if t.service == "" {
+		t.service = "url-shortener"
+	}
+	for _, kv := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS entry %q is not key=value", kv)
+		}
+		t.headers[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+	}
+	return t, nil
+}
+
+// sample decides from the trace ID whether a new trace is recorded, so that
+// every service using the same ratio agrees.
+func (t *Tracer) sample(id [16]byte) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(id[8:])>>1) < t.ratio*(1<<63)
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		spansDroppedTotal.Inc()
+	}
+}
+
+// Run exports queued spans every interval, or sooner when a batch fills up.
+func (t *Tracer) Run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	var batch []*Span
+	for {
+		select {
+		case <-ctx.Done():
+			// Leave the pending spans to Flush.
+			for _, s := range batch {
+				t.enqueue(s)
+			}
+			return
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-tick.C:
+		}
+		if len(batch) > 0 {
+			if err := t.export(ctx, batch); err != nil {
+				log.Printf("warn: failed to export %d spans: %v", len(batch), err)
+			}
+			batch = nil
+		}
+	}
+}
+
+// Flush exports the spans still queued, for shutdown.
+func (t *Tracer) Flush(ctx context.Context) error {
+	var batch []*Span
+drain:
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+		default:
+			break drain
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return t.export(ctx, batch)
+}
+
+func (t *Tracer) export(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(t.request(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// OTLP/JSON messages, see opentelemetry/proto/collector/trace/v1.
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    string   `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string `json:"timeUnixNano"`
+	Name         string `json:"name"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttr(key string, value interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	case int:
+		kv.Value.IntValue = strconv.Itoa(v)
+	case int64:
+		kv.Value.IntValue = strconv.FormatInt(v, 10)
+	case float64:
+		kv.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (t *Tracer) request(spans []*Span) otlpExportRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: unixNano(s.start),
+			EndTimeUnixNano:   unixNano(s.end),
+		}
+		if s.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for _, a := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpAttr(a.key, a.value))
+		}
+		for _, e := range s.events {
+			o.Events = append(o.Events, otlpEvent{TimeUnixNano: unixNano(e.time), Name: e.name})
+		}
+		if s.err != "" {
+			o.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		s.mu.Unlock()
+		out = append(out, o)
+	}
+	return otlpExportRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{otlpAttr("service.name", t.service)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/denizyoldas/url-shorter"},
+			Spans: out,
+		}},
+	}}}
+}
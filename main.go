@@ -1,253 +0,0 @@
-package main
-
-import (
-	"context"
-	"encoding/json"
-	"fmt"
-	"log"
-	"net"
-	"net/http"
-	"net/url"
-	"os"
-	"strings"
-	"sync"
-	"time"
-
-	"golang.org/x/oauth2"
-)
-
-// Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
-	// The file token.json stores the user's access and refresh tokens, and is
-	// created automatically when the authorization flow completes for the first
-	// time.
-	tokFile := "token.json"
-	tok, err := tokenFromFile(tokFile)
-	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(tokFile, tok)
-	}
-	return config.Client(context.Background(), tok)
-}
-
-// Request a token from the web, then returns the retrieved token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
-
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code: %v", err)
-	}
-
-	tok, err := config.Exchange(context.TODO(), authCode)
-	if err != nil {
-		log.Fatalf("Unable to retrieve token from web: %v", err)
-	}
-	return tok
-}
-
-// Retrieves a token from a local file.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
-	return tok, err
-}
-
-// Saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
-	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
-}
-
-type MyUrl struct {
-	shortcut string
-	url      string
-}
-
-func main() {
-	port, addr := os.Getenv("PORT"), os.Getenv("LISTEN_ADDR")
-	if port == "" {
-		port = "8080"
-	}
-	if addr == "" {
-		addr = "localhost"
-	}
-
-	googleSheetsID := os.Getenv("GOOGLE_SHEET_ID")
-	sheetName := os.Getenv("SHEET_NAME")
-	ttl := time.Second * 5
-
-	srv := &server{
-		db: &cachedURLMap{
-			ttl: ttl,
-			sheet: &sheetsProvider{
-				googleSheetsID: googleSheetsID,
-				sheetName:      sheetName,
-			},
-		},
-	}
-
-	http.HandleFunc("/", srv.redirect)
-
-	listenAddr := net.JoinHostPort(addr, port)
-	log.Printf("Starting server at %s", listenAddr)
-
-	err := http.ListenAndServe(listenAddr, nil)
-	log.Fatal(err)
-}
-
-type server struct {
-	db *cachedURLMap
-}
-
-type URLMap map[string]*url.URL
-
-type cachedURLMap struct {
-	sync.RWMutex
-	v          URLMap
-	lastUpdate time.Time
-	ttl        time.Duration
-	sheet      *sheetsProvider
-}
-
-func (c *cachedURLMap) Get(query string) (*url.URL, error) {
-	if err := c.Refresh(); err != nil {
-		return nil, err
-	}
-
-	c.RLock()
-	defer c.RUnlock()
-	return c.v[query], nil
-}
-
-func (c *cachedURLMap) Refresh() error {
-	c.Lock()
-	defer c.Unlock()
-	if time.Since(c.lastUpdate) <= c.ttl {
-		return nil
-	}
-
-	rows, err := c.sheet.Query()
-
-	if err != nil {
-		return err
-	}
-
-	c.v = urlMap(rows)
-	c.lastUpdate = time.Now()
-
-	return nil
-}
-
-func (s *server) redirect(w http.ResponseWriter, req *http.Request) {
-	if req.Body != nil {
-		defer req.Body.Close()
-	}
-
-	redirTo, err := s.findRedirect(req.URL)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to find redirect: %v", err)
-	}
-
-	if redirTo == nil {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "shortcut not found")
-		return
-	}
-
-	log.Printf("redirecting=%q to=%q", req.URL, redirTo.String())
-	http.Redirect(w, req, redirTo.String(), http.StatusMovedPermanently)
-}
-
-func (s *server) findRedirect(req *url.URL) (*url.URL, error) {
-	path := strings.TrimPrefix(req.Path, "/")
-
-	// "/a/b/c/d" -> "/a/b/c/d", "/a/b/c" -> "/a/b", "a"
-	segments := strings.Split(path, "/")
-	var discard []string
-	for len(segments) > 0 {
-		query := strings.Join(segments, "/")
-		v, err := s.db.Get(query)
-		if err != nil {
-			return nil, err
-		}
-		if v != nil {
-			return prepRedirect(v, strings.Join(discard, "/"), req.Query()), nil
-		}
-		segments = segments[:len(segments)-1]
-		discard = append([]string{segments[len(segments)-1]}, discard...)
-	}
-
-	return nil, nil
-}
-
-func prepRedirect(base *url.URL, addPath string, query url.Values) *url.URL {
-	if addPath != "" {
-		if !strings.HasSuffix(base.Path, "/") {
-			base.Path += "/"
-		}
-
-		base.Path += addPath
-	}
-
-	qs := base.Query()
-	for k := range query {
-		qs.Add(k, query.Get(k))
-	}
-	base.RawQuery = base.Query().Encode()
-
-	return base
-}
-
-func urlMap(in [][]interface{}) URLMap {
-	out := make(URLMap)
-	for _, row := range in {
-		if len(row) < 2 {
-			continue
-		}
-
-		k, ok := row[0].(string)
-		if !ok || k == "" {
-			continue
-		}
-
-		v, ok := row[1].(string)
-		if !ok || v == "" {
-			continue
-		}
-
-		k = strings.ToLower(k)
-
-		u, err := url.Parse(v)
-		if err != nil {
-			log.Printf("warn: %s=%s url is invalid", k, v)
-			continue
-		}
-
-		_, exists := out[k]
-		if exists {
-			log.Printf("warn: shortcut %q redeclare, overwriting", k)
-		}
-
-		out[k] = u
-	}
-
-	return out
-}
-
-func writeError(w http.ResponseWriter, code int, msg string, vals ...interface{}) {
-	w.WriteHeader(code)
-	fmt.Fprintf(w, msg, vals...)
-}
@@ -0,0 +1,92 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// ErrAliasLoop is returned for aliases that lead back to a shortcut of
+// their chain, or through more than maxAliasHops shortcuts.
+var ErrAliasLoop = errors.New("alias loop")
+
+// maxAliasHops bounds how many aliases are followed from a shortcut.
+const maxAliasHops = 8
+
+// follow returns the shortcut and link the chain of aliases starting at
+// link, the link of shortcut key, ends at, see store.Link.Alias. Every link
+// on the way must be enabled, approved and active, and in the namespace
+// inNamespace accepts. It returns a nil link when an alias leads nowhere.
+func (r *Resolver) follow(key string, link *store.Link, visitor store.Visitor, inNamespace func(string) bool) (string, *store.Link, error) {
+	seen := map[string]bool{key: true}
+	for hops := 0; ; hops++ {
+		target := link.Alias()
+		if target == "" {
+			return key, link, nil
+		}
+		if hops == maxAliasHops {
+			return "", nil, fmt.Errorf("%w: more than %d aliases from %q", ErrAliasLoop, maxAliasHops, key)
+		}
+		next, l, err := r.links.Lookup(target)
+		if err != nil || l == nil || !inNamespace(next) {
+			return "", nil, err
+		}
+		if seen[next] {
+			return "", nil, fmt.Errorf("%w: %q leads back to %q", ErrAliasLoop, key, next)
+		}
+		seen[next] = true
+		switch {
+		case l.Disabled:
+			return next, l, store.ErrLinkDisabled
+		case l.Unapproved:
+			return next, l, store.ErrLinkUnapproved
+		}
+		l = l.For(visitor, next)
+		if err := checkWindow(l, time.Now()); err != nil {
+			return next, l, err
+		}
+		key, link = next, l
+	}
+}
+
+// checkAliases warns about the aliases of m leading to no shortcut, or
+// around in a loop. index is that of m.
+func checkAliases(ctx context.Context, m store.URLMap, index *shortcutIndex) {
+	for k, v := range m {
+		if v.Alias() == "" {
+			continue
+		}
+		seen := map[string]bool{k: true}
+		key, link := k, v
+		for hops := 0; ; hops++ {
+			target := link.Alias()
+			if target == "" {
+				break
+			}
+			if hops == maxAliasHops {
+				store.Issuef(ctx, store.LinkIssue{Kind: store.IssueAlias, Shortcut: k},
+					"shortcut %q leads through more than %d aliases", k, maxAliasHops)
+				break
+			}
+			next := target
+			if m[next] == nil {
+				next = index.get(store.Norm.Key(target))
+			}
+			if next == "" {
+				store.Issuef(ctx, store.LinkIssue{Kind: store.IssueAlias, Shortcut: k},
+					"shortcut %q is an alias of %q, which does not exist", key, target)
+				break
+			}
+			if seen[next] {
+				store.Issuef(ctx, store.LinkIssue{Kind: store.IssueAlias, Shortcut: k},
+					"shortcut %q is an alias leading back to %q", k, next)
+				break
+			}
+			seen[next] = true
+			key, link = next, m[next]
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+)
+
+var (
+	breakerOpen = metrics.NewGauge("shortener_provider_breaker_open",
+		"1 while the circuit breaker keeps link table queries off the provider.")
+	breakerTripsTotal = metrics.NewCounter("shortener_provider_breaker_trips_total",
+		"Times the circuit breaker opened after consecutive provider failures.")
+	breakerRejectionsTotal = metrics.NewCounter("shortener_provider_breaker_rejections_total",
+		"Link table queries skipped because the circuit breaker was open.")
+)
+
+// ErrBreakerOpen is returned by refreshes skipped while the provider failed
+// too often in a row, see Breaker.
+var ErrBreakerOpen = errors.New("provider circuit breaker open")
+
+// Breaker stops querying a provider that keeps failing: after Failures
+// consecutive failures it opens, failing queries right away for Cooldown.
+// Then a single query is let through, closing it again when it succeeds and
+// reopening it when it fails. A nil Breaker never opens.
+type Breaker struct {
+	Failures int
+	Cooldown time.Duration
+
+	mu        sync.Mutex
+	failed    int
+	openUntil time.Time
+	// trial is set while the query let through after the cooldown runs.
+	trial bool
+}
+
+// BreakerState is the state of a Breaker, as reported by Cache.Breaker.
+type BreakerState struct {
+	// State is "closed", "open" or "half-open", when a query is let through
+	// to see whether the provider recovered.
+	State string `json:"state"`
+	// Failures counts the consecutive failed queries.
+	Failures  int        `json:"failures"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+// NewBreaker returns a breaker opening for cooldown after failures
+// consecutive failures, or nil when failures is zero.
+func NewBreaker(failures int, cooldown time.Duration) *Breaker {
+	if failures <= 0 {
+		return nil
+	}
+	return &Breaker{Failures: failures, Cooldown: cooldown}
+}
+
+// allow fails with ErrBreakerOpen unless a query may be sent now.
+func (b *Breaker) allow(now time.Time) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.openUntil.IsZero():
+		return nil
+	case now.Before(b.openUntil) || b.trial:
+		breakerRejectionsTotal.Inc()
+		return fmt.Errorf("%w until %s after %d failures", ErrBreakerOpen, b.openUntil.UTC().Format(time.RFC3339), b.failed)
+	}
+	b.trial = true
+	return nil
+}
+
+// observe records the outcome of a query allowed by allow. quiet keeps it
+// out of the logs and metrics, as for shadow backends.
+func (b *Breaker) observe(err error, now time.Time, quiet bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if err == nil {
+		if !b.openUntil.IsZero() && !quiet {
+			log.Printf("provider recovered, closing the circuit breaker")
+			breakerOpen.Set(0)
+		}
+		b.failed, b.openUntil = 0, time.Time{}
+		return
+	}
+	b.failed++
+	if b.failed < b.Failures {
+		return
+	}
+	b.openUntil = now.Add(b.Cooldown)
+	if !quiet {
+		log.Printf("warn: provider failed %d times in a row, not querying it until %s: %v",
+			b.failed, b.openUntil.UTC().Format(time.RFC3339), err)
+		breakerTripsTotal.Inc()
+		breakerOpen.Set(1)
+	}
+}
+
+// release ends a query allowed by allow without counting it, as when it was
+// abandoned.
+func (b *Breaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// state returns the state of b at now.
+func (b *Breaker) state(now time.Time) BreakerState {
+	if b == nil {
+		return BreakerState{State: "closed"}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := BreakerState{State: "closed", Failures: b.failed}
+	if !b.openUntil.IsZero() {
+		until := b.openUntil.UTC()
+		s.State, s.OpenUntil = "open", &until
+		if !now.Before(b.openUntil) {
+			s.State = "half-open"
+		}
+	}
+	return s
+}
+
+// remaining returns how long b stays open, or zero.
+func (b *Breaker) remaining(now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() || !now.Before(b.openUntil) {
+		return 0
+	}
+	return b.openUntil.Sub(now)
+}
@@ -0,0 +1,634 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+	"github.com/denizyoldas/url-shorter/internal/tracing"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+var (
+	cacheHitsTotal = metrics.NewCounter("shortener_cache_hits_total",
+		"Cache lookups that found a shortcut.")
+	cacheMissesTotal = metrics.NewCounter("shortener_cache_misses_total",
+		"Cache lookups that did not find a shortcut.")
+	providerQueryDuration = metrics.NewHistogram("shortener_provider_query_duration_seconds",
+		"Duration of full link table queries against the provider.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30})
+	providerQueryErrorsTotal = metrics.NewCounter("shortener_provider_query_errors_total",
+		"Failed link table queries against the provider.")
+	providerQuotaErrorsTotal = metrics.NewCounter("shortener_provider_quota_errors_total",
+		"Link table queries rejected because the provider quota was exhausted.")
+	lastRefreshTimestamp = metrics.NewGauge("shortener_last_successful_refresh_timestamp_seconds",
+		"Unix time of the last successful link table refresh.")
+	linksLoaded = metrics.NewGauge("shortener_links",
+		"Number of links in the current link table.")
+)
+
+// cacheState is a loaded map and everything derived from it. States are never
+// modified once stored in a Cache, so lookups read them without locking.
+type cacheState struct {
+	v store.URLMap
+	// expired holds links past their expiry, kept so they answer 410 Gone
+	// instead of 404 until the provider drops them.
+	expired store.URLMap
+	// deleted holds links in the trash, which resolve like missing ones.
+	deleted  store.URLMap
+	patterns []*linkPattern
+	// index finds shortcuts by their normalized form, see store.Norm.
+	index *shortcutIndex
+	// completions finds the shortcuts starting with a prefix, see Complete.
+	completions *completionTrie
+	// warnings are those raised while parsing the current map, and issues
+	// the same with their rows, see store.Issuef.
+	warnings      []string
+	issues        []store.LinkIssue
+	droppedIssues int
+	lastUpdate    time.Time
+	lastErr       error
+}
+
+// Cache serves lookups from the last map loaded from the provider and
+// refreshes it in the background, so reads never wait on the backend. Each
+// refresh swaps in a new cacheState, so reads never wait on each other
+// either.
+type Cache struct {
+	state atomic.Value // *cacheState
+	// ServeStale keeps serving the last map while refreshes fail, for up to
+	// MaxStale after the last successful one when that is set.
+	ServeStale bool
+	MaxStale   time.Duration
+	sched      *Scheduler
+	Provider   store.Provider
+	// notFound caches paths that matched no link; purged when links change.
+	notFound *NotFoundCache
+	// Reserved shortcuts are dropped from every loaded map.
+	Reserved *ReservedWords
+	// Destinations, if set, drops links leading where they may not.
+	Destinations *DestinationPolicy
+	// Peers, if set, relays invalidations to the other replicas.
+	Peers *Invalidator
+	// Shadow marks the cache of a shadow backend, whose lookups and
+	// refreshes stay out of the metrics and logs of the link table.
+	Shadow bool
+	// watchers receive the changes found by each refresh.
+	watchers linkWatchers
+
+	// Timeout bounds each provider query, see PROVIDER_TIMEOUT.
+	Timeout time.Duration
+	// Breaker, if set, keeps refreshes off a provider that keeps failing,
+	// see PROVIDER_BREAKER_FAILURES.
+	Breaker *Breaker
+	// BloomMinLinks is the size from which link tables get a Bloom filter
+	// to answer lookups of missing shortcuts; zero never builds one. See
+	// BLOOM_FILTER_MIN_LINKS.
+	BloomMinLinks int
+	// WarmRetry is how long Run first waits to retry while no map could be
+	// loaded yet, doubling up to the refresh interval; zero waits the
+	// refresh interval right away. See WARM_RETRY.
+	WarmRetry time.Duration
+
+	// refreshing serializes provider queries; callers waiting for their
+	// turn give up when their context ends.
+	refreshing chan struct{}
+	// loaded is closed once the first refresh attempt completed, after
+	// isLoaded is set; lookups check the flag to skip the channel.
+	loaded   chan struct{}
+	isLoaded int32
+	loadOnce sync.Once
+	// warm is closed once a map was loaded.
+	warm     chan struct{}
+	warmOnce sync.Once
+	kick     chan struct{}
+
+	// failures are the last failed refreshes, oldest first, see
+	// RecentFailures.
+	failuresMu sync.Mutex
+	failures   []RefreshFailure
+}
+
+// maxRecentFailures bounds the failed refreshes a Cache remembers.
+const maxRecentFailures = 10
+
+// RefreshFailure is a failed refresh, as reported by RecentFailures.
+type RefreshFailure struct {
+	Time  time.Time
+	Error string
+}
+
+// NewCache returns a cache of the links of provider, refreshed as sched
+// decides once Run is called. notFound may be nil.
+func NewCache(provider store.Provider, sched *Scheduler, notFound *NotFoundCache) *Cache {
+	return &Cache{
+		sched:    sched,
+		Provider: provider,
+		notFound: notFound,
+		loaded:   make(chan struct{}),
+		warm:     make(chan struct{}),
+		kick:     make(chan struct{}, 1),
+
+		refreshing: make(chan struct{}, 1),
+	}
+}
+
+// current returns the state lookups are served from.
+func (c *Cache) current() *cacheState {
+	if s, ok := c.state.Load().(*cacheState); ok {
+		return s
+	}
+	return &cacheState{}
+}
+
+// waitLoaded blocks until the first refresh attempt completed.
+func (c *Cache) waitLoaded() {
+	if !c.ready() {
+		<-c.loaded
+	}
+}
+
+// ready reports whether lookups are served without waiting for a refresh.
+func (c *Cache) ready() bool {
+	return atomic.LoadInt32(&c.isLoaded) != 0
+}
+
+// ErrStale is returned by lookups when refreshes have been failing for longer
+// than the stale policy allows.
+var ErrStale = errors.New("links are stale")
+
+// usable returns why lookups in s should fail: no map could be loaded yet, or
+// the last refresh failed and the stale policy forbids using the current map.
+func (c *Cache) usable(s *cacheState) error {
+	switch {
+	case s.v == nil:
+		return s.lastErr
+	case s.lastErr == nil:
+		return nil
+	case !c.ServeStale:
+		return fmt.Errorf("%w: refresh failed: %v", ErrStale, s.lastErr)
+	case c.MaxStale > 0 && time.Since(s.lastUpdate) > c.MaxStale:
+		return fmt.Errorf("%w: not refreshed since %s: %v", ErrStale, s.lastUpdate.UTC().Format(time.RFC3339), s.lastErr)
+	}
+	return nil
+}
+
+// Ready reports why the cache should not receive traffic, or nil.
+func (c *Cache) Ready(maxFailing time.Duration) error {
+	s := c.current()
+	switch {
+	case s.v == nil && s.lastErr != nil:
+		return fmt.Errorf("links not loaded: %v", s.lastErr)
+	case s.v == nil:
+		return fmt.Errorf("links not loaded yet")
+	case s.lastErr != nil && time.Since(s.lastUpdate) > maxFailing:
+		return fmt.Errorf("refresh failing since %s: %v", s.lastUpdate.UTC().Format(time.RFC3339), s.lastErr)
+	}
+	return nil
+}
+
+// Stale reports whether lookups are served from a map whose last refresh
+// failed.
+func (c *Cache) Stale() bool {
+	s := c.current()
+	return s.v != nil && s.lastErr != nil
+}
+
+// Get returns the link of query from the last loaded map, including expired
+// links; callers check Link.Expired. It fails when no map could be loaded yet
+// or, depending on SERVE_STALE and STALE_MAX_AGE, while refreshes fail.
+func (c *Cache) Get(query string) (*store.Link, error) {
+	_, u, err := c.Lookup(query)
+	return u, err
+}
+
+// Lookup is like Get but also returns the shortcut query is equivalent to
+// under store.Norm.
+func (c *Cache) Lookup(query string) (string, *store.Link, error) {
+	c.waitLoaded()
+
+	s := c.current()
+	if err := c.usable(s); err != nil {
+		return "", nil, err
+	}
+	key := query
+	var u *store.Link
+	if !store.IsPatternKey(query) && s.index.missing(query) {
+		key = ""
+	} else {
+		if u = s.v[key]; u == nil {
+			u = s.expired[key]
+		}
+		if u == nil {
+			if key = s.index.get(store.Norm.Key(query)); key != "" {
+				if u = s.v[key]; u == nil {
+					u = s.expired[key]
+				}
+			}
+		}
+	}
+	switch {
+	case c.Shadow:
+	case u != nil:
+		cacheHitsTotal.Inc()
+	default:
+		cacheMissesTotal.Inc()
+	}
+	return key, u, nil
+}
+
+// LastRefresh returns when the links were last loaded, and why the
+// refreshes since failed, if the last one did.
+func (c *Cache) LastRefresh() (time.Time, error) {
+	s := c.current()
+	return s.lastUpdate, s.lastErr
+}
+
+// RefreshInterval returns the current interval between refreshes.
+func (c *Cache) RefreshInterval() time.Duration {
+	return c.sched.Interval()
+}
+
+// recordFailure remembers a failed refresh for RecentFailures.
+func (c *Cache) recordFailure(err error) {
+	c.failuresMu.Lock()
+	defer c.failuresMu.Unlock()
+	c.failures = append(c.failures, RefreshFailure{Time: time.Now(), Error: err.Error()})
+	if len(c.failures) > maxRecentFailures {
+		c.failures = c.failures[len(c.failures)-maxRecentFailures:]
+	}
+}
+
+// RecentFailures returns the last failed refreshes, newest first.
+func (c *Cache) RecentFailures() []RefreshFailure {
+	c.failuresMu.Lock()
+	defer c.failuresMu.Unlock()
+	out := make([]RefreshFailure, len(c.failures))
+	for i, f := range c.failures {
+		out[len(out)-1-i] = f
+	}
+	return out
+}
+
+// BreakerState returns the state of the circuit breaker of the provider.
+func (c *Cache) BreakerState() BreakerState {
+	return c.Breaker.state(time.Now())
+}
+
+// Loaded returns the number of links in the current map, including expired
+// ones, and the warnings raised while parsing it.
+func (c *Cache) Loaded() (int, []string) {
+	s := c.current()
+	return len(s.v) + len(s.expired), s.warnings
+}
+
+// Issues returns the problems found in the link data by the last refresh
+// that loaded it, how many more were not kept, and when it was loaded.
+func (c *Cache) Issues() ([]store.LinkIssue, int, time.Time) {
+	s := c.current()
+	return s.issues, s.droppedIssues, s.lastUpdate
+}
+
+// logIssues logs a summary of the problems found in the link data.
+func logIssues(issues []store.LinkIssue, dropped int) {
+	if len(issues) == 0 {
+		return
+	}
+	log.Printf("warn: the links have %d problems (%s), see GET /api/lint",
+		len(issues)+dropped, store.SummarizeIssues(issues))
+}
+
+// Match returns the pattern shortcut matching path, its link, which may have
+// expired, and the captured values.
+func (c *Cache) Match(path string, accept func(key string) bool) (string, *store.Link, []string) {
+	p, args := matchPattern(c.current().patterns, path, accept)
+	if p == nil {
+		return "", nil, nil
+	}
+	return p.key, p.link, args
+}
+
+// All returns a copy of the last loaded map, without expired links.
+func (c *Cache) All() (store.URLMap, error) {
+	c.waitLoaded()
+
+	s := c.current()
+	if err := c.usable(s); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	out := make(store.URLMap, len(s.v))
+	for k, v := range s.v {
+		if !v.Expired(now) {
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+// Deleted returns a copy of the links in the trash of the last loaded map.
+func (c *Cache) Deleted() (store.URLMap, error) {
+	c.waitLoaded()
+
+	s := c.current()
+	if err := c.usable(s); err != nil {
+		return nil, err
+	}
+	out := make(store.URLMap, len(s.deleted))
+	for k, v := range s.deleted {
+		out[k] = v
+	}
+	return out, nil
+}
+
+// GetDeleted returns the link of shortcut if it is in the trash of the last
+// loaded map.
+func (c *Cache) GetDeleted(shortcut string) *store.Link {
+	return c.current().deleted[shortcut]
+}
+
+// Refresh queries the provider and swaps in the new map, moving expired and
+// deleted links aside. On failure the previous map is kept. A refresh whose
+// ctx ends, such as when the client asking for it disconnects, is abandoned
+// without counting as a failure.
+func (c *Cache) Refresh(ctx context.Context) (err error) {
+	ctx, sp := tracing.Start(ctx, "cache.refresh", tracing.Internal)
+	defer func() { sp.End(err) }()
+
+	select {
+	case c.refreshing <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-c.refreshing }()
+	sp.AddEvent("locked")
+
+	// While the breaker is open the current map is served as the stale
+	// policy allows, without asking the provider.
+	if err := c.Breaker.allow(time.Now()); err != nil {
+		return err
+	}
+	ctx, warnings := store.WithLinkWarnings(ctx)
+	start := time.Now()
+	m, err := c.query(ctx)
+	if !c.Shadow {
+		providerQueryDuration.Observe(time.Since(start).Seconds())
+	}
+	if err != nil && ctx.Err() != nil {
+		c.Breaker.release()
+		return fmt.Errorf("refresh abandoned: %w", ctx.Err())
+	}
+	if errors.Is(err, store.ErrNotModified) {
+		c.Breaker.observe(nil, time.Now(), c.Shadow)
+	} else {
+		c.Breaker.observe(err, time.Now(), c.Shadow)
+	}
+	sp.SetAttr("not_modified", errors.Is(err, store.ErrNotModified))
+
+	// Refreshes are serialized, so nothing else stores a state until this
+	// one returns.
+	cur := c.current()
+	prev, prevExpired, prevDeleted := cur.v, cur.expired, cur.deleted
+
+	rebuilt := false
+	if errors.Is(err, store.ErrNotModified) && prev != nil {
+		err = nil
+		if !anyExpired(prev, time.Now()) {
+			next := *cur
+			next.lastErr = nil
+			next.lastUpdate = time.Now()
+			c.state.Store(&next)
+			c.sched.Observe(nil)
+			if !c.Shadow {
+				lastRefreshTimestamp.Set(float64(time.Now().Unix()))
+			}
+			return nil
+		}
+		// Some links expired since the last query; rebuild from the
+		// previous maps.
+		rebuilt = true
+		m = make(store.URLMap, len(prev)+len(prevExpired)+len(prevDeleted))
+		for k, v := range prevDeleted {
+			m[k] = v
+		}
+		for k, v := range prevExpired {
+			m[k] = v
+		}
+		for k, v := range prev {
+			m[k] = v
+		}
+	}
+	c.sched.Observe(err)
+
+	expired, deleted := make(store.URLMap), make(store.URLMap)
+	var events []LinkEvent
+	if err == nil {
+		if rs, ok := c.Provider.(store.ReservedSource); ok {
+			c.Reserved.SetLoaded(rs.ReservedShortcuts())
+		}
+		c.Reserved.dropReserved(ctx, m)
+		c.Destinations.dropRefused(ctx, m)
+		now := time.Now()
+		for k, v := range m {
+			if !v.Deleted.IsZero() {
+				deleted[k] = v
+				delete(m, k)
+			} else if v.Expired(now) {
+				expired[k] = v
+				delete(m, k)
+			}
+		}
+		// Nothing is reported for the initial load.
+		if prev != nil {
+			events = diffLinks(prev, m)
+			if !c.Shadow {
+				logDiff(events)
+			}
+		}
+	}
+
+	next := *cur
+	next.lastErr = err
+	if err == nil {
+		// Compiled first, as they may warn too.
+		patterns, index := compilePatterns(ctx, m), indexShortcuts(ctx, c.BloomMinLinks, m, expired)
+		checkAliases(ctx, m, index)
+		completions := cur.completions
+		if prev == nil || len(events) > 0 {
+			completions = buildCompletions(m)
+		}
+		warned := warnings.Warnings()
+		issues, droppedIssues := warnings.Issues()
+		if rebuilt {
+			// The data did not change, nor did its problems.
+			warned, issues, droppedIssues = cur.warnings, cur.issues, cur.droppedIssues
+		} else if !c.Shadow {
+			logIssues(issues, droppedIssues)
+		}
+		next = cacheState{
+			v:           m,
+			expired:     expired,
+			deleted:     deleted,
+			patterns:    patterns,
+			index:       index,
+			completions: completions,
+			warnings:    warned,
+			lastUpdate:  time.Now(),
+
+			issues:        issues,
+			droppedIssues: droppedIssues,
+		}
+	}
+	c.state.Store(&next)
+	if err == nil {
+		if prev == nil || len(events) > 0 {
+			c.sched.Changed()
+		}
+		c.notFound.Purge()
+		c.watchers.publish(events)
+		c.warmOnce.Do(func() { close(c.warm) })
+	}
+	c.loadOnce.Do(func() {
+		atomic.StoreInt32(&c.isLoaded, 1)
+		close(c.loaded)
+	})
+
+	if c.Shadow {
+		return err
+	}
+	if err != nil {
+		providerQueryErrorsTotal.Inc()
+		c.recordFailure(err)
+		if errors.Is(err, store.ErrRateLimited) {
+			providerQuotaErrorsTotal.Inc()
+			log.Printf("warn: backend quota exceeded, next refresh in %v", c.sched.Interval())
+		}
+		return err
+	}
+	lastRefreshTimestamp.Set(float64(time.Now().Unix()))
+	linksLoaded.Set(float64(len(m)))
+	return nil
+}
+
+// query queries the provider within Timeout.
+func (c *Cache) query(ctx context.Context) (store.URLMap, error) {
+	if c.Timeout <= 0 {
+		return c.Provider.Query(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	m, err := c.Provider.Query(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("provider query timed out after %v: %w", c.Timeout, err)
+	}
+	return m, err
+}
+
+func anyExpired(m store.URLMap, now time.Time) bool {
+	for _, v := range m {
+		if v.Expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxDiffLog bounds the number of shortcuts named in each line of logDiff.
+const maxDiffLog = 20
+
+// logDiff logs the shortcuts added, removed and changed by events.
+func logDiff(events []LinkEvent) {
+	keys := make(map[string][]string)
+	for _, e := range events {
+		keys[e.Type] = append(keys[e.Type], e.Shortcut)
+	}
+	for _, d := range []struct {
+		what string
+		keys []string
+	}{{LinkAdded, keys[LinkAdded]}, {LinkRemoved, keys[LinkRemoved]}, {LinkChanged, keys[LinkChanged]}} {
+		if len(d.keys) == 0 {
+			continue
+		}
+		n := len(d.keys)
+		more := ""
+		if n > maxDiffLog {
+			more = fmt.Sprintf(" and %d more", n-maxDiffLog)
+			d.keys = d.keys[:maxDiffLog]
+		}
+		log.Printf("%s %d shortcuts: %s%s", d.what, n, strings.Join(d.keys, ", "), more)
+	}
+}
+
+// WaitWarm blocks until a map was loaded, or fails when ctx ends first.
+func (c *Cache) WaitWarm(ctx context.Context) error {
+	select {
+	case <-c.warm:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run refreshes the map immediately and then every scheduler interval until
+// ctx is cancelled. Until a map could be loaded, failed refreshes are retried
+// sooner, see WarmRetry.
+func (c *Cache) Run(ctx context.Context) {
+	retry := c.WarmRetry
+	for {
+		if err := c.Refresh(ctx); err != nil && ctx.Err() == nil && !errors.Is(err, ErrBreakerOpen) {
+			if c.Shadow {
+				log.Printf("warn: failed to refresh links of the shadow backend: %v", err)
+			} else {
+				log.Printf("warn: failed to refresh links: %v", err)
+			}
+		}
+
+		wait := c.sched.Interval()
+		if c.current().v == nil && retry > 0 && retry < wait {
+			wait, retry = retry, retry*2
+		}
+		// An open breaker lets a query through once its cooldown ends.
+		if d := c.Breaker.remaining(time.Now()); d > 0 {
+			wait = d
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-c.kick:
+			t.Stop()
+		case <-t.C:
+		}
+	}
+}
+
+// Invalidate makes this and all other replicas refresh their maps right away
+// instead of waiting for the next tick.
+func (c *Cache) Invalidate() {
+	c.InvalidateLocal()
+	c.Publish()
+}
+
+// Publish asks the other replicas, if any, to refresh their maps.
+func (c *Cache) Publish() {
+	if c.Peers != nil {
+		go c.Peers.Publish()
+	}
+}
+
+// InvalidateLocal is Invalidate for this replica only: it forgets cached
+// misses and makes Run refresh the map right away.
+func (c *Cache) InvalidateLocal() {
+	c.notFound.Purge()
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+}
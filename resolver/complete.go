@@ -0,0 +1,104 @@
+package resolver
+
+import (
+	"sort"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// MaxCompletions is how many shortcuts Complete returns at most.
+const MaxCompletions = 32
+
+// Completion is a shortcut starting with the prefix given to Complete.
+type Completion struct {
+	Shortcut string
+	Link     *store.Link
+}
+
+// completionTrie finds the shortcuts starting with a prefix by walking the
+// bytes of the prefix. Every node keeps the best MaxCompletions shortcuts
+// below it, shortest first, so lookups don't depend on the number of links.
+type completionTrie struct {
+	children map[byte]*completionTrie
+	best     []string
+}
+
+// buildCompletions returns the trie of the shortcuts of m by normalized
+// form, leaving out patterns.
+func buildCompletions(m store.URLMap) *completionTrie {
+	type entry struct{ key, norm string }
+	entries := make([]entry, 0, len(m))
+	for k := range m {
+		if store.IsPatternKey(k) {
+			continue
+		}
+		entries = append(entries, entry{k, store.Norm.Key(k)})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if len(a.norm) != len(b.norm) {
+			return len(a.norm) < len(b.norm)
+		}
+		return a.norm < b.norm
+	})
+
+	// Entries come best first, so the first ones reaching a node stay.
+	root := &completionTrie{}
+	for _, e := range entries {
+		n := root
+		n.add(e.key)
+		for i := 0; i < len(e.norm); i++ {
+			child := n.children[e.norm[i]]
+			if child == nil {
+				if n.children == nil {
+					n.children = make(map[byte]*completionTrie)
+				}
+				child = &completionTrie{}
+				n.children[e.norm[i]] = child
+			}
+			n = child
+			n.add(e.key)
+		}
+	}
+	return root
+}
+
+func (t *completionTrie) add(key string) {
+	if len(t.best) < MaxCompletions {
+		t.best = append(t.best, key)
+	}
+}
+
+// lookup returns the best shortcuts starting with the normalized prefix.
+func (t *completionTrie) lookup(prefix string) []string {
+	n := t
+	for i := 0; n != nil && i < len(prefix); i++ {
+		n = n.children[prefix[i]]
+	}
+	if n == nil {
+		return nil
+	}
+	return n.best
+}
+
+// Complete returns up to MaxCompletions shortcuts starting with prefix,
+// shortest first, and their links, without waiting for the first refresh.
+// They come from a trie built by each refresh, so typeahead stays fast
+// however many links there are. Patterns and links that are expired,
+// disabled or awaiting approval are left out.
+func (c *Cache) Complete(prefix string) []Completion {
+	s := c.current()
+	if s.completions == nil {
+		return nil
+	}
+	keys := s.completions.lookup(store.Norm.Key(prefix))
+	now := time.Now()
+	out := make([]Completion, 0, len(keys))
+	for _, k := range keys {
+		if l := s.v[k]; l != nil && !l.Expired(now) && !l.Disabled && !l.Unapproved {
+			out = append(out, Completion{Shortcut: k, Link: l})
+		}
+	}
+	return out
+}
@@ -0,0 +1,132 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// ErrDestinationRefused is returned for links leading where the destination
+// policy forbids.
+var ErrDestinationRefused = errors.New("destination not allowed")
+
+// DestinationPolicy decides where links may lead. Links can't lead back to
+// the shortener's own hosts, which would loop, and with allowlists only to
+// the schemes and domains listed, so the shortener can't be used to disguise
+// phishing links. A nil policy allows everything.
+type DestinationPolicy struct {
+	// self are the shortener's own hosts, in lower case without port.
+	self    map[string]bool
+	domains *Domains
+	// schemes and allowed are the allowlists; empty allows any.
+	schemes map[string]bool
+	allowed []string
+}
+
+// NewDestinationPolicy reads SELF_HOSTNAMES, ALLOWED_DESTINATION_SCHEMES and
+// ALLOWED_DESTINATION_DOMAINS (all comma-separated). The hosts of domains
+// and self are the shortener's own too. An allowed domain also allows its
+// subdomains.
+func NewDestinationPolicy(domains *Domains, self ...string) (*DestinationPolicy, error) {
+	p := &DestinationPolicy{self: make(map[string]bool), domains: domains, schemes: make(map[string]bool)}
+	for _, h := range append(splitList(os.Getenv("SELF_HOSTNAMES")), self...) {
+		if h = stripPort(h); h != "" {
+			p.self[h] = true
+		}
+	}
+	for _, s := range splitList(os.Getenv("ALLOWED_DESTINATION_SCHEMES")) {
+		p.schemes[strings.ToLower(strings.TrimSuffix(s, ":"))] = true
+	}
+	for _, d := range splitList(os.Getenv("ALLOWED_DESTINATION_DOMAINS")) {
+		d = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(d, "*"), "."))
+		if d == "" || strings.ContainsAny(d, "/:") {
+			return nil, fmt.Errorf("invalid ALLOWED_DESTINATION_DOMAINS entry %q, expected a domain such as example.com", d)
+		}
+		p.allowed = append(p.allowed, d)
+	}
+	return p, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Self reports whether host, which may carry a port, is the shortener's own.
+func (p *DestinationPolicy) Self(host string) bool {
+	if p == nil {
+		return false
+	}
+	return p.self[stripPort(host)] || p.domains.Configured(host)
+}
+
+// Check returns why u may not be a destination, or nil.
+func (p *DestinationPolicy) Check(u *url.URL) error {
+	if p == nil || u == nil {
+		return nil
+	}
+	if u.Host != "" && p.Self(u.Host) {
+		return fmt.Errorf("%w: %s is the shortener itself", ErrDestinationRefused, u.Host)
+	}
+	if len(p.schemes) > 0 && !p.schemes[strings.ToLower(u.Scheme)] {
+		return fmt.Errorf("%w: scheme %q is not allowed", ErrDestinationRefused, u.Scheme)
+	}
+	if len(p.allowed) > 0 {
+		host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+		for _, d := range p.allowed {
+			if host == d || strings.HasSuffix(host, "."+d) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s is not an allowed domain", ErrDestinationRefused, u.Hostname())
+	}
+	return nil
+}
+
+// CheckLink is Check for every destination of link: its own, its
+// variants' and its canary's. Links showing content have none, and aliases
+// lead to the destination of another link, checked in turn.
+func (p *DestinationPolicy) CheckLink(link *store.Link) error {
+	if p == nil || link.Type != "" {
+		return nil
+	}
+	if link.Alias() == "" {
+		if err := p.Check(link.URL); err != nil {
+			return err
+		}
+	}
+	for _, v := range link.Variants {
+		if err := p.CheckLink(v); err != nil {
+			return err
+		}
+	}
+	if link.Canary != nil {
+		return p.Check(link.Canary.URL)
+	}
+	return nil
+}
+
+// dropRefused removes the links of m leading where p forbids, with a
+// warning.
+func (p *DestinationPolicy) dropRefused(ctx context.Context, m store.URLMap) {
+	if p == nil {
+		return
+	}
+	for k, v := range m {
+		if err := p.CheckLink(v); err != nil {
+			store.Issuef(ctx, store.LinkIssue{Kind: store.IssueRefused, Shortcut: k, Skipped: true},
+				"shortcut %q ignored: %v", k, err)
+			delete(m, k)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// Domains maps the hosts the server answers on to link namespaces. A
+// namespace is the first segment of its shortcuts: on a host serving
+// "marketing", /spring resolves marketing/spring. Other hosts serve the
+// default namespace, where namespaced shortcuts can't be reached.
+type Domains struct {
+	// namespaces maps lower-case hosts, without port, to their namespace;
+	// hosts of the default namespace map to "".
+	namespaces map[string]string
+	// hosts maps each namespace to the first host serving it.
+	hosts map[string]string
+}
+
+// NewDomains reads DOMAINS, comma-separated hosts each optionally followed by
+// =namespace, such as "go,links.corp,s.example.com=marketing".
+func NewDomains() (*Domains, error) {
+	d := &Domains{namespaces: make(map[string]string), hosts: make(map[string]string)}
+	for _, entry := range strings.Split(os.Getenv("DOMAINS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, ns := entry, ""
+		if i := strings.IndexByte(entry, '='); i >= 0 {
+			host, ns = strings.TrimSpace(entry[:i]), strings.ToLower(strings.TrimSpace(entry[i+1:]))
+		}
+		host = strings.ToLower(host)
+		if host == "" || strings.ContainsAny(host, "/:") {
+			return nil, fmt.Errorf("invalid DOMAINS entry %q, expected host or host=namespace", entry)
+		}
+		if ns != "" && (strings.Contains(ns, "/") || !store.ShortcutPattern.MatchString(ns)) {
+			return nil, fmt.Errorf("invalid namespace %q in DOMAINS, expected a single shortcut segment", ns)
+		}
+		if _, dup := d.namespaces[host]; dup {
+			return nil, fmt.Errorf("host %q appears twice in DOMAINS", host)
+		}
+		d.namespaces[host] = ns
+		if _, ok := d.hosts[ns]; !ok {
+			d.hosts[ns] = host
+		}
+	}
+	return d, nil
+}
+
+// Configured reports whether host is listed in DOMAINS.
+func (d *Domains) Configured(host string) bool {
+	if d == nil {
+		return false
+	}
+	_, ok := d.namespaces[stripPort(host)]
+	return ok
+}
+
+// Namespace returns the namespace served on host.
+func (d *Domains) Namespace(host string) string {
+	if d == nil {
+		return ""
+	}
+	return d.namespaces[stripPort(host)]
+}
+
+// Host returns the host serving ns, or "" when DOMAINS doesn't name one.
+func (d *Domains) Host(ns string) string {
+	if d == nil {
+		return ""
+	}
+	return d.hosts[ns]
+}
+
+// Split returns the namespace of shortcut and the shortcut within it. Only
+// shortcuts below a namespace of DOMAINS belong to it; "marketing" alone is
+// a shortcut of the default namespace.
+func (d *Domains) Split(shortcut string) (ns, rest string) {
+	if d == nil {
+		return "", shortcut
+	}
+	i := strings.IndexByte(shortcut, '/')
+	if i <= 0 {
+		return "", shortcut
+	}
+	ns = strings.ToLower(shortcut[:i])
+	if _, ok := d.hosts[ns]; !ok {
+		return "", shortcut
+	}
+	return ns, shortcut[i+1:]
+}
+
+// Join returns the shortcut stored for rest in namespace ns.
+func (d *Domains) Join(ns, rest string) string {
+	if ns == "" {
+		return rest
+	}
+	return ns + "/" + rest
+}
+
+// Scope returns the links of all in namespace ns, keyed by their shortcut
+// within it.
+func (d *Domains) Scope(all store.URLMap, ns string) store.URLMap {
+	out := make(store.URLMap, len(all))
+	for k, v := range all {
+		if kns, rest := d.Split(k); kns == ns {
+			out[rest] = v
+		}
+	}
+	return out
+}
+
+// stripPort lower-cases host and removes its port, if any.
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,160 @@
+package resolver
+
+import (
+	"context"
+	"sort"
+
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+var bloomSkipsTotal = metrics.NewCounter("shortener_bloom_filter_skips_total",
+	"Lookups of missing shortcuts answered by the Bloom filter alone.")
+
+const (
+	// indexShardBits is the log2 of the number of shards of the index.
+	indexShardBits = 6
+	// bloomBitsPerKey and bloomHashes make about 1% of the lookups of
+	// missing shortcuts search the index anyway.
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+// indexEntry is a shortcut under its normalized form.
+type indexEntry struct {
+	norm, shortcut string
+}
+
+// shortcutIndex maps the normalized form of each shortcut to the shortcut,
+// see store.Norm. Entries are spread over shards by hash and kept sorted, so
+// that large link tables take a fraction of the memory of a map and no
+// single huge allocation. A Bloom filter, if set, answers most lookups of
+// missing shortcuts without searching at all, which keeps 404s and the
+// prefix fallback of deep paths cheap.
+type shortcutIndex struct {
+	shards [1 << indexShardBits][]indexEntry
+	bloom  *bloomFilter
+}
+
+// indexShortcuts indexes every non-pattern shortcut of maps, warning about
+// shortcuts equivalent to another; the first in key order wins. Tables of
+// at least bloomMinLinks shortcuts get a Bloom filter, unless it is zero.
+func indexShortcuts(ctx context.Context, bloomMinLinks int, maps ...store.URLMap) *shortcutIndex {
+	var keys []string
+	for _, m := range maps {
+		for k := range m {
+			if !store.IsPatternKey(k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	x := &shortcutIndex{}
+	if bloomMinLinks > 0 && len(keys) >= bloomMinLinks {
+		x.bloom = newBloomFilter(len(keys))
+	}
+	for _, k := range keys {
+		n := store.Norm.Key(k)
+		h := keyHash(n)
+		i := h >> (64 - indexShardBits)
+		x.shards[i] = append(x.shards[i], indexEntry{norm: n, shortcut: k})
+		if x.bloom != nil {
+			x.bloom.add(h)
+		}
+	}
+
+	var dups []indexEntry
+	first := make(map[string]string)
+	for i, shard := range x.shards {
+		// Stable, so that equivalent shortcuts stay in key order.
+		sort.SliceStable(shard, func(a, b int) bool { return shard[a].norm < shard[b].norm })
+		out := shard[:0]
+		for _, e := range shard {
+			if len(out) > 0 && out[len(out)-1].norm == e.norm {
+				first[e.shortcut] = out[len(out)-1].shortcut
+				dups = append(dups, e)
+				continue
+			}
+			out = append(out, e)
+		}
+		x.shards[i] = out
+	}
+	sort.Slice(dups, func(a, b int) bool { return dups[a].shortcut < dups[b].shortcut })
+	for _, e := range dups {
+		prev := first[e.shortcut]
+		store.Warnf(ctx, "shortcuts %q and %q are equivalent, using %q", prev, e.shortcut, prev)
+	}
+	return x
+}
+
+// missing reports whether the Bloom filter rules out that query, or an
+// equivalent shortcut, is indexed. Without one it never does.
+func (x *shortcutIndex) missing(query string) bool {
+	if x == nil || x.bloom == nil || x.bloom.mayContain(keyHash(store.Norm.Key(query))) {
+		return false
+	}
+	bloomSkipsTotal.Inc()
+	return true
+}
+
+// get returns the shortcut whose normalized form is norm, or "".
+func (x *shortcutIndex) get(norm string) string {
+	if x == nil {
+		return ""
+	}
+	shard := x.shards[keyHash(norm)>>(64-indexShardBits)]
+	i := sort.Search(len(shard), func(i int) bool { return shard[i].norm >= norm })
+	if i < len(shard) && shard[i].norm == norm {
+		return shard[i].shortcut
+	}
+	return ""
+}
+
+// keyHash is the 64-bit FNV-1a hash of key, without allocating.
+func keyHash(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// bloomFilter tells for sure when a key is not in a set.
+type bloomFilter struct {
+	bits []uint64
+}
+
+func newBloomFilter(n int) *bloomFilter {
+	return &bloomFilter{bits: make([]uint64, (n*bloomBitsPerKey+63)/64+1)}
+}
+
+// positions calls fn with the bits of the key hashed to h, derived from two
+// halves of h by double hashing.
+func (f *bloomFilter) positions(h uint64, fn func(word int, mask uint64) bool) {
+	n := uint64(len(f.bits)) * 64
+	h1, h2 := h&0xffffffff, h>>32|1
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % n
+		if !fn(int(bit/64), 1<<(bit%64)) {
+			return
+		}
+	}
+}
+
+func (f *bloomFilter) add(h uint64) {
+	f.positions(h, func(word int, mask uint64) bool {
+		f.bits[word] |= mask
+		return true
+	})
+}
+
+func (f *bloomFilter) mayContain(h uint64) bool {
+	found := true
+	f.positions(h, func(word int, mask uint64) bool {
+		found = f.bits[word]&mask != 0
+		return found
+	})
+	return found
+}
@@ -0,0 +1,70 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// invalidationRetry is how long to wait before resubscribing after the
+// pub/sub connection failed.
+const invalidationRetry = 5 * time.Second
+
+// Invalidator tells other replicas to reload their links through a Redis
+// pub/sub channel, so a write on one replica is visible on all of them right
+// away instead of after their next refresh.
+type Invalidator struct {
+	client  *store.RedisClient
+	channel string
+	// id identifies this replica, so it ignores its own messages.
+	id string
+}
+
+// NewInvalidator connects to the Redis server at rawURL and publishes on
+// channel.
+func NewInvalidator(rawURL, channel string) (*Invalidator, error) {
+	client, err := store.NewRedisClient(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &Invalidator{client: client, channel: channel, id: hex.EncodeToString(b)}, nil
+}
+
+// Publish notifies the other replicas. Failures are only logged: replicas
+// still catch up on their next scheduled refresh.
+func (i *Invalidator) Publish() {
+	ctx, cancel := context.WithTimeout(context.Background(), store.RedisTimeout)
+	defer cancel()
+	if _, err := i.client.Do(ctx, "PUBLISH", i.channel, i.id); err != nil {
+		log.Printf("warn: failed to publish invalidation: %v", err)
+	}
+}
+
+// Run calls invalidate for every message from another replica until ctx is
+// cancelled. Messages may have been missed while the subscription was down,
+// so invalidate is also called before resubscribing.
+func (i *Invalidator) Run(ctx context.Context, invalidate func()) {
+	for {
+		err := i.client.Subscribe(ctx, i.channel, func(msg string) {
+			if msg != i.id {
+				invalidate()
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("warn: invalidation subscription to %q failed: %v", i.channel, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(invalidationRetry):
+		}
+		invalidate()
+	}
+}
@@ -0,0 +1,158 @@
+package resolver
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+)
+
+// Lookup kinds latency is broken down by: resolutions served from the
+// loaded links, and those that had to wait for a refresh of the provider.
+const (
+	LookupCache   = "cache"
+	LookupRefresh = "refresh"
+)
+
+const (
+	// latencyWindow is the number of recent resolutions quantiles are
+	// computed over, per lookup kind.
+	latencyWindow = 4096
+	// shortcutLatencyWindow is the same for each shortcut.
+	shortcutLatencyWindow = 256
+	// maxLatencyShortcuts caps the shortcuts tracked; resolutions of others
+	// only count towards their lookup kind.
+	maxLatencyShortcuts = 10000
+)
+
+// latencyQuantiles are the quantiles reported.
+var latencyQuantiles = []float64{0.5, 0.95, 0.99}
+
+var resolveDuration = metrics.NewSummaryVec("shortener_resolve_duration_seconds",
+	"Duration of shortcut resolutions over the recent ones, by lookup: served from the cache or waiting for a refresh.",
+	"lookup", latencyQuantiles, latencyWindow)
+
+// LatencySummary describes the latency of recent resolutions against SLO,
+// the target latency.
+type LatencySummary struct {
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50_seconds"`
+	P95   float64 `json:"p95_seconds"`
+	P99   float64 `json:"p99_seconds"`
+	// WithinSLO is the fraction of all resolutions faster than the target.
+	WithinSLO float64 `json:"within_slo"`
+}
+
+// Latency records how long resolutions take, by lookup kind and by
+// shortcut, against a target, see LATENCY_SLO.
+type Latency struct {
+	SLO time.Duration
+
+	kinds     sync.Map // lookup kind -> *latencyStats
+	mu        sync.Mutex
+	shortcuts map[string]*latencyStats
+}
+
+type latencyStats struct {
+	window *metrics.Window
+	slow   uint64 // resolutions over the SLO
+}
+
+// NewLatency returns a Latency with the given target.
+func NewLatency(slo time.Duration) *Latency {
+	return &Latency{SLO: slo, shortcuts: make(map[string]*latencyStats)}
+}
+
+// Observe records a resolution of shortcut, "" when nothing matched, of the
+// given lookup kind.
+func (l *Latency) Observe(kind, shortcut string, d time.Duration) {
+	slow := d > l.SLO
+	resolveDuration.Observe(kind, d.Seconds())
+	s, ok := l.kinds.Load(kind)
+	if !ok {
+		s, _ = l.kinds.LoadOrStore(kind, &latencyStats{window: metrics.NewWindow(latencyWindow)})
+	}
+	s.(*latencyStats).add(d, slow)
+	if shortcut == "" {
+		return
+	}
+
+	l.mu.Lock()
+	st := l.shortcuts[shortcut]
+	if st == nil && len(l.shortcuts) < maxLatencyShortcuts {
+		st = &latencyStats{window: metrics.NewWindow(shortcutLatencyWindow)}
+		l.shortcuts[shortcut] = st
+	}
+	l.mu.Unlock()
+	if st != nil {
+		st.add(d, slow)
+	}
+}
+
+func (s *latencyStats) add(d time.Duration, slow bool) {
+	s.window.Observe(d.Seconds())
+	if slow {
+		atomic.AddUint64(&s.slow, 1)
+	}
+}
+
+func (s *latencyStats) summary() LatencySummary {
+	qs, _, count := s.window.Quantiles(latencyQuantiles...)
+	out := LatencySummary{Count: count, P50: qs[0], P95: qs[1], P99: qs[2], WithinSLO: 1}
+	if count > 0 {
+		out.WithinSLO = 1 - float64(atomic.LoadUint64(&s.slow))/float64(count)
+	}
+	return out
+}
+
+// Kinds summarizes the resolutions of each lookup kind seen.
+func (l *Latency) Kinds() map[string]LatencySummary {
+	out := make(map[string]LatencySummary)
+	l.kinds.Range(func(k, v interface{}) bool {
+		out[k.(string)] = v.(*latencyStats).summary()
+		return true
+	})
+	return out
+}
+
+// Shortcut summarizes the resolutions of shortcut, reporting false if none
+// were recorded.
+func (l *Latency) Shortcut(shortcut string) (LatencySummary, bool) {
+	l.mu.Lock()
+	s := l.shortcuts[shortcut]
+	l.mu.Unlock()
+	if s == nil {
+		return LatencySummary{}, false
+	}
+	return s.summary(), true
+}
+
+// Slowest returns the n shortcuts with the highest p99 latency.
+func (l *Latency) Slowest(n int) []string {
+	l.mu.Lock()
+	stats := make(map[string]*latencyStats, len(l.shortcuts))
+	for k, v := range l.shortcuts {
+		stats[k] = v
+	}
+	l.mu.Unlock()
+
+	p99 := make(map[string]float64, len(stats))
+	keys := make([]string, 0, len(stats))
+	for k, s := range stats {
+		qs, _, _ := s.window.Quantiles(0.99)
+		p99[k] = qs[0]
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if p99[keys[i]] != p99[keys[j]] {
+			return p99[keys[i]] > p99[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
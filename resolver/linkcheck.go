@@ -0,0 +1,243 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/env"
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+var brokenLinks = metrics.NewGauge("shortener_broken_links",
+	"Links whose destination failed the last dead-link check.")
+
+// LinkHealth is the outcome of the last check of a link's destination.
+type LinkHealth struct {
+	// Status is the final status code after following redirects, zero when
+	// the request failed.
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Broken    bool      `json:"broken"`
+	CheckedAt time.Time `json:"checked_at"`
+	// BrokenSince is the first failed check of the current failure streak.
+	BrokenSince *time.Time `json:"broken_since,omitempty"`
+}
+
+// brokenStatus reports whether a destination answering code is gone.
+// Authentication and rate limit errors mean the page likely exists.
+func brokenStatus(code int) bool {
+	return code == http.StatusNotFound || code == http.StatusGone || code >= 500
+}
+
+// LinkChecker periodically requests every destination and remembers which
+// ones are broken. A nil checker is disabled.
+type LinkChecker struct {
+	db          *Cache
+	client      *http.Client
+	concurrency int
+	// webhook is a Slack incoming webhook told about newly broken links.
+	webhook string
+
+	mu      sync.Mutex
+	results map[string]*LinkHealth
+}
+
+// NewLinkChecker returns a checker configured by LINK_CHECK_CONCURRENCY,
+// LINK_CHECK_TIMEOUT and LINK_CHECK_SLACK_WEBHOOK.
+func NewLinkChecker(db *Cache) *LinkChecker {
+	return &LinkChecker{
+		db:          db,
+		client:      &http.Client{Timeout: env.Duration("LINK_CHECK_TIMEOUT", 10*time.Second)},
+		concurrency: env.Int("LINK_CHECK_CONCURRENCY", 4, 1, 256),
+		webhook:     os.Getenv("LINK_CHECK_SLACK_WEBHOOK"),
+		results:     make(map[string]*LinkHealth),
+	}
+}
+
+// Health returns the last check of shortcut, or nil if it was not checked.
+func (c *LinkChecker) Health(shortcut string) *LinkHealth {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.results[shortcut]
+}
+
+// Run checks every link right away and then every interval until ctx is
+// done.
+func (c *LinkChecker) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		c.CheckAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// CheckAll checks the destination of every active link. Templates with
+// placeholders are skipped since they are only complete once filled.
+func (c *LinkChecker) CheckAll(ctx context.Context) {
+	all, err := c.db.All()
+	if err != nil {
+		log.Printf("warn: link check: failed to load links: %v", err)
+		return
+	}
+
+	// Each destination is requested once however many shortcuts use it.
+	byURL := make(map[string][]string)
+	for k, l := range all {
+		if store.IsPatternKey(k) || hasPlaceholders(l.URL) || (l.URL.Scheme != "http" && l.URL.Scheme != "https") {
+			continue
+		}
+		u := l.URL.String()
+		byURL[u] = append(byURL[u], k)
+	}
+
+	start := time.Now()
+	checked := make(map[string]LinkHealth, len(byURL))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, c.concurrency)
+	for u := range byURL {
+		select {
+		case <-ctx.Done():
+			return
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(u string) {
+			defer func() { <-sem; wg.Done() }()
+			h := c.check(ctx, u)
+			mu.Lock()
+			checked[u] = h
+			mu.Unlock()
+		}(u)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	var newlyBroken []string
+	c.mu.Lock()
+	results := make(map[string]*LinkHealth, len(all))
+	for u, shortcuts := range byURL {
+		for _, k := range shortcuts {
+			h := checked[u]
+			if h.Broken {
+				if prev := c.results[k]; prev != nil && prev.Broken {
+					h.BrokenSince = prev.BrokenSince
+				} else {
+					since := h.CheckedAt
+					h.BrokenSince = &since
+					newlyBroken = append(newlyBroken, k)
+				}
+			}
+			results[k] = &h
+		}
+	}
+	c.results = results
+	c.mu.Unlock()
+
+	broken := 0
+	for _, h := range results {
+		if h.Broken {
+			broken++
+		}
+	}
+	brokenLinks.Set(float64(broken))
+	log.Printf("checked %d destinations of %d links in %v, %d broken", len(byURL), len(results), time.Since(start).Round(time.Millisecond), broken)
+
+	if len(newlyBroken) > 0 {
+		sort.Strings(newlyBroken)
+		if err := c.notify(ctx, newlyBroken, all); err != nil {
+			log.Printf("warn: link check: failed to notify about broken links: %v", err)
+		}
+	}
+}
+
+// check requests u with HEAD, falling back to GET for servers that don't
+// support it.
+func (c *LinkChecker) check(ctx context.Context, u string) LinkHealth {
+	h := LinkHealth{CheckedAt: time.Now().UTC()}
+	code, err := c.request(ctx, http.MethodHead, u)
+	if err == nil && (code == http.StatusMethodNotAllowed || code == http.StatusNotImplemented) {
+		code, err = c.request(ctx, http.MethodGet, u)
+	}
+	if err != nil {
+		h.Error = err.Error()
+		h.Broken = true
+		return h
+	}
+	h.Status = code
+	h.Broken = brokenStatus(code)
+	return h
+}
+
+func (c *LinkChecker) request(ctx context.Context, method, u string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "url-shortener-linkcheck/1.0")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// notify posts the newly broken shortcuts and their owners to the Slack
+// webhook.
+func (c *LinkChecker) notify(ctx context.Context, shortcuts []string, all store.URLMap) error {
+	if c.webhook == "" {
+		return nil
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d links point at broken pages:\n", len(shortcuts))
+	for _, k := range shortcuts {
+		h := c.Health(k)
+		reason := h.Error
+		if reason == "" {
+			reason = fmt.Sprintf("HTTP %d", h.Status)
+		}
+		fmt.Fprintf(&b, "• `%s` → %s (%s)", k, all[k].URL, reason)
+		if owner := all[k].Owner; owner != "" {
+			fmt.Fprintf(&b, ", owned by %s", owner)
+		}
+		b.WriteString("\n")
+	}
+	body, _ := json.Marshal(map[string]string{"text": b.String()})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package resolver
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// NotFoundCache remembers recent paths that matched no shortcut, so repeated
+// requests for them (favicon.ico, crawlers) skip the lookup loop. It holds at
+// most size entries, evicting the least recently used. A nil cache is
+// disabled.
+type NotFoundCache struct {
+	sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type notFoundEntry struct {
+	path    string
+	expires time.Time
+}
+
+// NewNotFoundCache returns a cache of size entries kept for ttl, or nil when
+// either is zero.
+func NewNotFoundCache(size int, ttl time.Duration) *NotFoundCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &NotFoundCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Has reports whether path was recorded as not found less than ttl ago.
+func (c *NotFoundCache) Has(path string, now time.Time) bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.items[path]
+	if !ok {
+		return false
+	}
+	if now.After(el.Value.(*notFoundEntry).expires) {
+		c.ll.Remove(el)
+		delete(c.items, path)
+		return false
+	}
+	c.ll.MoveToFront(el)
+	return true
+}
+
+// Add records path as not found.
+func (c *NotFoundCache) Add(path string, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.items[path]; ok {
+		el.Value.(*notFoundEntry).expires = now.Add(c.ttl)
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[path] = c.ll.PushFront(&notFoundEntry{path: path, expires: now.Add(c.ttl)})
+	for c.ll.Len() > c.size {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.items, el.Value.(*notFoundEntry).path)
+	}
+}
+
+// Purge forgets all entries, e.g. when links changed.
+func (c *NotFoundCache) Purge() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
@@ -0,0 +1,244 @@
+package resolver
+
+import (
+	"context"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/denizyoldas/url-shorter/internal/env"
+	"github.com/denizyoldas/url-shorter/store"
+	"golang.org/x/net/html"
+)
+
+const (
+	// pageInfoPoll is how often new destinations are looked for.
+	pageInfoPoll = time.Minute
+	// maxPageInfoBody is how much of a page is read looking for its title.
+	maxPageInfoBody = 512 << 10
+	// maxTitleLength bounds the titles kept, in runes.
+	maxTitleLength = 200
+)
+
+// PageInfo is what the destination of a link says about itself.
+type PageInfo struct {
+	Title string `json:"title,omitempty"`
+	// Favicon is the URL of the icon the page declares, or /favicon.ico of
+	// its host.
+	Favicon   string    `json:"favicon,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// PageFetcher fetches the title and favicon of every destination in the
+// background and remembers them. A nil fetcher is disabled.
+type PageFetcher struct {
+	db          *Cache
+	client      *http.Client
+	concurrency int
+
+	mu    sync.Mutex
+	pages map[string]*PageInfo
+}
+
+// NewPageFetcher returns a fetcher configured by PAGE_INFO_CONCURRENCY and
+// PAGE_INFO_TIMEOUT.
+func NewPageFetcher(db *Cache) *PageFetcher {
+	return &PageFetcher{
+		db:          db,
+		client:      &http.Client{Timeout: env.Duration("PAGE_INFO_TIMEOUT", 10*time.Second)},
+		concurrency: env.Int("PAGE_INFO_CONCURRENCY", 4, 1, 256),
+		pages:       make(map[string]*PageInfo),
+	}
+}
+
+// Info returns what the destination of link was found to say about itself,
+// or nil if it was not fetched.
+func (f *PageFetcher) Info(link *store.Link) *PageInfo {
+	if f == nil || link.URL == nil || link.Type != "" {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pages[link.URL.String()]
+}
+
+// Run fetches the destinations not fetched yet, or not within maxAge, right
+// away and then every minute until ctx is done, so new links get their
+// title soon.
+func (f *PageFetcher) Run(ctx context.Context, maxAge time.Duration) {
+	t := time.NewTicker(pageInfoPoll)
+	defer t.Stop()
+	for {
+		f.FetchAll(ctx, maxAge)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// FetchAll fetches the destinations of the links that were not fetched
+// within maxAge and forgets those no link leads to anymore. Like the link
+// check it skips templates with placeholders.
+func (f *PageFetcher) FetchAll(ctx context.Context, maxAge time.Duration) {
+	all, err := f.db.All()
+	if err != nil {
+		log.Printf("warn: page info: failed to load links: %v", err)
+		return
+	}
+
+	used := make(map[string]bool)
+	var due []string
+	now := time.Now()
+	f.mu.Lock()
+	for k, l := range all {
+		if store.IsPatternKey(k) || l.Type != "" || hasPlaceholders(l.URL) || (l.URL.Scheme != "http" && l.URL.Scheme != "https") {
+			continue
+		}
+		u := l.URL.String()
+		if used[u] {
+			continue
+		}
+		used[u] = true
+		if p := f.pages[u]; p == nil || now.Sub(p.FetchedAt) >= maxAge {
+			due = append(due, u)
+		}
+	}
+	for u := range f.pages {
+		if !used[u] {
+			delete(f.pages, u)
+		}
+	}
+	f.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, f.concurrency)
+	for _, u := range due {
+		select {
+		case <-ctx.Done():
+			return
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(u string) {
+			defer func() { <-sem; wg.Done() }()
+			p := f.fetch(ctx, u)
+			if ctx.Err() != nil {
+				return
+			}
+			f.mu.Lock()
+			f.pages[u] = &p
+			f.mu.Unlock()
+		}(u)
+	}
+	wg.Wait()
+	log.Printf("fetched the titles of %d destinations in %v", len(due), time.Since(start).Round(time.Millisecond))
+}
+
+// fetch requests u and reads the title and favicon from the head of the page.
+func (f *PageFetcher) fetch(ctx context.Context, u string) PageInfo {
+	p := PageInfo{FetchedAt: time.Now().UTC()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	req.Header.Set("User-Agent", "url-shortener-pageinfo/1.0")
+	req.Header.Set("Accept", "text/html")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	defer resp.Body.Close()
+	base := resp.Request.URL
+	p.Favicon = base.ResolveReference(&url.URL{Path: "/favicon.ico"}).String()
+	if resp.StatusCode != http.StatusOK {
+		p.Error = "HTTP " + resp.Status
+		return p
+	}
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct != "text/html" && ct != "application/xhtml+xml" {
+		return p
+	}
+	title, icon := parseHead(io.LimitReader(resp.Body, maxPageInfoBody))
+	p.Title = title
+	if icon != "" {
+		if ref, err := url.Parse(icon); err == nil {
+			p.Favicon = base.ResolveReference(ref).String()
+		}
+	}
+	return p
+}
+
+// parseHead returns the title and the href of the icon declared in the head
+// of an HTML page.
+func parseHead(r io.Reader) (title, icon string) {
+	z := html.NewTokenizer(r)
+	inTitle := false
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return cleanTitle(title), icon
+		case html.TextToken:
+			if inTitle {
+				title += string(z.Text())
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = title == ""
+			case "link":
+				var rel, href string
+				for hasAttr {
+					var k, v []byte
+					k, v, hasAttr = z.TagAttr()
+					switch string(k) {
+					case "rel":
+						rel = strings.ToLower(string(v))
+					case "href":
+						href = string(v)
+					}
+				}
+				// "icon" is preferred over Apple's larger touch icons.
+				for _, v := range strings.Fields(rel) {
+					if v == "icon" || (v == "apple-touch-icon" && icon == "") {
+						icon = href
+					}
+				}
+			case "body":
+				return cleanTitle(title), icon
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				return cleanTitle(title), icon
+			}
+		}
+	}
+}
+
+// cleanTitle collapses the whitespace of title and shortens it to
+// maxTitleLength runes.
+func cleanTitle(title string) string {
+	title = strings.Join(strings.Fields(title), " ")
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		title = string([]rune(title)[:maxTitleLength-1]) + "…"
+	}
+	return title
+}
@@ -0,0 +1,67 @@
+package resolver
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// linkPattern is a shortcut matched against whole request paths. Its
+// wildcards or capture groups fill the {n} placeholders of the destination.
+type linkPattern struct {
+	key  string
+	re   *regexp.Regexp
+	link *store.Link
+}
+
+func compilePattern(key string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(key, store.RegexPrefix) {
+		return regexp.Compile("(?i)^(?:" + strings.TrimPrefix(key, store.RegexPrefix) + ")$")
+	}
+	parts := strings.Split(key, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	return regexp.Compile("(?i)^" + strings.Join(parts, "([^/]+)") + "$")
+}
+
+// compilePatterns extracts the pattern shortcuts of m, most specific (longest)
+// first so that matching is deterministic. Invalid patterns are skipped.
+func compilePatterns(ctx context.Context, m store.URLMap) []*linkPattern {
+	var out []*linkPattern
+	for k, v := range m {
+		if !store.IsPatternKey(k) {
+			continue
+		}
+		re, err := compilePattern(k)
+		if err != nil {
+			store.Warnf(ctx, "shortcut pattern %q is invalid: %v", k, err)
+			continue
+		}
+		out = append(out, &linkPattern{key: k, re: re, link: v})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if len(out[i].key) != len(out[j].key) {
+			return len(out[i].key) > len(out[j].key)
+		}
+		return out[i].key < out[j].key
+	})
+	return out
+}
+
+// matchPattern returns the first of patterns matching path and its captures,
+// skipping those whose key is not accepted when accept is set.
+func matchPattern(patterns []*linkPattern, path string, accept func(key string) bool) (*linkPattern, []string) {
+	for _, p := range patterns {
+		if accept != nil && !accept(p.key) {
+			continue
+		}
+		if m := p.re.FindStringSubmatch(path); m != nil {
+			return p, m[1:]
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,39 @@
+package resolver
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+// placeholderPattern matches {1}, {2}, ... in destination URLs.
+var placeholderPattern = regexp.MustCompile(`\{([1-9][0-9]*)\}`)
+
+// hasPlaceholders reports whether u is a template whose placeholders are
+// filled from the path segments following the shortcut.
+func hasPlaceholders(u *url.URL) bool {
+	return placeholderPattern.MatchString(u.Path) ||
+		placeholderPattern.MatchString(u.RawQuery) ||
+		placeholderPattern.MatchString(u.Fragment)
+}
+
+// fillPlaceholders replaces each {n} in s with the n-th of args passed
+// through escape. Placeholders without a matching argument become empty.
+func fillPlaceholders(s string, args []string, escape func(string) string) string {
+	return placeholderPattern.ReplaceAllStringFunc(s, func(m string) string {
+		n, _ := strconv.Atoi(m[1 : len(m)-1])
+		if n > len(args) {
+			return ""
+		}
+		return escape(args[n-1])
+	})
+}
+
+// fillTemplate fills the placeholders of u in place with args.
+func fillTemplate(u *url.URL, args []string) {
+	keep := func(s string) string { return s }
+	u.Path = fillPlaceholders(u.Path, args, keep)
+	u.RawPath = ""
+	u.RawQuery = fillPlaceholders(u.RawQuery, args, url.QueryEscape)
+	u.Fragment = fillPlaceholders(u.Fragment, args, keep)
+}
@@ -0,0 +1,130 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// ErrShortcutReserved is returned when creating a reserved shortcut.
+var ErrShortcutReserved = errors.New("shortcut is reserved")
+
+// builtinReserved are the first path segments of the server's own routes.
+var builtinReserved = []string{"admin", "api", "favicon.ico", "healthz", "metrics", "new", "opensearch.xml", "popular", "readyz", "robots.txt", "slack", "tools"}
+
+// ReservedWords are shortcuts that can be neither created nor loaded. Plain
+// words match a whole shortcut or its first segment, so "api" also reserves
+// "api/foo"; path.Match patterns such as "*damn*" match any segment.
+type ReservedWords struct {
+	static []string
+
+	mu sync.RWMutex
+	// loaded come from the provider and are replaced on every refresh.
+	loaded []string
+}
+
+// NewReservedWords returns the built-in words and those of
+// RESERVED_SHORTCUTS (comma-separated) and RESERVED_SHORTCUTS_FILE (one per
+// line, # starts a comment).
+func NewReservedWords() (*ReservedWords, error) {
+	r := &ReservedWords{static: append([]string{}, builtinReserved...)}
+	for _, w := range strings.Split(os.Getenv("RESERVED_SHORTCUTS"), ",") {
+		r.static = appendReserved(r.static, w)
+	}
+	if name := os.Getenv("RESERVED_SHORTCUTS_FILE"); name != "" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read RESERVED_SHORTCUTS_FILE: %w", err)
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := sc.Text()
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			r.static = appendReserved(r.static, line)
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read RESERVED_SHORTCUTS_FILE: %w", err)
+		}
+	}
+	for _, w := range r.static {
+		if _, err := path.Match(w, ""); err != nil {
+			return nil, fmt.Errorf("reserved shortcut %q is not a valid pattern", w)
+		}
+	}
+	return r, nil
+}
+
+// appendReserved adds w in the normalized form shortcuts are compared in.
+func appendReserved(words []string, w string) []string {
+	if w = store.Norm.Key(strings.TrimSpace(w)); w != "" {
+		words = append(words, w)
+	}
+	return words
+}
+
+// SetLoaded replaces the words loaded from the provider.
+func (r *ReservedWords) SetLoaded(words []string) {
+	if r == nil {
+		return
+	}
+	var out []string
+	for _, w := range words {
+		out = appendReserved(out, w)
+	}
+	r.mu.Lock()
+	r.loaded = out
+	r.mu.Unlock()
+}
+
+// Reserved returns the word reserving shortcut, if any.
+func (r *ReservedWords) Reserved(shortcut string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	key := store.Norm.Key(shortcut)
+	segments := strings.Split(key, "/")
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, words := range [][]string{r.static, r.loaded} {
+		for _, w := range words {
+			if !strings.ContainsAny(w, "*?[") {
+				if w == key || w == segments[0] {
+					return w, true
+				}
+				continue
+			}
+			for _, s := range segments {
+				if ok, _ := path.Match(w, s); ok {
+					return w, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// dropReserved removes reserved shortcuts from m with a warning. Regular
+// expression shortcuts are kept since they can't be compared.
+func (r *ReservedWords) dropReserved(ctx context.Context, m store.URLMap) {
+	for k := range m {
+		if strings.HasPrefix(k, store.RegexPrefix) {
+			continue
+		}
+		if w, ok := r.Reserved(k); ok {
+			store.Issuef(ctx, store.LinkIssue{Kind: store.IssueReserved, Shortcut: k, Skipped: true},
+				"shortcut %q is reserved by %q, ignoring it", k, w)
+			delete(m, k)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Package resolver caches the links of a provider and finds the destination
+// of request paths among them.
+package resolver
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+var notFoundCacheHitsTotal = metrics.NewCounter("shortener_not_found_cache_hits_total",
+	"Requests answered from the cache of recently not found paths.")
+
+// defaultLatencySLO is the target resolution latency unless LATENCY_SLO
+// is set.
+const defaultLatencySLO = 50 * time.Millisecond
+
+// Resolver finds the destination of request paths in the links of a cache.
+type Resolver struct {
+	links   *Cache
+	domains *Domains
+	// Latency records how long resolutions take.
+	Latency *Latency
+	// NoPrefixFallback only resolves exact and pattern shortcuts, so
+	// "/go/doc" is not found unless it is a shortcut itself, see
+	// PATH_FALLBACK.
+	NoPrefixFallback bool
+	// MaxFallbackDepth bounds how many trailing path segments the longest
+	// prefix fallback passes on to the destination, see
+	// PATH_FALLBACK_DEPTH. Zero means no limit.
+	MaxFallbackDepth int
+}
+
+// NewResolver returns a Resolver over links, with namespaces from domains,
+// which may be nil.
+func NewResolver(links *Cache, domains *Domains) *Resolver {
+	return &Resolver{links: links, domains: domains, Latency: NewLatency(defaultLatencySLO)}
+}
+
+// Resolve returns the shortcut matching the request path in namespace ns,
+// its link and the destination to redirect to: an exact match, else a
+// pattern shortcut, else the longest prefix, unless NoPrefixFallback is set
+// or the prefix leaves more than MaxFallbackDepth segments. If that shortcut
+// has expired it fails with store.ErrLinkExpired, if it is disabled with
+// store.ErrLinkDisabled, if it awaits approval with store.ErrLinkUnapproved,
+// and if it is not active yet with store.ErrLinkPending. Conditional
+// variants are skipped and splits drawn at random, see ResolveFor.
+func (r *Resolver) Resolve(req *url.URL, ns string) (string, *store.Link, *url.URL, error) {
+	return r.ResolveFor(req, ns, store.Visitor{})
+}
+
+// ResolveFor is Resolve for visitor: the link returned is the variant of the
+// matching shortcut that visitor should follow.
+func (r *Resolver) ResolveFor(req *url.URL, ns string, visitor store.Visitor) (string, *store.Link, *url.URL, error) {
+	if r.links.Shadow {
+		return r.resolve(req, ns, visitor)
+	}
+	start := time.Now()
+	kind := LookupCache
+	if !r.links.ready() {
+		kind = LookupRefresh
+	}
+	shortcut, link, dest, err := r.resolve(req, ns, visitor)
+	r.Latency.Observe(kind, shortcut, time.Since(start))
+	return shortcut, link, dest, err
+}
+
+func (r *Resolver) resolve(req *url.URL, ns string, visitor store.Visitor) (string, *store.Link, *url.URL, error) {
+	path := strings.TrimPrefix(DecodePath(req.Path), "/")
+	// The same path leads elsewhere in each namespace.
+	cacheKey := path
+	if ns != "" {
+		cacheKey = ns + "\x00" + path
+	}
+	if r.links.notFound.Has(cacheKey, time.Now()) {
+		notFoundCacheHitsTotal.Inc()
+		return "", nil, nil, nil
+	}
+	inNamespace := func(key string) bool {
+		kns, _ := r.domains.Split(key)
+		return kns == ns
+	}
+
+	// "/a/b/c/d" -> "/a/b/c/d", "/a/b/c" -> "/a/b", "a"; below ns when set.
+	full := r.domains.Join(ns, path)
+	segments := strings.Split(full, "/")
+	minSegments := 0
+	if ns != "" {
+		minSegments = 1
+	}
+	var discard []string
+	for len(segments) > minSegments {
+		query, v, err := r.links.Lookup(strings.Join(segments, "/"))
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if v != nil && !inNamespace(query) {
+			v = nil
+		}
+		if v != nil {
+			// Disabling a link disables its variants too.
+			if v.Disabled {
+				return query, v, nil, store.ErrLinkDisabled
+			}
+			if v.Unapproved {
+				return query, v, nil, store.ErrLinkUnapproved
+			}
+			v = v.For(visitor, query)
+			if err := checkWindow(v, time.Now()); err != nil {
+				return query, v, nil, err
+			}
+			if v.Alias() != "" {
+				_, to, err := r.follow(query, v, visitor, inNamespace)
+				if err != nil || to == nil {
+					return query, v, nil, err
+				}
+				v = to
+			}
+			addPath := strings.Join(discard, "/")
+			dest := prepRedirect(v.URL, addPath, rawTail(req, addPath), v.Params, req.RawQuery)
+			if store.Norm.KeepTrailingSlash && addPath == "" && strings.HasSuffix(full, "/") &&
+				!hasPlaceholders(v.URL) && !strings.HasSuffix(dest.Path, "/") {
+				dest.Path += "/"
+			}
+			return query, v, dest, nil
+		}
+		if len(discard) == 0 {
+			if key, v, args := r.links.Match(full, inNamespace); v != nil {
+				if v.Disabled {
+					return key, v, nil, store.ErrLinkDisabled
+				}
+				if v.Unapproved {
+					return key, v, nil, store.ErrLinkUnapproved
+				}
+				v = v.For(visitor, key)
+				if err := checkWindow(v, time.Now()); err != nil {
+					return key, v, nil, err
+				}
+				if v.Alias() != "" {
+					_, to, err := r.follow(key, v, visitor, inNamespace)
+					if err != nil || to == nil {
+						return key, v, nil, err
+					}
+					return key, to, prepRedirect(to.URL, "", "", to.Params, req.RawQuery), nil
+				}
+				dest := *v.URL
+				fillTemplate(&dest, args)
+				return key, v, prepRedirect(&dest, "", "", v.Params, req.RawQuery), nil
+			}
+		}
+		if r.NoPrefixFallback || (r.MaxFallbackDepth > 0 && len(discard) >= r.MaxFallbackDepth) {
+			break
+		}
+		discard = append([]string{segments[len(segments)-1]}, discard...)
+		segments = segments[:len(segments)-1]
+	}
+
+	r.links.notFound.Add(cacheKey, time.Now())
+	return "", nil, nil, nil
+}
+
+// checkWindow returns the error resolving link at now fails with when now
+// is outside its activation window.
+func checkWindow(link *store.Link, now time.Time) error {
+	switch {
+	case link.Expired(now):
+		return store.ErrLinkExpired
+	case link.Pending(now):
+		return store.ErrLinkPending
+	}
+	return nil
+}
+
+// prepRedirect builds the destination from a copy of link: placeholders such
+// as {1} are filled from the segments of addPath, or when there are none
+// addPath is appended to the path, escaped as in rawAddPath when that is
+// set. params replace those of the destination and rawQuery, the query
+// string of the request, is added as it was sent, so the case, order,
+// escaping and repeats of its parameters reach the destination.
+func prepRedirect(link *url.URL, addPath, rawAddPath string, params url.Values, rawQuery string) *url.URL {
+	// link is shared with the cache, never modify it in place.
+	base := new(url.URL)
+	*base = *link
+	base.Host = asciiHost(base.Host)
+	if hasPlaceholders(base) {
+		var args []string
+		if addPath != "" {
+			args = strings.Split(addPath, "/")
+		}
+		fillTemplate(base, args)
+	} else if addPath != "" {
+		rawPath := base.EscapedPath()
+		if !strings.HasSuffix(base.Path, "/") {
+			base.Path += "/"
+			rawPath += "/"
+		}
+		base.Path += addPath
+		base.RawPath = ""
+		if rawAddPath != "" {
+			// Ignored by String unless it is a valid escaping of Path.
+			base.RawPath = rawPath + rawAddPath
+		}
+	}
+
+	if len(params) > 0 {
+		base.RawQuery = replaceParams(base.RawQuery, params)
+	}
+	base.RawQuery = joinQuery(base.RawQuery, rawQuery)
+	return base
+}
+
+// rawTail returns the end of the path of req that decodes to tail, as the
+// client escaped it, or "" when there is none, as when DecodePath repaired
+// the path.
+func rawTail(req *url.URL, tail string) string {
+	if tail == "" {
+		return ""
+	}
+	raw := req.EscapedPath()
+	for i := len(raw) - 1; i >= 0; i-- {
+		if raw[i] != '/' {
+			continue
+		}
+		p, err := url.PathUnescape(raw[i+1:])
+		if err == nil && p == tail {
+			return raw[i+1:]
+		}
+		if len(p) > len(tail) {
+			break
+		}
+	}
+	return ""
+}
+
+// replaceParams returns the query string raw with params in place of the
+// parameters of the same names, leaving the others as they were. Parameters
+// raw lacks are added at the end.
+func replaceParams(raw string, params url.Values) string {
+	var pairs []string
+	done := make(map[string]bool)
+	add := func(k string) {
+		if done[k] {
+			return
+		}
+		done[k] = true
+		for _, v := range params[k] {
+			pairs = append(pairs, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+	for _, pair := range strings.Split(raw, "&") {
+		if pair == "" {
+			continue
+		}
+		k := pair
+		if i := strings.IndexByte(k, '='); i >= 0 {
+			k = k[:i]
+		}
+		if unescaped, err := url.QueryUnescape(k); err == nil {
+			k = unescaped
+		}
+		if _, ok := params[k]; ok {
+			add(k)
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		add(k)
+	}
+	return strings.Join(pairs, "&")
+}
+
+// joinQuery joins two query strings, either of which may be empty.
+func joinQuery(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	return a + "&" + b
+}
@@ -0,0 +1,828 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/store"
+	"github.com/denizyoldas/url-shorter/store/storetest"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestCache returns a cache of p after its first refresh.
+func newTestCache(t *testing.T, p store.Provider) *Cache {
+	t.Helper()
+	c := NewCache(p, NewScheduler(time.Minute, time.Minute), NewNotFoundCache(16, time.Minute))
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	return c
+}
+
+func TestResolve(t *testing.T) {
+	t.Setenv("DOMAINS", "go.example.com,m.example.com=marketing")
+	domains, err := NewDomains()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := storetest.New(map[string]string{
+		"go":               "https://go.dev/",
+		"gh":               "https://github.com/org/{1}/issues/{2}",
+		"jira/*":           "https://jira.example.com/browse/{1}",
+		"re:bug/([0-9]+)":  "https://bugs.example.com/show?id={1}",
+		"marketing/spring": "https://m.example.com/spring",
+	})
+	old := storetest.Link("https://old.example.com/")
+	old.Expires = time.Now().Add(-time.Hour)
+	p.Set("old", old)
+	soon := storetest.Link("https://allhands.example.com/stream")
+	soon.ActiveFrom = time.Now().Add(time.Hour)
+	p.Set("soon", soon)
+	live := storetest.Link("https://allhands.example.com/live")
+	live.ActiveFrom = time.Now().Add(-time.Hour)
+	live.Expires = time.Now().Add(time.Hour)
+	p.Set("live", live)
+	utm := storetest.Link("https://x.example.com/?utm_source=old&keep=1")
+	utm.Params = url.Values{"utm_source": {"go"}}
+	p.Set("utm", utm)
+	r := NewResolver(newTestCache(t, p), domains)
+
+	tests := []struct {
+		path, ns string
+		shortcut string
+		want     string
+		err      error
+	}{
+		{path: "/go", shortcut: "go", want: "https://go.dev/"},
+		{path: "/GO", shortcut: "go", want: "https://go.dev/"},
+		{path: "/go/doc/install", shortcut: "go", want: "https://go.dev/doc/install"},
+		{path: "/go/doc?x=1", shortcut: "go", want: "https://go.dev/doc?x=1"},
+		{path: "/gh/repo/123", shortcut: "gh", want: "https://github.com/org/repo/issues/123"},
+		{path: "/gh/repo", shortcut: "gh", want: "https://github.com/org/repo/issues/"},
+		{path: "/jira/ABC-1", shortcut: "jira/*", want: "https://jira.example.com/browse/ABC-1"},
+		{path: "/bug/42", shortcut: "re:bug/([0-9]+)", want: "https://bugs.example.com/show?id=42"},
+		{path: "/utm?q=1", shortcut: "utm", want: "https://x.example.com/?utm_source=go&keep=1&q=1"},
+		// Deep links reach the destination as they were sent.
+		{path: "/go/Doc/A%2Fb?Z=1&a=2&a=1&q=x+y", shortcut: "go", want: "https://go.dev/Doc/A%2Fb?Z=1&a=2&a=1&q=x+y"},
+		{path: "/old", shortcut: "old", err: store.ErrLinkExpired},
+		{path: "/old/sub", shortcut: "old", err: store.ErrLinkExpired},
+		{path: "/soon", shortcut: "soon", err: store.ErrLinkPending},
+		{path: "/live", shortcut: "live", want: "https://allhands.example.com/live"},
+		{path: "/missing"},
+		{path: "/"},
+		{path: "/spring", ns: "marketing", shortcut: "marketing/spring", want: "https://m.example.com/spring"},
+		// Namespaced links are out of reach of other hosts, and the other
+		// way round.
+		{path: "/marketing/spring"},
+		{path: "/go", ns: "marketing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ns+tt.path, func(t *testing.T) {
+			u, err := url.Parse(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			shortcut, _, to, err := r.Resolve(u, tt.ns)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+			if shortcut != tt.shortcut {
+				t.Errorf("shortcut = %q, want %q", shortcut, tt.shortcut)
+			}
+			got := ""
+			if to != nil {
+				got = to.String()
+			}
+			if got != tt.want {
+				t.Errorf("destination = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveFor(t *testing.T) {
+	p := storetest.New(nil)
+	app := storetest.Link("https://example.com/app")
+	ios := storetest.Link("https://apps.apple.com/app/{1}")
+	ios.When = &store.Condition{Devices: []string{store.DeviceIOS}}
+	app.Variants = []*store.Link{ios}
+	p.Set("app", app)
+	r := NewResolver(newTestCache(t, p), nil)
+
+	tests := []struct {
+		path    string
+		visitor store.Visitor
+		want    string
+	}{
+		{"/app", store.Visitor{}, "https://example.com/app"},
+		{"/app/beta", store.Visitor{Devices: []string{store.DeviceAndroid}}, "https://example.com/app/beta"},
+		{"/app/beta", store.Visitor{Devices: []string{store.DeviceIOS}}, "https://apps.apple.com/app/beta"},
+	}
+	for _, tt := range tests {
+		_, _, to, err := r.ResolveFor(&url.URL{Path: tt.path}, "", tt.visitor)
+		if err != nil || to == nil || to.String() != tt.want {
+			t.Errorf("ResolveFor(%s, %+v) = %v, %v, want %s", tt.path, tt.visitor, to, err, tt.want)
+		}
+	}
+}
+
+func TestResolveAfterRefresh(t *testing.T) {
+	p := storetest.New(nil)
+	c := newTestCache(t, p)
+	r := NewResolver(c, nil)
+
+	u := &url.URL{Path: "/new"}
+	if _, _, to, _ := r.Resolve(u, ""); to != nil {
+		t.Fatalf("resolved %v before the link existed", to)
+	}
+	// The miss is cached until the next refresh.
+	p.Set("new", storetest.Link("https://new.example.com/"))
+	if _, _, to, _ := r.Resolve(u, ""); to != nil {
+		t.Fatalf("resolved %v before the refresh", to)
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, to, _ := r.Resolve(u, ""); to == nil || to.String() != "https://new.example.com/" {
+		t.Errorf("destination = %v after the refresh", to)
+	}
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	p := storetest.New(map[string]string{"live": "https://live.example.com/"})
+	for k, age := range map[string]time.Duration{"recent": time.Hour, "old": 48 * time.Hour} {
+		l := storetest.Link("https://" + k + ".example.com/")
+		l.Deleted = time.Now().Add(-age)
+		p.Set(k, l)
+	}
+	c := newTestCache(t, p)
+	r := NewResolver(c, nil)
+	if _, _, to, _ := r.Resolve(&url.URL{Path: "/recent"}, ""); to != nil {
+		t.Errorf("deleted link resolved to %v", to)
+	}
+
+	if n, err := c.PurgeDeleted(context.Background(), 24*time.Hour); err != nil || n != 1 {
+		t.Fatalf("PurgeDeleted = %d, %v, want 1 purged", n, err)
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	deleted, _ := c.Deleted()
+	all, _ := c.All()
+	if len(deleted) != 1 || deleted["recent"] == nil || len(all) != 1 || all["live"] == nil {
+		t.Errorf("after purge: deleted %v, live %v", deleted, all)
+	}
+}
+
+func TestResolveStale(t *testing.T) {
+	for _, serveStale := range []bool{true, false} {
+		p := storetest.New(map[string]string{"go": "https://go.dev/"})
+		c := newTestCache(t, p)
+		c.ServeStale = serveStale
+		p.Fail(errors.New("backend down"))
+		if err := c.Refresh(context.Background()); err == nil {
+			t.Fatal("Refresh succeeded with a failing provider")
+		}
+
+		_, _, to, err := NewResolver(c, nil).Resolve(&url.URL{Path: "/go"}, "")
+		if serveStale && (err != nil || to == nil) {
+			t.Errorf("ServeStale: got %v, %v, want the last loaded link", to, err)
+		}
+		if !serveStale && !errors.Is(err, ErrStale) {
+			t.Errorf("no ServeStale: error = %v, want ErrStale", err)
+		}
+	}
+}
+
+// hangingProvider blocks queries until their context ends.
+type hangingProvider struct {
+	*storetest.Provider
+	hang bool
+}
+
+func (p *hangingProvider) Query(ctx context.Context) (store.URLMap, error) {
+	if p.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return p.Provider.Query(ctx)
+}
+
+func TestRefreshTimeout(t *testing.T) {
+	p := &hangingProvider{Provider: storetest.New(map[string]string{"go": "https://go.dev/"})}
+	c := newTestCache(t, p)
+	c.ServeStale = true
+	p.hang = true
+
+	// An abandoned refresh, like that of a client gone away, is no failure.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.Refresh(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Refresh = %v, want the context's error", err)
+	}
+	if c.Stale() {
+		t.Error("abandoned refresh left the cache stale")
+	}
+
+	c.Timeout = 10 * time.Millisecond
+	if err := c.Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh of a hung provider succeeded")
+	}
+	if !c.Stale() {
+		t.Error("timed out refresh didn't count as a failure")
+	}
+	if _, _, to, err := NewResolver(c, nil).Resolve(&url.URL{Path: "/go"}, ""); err != nil || to == nil {
+		t.Errorf("after timeout: got %v, %v, want the last loaded link", to, err)
+	}
+
+	// Later refreshes aren't blocked by the timed out one.
+	p.hang = false
+	if err := c.Refresh(context.Background()); err != nil || c.Stale() {
+		t.Errorf("Refresh = %v, stale %v after the provider recovered", err, c.Stale())
+	}
+}
+
+// flakyProvider fails its first queries.
+type flakyProvider struct {
+	*storetest.Provider
+	failures int32
+}
+
+func (p *flakyProvider) Query(ctx context.Context) (store.URLMap, error) {
+	if atomic.AddInt32(&p.failures, -1) >= 0 {
+		return nil, errors.New("credentials not ready")
+	}
+	return p.Provider.Query(ctx)
+}
+
+func TestWarmRetry(t *testing.T) {
+	p := &flakyProvider{Provider: storetest.New(map[string]string{"go": "https://go.dev/"}), failures: 3}
+	c := NewCache(p, NewScheduler(time.Minute, time.Minute), nil)
+	c.WarmRetry = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	wctx, wcancel := context.WithTimeout(ctx, 5*time.Second)
+	defer wcancel()
+	if err := c.WaitWarm(wctx); err != nil {
+		t.Fatalf("WaitWarm: %v, want the links loaded long before the refresh interval", err)
+	}
+	if l, err := c.Get("go"); err != nil || l == nil {
+		t.Errorf("Get after warming up = %v, %v", l, err)
+	}
+
+	// Without any load, WaitWarm gives up with its context.
+	c = NewCache(&flakyProvider{Provider: storetest.New(nil), failures: 1}, NewScheduler(time.Minute, time.Minute), nil)
+	go c.Run(ctx)
+	wctx, wcancel = context.WithTimeout(ctx, 20*time.Millisecond)
+	defer wcancel()
+	if err := c.WaitWarm(wctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitWarm without retries = %v, want a timeout", err)
+	}
+}
+
+func TestAdaptiveScheduler(t *testing.T) {
+	p := storetest.New(map[string]string{"go": "https://go.dev/"})
+	sched := NewScheduler(5*time.Second, 5*time.Minute)
+	sched.Adapt(10 * time.Minute)
+	c := NewCache(p, sched, nil)
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	loaded := sched.lastChange
+	if loaded.IsZero() {
+		t.Fatal("the initial load is not a change")
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if sched.lastChange != loaded {
+		t.Error("a refresh without changes moved the last change")
+	}
+	p.Set("new", storetest.Link("https://new.example.com/"))
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !sched.lastChange.After(loaded) {
+		t.Error("a refresh with a new link did not record a change")
+	}
+
+	tests := []struct {
+		since time.Duration
+		want  time.Duration
+	}{
+		{0, 5 * time.Second},
+		{time.Minute, 6 * time.Second},
+		{time.Hour, 6 * time.Minute},
+		{24 * time.Hour, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := sched.adapted(sched.lastChange.Add(tt.since)); got != tt.want {
+			t.Errorf("interval %v after a change = %v, want %v", tt.since, got, tt.want)
+		}
+	}
+
+	// Quota errors still back off.
+	sched.Observe(store.ErrRateLimited)
+	sched.Observe(store.ErrRateLimited)
+	if got := sched.adapted(sched.lastChange.Add(time.Minute)); got != 20*time.Second {
+		t.Errorf("interval after two quota errors = %v, want 20s", got)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	p := &flakyProvider{Provider: storetest.New(map[string]string{"go": "https://go.dev/"})}
+	c := newTestCache(t, p)
+	c.ServeStale = true
+	c.Breaker = NewBreaker(2, 20*time.Millisecond)
+
+	atomic.StoreInt32(&p.failures, 3)
+	for i := 0; i < 2; i++ {
+		if err := c.Refresh(context.Background()); err == nil || errors.Is(err, ErrBreakerOpen) {
+			t.Fatalf("Refresh #%d = %v, want the provider's error", i+1, err)
+		}
+	}
+	if err := c.Refresh(context.Background()); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("Refresh after 2 failures = %v, want ErrBreakerOpen", err)
+	}
+	if n := atomic.LoadInt32(&p.failures); n != 1 {
+		t.Errorf("provider queried while the breaker was open, %d failures left", n)
+	}
+	if s := c.BreakerState(); s.State != "open" || s.Failures != 2 {
+		t.Errorf("BreakerState = %+v, want open after 2 failures", s)
+	}
+	if l, err := c.Get("go"); err != nil || l == nil {
+		t.Errorf("Get while open = %v, %v, want the stale link", l, err)
+	}
+
+	// After the cooldown one query goes through; failing reopens the breaker.
+	time.Sleep(30 * time.Millisecond)
+	if s := c.BreakerState(); s.State != "half-open" {
+		t.Errorf("BreakerState after the cooldown = %+v, want half-open", s)
+	}
+	if err := c.Refresh(context.Background()); err == nil || errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("trial Refresh = %v, want the provider's error", err)
+	}
+	if err := c.Refresh(context.Background()); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("Refresh after a failed trial = %v, want ErrBreakerOpen", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh once the provider recovered: %v", err)
+	}
+	if s := c.BreakerState(); s.State != "closed" || s.Failures != 0 || s.OpenUntil != nil {
+		t.Errorf("BreakerState after recovering = %+v, want closed", s)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	l := NewLatency(10 * time.Millisecond)
+	for i := 1; i <= 100; i++ {
+		l.Observe(LookupCache, "go", time.Duration(i)*time.Millisecond/10)
+	}
+	l.Observe(LookupRefresh, "docs", time.Second)
+
+	kinds := l.Kinds()
+	cache := kinds[LookupCache]
+	if cache.Count != 100 || cache.P50 != 0.0051 || cache.P99 != 0.0099 || cache.WithinSLO != 1 {
+		t.Errorf("cache lookups = %+v", cache)
+	}
+	if refresh := kinds[LookupRefresh]; refresh.Count != 1 || refresh.WithinSLO != 0 {
+		t.Errorf("refresh lookups = %+v", refresh)
+	}
+	if got := l.Slowest(1); len(got) != 1 || got[0] != "docs" {
+		t.Errorf("Slowest(1) = %q, want docs", got)
+	}
+	if _, ok := l.Shortcut("missing"); ok {
+		t.Error("missing shortcut has a summary")
+	}
+
+	r := NewResolver(newTestCache(t, storetest.New(map[string]string{"go": "https://go.dev/"})), nil)
+	r.Resolve(&url.URL{Path: "/go"}, "")
+	if s, ok := r.Latency.Shortcut("go"); !ok || s.Count != 1 {
+		t.Errorf("resolving go: latency = %+v, %v", s, ok)
+	}
+}
+
+func TestResolveUnicode(t *testing.T) {
+	p := storetest.New(map[string]string{
+		"çay":    "https://tea.example.com/",
+		"日本語":    "https://ja.example.com/",
+		"straße": "https://street.example.com/",
+	})
+	r := NewResolver(newTestCache(t, p), nil)
+
+	tests := []struct {
+		path, shortcut string
+	}{
+		{"/%C3%A7ay", "çay"},
+		{"/%C3%87AY", "çay"},
+		// "c" and a combining cedilla, as macOS spells it.
+		{"/c%CC%A7ay", "çay"},
+		// Windows-1252, and encoded twice.
+		{"/%E7ay", "çay"},
+		{"/%25C3%25A7ay", "çay"},
+		{"/%E6%97%A5%E6%9C%AC%E8%AA%9E", "日本語"},
+		{"/日本語/docs", "日本語"},
+		{"/STRASSE", "straße"},
+		{"/%C3%A7ay%25", ""},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shortcut, _, _, err := r.Resolve(u, ""); err != nil || shortcut != tt.shortcut {
+			t.Errorf("Resolve(%s) = %q, %v, want %q", tt.path, shortcut, err, tt.shortcut)
+		}
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	links := map[string]string{
+		"Team-Docs": "https://docs.example.com/first",
+		"team-docs": "https://docs.example.com/second",
+	}
+	for i := 0; i < 5000; i++ {
+		links[fmt.Sprintf("link%d", i)] = fmt.Sprintf("https://example.com/%d", i)
+	}
+	c := NewCache(storetest.New(links), NewScheduler(time.Minute, time.Minute), nil)
+	c.BloomMinLinks = 1000
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.current().index.bloom == nil {
+		t.Fatal("no Bloom filter for 5002 links")
+	}
+
+	for i := 0; i < 5000; i++ {
+		query := fmt.Sprintf("LINK%d", i)
+		if shortcut, link, err := c.Lookup(query); err != nil || link == nil || shortcut != fmt.Sprintf("link%d", i) {
+			t.Fatalf("Lookup(%s) = %q, %v, %v, want link%d", query, shortcut, link, err, i)
+		}
+	}
+	// Equivalent shortcuts resolve to the first in key order.
+	if shortcut, _, err := c.Lookup("TEAM-DOCS"); err != nil || shortcut != "Team-Docs" {
+		t.Errorf("Lookup(TEAM-DOCS) = %q, %v, want Team-Docs", shortcut, err)
+	}
+	for i := 5000; i < 5100; i++ {
+		if _, link, err := c.Lookup(fmt.Sprintf("link%d", i)); err != nil || link != nil {
+			t.Errorf("Lookup(link%d) = %v, %v, want no link", i, link, err)
+		}
+	}
+}
+
+func TestPrepRedirect(t *testing.T) {
+	tests := []struct {
+		link       string
+		addPath    string
+		rawAddPath string
+		params     url.Values
+		query      string
+		want       string
+	}{
+		{link: "https://a.com/x", want: "https://a.com/x"},
+		{link: "https://a.com/x", addPath: "y/z", want: "https://a.com/x/y/z"},
+		{link: "https://a.com/x/", addPath: "y", want: "https://a.com/x/y"},
+		{link: "https://a.com", addPath: "y", want: "https://a.com/y"},
+		{link: "https://a.com/{1}/{2}", addPath: "p/q/r", want: "https://a.com/p/q"},
+		{link: "https://a.com/{1}/{2}", addPath: "p", want: "https://a.com/p/"},
+		{link: "https://a.com/s?q={1}", addPath: "a b&c", want: "https://a.com/s?q=a+b%26c"},
+		{link: "https://a.com/?a=1&b=2", params: url.Values{"a": {"9"}}, want: "https://a.com/?a=9&b=2"},
+		{link: "https://a.com/?b=2", params: url.Values{"a": {"9"}}, want: "https://a.com/?b=2&a=9"},
+		{link: "https://a.com/?a=1", query: "a=2&c=3", want: "https://a.com/?a=1&a=2&c=3"},
+		{link: "https://a.com/", query: "Z=1&a=2&a=1&q=x%20y", want: "https://a.com/?Z=1&a=2&a=1&q=x%20y"},
+		{link: "https://a.com/x", addPath: "a/b c", rawAddPath: "a%2Fb%20c", want: "https://a.com/x/a%2Fb%20c"},
+		{link: "https://a.com/x", addPath: "a/b", rawAddPath: "a/c", want: "https://a.com/x/a/b"},
+		{link: "https://bücher.example:8443/x", addPath: "ü", want: "https://xn--bcher-kva.example:8443/x/%C3%BC"},
+	}
+	for _, tt := range tests {
+		link, err := url.Parse(tt.link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		orig := link.String()
+		got := prepRedirect(link, tt.addPath, tt.rawAddPath, tt.params, tt.query).String()
+		if got != tt.want {
+			t.Errorf("prepRedirect(%s, %q, %q, %v, %q) = %s, want %s", tt.link, tt.addPath, tt.rawAddPath, tt.params, tt.query, got, tt.want)
+		}
+		if link.String() != orig {
+			t.Errorf("prepRedirect modified the link to %s", link)
+		}
+	}
+}
+
+func TestPrefixFallback(t *testing.T) {
+	p := storetest.New(map[string]string{"go": "https://go.dev/"})
+	r := NewResolver(newTestCache(t, p), nil)
+	resolve := func(path string) string {
+		t.Helper()
+		u, err := url.Parse(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, to, err := r.Resolve(u, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if to == nil {
+			return ""
+		}
+		return to.String()
+	}
+
+	r.MaxFallbackDepth = 2
+	if got, want := resolve("/go/doc/install"), "https://go.dev/doc/install"; got != want {
+		t.Errorf("two segments deep = %q, want %q", got, want)
+	}
+	if got := resolve("/go/doc/install/linux"); got != "" {
+		t.Errorf("three segments deep = %q, want not found", got)
+	}
+	r.MaxFallbackDepth, r.NoPrefixFallback = 0, true
+	if got := resolve("/go/doc"); got != "" {
+		t.Errorf("without the fallback = %q, want not found", got)
+	}
+	if got, want := resolve("/go"), "https://go.dev/"; got != want {
+		t.Errorf("exact match without the fallback = %q, want %q", got, want)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	links := map[string]string{
+		"new":     "https://new.example.com/",
+		"old":     "go:new",
+		"older":   "go:OLD",
+		"gone":    "go:missing",
+		"ping":    "go:pong",
+		"pong":    "go:ping",
+		"bug/*":   "go:new",
+		"chain0":  "https://chain.example.com/",
+		"retired": "go:disabled",
+	}
+	for i := 1; i <= maxAliasHops+1; i++ {
+		links[fmt.Sprintf("chain%d", i)] = fmt.Sprintf("go:chain%d", i-1)
+	}
+	p := storetest.New(links)
+	disabled := storetest.Link("https://disabled.example.com/")
+	disabled.Disabled = true
+	p.Set("disabled", disabled)
+	c := newTestCache(t, p)
+	r := NewResolver(c, nil)
+
+	tests := []struct {
+		path     string
+		shortcut string
+		want     string
+		err      error
+	}{
+		{path: "/old", shortcut: "old", want: "https://new.example.com/"},
+		{path: "/old/sub?q=1", shortcut: "old", want: "https://new.example.com/sub?q=1"},
+		{path: "/older", shortcut: "older", want: "https://new.example.com/"},
+		{path: "/bug/1", shortcut: "bug/*", want: "https://new.example.com/"},
+		{path: "/gone", shortcut: "gone"},
+		{path: "/ping", shortcut: "ping", err: ErrAliasLoop},
+		{path: fmt.Sprintf("/chain%d", maxAliasHops), shortcut: fmt.Sprintf("chain%d", maxAliasHops), want: "https://chain.example.com/"},
+		{path: fmt.Sprintf("/chain%d", maxAliasHops+1), shortcut: fmt.Sprintf("chain%d", maxAliasHops+1), err: ErrAliasLoop},
+		{path: "/retired", shortcut: "retired", err: store.ErrLinkDisabled},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shortcut, _, to, err := r.Resolve(u, "")
+		got := ""
+		if to != nil {
+			got = to.String()
+		}
+		if !errors.Is(err, tt.err) || shortcut != tt.shortcut || got != tt.want {
+			t.Errorf("Resolve(%s) = %q, %q, %v, want %q, %q, %v", tt.path, shortcut, got, err, tt.shortcut, tt.want, tt.err)
+		}
+	}
+
+	broken := make(map[string]bool)
+	issues, _, _ := c.Issues()
+	for _, i := range issues {
+		if i.Kind == store.IssueAlias {
+			broken[i.Shortcut] = true
+		}
+	}
+	for _, k := range []string{"gone", "ping", "pong", fmt.Sprintf("chain%d", maxAliasHops+1)} {
+		if !broken[k] {
+			t.Errorf("no issue about alias %q, got %v", k, issues)
+		}
+	}
+	if broken["old"] || broken["older"] || broken["chain1"] {
+		t.Errorf("issues about working aliases: %v", issues)
+	}
+}
+
+func TestDomains(t *testing.T) {
+	t.Setenv("DOMAINS", "Go.Example.com, m.example.com=Marketing")
+	d, err := NewDomains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns := d.Namespace("m.example.com:8080"); ns != "marketing" {
+		t.Errorf("Namespace = %q", ns)
+	}
+	if !d.Configured("go.example.com") || d.Configured("other.example.com") {
+		t.Error("Configured doesn't match DOMAINS")
+	}
+	if ns, rest := d.Split("marketing/spring/sale"); ns != "marketing" || rest != "spring/sale" {
+		t.Errorf("Split = %q, %q", ns, rest)
+	}
+	if ns, rest := d.Split("marketing"); ns != "" || rest != "marketing" {
+		t.Errorf("Split of a bare namespace = %q, %q", ns, rest)
+	}
+
+	for _, bad := range []string{"a.com,a.com", "a.com=x/y", "http://a.com"} {
+		t.Setenv("DOMAINS", bad)
+		if _, err := NewDomains(); err == nil {
+			t.Errorf("NewDomains accepted %q", bad)
+		}
+	}
+}
+
+func TestDestinationPolicy(t *testing.T) {
+	t.Setenv("DOMAINS", "go.example.com")
+	t.Setenv("SELF_HOSTNAMES", "links.corp")
+	t.Setenv("ALLOWED_DESTINATION_SCHEMES", "https")
+	t.Setenv("ALLOWED_DESTINATION_DOMAINS", "example.com,*.corp")
+	d, err := NewDomains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewDestinationPolicy(d, "s.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dest string
+		ok   bool
+	}{
+		{"https://docs.example.com/a", true},
+		{"https://wiki.corp/", true},
+		{"https://GO.example.com/other", false},
+		{"https://links.corp:8443/x", false},
+		{"https://s.example.com/", false},
+		{"http://docs.example.com/", false},
+		{"https://evil.com/", false},
+		{"https://example.com.evil.com/", false},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.dest)
+		err := p.Check(u)
+		if (err == nil) != tt.ok {
+			t.Errorf("Check(%s) = %v, want ok %v", tt.dest, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrDestinationRefused) {
+			t.Errorf("Check(%s) = %v, want ErrDestinationRefused", tt.dest, err)
+		}
+	}
+
+	t.Setenv("ALLOWED_DESTINATION_DOMAINS", "https://example.com")
+	if _, err := NewDestinationPolicy(d); err == nil {
+		t.Error("NewDestinationPolicy accepted a URL as domain")
+	}
+}
+
+func BenchmarkResolve(b *testing.B) {
+	links := make(map[string]string)
+	for i := 0; i < 10000; i++ {
+		links[fmt.Sprintf("link%d", i)] = fmt.Sprintf("https://example.com/%d", i)
+	}
+	links["jira/*"] = "https://jira.example.com/browse/{1}"
+	links["re:bug/([0-9]+)"] = "https://bugs.example.com/show?id={1}"
+	c := NewCache(storetest.New(links), NewScheduler(time.Minute, time.Minute), NewNotFoundCache(4096, time.Minute))
+	if err := c.Refresh(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	r := NewResolver(c, nil)
+
+	for _, path := range []string{"/link42", "/LINK42/a/b", "/jira/ABC-1", "/bug/42", "/missing"} {
+		u := &url.URL{Path: path}
+		b.Run(path, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					r.Resolve(u, "")
+				}
+			})
+		})
+	}
+
+	// Lookups while the map is swapped out underneath.
+	b.Run("refreshing", func(b *testing.B) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			for ctx.Err() == nil {
+				c.Refresh(ctx)
+			}
+		}()
+		u := &url.URL{Path: "/link42"}
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				r.Resolve(u, "")
+			}
+		})
+	})
+}
+
+func TestShadow(t *testing.T) {
+	primary := storetest.New(map[string]string{
+		"go":   "https://go.dev/",
+		"docs": "https://docs.example.com/",
+		"hr":   "https://hr.example.com/",
+	})
+	secondary := storetest.New(map[string]string{
+		"go":   "https://go.dev/",
+		"docs": "https://wiki.example.com/docs",
+		"new":  "https://new.example.com/",
+	})
+	r := NewResolver(newTestCache(t, primary), nil)
+	shadow := NewShadow(r, newTestCache(t, secondary), nil)
+
+	tests := []struct{ path, want string }{
+		{"/go/doc", "match"},
+		{"/nothing", "match"},
+		{"/docs", "different"},
+		{"/hr", "missing"},
+		{"/new", "extra"},
+	}
+	for _, tt := range tests {
+		req := &url.URL{Path: tt.path}
+		shortcut, link, dest, err := r.Resolve(req, "")
+		if got := shadow.Compare(req, "", store.Visitor{}, shortcut, link, dest, err); got != tt.want {
+			t.Errorf("Compare(%s) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+	if n := shadow.CompareAll(); n != 3 {
+		t.Errorf("CompareAll = %d, want 3", n)
+	}
+}
+
+func TestPageFetcher(t *testing.T) {
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/docs":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, `<html><head><title>
+  Team &amp; docs </title><link rel="shortcut icon" href="/static/icon.png"></head><body><title>not this</title></body></html>`)
+		case "/plain":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, "<title>not html</title>")
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer dest.Close()
+
+	c := newTestCache(t, storetest.New(map[string]string{
+		"docs":  dest.URL + "/docs",
+		"alias": dest.URL + "/docs",
+		"plain": dest.URL + "/plain",
+		"gone":  dest.URL + "/gone",
+	}))
+	f := NewPageFetcher(c)
+	f.FetchAll(context.Background(), time.Hour)
+
+	info := func(shortcut string) *PageInfo {
+		t.Helper()
+		l, err := c.Get(shortcut)
+		if err != nil || l == nil {
+			t.Fatalf("Get(%q) = %v, %v", shortcut, l, err)
+		}
+		return f.Info(l)
+	}
+	if p := info("alias"); p == nil || p.Title != "Team & docs" || p.Favicon != dest.URL+"/static/icon.png" || p.Error != "" {
+		t.Errorf("docs = %+v", p)
+	}
+	if p := info("plain"); p == nil || p.Title != "" || p.Favicon != dest.URL+"/favicon.ico" {
+		t.Errorf("plain = %+v", p)
+	}
+	if p := info("gone"); p == nil || p.Title != "" || p.Error == "" {
+		t.Errorf("gone = %+v", p)
+	}
+	var nilFetcher *PageFetcher
+	if p := nilFetcher.Info(&store.Link{URL: &url.URL{Scheme: "https", Host: "example.com"}}); p != nil {
+		t.Errorf("disabled fetcher returned %+v", p)
+	}
+}
@@ -0,0 +1,99 @@
+package resolver
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// Scheduler decides how long to wait between backend queries. It
+// starts at the configured TTL, doubles the interval every time the backend
+// reports a quota error (up to max), and halves it again after each
+// successful query until it is back at the base TTL. Made adaptive with
+// Adapt, it also waits longer the longer the links have not changed.
+type Scheduler struct {
+	sync.Mutex
+	base     time.Duration
+	max      time.Duration
+	interval time.Duration
+
+	// adaptMax bounds the adaptive interval; zero keeps it at base.
+	adaptMax   time.Duration
+	lastChange time.Time
+}
+
+// adaptiveShare is the fraction of the time since the links last changed
+// that an adaptive scheduler waits between queries: links unchanged for an
+// hour are queried every 6 minutes, links edited a minute ago every 6
+// seconds.
+const adaptiveShare = 10
+
+// NewScheduler returns a scheduler starting at base and backing off up to
+// max.
+func NewScheduler(base, max time.Duration) *Scheduler {
+	if max < base {
+		max = base
+	}
+	return &Scheduler{base: base, max: max, interval: base}
+}
+
+// Adapt makes the interval follow how often the links change, from the
+// base TTL up to max, see REFRESH_ADAPTIVE_MAX. Backing off from quota
+// errors still applies on top.
+func (s *Scheduler) Adapt(max time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.adaptMax = max
+}
+
+// Interval returns the current effective refresh interval.
+func (s *Scheduler) Interval() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return s.adapted(time.Now())
+}
+
+// adapted returns the interval at now, the longer of the backoff interval
+// and the adaptive one.
+func (s *Scheduler) adapted(now time.Time) time.Duration {
+	if s.adaptMax <= s.base || s.lastChange.IsZero() {
+		return s.interval
+	}
+	d := now.Sub(s.lastChange) / adaptiveShare
+	if d > s.adaptMax {
+		d = s.adaptMax
+	}
+	if d < s.interval {
+		d = s.interval
+	}
+	return d
+}
+
+// Changed records that a backend query returned links different from the
+// previous ones, which shortens the adaptive interval back to the base TTL.
+func (s *Scheduler) Changed() {
+	s.Lock()
+	defer s.Unlock()
+	s.lastChange = time.Now()
+}
+
+// Observe adjusts the interval according to the result of a backend query.
+func (s *Scheduler) Observe(err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case errors.Is(err, store.ErrRateLimited):
+		s.interval *= 2
+		if s.interval > s.max {
+			s.interval = s.max
+		}
+	case err == nil && s.interval > s.base:
+		s.interval /= 2
+		if s.interval < s.base {
+			s.interval = s.base
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/metrics"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+var (
+	shadowLookupsTotal = metrics.NewCounterVec("shortener_shadow_lookups_total",
+		"Lookups repeated against the shadow backend, by result: match, missing, extra, different or unavailable.", "result")
+	shadowMismatchedLinks = metrics.NewGauge("shortener_shadow_mismatched_links",
+		"Links missing, extra or different in the shadow backend at the last comparison.")
+)
+
+// shadowLogInterval is how often a mismatch of the same path is logged.
+const shadowLogInterval = time.Minute
+
+// Shadow repeats lookups against the links of a second backend and counts
+// where its answers differ, to validate a migration before switching
+// backends, see SHADOW_PROVIDER. Visitors are only ever served by the
+// primary backend.
+type Shadow struct {
+	primary  *Cache
+	links    *Cache
+	resolver *Resolver
+
+	mu     sync.Mutex
+	logged map[string]time.Time
+}
+
+// NewShadow compares the lookups of primary with those of links, a cache
+// of the shadow backend, with namespaces from domains, which may be nil.
+// The shadow lookups fall back to prefixes as primary does.
+func NewShadow(primary *Resolver, links *Cache, domains *Domains) *Shadow {
+	links.Shadow = true
+	r := NewResolver(links, domains)
+	r.NoPrefixFallback, r.MaxFallbackDepth = primary.NoPrefixFallback, primary.MaxFallbackDepth
+	return &Shadow{
+		primary:  primary.links,
+		links:    links,
+		resolver: r,
+		logged:   make(map[string]time.Time),
+	}
+}
+
+// Compare resolves req for visitor in namespace ns against the shadow
+// backend and records whether it agrees with the answer of the primary one:
+// shortcut, link, dest and err as returned by Resolver.ResolveFor. It
+// returns the result counted, or "" when the primary lookup failed.
+func (s *Shadow) Compare(req *url.URL, ns string, visitor store.Visitor, shortcut string, link *store.Link, dest *url.URL, err error) string {
+	if s == nil || !answered(err) {
+		return ""
+	}
+	// Don't wait for the first refresh of the shadow backend.
+	if atomic.LoadInt32(&s.links.isLoaded) == 0 {
+		shadowLookupsTotal.Inc("unavailable")
+		return "unavailable"
+	}
+	sShortcut, sLink, sDest, sErr := s.resolver.ResolveFor(req, ns, visitor)
+	if !answered(sErr) {
+		shadowLookupsTotal.Inc("unavailable")
+		return "unavailable"
+	}
+
+	// Without a visitor ID each side draws its own side of a split.
+	ignoreDest := visitor.ID == "" && link != nil && link.Split()
+	want := shadowAnswer(shortcut, link, dest, err, ignoreDest)
+	got := shadowAnswer(sShortcut, sLink, sDest, sErr, ignoreDest)
+	result := "match"
+	switch {
+	case want == got:
+	case link == nil:
+		result = "extra"
+	case sLink == nil:
+		result = "missing"
+	default:
+		result = "different"
+	}
+	shadowLookupsTotal.Inc(result)
+	if result != "match" && s.shouldLog(ns+"\x00"+req.Path) {
+		log.Printf("warn: shadow backend disagrees on %q: primary %s, shadow %s", req.Path, want, got)
+	}
+	return result
+}
+
+// answered reports whether a lookup that returned err found an answer,
+// which may be a link outside its activation window.
+func answered(err error) bool {
+	return err == nil || errors.Is(err, store.ErrLinkExpired) || errors.Is(err, store.ErrLinkPending)
+}
+
+// shadowAnswer summarizes the answer to a lookup for comparison.
+func shadowAnswer(shortcut string, link *store.Link, dest *url.URL, err error, ignoreDest bool) string {
+	switch {
+	case link == nil:
+		return "not found"
+	case errors.Is(err, store.ErrLinkExpired):
+		return fmt.Sprintf("%q expired", shortcut)
+	case errors.Is(err, store.ErrLinkPending):
+		return fmt.Sprintf("%q not active yet", shortcut)
+	case ignoreDest:
+		return fmt.Sprintf("%q (split)", shortcut)
+	case link.Type != "":
+		return fmt.Sprintf("%q %s %q", shortcut, link.Type, link.Content)
+	}
+	return fmt.Sprintf("%q -> %s (%d, private %v)", shortcut, dest, link.RedirectStatus(), link.Private)
+}
+
+// shouldLog reports whether a mismatch of key was not logged for
+// shadowLogInterval, so a popular link doesn't flood the log.
+func (s *Shadow) shouldLog(key string) bool {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.logged[key]) < shadowLogInterval {
+		return false
+	}
+	if len(s.logged) >= 1000 {
+		s.logged = make(map[string]time.Time)
+	}
+	s.logged[key] = now
+	return true
+}
+
+// Run compares the full link tables of both backends every interval until
+// ctx is cancelled, which also finds mismatches of links nobody visits.
+func (s *Shadow) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.CompareAll()
+		}
+	}
+}
+
+// CompareAll compares the links loaded from both backends and logs the
+// shortcuts that differ. It returns the number of mismatched links, or -1
+// when either backend has no usable links.
+func (s *Shadow) CompareAll() int {
+	if atomic.LoadInt32(&s.primary.isLoaded) == 0 || atomic.LoadInt32(&s.links.isLoaded) == 0 {
+		return -1
+	}
+	primary, err := s.primary.All()
+	if err != nil {
+		return -1
+	}
+	shadow, err := s.links.All()
+	if err != nil {
+		log.Printf("warn: shadow backend unavailable: %v", err)
+		return -1
+	}
+
+	events := diffLinks(primary, shadow)
+	shadowMismatchedLinks.Set(float64(len(events)))
+	if len(events) == 0 {
+		return 0
+	}
+	byType := map[string][]string{}
+	for _, e := range events {
+		byType[e.Type] = append(byType[e.Type], e.Shortcut)
+	}
+	for _, d := range []struct{ typ, what string }{
+		{LinkRemoved, "missing"},
+		{LinkAdded, "extra"},
+		{LinkChanged, "different"},
+	} {
+		keys := byType[d.typ]
+		if len(keys) == 0 {
+			continue
+		}
+		more := ""
+		if len(keys) > 10 {
+			keys, more = keys[:10], fmt.Sprintf(" and %d more", len(keys)-10)
+		}
+		log.Printf("warn: %d shortcuts %s in shadow backend: %s%s", len(byType[d.typ]), d.what, strings.Join(keys, ", "), more)
+	}
+	return len(events)
+}
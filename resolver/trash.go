@@ -0,0 +1,66 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// purgeInterval is how often RunPurge looks for links to purge.
+const purgeInterval = time.Hour
+
+// PurgeDeleted removes the links deleted more than retention ago for good.
+// It returns the number of links removed.
+func (c *Cache) PurgeDeleted(ctx context.Context, retention time.Duration) (int, error) {
+	editor, ok := c.Provider.(store.Editor)
+	if !ok {
+		return 0, nil
+	}
+	deleted, err := c.Deleted()
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-retention)
+	var keys []string
+	for k, l := range deleted {
+		if l.Deleted.Before(cutoff) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	n := 0
+	for _, k := range keys {
+		// Another replica may have purged it already.
+		if err := editor.Delete(ctx, k); err != nil && !errors.Is(err, store.ErrLinkNotFound) {
+			return n, err
+		}
+		n++
+	}
+	if n > 0 {
+		log.Printf("purged %d shortcuts deleted before %s", n, cutoff.UTC().Format(time.RFC3339))
+		c.Invalidate()
+	}
+	return n, nil
+}
+
+// RunPurge purges the links deleted more than retention ago every hour
+// until ctx is cancelled.
+func (c *Cache) RunPurge(ctx context.Context, retention time.Duration) {
+	t := time.NewTicker(purgeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := c.PurgeDeleted(ctx, retention); err != nil {
+				log.Printf("warn: failed to purge deleted links: %v", err)
+			}
+		}
+	}
+}
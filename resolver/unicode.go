@@ -0,0 +1,60 @@
+package resolver
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// DecodePath repairs request paths that browsers and mail clients encoded
+// differently than UTF-8 percent-encoding, so "/çay" is found however it
+// was sent: bytes that aren't UTF-8 are read as Windows-1252, which older
+// clients use for Latin-1 characters, and paths encoded twice, such as
+// "/%25C3%25A7ay", are decoded once more when that yields non-ASCII UTF-8.
+func DecodePath(p string) string {
+	if !utf8.ValidString(p) {
+		if s, err := charmap.Windows1252.NewDecoder().String(p); err == nil {
+			return s
+		}
+		return p
+	}
+	if strings.Contains(p, "%") {
+		if s, err := url.PathUnescape(p); err == nil && s != p && utf8.ValidString(s) && !isASCII(s) {
+			return s
+		}
+	}
+	return p
+}
+
+// asciiHost returns host, which may carry a port, with internationalized
+// domain names in their punycode form, which all clients can follow.
+func asciiHost(host string) string {
+	if isASCII(host) {
+		return host
+	}
+	name, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		name, port = h, p
+	}
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return host
+	}
+	if port != "" {
+		return net.JoinHostPort(ascii, port)
+	}
+	return ascii
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package resolver
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// watchBuffer is the number of refreshes a watcher may fall behind before it
+// is dropped.
+const watchBuffer = 16
+
+const (
+	LinkAdded   = "added"
+	LinkChanged = "changed"
+	LinkRemoved = "removed"
+)
+
+// LinkEvent describes a change of a shortcut between two refreshes. Link is
+// the new value, or the last one for removals.
+type LinkEvent struct {
+	Type     string
+	Shortcut string
+	Link     *store.Link
+}
+
+// linkWatchers fans out the changes found by each refresh.
+type linkWatchers struct {
+	mu   sync.Mutex
+	subs map[chan []LinkEvent]struct{}
+}
+
+// Watch returns a channel receiving the changes of every refresh, and a
+// function to stop watching. The channel is closed when the watcher falls
+// too far behind.
+func (c *Cache) Watch() (<-chan []LinkEvent, func()) {
+	w := &c.watchers
+	ch := make(chan []LinkEvent, watchBuffer)
+	w.mu.Lock()
+	if w.subs == nil {
+		w.subs = make(map[chan []LinkEvent]struct{})
+	}
+	w.subs[ch] = struct{}{}
+	w.mu.Unlock()
+
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, ok := w.subs[ch]; ok {
+			delete(w.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (w *linkWatchers) publish(events []LinkEvent) {
+	if len(events) == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.subs {
+		select {
+		case ch <- events:
+		default:
+			delete(w.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// diffLinks returns the changes from prev to next, sorted by shortcut.
+func diffLinks(prev, next store.URLMap) []LinkEvent {
+	var events []LinkEvent
+	for k, v := range next {
+		old, ok := prev[k]
+		switch {
+		case !ok:
+			events = append(events, LinkEvent{LinkAdded, k, v})
+		case !sameLink(old, v):
+			events = append(events, LinkEvent{LinkChanged, k, v})
+		}
+	}
+	for k, v := range prev {
+		if _, ok := next[k]; !ok {
+			events = append(events, LinkEvent{LinkRemoved, k, v})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Shortcut < events[j].Shortcut })
+	return events
+}
+
+func sameLink(a, b *store.Link) bool {
+	return a.Type == b.Type &&
+		a.Target() == b.Target() &&
+		a.ActiveFrom.Equal(b.ActiveFrom) &&
+		a.Expires.Equal(b.Expires) &&
+		a.Status == b.Status &&
+		a.Private == b.Private &&
+		a.Preview == b.Preview &&
+		store.FormatParams(a.Params) == store.FormatParams(b.Params) &&
+		a.Owner == b.Owner &&
+		a.Password == b.Password &&
+		a.CacheControl == b.CacheControl &&
+		a.Description == b.Description &&
+		store.FormatTags(a.Tags) == store.FormatTags(b.Tags) &&
+		a.Deleted.Equal(b.Deleted) &&
+		store.FormatCanary(a.Canary) == store.FormatCanary(b.Canary) &&
+		a.Unapproved == b.Unapproved &&
+		sameVariants(a, b)
+}
+
+func sameVariants(a, b *store.Link) bool {
+	if len(a.Variants) != len(b.Variants) {
+		return false
+	}
+	for i := range a.Variants {
+		if !sameLink(a.Variants[i], b.Variants[i]) || a.Variants[i].When.String() != b.Variants[i].When.String() {
+			return false
+		}
+	}
+	return true
+}
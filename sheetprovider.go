@@ -1,54 +0,0 @@
-package main
-
-import (
-	"context"
-	"fmt"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/option"
-	"google.golang.org/api/sheets/v4"
-	"io/ioutil"
-	"log"
-)
-
-type sheetsProvider struct {
-	googleSheetsID string
-	sheetName      string
-}
-
-func (s *sheetsProvider) Query() ([][]interface{}, error) {
-	if s.googleSheetsID == "" {
-		return nil, fmt.Errorf("GOOGLE_SHEET_ID not set")
-	} else if s.sheetName == "" {
-		return nil, fmt.Errorf("SHEET_NAME not set")
-	}
-
-	b, err := ioutil.ReadFile("credentials.json")
-	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
-	}
-
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, "https://www.googleapis.com/auth/spreadsheets.readonly")
-	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
-	}
-	client := getClient(config)
-
-	srv, err := sheets.NewService(context.TODO(), option.WithHTTPClient(client))
-	if err != nil {
-		log.Fatalf("Unable to retrieve Sheets client: %v", err)
-	}
-
-	// Prints the names and majors of students in a sample spreadsheet:
-	// https://docs.google.com/spreadsheets/d/1BxiMVs0XRA5nFMdKvBdBZjgmUUqptlbs74OgvE2upms/edit
-	spreadsheetId := s.googleSheetsID
-	readRange := s.sheetName + "!A:B"
-	resp, err := srv.Spreadsheets.Values.Get(spreadsheetId, readRange).Do()
-	if err != nil {
-		log.Fatalf("Unable to retrieve data from sheet: %v", err)
-	}
-
-	log.Printf("queried %d rows", len(resp.Values))
-
-	return resp.Values, nil
-}
@@ -0,0 +1,148 @@
+// Package shortener resolves go links inside other Go services: Handler
+// returns an http.Handler redirecting the shortcuts of a provider, to mount
+// in an existing mux instead of running the server separately.
+//
+//	provider, err := store.NewProvider("sql")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	mux.Handle("/go/", shortener.New(provider, shortener.Options{Prefix: "/go"}))
+package shortener
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/httpapi"
+	"github.com/denizyoldas/url-shorter/resolver"
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// Options configure the handler returned by New. The zero value serves
+// shortcuts from the root of the mux, like the server does.
+type Options struct {
+	// Prefix is the path the handler is mounted under, such as "/go". It
+	// is stripped from request paths before they are resolved, so that
+	// "/go/docs/install" finds the shortcut "docs" and appends "install" to
+	// its destination.
+	Prefix string
+	// NotFound serves paths no shortcut matches, with the prefix still in
+	// the path. It defaults to http.NotFound; passing a handler of the
+	// service lets unknown shortcuts fall through to it. It must not be the
+	// mux the handler is registered in, which would call it again.
+	NotFound http.Handler
+	// CanViewPrivate reports whether the client of a request may follow
+	// private links. Without it private links are refused.
+	CanViewPrivate func(req *http.Request) bool
+	// PermanentRedirects allows links to redirect with 301 and 308, see
+	// PERMANENT_REDIRECTS.
+	PermanentRedirects bool
+	// NoPrefixFallback and MaxFallbackDepth limit the longest prefix
+	// fallback, see PATH_FALLBACK and PATH_FALLBACK_DEPTH.
+	NoPrefixFallback bool
+	MaxFallbackDepth int
+	// Scheduler decides how often links are reloaded, by default every 5
+	// seconds backing off to 5 minutes while they don't change.
+	Scheduler *resolver.Scheduler
+	// Context stops reloading the links when done. It defaults to
+	// context.Background, reloading for the life of the process.
+	Context context.Context
+}
+
+// Handler returns an http.Handler redirecting the shortcuts of provider from
+// the root of the mux it is registered in, see New.
+func Handler(provider store.Provider) http.Handler {
+	return New(provider, Options{})
+}
+
+// New returns an http.Handler redirecting the shortcuts of provider as
+// configured by opts. Links are loaded in the background and reloaded until
+// opts.Context is done. Paths are resolved like by the server: an exact
+// shortcut, else a pattern, else the longest shortcut prefixing the path,
+// with the rest of the path appended to its destination.
+func New(provider store.Provider, opts Options) http.Handler {
+	if opts.Scheduler == nil {
+		opts.Scheduler = resolver.NewScheduler(5*time.Second, 5*time.Minute)
+	}
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+	if opts.NotFound == nil {
+		opts.NotFound = http.HandlerFunc(http.NotFound)
+	}
+	opts.Prefix = strings.TrimSuffix(opts.Prefix, "/")
+	links := resolver.NewCache(provider, opts.Scheduler, resolver.NewNotFoundCache(1024, time.Minute))
+	go links.Run(opts.Context)
+	r := resolver.NewResolver(links, nil)
+	r.NoPrefixFallback, r.MaxFallbackDepth = opts.NoPrefixFallback, opts.MaxFallbackDepth
+	return &handler{opts: opts, resolver: r}
+}
+
+type handler struct {
+	opts     Options
+	resolver *resolver.Resolver
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	target := *req.URL
+	if h.opts.Prefix != "" {
+		path := strings.TrimPrefix(req.URL.Path, h.opts.Prefix)
+		if path == req.URL.Path || (path != "" && path[0] != '/') {
+			h.opts.NotFound.ServeHTTP(w, req)
+			return
+		}
+		// The escaping the client chose is kept for the destination.
+		target.Path, target.RawPath = path, strings.TrimPrefix(req.URL.RawPath, h.opts.Prefix)
+	}
+
+	shortcut, link, to, err := h.resolver.ResolveFor(&target, "", httpapi.RequestVisitor(req))
+	switch {
+	case errors.Is(err, store.ErrLinkExpired):
+		http.Error(w, "shortcut "+shortcut+" has expired", http.StatusGone)
+		return
+	case errors.Is(err, store.ErrLinkPending):
+		to = nil
+	case err != nil:
+		log.Printf("warn: failed to resolve %s: %v", target.Path, err)
+		http.Error(w, "links are temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if to == nil {
+		h.opts.NotFound.ServeHTTP(w, req)
+		return
+	}
+	if link.Private && (h.opts.CanViewPrivate == nil || !h.opts.CanViewPrivate(req)) {
+		http.Error(w, "shortcut "+shortcut+" is private", http.StatusForbidden)
+		return
+	}
+	if link.Password != "" {
+		// Unlocking needs the server's password page and signed cookies.
+		http.Error(w, "shortcut "+shortcut+" is password-protected", http.StatusForbidden)
+		return
+	}
+	if link.Type != "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		io.WriteString(w, link.Content)
+		return
+	}
+
+	status := link.RedirectStatus()
+	if !h.opts.PermanentRedirects {
+		switch status {
+		case http.StatusMovedPermanently:
+			status = http.StatusFound
+		case http.StatusPermanentRedirect:
+			status = http.StatusTemporaryRedirect
+		}
+	}
+	if link.When != nil || len(link.Variants) > 0 || link.Canary != nil {
+		w.Header().Set("Vary", "User-Agent, Accept-Language")
+	}
+	http.Redirect(w, req, to.String(), status)
+}
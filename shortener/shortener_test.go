@@ -0,0 +1,66 @@
+package shortener
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/store/storetest"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestHandler(t *testing.T) {
+	p := storetest.New(map[string]string{
+		"go":     "https://go.dev/",
+		"jira/*": "https://jira.example.com/browse/{1}",
+		"hr":     "https://hr.example.com/",
+	})
+	hr := storetest.Link("https://hr.example.com/")
+	hr.Private = true
+	p.Set("hr", hr)
+	old := storetest.Link("https://old.example.com/")
+	old.Expires = time.Now().Add(-time.Hour)
+	p.Set("old", old)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	app := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "app")
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/", app)
+	mux.Handle("/links/", New(p, Options{Prefix: "/links/", NotFound: app, Context: ctx}))
+	mux.Handle("/plain/", New(p, Options{Prefix: "/plain", Context: ctx}))
+
+	tests := []struct {
+		path     string
+		status   int
+		location string
+	}{
+		{"/links/go", http.StatusFound, "https://go.dev/"},
+		{"/links/GO/doc/install?x=1", http.StatusFound, "https://go.dev/doc/install?x=1"},
+		{"/links/jira/ABC-1", http.StatusFound, "https://jira.example.com/browse/ABC-1"},
+		{"/links/old", http.StatusGone, ""},
+		{"/links/hr", http.StatusForbidden, ""},
+		// Unknown shortcuts fall through to the rest of the app.
+		{"/links/missing", http.StatusOK, ""},
+		{"/plain/missing", http.StatusNotFound, ""},
+		{"/plain/go", http.StatusFound, "https://go.dev/"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+			t.Errorf("GET %s = %d to %q, want %d to %q", tt.path, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// AnalyticsSink exports raw click events, such as to a data warehouse.
+// Clicks are sent in batches; a batch that fails is sent again later, so
+// sinks should tolerate duplicates or drop them by ClickID.
+type AnalyticsSink interface {
+	// Name identifies the sink in logs and metrics.
+	Name() string
+	ExportClicks(ctx context.Context, clicks []Click) error
+}
+
+var sinks = map[string]func(getenv func(string) string) (AnalyticsSink, error){}
+
+// registerSink makes an analytics sink available under name. It is meant to
+// be called from the init function of the file implementing the sink.
+func registerSink(name string, newSink func(getenv func(string) string) (AnalyticsSink, error)) {
+	if _, exists := sinks[name]; exists {
+		panic("analytics sink " + name + " registered twice")
+	}
+	sinks[name] = newSink
+}
+
+// NewAnalyticsSinks returns the sinks named in the comma-separated names,
+// such as ANALYTICS_SINKS, each configured from the environment.
+func NewAnalyticsSinks(names string) ([]AnalyticsSink, error) {
+	var out []AnalyticsSink
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		fn, ok := sinks[name]
+		if !ok {
+			var names []string
+			for n := range sinks {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown analytics sink %q, available: %s", name, strings.Join(names, ", "))
+		}
+		s, err := fn(os.Getenv)
+		if err != nil {
+			return nil, fmt.Errorf("analytics sink %s: %w", name, err)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// ClickID identifies c across retries of the batch holding it.
+func ClickID(c Click) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%s\x00%s\x00%s", c.Shortcut, c.Time.UnixNano(), c.Referrer, c.UserAgent, c.Destination)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
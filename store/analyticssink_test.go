@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testClicks = []Click{
+	{Shortcut: "go", Time: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), Referrer: "https://wiki/"},
+	{Shortcut: "docs", Time: time.Date(2024, 6, 1, 12, 0, 1, 0, time.UTC)},
+}
+
+// newTestSink configures the sink name from env.
+func newTestSink(t *testing.T, name string, env map[string]string) AnalyticsSink {
+	t.Helper()
+	s, err := sinks[name](func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return s
+}
+
+func TestS3Sink(t *testing.T) {
+	var path, auth string
+	var lines []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		sum := sha256.Sum256(b)
+		if req.Method != http.MethodPut || req.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		path, auth = req.URL.Path, req.Header.Get("Authorization")
+		lines = strings.Split(strings.TrimSpace(string(b)), "\n")
+	}))
+	defer srv.Close()
+
+	s := newTestSink(t, "s3", map[string]string{
+		"S3_BUCKET": "clicks", "S3_ENDPOINT": srv.URL, "S3_REGION": "eu-west-1",
+		"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "secret",
+	})
+	if err := s.ExportClicks(context.Background(), testClicks); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(path, "/clicks/clicks/dt=") || !strings.HasSuffix(path, ".ndjson") {
+		t.Errorf("object path = %q", path)
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+		t.Errorf("Authorization = %q", auth)
+	}
+	var c Click
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[0]), &c) != nil || c.Shortcut != "go" || c.Referrer != "https://wiki/" {
+		t.Errorf("object = %q", lines)
+	}
+
+	if _, err := sinks["s3"](func(string) string { return "" }); err == nil {
+		t.Error("s3 sink configured without a bucket")
+	}
+}
+
+func TestKafkaSink(t *testing.T) {
+	failed := false
+	var got struct {
+		Records []kafkaRecord `json:"records"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/topics/clicks" || req.Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(req.Body).Decode(&got)
+		if failed {
+			io.WriteString(w, `{"offsets":[{"partition":0,"offset":1},{"error_code":50003,"error":"broker unavailable"}]}`)
+			return
+		}
+		io.WriteString(w, `{"offsets":[{"partition":0,"offset":1},{"partition":0,"offset":2}]}`)
+	}))
+	defer srv.Close()
+
+	s := newTestSink(t, "kafka", map[string]string{"KAFKA_REST_URL": srv.URL + "/", "KAFKA_TOPIC": "clicks"})
+	if err := s.ExportClicks(context.Background(), testClicks); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Records) != 2 || got.Records[1].Key != "docs" || got.Records[1].Value.Shortcut != "docs" {
+		t.Errorf("records = %+v", got.Records)
+	}
+	failed = true
+	if err := s.ExportClicks(context.Background(), testClicks); err == nil || !strings.Contains(err.Error(), "broker unavailable") {
+		t.Errorf("partially failed produce: error = %v", err)
+	}
+}
+
+func TestNewAnalyticsSinks(t *testing.T) {
+	if s, err := NewAnalyticsSinks(" "); err != nil || len(s) != 0 {
+		t.Errorf("no sinks: %v, %v", s, err)
+	}
+	if _, err := NewAnalyticsSinks("kafka,warehouse"); err == nil {
+		t.Error("unknown sink accepted")
+	}
+}
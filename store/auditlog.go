@@ -0,0 +1,115 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry records a single change to a link. Old and New hold the link as
+// served by the API; Old is nil for creations and New is nil for deletions.
+type AuditEntry struct {
+	Time     time.Time       `json:"time"`
+	Actor    string          `json:"actor"`
+	Client   string          `json:"client,omitempty"`
+	Action   string          `json:"action"`
+	Shortcut string          `json:"shortcut"`
+	Old      json.RawMessage `json:"old,omitempty"`
+	New      json.RawMessage `json:"new,omitempty"`
+}
+
+const (
+	AuditCreate   = "create"
+	AuditUpdate   = "update"
+	AuditDelete   = "delete"
+	AuditRestore  = "restore"
+	AuditRollback = "rollback"
+	AuditDisable  = "disable"
+	AuditApprove  = "approve"
+)
+
+// AuditLog is an append-only store of link changes.
+type AuditLog interface {
+	AppendAudit(ctx context.Context, e AuditEntry) error
+	// Audit returns up to limit entries, newest first, optionally only
+	// those of shortcut.
+	Audit(ctx context.Context, shortcut string, limit int) ([]AuditEntry, error)
+}
+
+// NewAuditLog picks the audit store: the JSONL file AUDIT_LOG_FILE if set,
+// otherwise the provider if it keeps one. It returns nil when neither does.
+func NewAuditLog(provider Provider) AuditLog {
+	if path := os.Getenv("AUDIT_LOG_FILE"); path != "" {
+		return &fileAuditLog{path: path}
+	}
+	a, _ := provider.(AuditLog)
+	return a
+}
+
+// maxAuditLine bounds the length of a line read back from an audit file.
+const maxAuditLine = 1 << 20
+
+// fileAuditLog appends entries to a JSON Lines file.
+type fileAuditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (f *fileAuditLog) AppendAudit(ctx context.Context, e AuditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Reopen each time so external log rotation is picked up.
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(b, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (f *fileAuditLog) Audit(ctx context.Context, shortcut string, limit int) ([]AuditEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Keep the last limit matching entries.
+	var out []AuditEntry
+	sc := bufio.NewScanner(file)
+	sc.Buffer(nil, maxAuditLine)
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue
+		}
+		if shortcut != "" && e.Shortcut != shortcut {
+			continue
+		}
+		out = append(out, e)
+		if len(out) > limit {
+			out = out[1:]
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/option"
+)
+
+// bigQueryBatch is the number of rows per insertAll request, as recommended
+// by BigQuery.
+const bigQueryBatch = 500
+
+func init() {
+	registerSink("bigquery", func(getenv func(string) string) (AnalyticsSink, error) {
+		table := getenv("BIGQUERY_TABLE")
+		parts := strings.Split(table, ".")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("BIGQUERY_TABLE must be set to PROJECT.DATASET.TABLE")
+		}
+		ctx := context.Background()
+		opts := []option.ClientOption{option.WithScopes(bigquery.BigqueryInsertdataScope)}
+		if f := getenv("GOOGLE_APPLICATION_CREDENTIALS"); f != "" {
+			opts = append(opts, option.WithCredentialsFile(f))
+		}
+		client, err := googleClient(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create BigQuery client: %w", err)
+		}
+		srv, err := bigquery.NewService(ctx, client)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create BigQuery client: %w", err)
+		}
+		return &bigQuerySink{srv: srv, project: parts[0], dataset: parts[1], table: parts[2]}, nil
+	})
+}
+
+// bigQuerySink streams clicks into a BigQuery table with the columns
+// shortcut, time (TIMESTAMP), referrer, user_agent and destination. Rows
+// carry ClickID as insert ID, so BigQuery drops retried duplicates.
+type bigQuerySink struct {
+	srv                     *bigquery.Service
+	project, dataset, table string
+}
+
+func (s *bigQuerySink) Name() string { return "bigquery" }
+
+func (s *bigQuerySink) ExportClicks(ctx context.Context, clicks []Click) error {
+	for len(clicks) > 0 {
+		n := len(clicks)
+		if n > bigQueryBatch {
+			n = bigQueryBatch
+		}
+		if err := s.insert(ctx, clicks[:n]); err != nil {
+			return err
+		}
+		clicks = clicks[n:]
+	}
+	return nil
+}
+
+func (s *bigQuerySink) insert(ctx context.Context, clicks []Click) error {
+	req := &bigquery.TableDataInsertAllRequest{Rows: make([]*bigquery.TableDataInsertAllRequestRows, len(clicks))}
+	for i, c := range clicks {
+		req.Rows[i] = &bigquery.TableDataInsertAllRequestRows{
+			InsertId: ClickID(c),
+			Json: map[string]bigquery.JsonValue{
+				"shortcut":    c.Shortcut,
+				"time":        c.Time.UTC().Format(time.RFC3339Nano),
+				"referrer":    c.Referrer,
+				"user_agent":  c.UserAgent,
+				"destination": c.Destination,
+			},
+		}
+	}
+	resp, err := s.srv.Tabledata.InsertAll(s.project, s.dataset, s.table, req).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to insert clicks into BigQuery: %w", err)
+	}
+	// Rows are inserted all or nothing unless skipInvalidRows is set, so any
+	// error fails the batch.
+	if len(resp.InsertErrors) > 0 {
+		ie, msg := resp.InsertErrors[0], "unknown error"
+		if len(ie.Errors) > 0 {
+			msg = ie.Errors[0].Message
+		}
+		return fmt.Errorf("failed to insert clicks into BigQuery: row %d: %s", ie.Index, msg)
+	}
+	return nil
+}
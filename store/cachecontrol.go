@@ -0,0 +1,74 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheDirectives are the Cache-Control response directives a link may set,
+// and whether they take a number of seconds.
+var cacheDirectives = map[string]bool{
+	"public":                 false,
+	"private":                false,
+	"no-cache":               false,
+	"no-store":               false,
+	"no-transform":           false,
+	"must-revalidate":        false,
+	"proxy-revalidate":       false,
+	"immutable":              false,
+	"max-age":                true,
+	"s-maxage":               true,
+	"stale-while-revalidate": true,
+	"stale-if-error":         true,
+}
+
+// ParseCacheControl parses a cache cell: either a Go duration such as "1h",
+// short for max-age, or Cache-Control directives such as
+// "public, max-age=300, s-maxage=3600". It returns the normalized header
+// value, "" for an empty cell.
+func ParseCacheControl(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		if d < 0 {
+			return "", fmt.Errorf("cache duration %q is negative", s)
+		}
+		return "max-age=" + strconv.FormatInt(int64(d/time.Second), 10), nil
+	}
+
+	var out []string
+	for _, d := range strings.Split(s, ",") {
+		if d = strings.TrimSpace(d); d == "" {
+			continue
+		}
+		name, value := d, ""
+		if i := strings.IndexByte(d, '='); i >= 0 {
+			name, value = strings.TrimSpace(d[:i]), strings.TrimSpace(d[i+1:])
+		}
+		name = strings.ToLower(name)
+		seconds, ok := cacheDirectives[name]
+		if !ok {
+			return "", fmt.Errorf("unknown Cache-Control directive %q", name)
+		}
+		if !seconds {
+			if value != "" {
+				return "", fmt.Errorf("Cache-Control directive %q takes no value", name)
+			}
+			out = append(out, name)
+			continue
+		}
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return "", fmt.Errorf("Cache-Control directive %q needs a number of seconds", name)
+		}
+		out = append(out, name+"="+strconv.FormatUint(n, 10))
+	}
+	if len(out) == 0 {
+		return "", fmt.Errorf("empty Cache-Control %q", s)
+	}
+	return strings.Join(out, ", "), nil
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Canary rolls a new destination of a link out to a share of its visitors
+// while it bakes. Once Until passes, everyone goes to the new destination.
+type Canary struct {
+	URL *url.URL
+	// Percent of the visitors sent to URL, 1 to 99.
+	Percent int
+	// Until is when the canary serves everyone; zero keeps it going until
+	// the link is changed.
+	Until time.Time
+}
+
+// ParseCanary parses the canary column, such as
+// "10% https://new.example.com/ until 2024-06-01T18:00:00Z".
+func ParseCanary(s string) (*Canary, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 && len(fields) != 4 {
+		return nil, errors.New(`expected "PERCENT% URL [until TIME]"`)
+	}
+	c := &Canary{}
+	pct := strings.TrimSuffix(fields[0], "%")
+	var err error
+	if c.Percent, err = strconv.Atoi(pct); err != nil || pct == fields[0] || c.Percent < 1 || c.Percent > 99 {
+		return nil, fmt.Errorf("percentage %q must be between 1%% and 99%%", fields[0])
+	}
+	if c.URL, err = url.Parse(fields[1]); err != nil || !c.URL.IsAbs() {
+		return nil, fmt.Errorf("url %q is invalid", fields[1])
+	}
+	if len(fields) == 4 {
+		if !strings.EqualFold(fields[2], "until") {
+			return nil, fmt.Errorf("unexpected %q, expected until", fields[2])
+		}
+		if c.Until, err = ParseExpiry(fields[3]); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// FormatCanary renders c for the canary column, "" for none.
+func FormatCanary(c *Canary) string {
+	if c == nil {
+		return ""
+	}
+	s := strconv.Itoa(c.Percent) + "% " + c.URL.String()
+	if !c.Until.IsZero() {
+		s += " until " + FormatExpiry(c.Until)
+	}
+	return s
+}
+
+// Baking reports whether c still splits the visitors at now.
+func (c *Canary) Baking(now time.Time) bool {
+	return c != nil && (c.Until.IsZero() || now.Before(c.Until))
+}
+
+// canaryFor returns l, or l leading to its canary for the visitors of
+// shortcut the canary takes.
+func (l *Link) canaryFor(v Visitor, shortcut string, now time.Time) *Link {
+	if l.Canary == nil {
+		return l
+	}
+	if l.Canary.Baking(now) && v.bucket(shortcut+"\x00canary") > l.Canary.Percent {
+		return l
+	}
+	c := *l
+	c.URL = l.Canary.URL
+	return &c
+}
+
+// OnCanary reports whether l, as returned by For, leads to its canary.
+func (l *Link) OnCanary() bool {
+	return l.Canary != nil && l.URL == l.Canary.URL
+}
+
+// Settled returns l with its canary as the destination once it is done
+// baking, or l itself.
+func (l *Link) Settled(now time.Time) *Link {
+	if l.Canary == nil || l.Canary.Baking(now) {
+		return l
+	}
+	c := *l
+	c.URL, c.Canary = l.Canary.URL, nil
+	return &c
+}
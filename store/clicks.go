@@ -0,0 +1,100 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// maxReferrers bounds the number of distinct referrers tracked in memory
+	// per shortcut; the rest are counted under otherReferrer.
+	maxReferrers  = 1000
+	otherReferrer = "(other)"
+	TopReferrers  = 10
+)
+
+// Click is a single redirect served for a shortcut.
+type Click struct {
+	Shortcut  string    `json:"shortcut"`
+	Time      time.Time `json:"time"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	// Destination is the URL of the variant followed, for links with
+	// variants.
+	Destination string `json:"destination,omitempty"`
+}
+
+// ClickRecorder is implemented by providers that can persist click events
+// and aggregate them back into statistics.
+type ClickRecorder interface {
+	RecordClicks(ctx context.Context, clicks []Click) error
+	ClickStats(ctx context.Context, shortcut string) (*LinkStats, error)
+	// ClickTotals returns the total clicks of each of shortcuts; missing
+	// entries count as zero.
+	ClickTotals(ctx context.Context, shortcuts []string) (map[string]int64, error)
+	// ClicksSince returns the clicks of each of shortcuts from the UTC day
+	// of since on; missing entries count as zero.
+	ClicksSince(ctx context.Context, shortcuts []string, since time.Time) (map[string]int64, error)
+}
+
+// LinkStats aggregates the clicks of a single shortcut.
+type LinkStats struct {
+	Total     int64
+	PerDay    map[string]int64
+	Referrers map[string]int64
+	// Destinations counts the clicks of each variant of links with variants.
+	Destinations map[string]int64
+}
+
+// NewLinkStats returns empty statistics.
+func NewLinkStats() *LinkStats {
+	return &LinkStats{
+		PerDay:       make(map[string]int64),
+		Referrers:    make(map[string]int64),
+		Destinations: make(map[string]int64),
+	}
+}
+
+// Add counts c.
+func (ls *LinkStats) Add(c Click) {
+	ls.Total++
+	ls.PerDay[Day(c.Time)]++
+
+	ref := c.Referrer
+	if ref == "" {
+		ref = "(direct)"
+	}
+	if _, ok := ls.Referrers[ref]; !ok && len(ls.Referrers) >= maxReferrers {
+		ref = otherReferrer
+	}
+	ls.Referrers[ref]++
+	if c.Destination != "" {
+		ls.Destinations[c.Destination]++
+	}
+}
+
+// Day returns the UTC day of t as clicks are bucketed by, "2006-01-02".
+func Day(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// Days returns the UTC days from since to now, oldest first.
+func Days(since, now time.Time) []string {
+	var out []string
+	for d := since.UTC().Truncate(24 * time.Hour); !d.After(now); d = d.AddDate(0, 0, 1) {
+		out = append(out, Day(d))
+	}
+	return out
+}
+
+// ClicksSince returns the clicks of ls from the UTC day of since on.
+func (ls *LinkStats) ClicksSince(since time.Time) int64 {
+	first := Day(since)
+	var n int64
+	for day, c := range ls.PerDay {
+		if day >= first {
+			n += c
+		}
+	}
+	return n
+}
@@ -0,0 +1,165 @@
+package store
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Positions of the columns in the default layout of the sheet, see urlMap.
+const (
+	colShortcut = iota
+	colURL
+	colExpires
+	colStatus
+	colPrivate
+	colPreview
+	colParams
+	colOwner
+	colPassword
+	colCondition
+	colCache
+	colType
+	colDescription
+	colTags
+	colDeleted
+	colActiveFrom
+	colCanary
+	colMaxClicks
+	colDisabled
+	colUnapproved
+	numColumns
+)
+
+// columnNames are the header names of the columns of the default layout,
+// as normalized by headerName.
+var columnNames = [numColumns][]string{
+	colShortcut:    {"shortcut", "short", "slug", "key"},
+	colURL:         {"url", "value", "destination", "target", "link"},
+	colExpires:     {"expires", "expiry", "expiresat", "expiration", "activeuntil"},
+	colStatus:      {"status", "statuscode", "redirectstatus"},
+	colPrivate:     {"private"},
+	colPreview:     {"preview"},
+	colParams:      {"params", "parameters", "query"},
+	colOwner:       {"owner"},
+	colPassword:    {"password"},
+	colCondition:   {"condition", "when"},
+	colCache:       {"cache", "cachecontrol"},
+	colType:        {"type"},
+	colDescription: {"description", "notes"},
+	colTags:        {"tags"},
+	colDeleted:     {"deleted", "deletedat"},
+	colActiveFrom:  {"activefrom", "from"},
+	colCanary:      {"canary"},
+	colMaxClicks:   {"maxclicks", "clickbudget"},
+	colDisabled:    {"disabled"},
+	colUnapproved:  {"unapproved"},
+}
+
+// columnOf returns the position in the default layout of the column named
+// by the header cell.
+func columnOf(cell interface{}) (int, bool) {
+	name := headerName(cell)
+	for pos, names := range columnNames {
+		for _, n := range names {
+			if n == name {
+				return pos, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// headerName normalizes the name of a column, so that "Max clicks",
+// "max_clicks" and "MaxClicks" are the same.
+func headerName(cell interface{}) string {
+	s, _ := cell.(string)
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+}
+
+// sheetColumns is the layout of a tab with a header row: the position in
+// the default layout of each of its columns, or -1 for columns it doesn't
+// know. Tabs without a header have a nil layout, that of urlMap.
+type sheetColumns []int
+
+// parseHeader returns the layout named by row, or nil when row isn't a
+// header, which needs both a shortcut and a URL column. unknown lists the
+// names of the columns left out, and those naming a column twice.
+func parseHeader(row []interface{}) (cols sheetColumns, unknown []string) {
+	cols = make(sheetColumns, len(row))
+	seen := make(map[int]bool)
+	for i, cell := range row {
+		pos, ok := columnOf(cell)
+		if !ok || seen[pos] {
+			cols[i] = -1
+			if name, _ := cell.(string); strings.TrimSpace(name) != "" {
+				unknown = append(unknown, strings.TrimSpace(name))
+			}
+			continue
+		}
+		cols[i], seen[pos] = pos, true
+	}
+	if !seen[colShortcut] || !seen[colURL] {
+		return nil, nil
+	}
+	return cols, unknown
+}
+
+// defaultRow rearranges row of a tab laid out as c into the default layout.
+func (c sheetColumns) defaultRow(row []interface{}) []interface{} {
+	if c == nil {
+		return row
+	}
+	out := make([]interface{}, numColumns)
+	n := 0
+	for i, cell := range row {
+		if i < len(c) && c[i] >= 0 {
+			out[c[i]] = cell
+			if c[i] >= n {
+				n = c[i] + 1
+			}
+		}
+	}
+	return out[:n]
+}
+
+// tabRow rearranges values in the default layout into the columns of a tab
+// laid out as c. Columns the tab doesn't know are left empty; columns it
+// lacks are dropped.
+func (c sheetColumns) tabRow(values []string) []string {
+	if c == nil {
+		return values
+	}
+	out := make([]string, len(c))
+	for i, pos := range c {
+		if pos >= 0 && pos < len(values) {
+			out[i] = values[pos]
+		}
+	}
+	return out
+}
+
+// spans returns the runs [start, end) of adjacent columns of a row of n
+// cells that c knows, which updates write so that they leave the other
+// columns alone.
+func (c sheetColumns) spans(n int) [][2]int {
+	if c == nil {
+		return [][2]int{{0, n}}
+	}
+	var out [][2]int
+	for i := 0; i < n && i < len(c); i++ {
+		if c[i] < 0 {
+			continue
+		}
+		if len(out) > 0 && out[len(out)-1][1] == i {
+			out[len(out)-1][1]++
+		} else {
+			out = append(out, [2]int{i, i + 1})
+		}
+	}
+	return out
+}
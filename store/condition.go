@@ -0,0 +1,195 @@
+package store
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Device classes a Condition can match. A visitor can be in several, such as
+// ios and mobile.
+const (
+	DeviceIOS     = "ios"
+	DeviceAndroid = "android"
+	DeviceMobile  = "mobile"
+	DeviceDesktop = "desktop"
+)
+
+// Visitor describes the client following a link, for choosing among its
+// variants. Empty fields are unknown and match no condition on them.
+type Visitor struct {
+	// Country is an ISO 3166-1 alpha-2 code in upper case.
+	Country string
+	// Devices are the device classes of the client.
+	Devices []string
+	// Language is the primary subtag of the most preferred language, in
+	// lower case.
+	Language string
+	// ID identifies the visitor across requests, such as by a cookie, and
+	// keeps them on the same side of each split. Empty draws anew every time.
+	ID string
+}
+
+// bucket places v in 1..100 for the splits of shortcut.
+func (v Visitor) bucket(shortcut string) int {
+	if v.ID == "" {
+		return rand.Intn(100) + 1
+	}
+	h := fnv.New32a()
+	h.Write([]byte(v.ID))
+	h.Write([]byte{0})
+	h.Write([]byte(shortcut))
+	return int(h.Sum32()%100) + 1
+}
+
+// Condition restricts a variant of a link to some visitors. Each non-empty
+// field must match one of its values.
+type Condition struct {
+	Countries []string
+	Devices   []string
+	Languages []string
+	// Weight, when set, sends only this percentage of the matching visitors
+	// to the variant, for A/B tests.
+	Weight int
+}
+
+// ParseCondition parses the "when" column of a conditional row, such as
+// "device=ios" or "country=DE,AT; lang=de".
+func ParseCondition(s string) (*Condition, error) {
+	c := &Condition{}
+	for _, clause := range strings.Split(s, ";") {
+		if clause = strings.TrimSpace(clause); clause == "" {
+			continue
+		}
+		i := strings.IndexByte(clause, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid condition %q, expected key=value[,value...]", clause)
+		}
+		var values []string
+		for _, v := range strings.Split(clause[i+1:], ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("condition %q has no values", clause)
+		}
+
+		switch key := strings.ToLower(strings.TrimSpace(clause[:i])); key {
+		case "weight":
+			w, err := strconv.Atoi(strings.TrimSuffix(values[0], "%"))
+			if err != nil || len(values) > 1 || w < 1 || w > 100 {
+				return nil, fmt.Errorf("weight %q is not a percentage between 1 and 100", clause[i+1:])
+			}
+			c.Weight = w
+		case "country":
+			for _, v := range values {
+				if len(v) != 2 {
+					return nil, fmt.Errorf("country %q is not a two-letter code", v)
+				}
+				c.Countries = append(c.Countries, strings.ToUpper(v))
+			}
+		case "device":
+			for _, v := range values {
+				switch v = strings.ToLower(v); v {
+				case DeviceIOS, DeviceAndroid, DeviceMobile, DeviceDesktop:
+					c.Devices = append(c.Devices, v)
+				default:
+					return nil, fmt.Errorf("unknown device %q, expected ios, android, mobile or desktop", v)
+				}
+			}
+		case "lang", "language":
+			for _, v := range values {
+				c.Languages = append(c.Languages, strings.ToLower(strings.SplitN(v, "-", 2)[0]))
+			}
+		default:
+			return nil, fmt.Errorf("unknown condition %q, expected country, device, lang or weight", key)
+		}
+	}
+	if len(c.Countries)+len(c.Devices)+len(c.Languages) == 0 && c.Weight == 0 {
+		return nil, fmt.Errorf("empty condition")
+	}
+	return c, nil
+}
+
+// String formats c as ParseCondition accepts it.
+func (c *Condition) String() string {
+	var clauses []string
+	for _, kv := range []struct {
+		key    string
+		values []string
+	}{{"country", c.Countries}, {"device", c.Devices}, {"lang", c.Languages}} {
+		if len(kv.values) > 0 {
+			clauses = append(clauses, kv.key+"="+strings.Join(kv.values, ","))
+		}
+	}
+	if c.Weight > 0 {
+		clauses = append(clauses, "weight="+strconv.Itoa(c.Weight))
+	}
+	return strings.Join(clauses, "; ")
+}
+
+// Matches reports whether v satisfies c.
+func (c *Condition) Matches(v Visitor) bool {
+	return matchesAny(c.Countries, v.Country) &&
+		matchesAny(c.Devices, v.Devices...) &&
+		matchesAny(c.Languages, v.Language)
+}
+
+// matchesAny reports whether want is empty or holds one of got.
+func matchesAny(want []string, got ...string) bool {
+	if len(want) == 0 {
+		return true
+	}
+	for _, w := range want {
+		for _, g := range got {
+			if g != "" && w == g {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// For returns the first variant of shortcut l whose condition v matches, or l
+// itself. Weighted variants split the visitors they match: each takes its
+// weight in percent, in order, and the rest go on to the next variants. The
+// canary of l takes its share of the visitors left.
+func (l *Link) For(v Visitor, shortcut string) *Link {
+	bucket, split := 0, 0
+	for _, alt := range l.Variants {
+		if !alt.When.Matches(v) {
+			continue
+		}
+		if alt.When.Weight == 0 {
+			return alt
+		}
+		if bucket == 0 {
+			bucket = v.bucket(shortcut)
+		}
+		if split += alt.When.Weight; bucket <= split {
+			return alt
+		}
+	}
+	return l.canaryFor(v, shortcut, time.Now())
+}
+
+// Split reports whether l or its variants send visitors by weight, or l has
+// a canary baking.
+func (l *Link) Split() bool {
+	if l.When != nil && l.When.Weight > 0 {
+		return true
+	}
+	if l.Canary.Baking(time.Now()) {
+		return true
+	}
+	for _, alt := range l.Variants {
+		if alt.When.Weight > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		in, want string
+		err      bool
+	}{
+		{in: "device=ios", want: "device=ios"},
+		{in: " Country = de, at ; LANG=de-CH ", want: "country=DE,AT; lang=de"},
+		{in: "language=en;device=mobile,desktop", want: "device=mobile,desktop; lang=en"},
+		{in: "weight=50%; country=us", want: "country=US; weight=50"},
+		{in: "weight=0", err: true},
+		{in: "weight=101", err: true},
+		{in: "weight=20,30", err: true},
+		{in: "", err: true},
+		{in: "device", err: true},
+		{in: "device=", err: true},
+		{in: "device=fridge", err: true},
+		{in: "country=GER", err: true},
+		{in: "os=ios", err: true},
+	}
+	for _, tt := range tests {
+		c, err := ParseCondition(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseCondition(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if err == nil && c.String() != tt.want {
+			t.Errorf("ParseCondition(%q) = %q, want %q", tt.in, c, tt.want)
+		}
+	}
+}
+
+func TestLinkFor(t *testing.T) {
+	ctx, w := WithLinkWarnings(context.Background())
+	m := urlMap(ctx, [][]interface{}{
+		{"app", "https://apps.apple.com/app", "", "", "", "", "", "", "", "device=ios"},
+		{"app", "https://play.google.com/app", "", "", "", "", "", "", "", "device=android"},
+		{"app", "https://example.com/app"},
+		{"app", "https://example.de/app", "", "", "", "", "", "", "", "country=DE,AT; device=desktop"},
+		{"orphan", "https://x.com", "", "", "", "", "", "", "", "lang=fr"},
+		{"bad", "https://x.com", "", "", "", "", "", "", "", "planet=mars"},
+	})
+	if n := len(w.Warnings()); n != 2 {
+		t.Errorf("got warnings %q, want 2", w.Warnings())
+	}
+	if len(m) != 1 {
+		t.Fatalf("got %d links, want only app", len(m))
+	}
+
+	app := m["app"]
+	tests := []struct {
+		v    Visitor
+		want string
+	}{
+		{Visitor{}, "https://example.com/app"},
+		{Visitor{Devices: []string{DeviceIOS, DeviceMobile}}, "https://apps.apple.com/app"},
+		{Visitor{Devices: []string{DeviceAndroid, DeviceMobile}, Country: "DE"}, "https://play.google.com/app"},
+		{Visitor{Devices: []string{DeviceDesktop}, Country: "AT"}, "https://example.de/app"},
+		{Visitor{Devices: []string{DeviceDesktop}, Country: "FR"}, "https://example.com/app"},
+		{Visitor{Country: "DE"}, "https://example.com/app"},
+	}
+	for _, tt := range tests {
+		if got := app.For(tt.v, "app").URL.String(); got != tt.want {
+			t.Errorf("For(%+v) = %s, want %s", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestLinkForSplit(t *testing.T) {
+	ctx, w := WithLinkWarnings(context.Background())
+	m := urlMap(ctx, [][]interface{}{
+		{"lp", "https://example.com/a"},
+		{"lp", "https://example.com/b", "", "", "", "", "", "", "", "weight=30"},
+		{"lp", "https://example.com/c", "", "", "", "", "", "", "", "weight=20"},
+		{"lp", "https://example.com/de", "", "", "", "", "", "", "", "country=DE"},
+		{"over", "https://example.com/a"},
+		{"over", "https://example.com/b", "", "", "", "", "", "", "", "weight=60"},
+		{"over", "https://example.com/c", "", "", "", "", "", "", "", "weight=60"},
+	})
+	if n := len(w.Warnings()); n != 1 {
+		t.Errorf("got warnings %q, want 1 for the weights of over", w.Warnings())
+	}
+	lp := m["lp"]
+	if !lp.Split() || m["lp"].Variants[2].Split() {
+		t.Error("Split doesn't match the weights")
+	}
+
+	got := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		got[lp.For(Visitor{ID: strconv.Itoa(i)}, "lp").URL.Path]++
+	}
+	for path, want := range map[string]int{"/a": 500, "/b": 300, "/c": 200} {
+		if n := got[path]; n < want-75 || n > want+75 {
+			t.Errorf("%s got %d of 1000 visitors, want about %d", path, n, want)
+		}
+	}
+	if got["/de"] != 0 {
+		t.Errorf("the split sent %d visitors to the country=DE variant", got["/de"])
+	}
+
+	// The same visitor stays on the same side, but may be on another side of
+	// another split.
+	v := Visitor{ID: "abc"}
+	first := lp.For(v, "lp")
+	for i := 0; i < 10; i++ {
+		if lp.For(v, "lp") != first {
+			t.Fatal("For isn't sticky for a visitor ID")
+		}
+	}
+}
+
+func TestLinkForCanary(t *testing.T) {
+	ctx, w := WithLinkWarnings(context.Background())
+	row := func(k, canary string) []interface{} {
+		return []interface{}{k, "https://example.com/old", "", "", "", "", "", "", "", "", "", "", "", "", "", "", canary}
+	}
+	m := urlMap(ctx, [][]interface{}{
+		row("baking", "20% https://example.com/new until 2999-01-01T00:00:00Z"),
+		row("baked", "20% https://example.com/new until 2000-01-01T00:00:00Z"),
+		row("bad", "120% https://example.com/new"),
+	})
+	if n := len(w.Warnings()); n != 1 || m["bad"].Canary != nil {
+		t.Errorf("got warnings %q, want 1 for the canary of bad", w.Warnings())
+	}
+	if s := FormatCanary(m["baking"].Canary); s != "20% https://example.com/new until 2999-01-01T00:00:00Z" {
+		t.Errorf("FormatCanary = %q", s)
+	}
+
+	baking := m["baking"]
+	if !baking.Split() {
+		t.Error("a baking canary doesn't split")
+	}
+	got := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		l := baking.For(Visitor{ID: strconv.Itoa(i)}, "baking")
+		if l.OnCanary() != (l.URL.Path == "/new") {
+			t.Fatalf("OnCanary = %v for %v", l.OnCanary(), l.URL)
+		}
+		got[l.URL.Path]++
+	}
+	if n := got["/new"]; n < 200-60 || n > 200+60 {
+		t.Errorf("canary got %d of 1000 visitors, want about 200", n)
+	}
+
+	baked := m["baked"]
+	if baked.Split() {
+		t.Error("a baked canary still splits")
+	}
+	for i := 0; i < 100; i++ {
+		if l := baked.For(Visitor{ID: strconv.Itoa(i)}, "baked"); l.URL.Path != "/new" {
+			t.Fatalf("baked canary sent a visitor to %v", l.URL)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/tracing"
+)
+
+// maxCSVBody caps the size of a downloaded CSV.
+const maxCSVBody = 32 << 20
+
+func init() {
+	registerProvider("csv", func(getenv func(string) string) (Provider, error) {
+		raw := getenv("SHEET_CSV_URL")
+		if raw == "" {
+			return nil, fmt.Errorf("SHEET_CSV_URL not set")
+		}
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid SHEET_CSV_URL %q", raw)
+		}
+		return &csvProvider{
+			url:    raw,
+			client: &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	})
+}
+
+// csvProvider reads links from a CSV document, typically a Google Sheet
+// published to the web (File > Share > Publish to web > CSV) or its export
+// URL. It needs no credentials and is read-only. Columns are the same as
+// in the sheet.
+type csvProvider struct {
+	url    string
+	client *http.Client
+
+	// etag and checksum of the previous response, to detect unchanged data.
+	etag     string
+	checksum [sha256.Size]byte
+}
+
+func (p *csvProvider) Query(ctx context.Context) (_ URLMap, err error) {
+	ctx, sp := tracing.Start(ctx, "csv.fetch", tracing.Client)
+	defer func() { sp.End(spanError(err)) }()
+	ctx = tracing.WithClientTrace(ctx, sp)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.etag != "" {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch CSV: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil, ErrNotModified
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, fmt.Errorf("%w: CSV fetch returned %s", ErrRateLimited, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unable to fetch CSV: %s", resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxCSVBody))
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch CSV: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	if sum == p.checksum {
+		return nil, ErrNotModified
+	}
+
+	rows, err := csvRows(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+	p.etag, p.checksum = resp.Header.Get("ETag"), sum
+
+	log.Printf("queried %d rows from CSV", len(rows))
+	return urlMap(withRows(ctx, ""), rows), nil
+}
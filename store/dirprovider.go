@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// configMapDataLink is the symlink Kubernetes swaps to update the files of
+// a mounted ConfigMap or Secret at once.
+const configMapDataLink = "..data"
+
+func init() {
+	registerProvider("dir", func(getenv func(string) string) (Provider, error) {
+		dir := getenv("LINKS_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("LINKS_DIR not set")
+		}
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return nil, fmt.Errorf("LINKS_DIR: %w", err)
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("LINKS_DIR %q is not a directory", dir)
+		}
+		interval, err := watchInterval(getenv)
+		if err != nil {
+			return nil, err
+		}
+		return &dirProvider{dir: dir, interval: interval}, nil
+	})
+}
+
+// dirProvider reads links from the YAML, JSON and CSV files of a directory,
+// such as a ConfigMap or Secret mounted in a pod, in name order as if they
+// were one file. Hidden files, like the "..data" links Kubernetes keeps,
+// are skipped. It is read-only.
+type dirProvider struct {
+	dir string
+	// interval is how often Watch checks the files, fileWatchInterval if 0.
+	interval time.Duration
+	// checksum of the files read by the previous query.
+	checksum [sha256.Size]byte
+}
+
+// files returns the paths of the links files in the directory, sorted.
+func (p *dirProvider) files() ([]string, error) {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list links directory: %w", err)
+	}
+	var paths []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") || !isLinksFile(e.Name()) {
+			continue
+		}
+		// ConfigMap keys are symlinks to the files, so follow them.
+		path := filepath.Join(p.dir, e.Name())
+		if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (p *dirProvider) Query(ctx context.Context) (URLMap, error) {
+	paths, err := p.files()
+	if err != nil {
+		return nil, err
+	}
+	contents := make([][]byte, len(paths))
+	h := sha256.New()
+	for i, path := range paths {
+		if contents[i], err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("unable to read links file: %w", err)
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.Base(path), len(contents[i]))
+		h.Write(contents[i])
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	if sum == p.checksum {
+		return nil, ErrNotModified
+	}
+
+	var rows [][]interface{}
+	for i, path := range paths {
+		r, err := parseLinksFile(ctx, path, contents[i])
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, r...)
+	}
+	p.checksum = sum
+	log.Printf("read %d rows from %d files in %s", len(rows), len(paths), p.dir)
+	return urlMap(ctx, rows), nil
+}
+
+// Watch implements Watcher, checking every interval where the "..data" link
+// of a mounted ConfigMap points, and the modification time and size of
+// each file for other directories.
+func (p *dirProvider) Watch(ctx context.Context, changed func()) {
+	pollChanges(ctx, p.dir, p.interval, func() string {
+		var b strings.Builder
+		if target, err := os.Readlink(filepath.Join(p.dir, configMapDataLink)); err == nil {
+			b.WriteString(target)
+		}
+		paths, _ := p.files()
+		for _, path := range paths {
+			if fi, err := os.Stat(path); err == nil {
+				fmt.Fprintf(&b, "\x00%s %d %d", path, fi.ModTime().UnixNano(), fi.Size())
+			}
+		}
+		return b.String()
+	}, changed)
+}
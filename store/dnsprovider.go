@@ -0,0 +1,473 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/tracing"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dnsIndexLabel prefixes the zone for the name whose TXT records list
+	// the shortcuts, as a zone's names can't be listed over DNS.
+	dnsIndexLabel = "_links"
+	// dnsMinTTL floors the TTLs of answers, so that records with tiny TTLs
+	// don't keep the provider querying.
+	dnsMinTTL = 5 * time.Second
+	// dnsNegativeTTL is how long missing names are cached when the answer
+	// carries no SOA record to tell.
+	dnsNegativeTTL = time.Minute
+	// dnsRetry is how long after a failed lookup it is retried; the last
+	// answer is used meanwhile.
+	dnsRetry = 30 * time.Second
+	// dnsTimeout bounds each lookup that is not already bounded by a
+	// context deadline.
+	dnsTimeout = 5 * time.Second
+	// dnsConcurrency bounds the lookups in flight.
+	dnsConcurrency = 8
+)
+
+func init() {
+	registerProvider("dns", func(getenv func(string) string) (Provider, error) {
+		zone := strings.ToLower(strings.Trim(getenv("DNS_ZONE"), "."))
+		if zone == "" {
+			return nil, fmt.Errorf("DNS_ZONE not set")
+		}
+		for _, label := range strings.Split(zone, ".") {
+			if !validDNSLabel(label) {
+				return nil, fmt.Errorf("invalid DNS_ZONE %q", zone)
+			}
+		}
+		server := getenv("DNS_SERVER")
+		if server == "" {
+			var err error
+			if server, err = systemNameserver("/etc/resolv.conf"); err != nil {
+				return nil, fmt.Errorf("DNS_SERVER not set and %w", err)
+			}
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		return &dnsProvider{zone: zone, server: server, records: make(map[string]dnsRecord)}, nil
+	})
+}
+
+// dnsRecord is the last answer for a name: its TXT records, each with its
+// strings joined, none if the name doesn't exist.
+type dnsRecord struct {
+	txt     []string
+	err     error
+	expires time.Time
+}
+
+// dnsProvider resolves shortcuts from the TXT records of a DNS zone: "docs"
+// from docs.<zone> and "team/docs" from docs.team.<zone>, whose record holds
+// the destination. The TXT records of _links.<zone> list the shortcuts,
+// separated by spaces. Answers are kept for their TTL, so a refresh only
+// asks again for the names that expired. It is read-only.
+type dnsProvider struct {
+	zone   string
+	server string
+
+	// records are the last answers by name; only Query uses them.
+	records map[string]dnsRecord
+	// checksum of the links built by the previous query.
+	checksum [sha256.Size]byte
+	// next is the UnixNano time the first answer expires, or zero, for
+	// Watch.
+	next int64
+}
+
+// systemNameserver returns the first nameserver of the resolv.conf file at
+// path.
+func systemNameserver(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to find a nameserver: %w", err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if fields := strings.Fields(s.Text()); len(fields) > 1 && fields[0] == "nameserver" {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("no nameserver in %s", path)
+}
+
+// validDNSLabel reports whether label can be a label of a host name.
+func validDNSLabel(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	return strings.Trim(label, "abcdefghijklmnopqrstuvwxyz0123456789-_") == ""
+}
+
+// name returns the DNS name of shortcut, its segments reversed below the
+// zone, or false if it has none.
+func (p *dnsProvider) name(shortcut string) (string, bool) {
+	segments := strings.Split(strings.ToLower(shortcut), "/")
+	labels := make([]string, 0, len(segments)+1)
+	for i := len(segments) - 1; i >= 0; i-- {
+		if !validDNSLabel(segments[i]) {
+			return "", false
+		}
+		labels = append(labels, segments[i])
+	}
+	name := strings.Join(append(labels, p.zone), ".")
+	return name, len(name) <= 253
+}
+
+func (p *dnsProvider) Query(ctx context.Context) (_ URLMap, err error) {
+	ctx, sp := tracing.Start(ctx, "dns.query", tracing.Client)
+	defer func() { sp.End(spanError(err)) }()
+
+	now := time.Now()
+	index := dnsIndexLabel + "." + p.zone
+	p.refresh(ctx, now, []string{index})
+	if rec := p.records[index]; rec.err != nil {
+		return nil, fmt.Errorf("unable to look up the shortcuts at %s: %w", index, rec.err)
+	}
+	names := make(map[string]string)
+	var shortcuts []string
+	var issues []LinkIssue
+	for _, txt := range p.records[index].txt {
+		for _, shortcut := range strings.Fields(txt) {
+			shortcut = Norm.Canonical(shortcut)
+			if _, dup := names[shortcut]; dup {
+				continue
+			}
+			name, ok := p.name(shortcut)
+			if !ok {
+				issues = append(issues, LinkIssue{Kind: IssueInvalidCell, Shortcut: shortcut, Skipped: true,
+					Message: fmt.Sprintf("%s can't be a DNS name, ignoring it", shortcut)})
+				continue
+			}
+			names[shortcut] = name
+			shortcuts = append(shortcuts, shortcut)
+		}
+	}
+	sort.Strings(shortcuts)
+	lookups := make([]string, 0, len(shortcuts))
+	for _, shortcut := range shortcuts {
+		lookups = append(lookups, names[shortcut])
+	}
+	p.refresh(ctx, now, lookups)
+	p.forget(index, lookups)
+
+	h := sha256.New()
+	var rows [][]interface{}
+	for _, shortcut := range shortcuts {
+		name := names[shortcut]
+		rec := p.records[name]
+		switch {
+		case rec.err != nil:
+			issues = append(issues, LinkIssue{Kind: IssueOther, Shortcut: shortcut, Skipped: true,
+				Message: fmt.Sprintf("unable to look up %s at %s, ignoring it: %v", shortcut, name, rec.err)})
+			continue
+		case len(rec.txt) == 0:
+			issues = append(issues, LinkIssue{Kind: IssueEmptyCell, Shortcut: shortcut, Skipped: true,
+				Message: fmt.Sprintf("%s has no TXT record at %s, ignoring it", shortcut, name)})
+			continue
+		case len(rec.txt) > 1:
+			issues = append(issues, LinkIssue{Kind: IssueDuplicate, Shortcut: shortcut,
+				Message: fmt.Sprintf("%s has %d TXT records at %s, using %q", shortcut, len(rec.txt), name, rec.txt[0])})
+		}
+		rows = append(rows, []interface{}{shortcut, rec.txt[0]})
+		fmt.Fprintf(h, "%s\x00%s\x00", shortcut, rec.txt[0])
+	}
+	for _, issue := range issues {
+		fmt.Fprintf(h, "%s\x00", issue.Message)
+	}
+	p.schedule()
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	if sum == p.checksum {
+		return nil, ErrNotModified
+	}
+	for _, issue := range issues {
+		Issuef(ctx, issue, "%s", issue.Message)
+	}
+	p.checksum = sum
+	log.Printf("resolved %d shortcuts from DNS zone %s", len(rows), p.zone)
+	return urlMap(ctx, rows), nil
+}
+
+// refresh looks up those of names whose answer expired, at most
+// dnsConcurrency at a time. Names whose lookup fails keep their last answer
+// until dnsRetry, or record the error if they have none.
+func (p *dnsProvider) refresh(ctx context.Context, now time.Time, names []string) {
+	type due struct {
+		name  string
+		last  dnsRecord
+		known bool
+	}
+	var lookups []due
+	for _, name := range names {
+		if rec, ok := p.records[name]; !ok || !now.Before(rec.expires) {
+			lookups = append(lookups, due{name, rec, ok})
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, dnsConcurrency)
+	for _, l := range lookups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string, last dnsRecord, known bool) {
+			defer func() { <-sem; wg.Done() }()
+			txt, ttl, err := p.lookupTXT(ctx, name)
+			switch {
+			case err == nil:
+				if ttl < dnsMinTTL {
+					ttl = dnsMinTTL
+				}
+				last = dnsRecord{txt: txt, expires: now.Add(ttl)}
+			case known && last.err == nil:
+				log.Printf("warn: unable to look up %s, keeping its last answer: %v", name, err)
+				last.expires = now.Add(dnsRetry)
+			default:
+				last = dnsRecord{err: err, expires: now.Add(dnsRetry)}
+			}
+			mu.Lock()
+			p.records[name] = last
+			mu.Unlock()
+		}(l.name, l.last, l.known)
+	}
+	wg.Wait()
+}
+
+// forget drops the answers for names that are no longer listed.
+func (p *dnsProvider) forget(index string, names []string) {
+	keep := make(map[string]bool, len(names)+1)
+	keep[index] = true
+	for _, name := range names {
+		keep[name] = true
+	}
+	for name := range p.records {
+		if !keep[name] {
+			delete(p.records, name)
+		}
+	}
+}
+
+// schedule records when the first answer expires, for Watch.
+func (p *dnsProvider) schedule() {
+	var next time.Time
+	for _, rec := range p.records {
+		if next.IsZero() || rec.expires.Before(next) {
+			next = rec.expires
+		}
+	}
+	atomic.StoreInt64(&p.next, next.UnixNano())
+}
+
+// Watch implements Watcher, reloading the links once the first answer
+// expires, so that changes show after their TTL rather than the refresh
+// interval.
+func (p *dnsProvider) Watch(ctx context.Context, changed func()) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			next := atomic.LoadInt64(&p.next)
+			if next != 0 && now.UnixNano() >= next && atomic.CompareAndSwapInt64(&p.next, next, 0) {
+				changed()
+			}
+		}
+	}
+}
+
+// lookupTXT asks the server for the TXT records of name, returning them with
+// how long they may be cached. A name that doesn't exist has none.
+func (p *dnsProvider) lookupTXT(ctx context.Context, name string) ([]string, time.Duration, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dnsTimeout)
+		defer cancel()
+	}
+	q, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	var idb [2]byte
+	rand.Read(idb[:])
+	id := binary.BigEndian.Uint16(idb[:])
+	msg, err := txtQuestion(id, q)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := p.exchange(ctx, "udp", msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	var parser dnsmessage.Parser
+	h, err := parser.Start(resp)
+	if err == nil && h.Truncated {
+		if resp, err = p.exchange(ctx, "tcp", msg); err != nil {
+			return nil, 0, err
+		}
+		h, err = parser.Start(resp)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid DNS answer: %w", err)
+	}
+	if h.ID != id || !h.Response {
+		return nil, 0, errors.New("DNS answer does not match the question")
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return nil, 0, fmt.Errorf("DNS server answered %v", h.RCode)
+	}
+	return parseTXTAnswer(&parser)
+}
+
+// txtQuestion returns a message asking for the TXT records of name,
+// accepting answers of up to 4096 bytes over UDP.
+func txtQuestion(id uint16, name dnsmessage.Name) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseTXTAnswer returns the TXT records of the answer parser is at, past
+// its header, and their lowest TTL; for answers without any, the TTL of the
+// SOA record sent along, or dnsNegativeTTL.
+func parseTXTAnswer(parser *dnsmessage.Parser) ([]string, time.Duration, error) {
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+	var txt []string
+	var ttl uint32
+	for {
+		h, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if h.Type != dnsmessage.TypeTXT || h.Class != dnsmessage.ClassINET {
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		r, err := parser.TXTResource()
+		if err != nil {
+			return nil, 0, err
+		}
+		// Long values are split into strings of up to 255 bytes.
+		txt = append(txt, strings.Join(r.TXT, ""))
+		if len(txt) == 1 || h.TTL < ttl {
+			ttl = h.TTL
+		}
+	}
+	if len(txt) > 0 {
+		sort.Strings(txt)
+		return txt, time.Duration(ttl) * time.Second, nil
+	}
+
+	for {
+		h, err := parser.AuthorityHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			return nil, dnsNegativeTTL, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if h.Type != dnsmessage.TypeSOA {
+			if err := parser.SkipAuthority(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		soa, err := parser.SOAResource()
+		if err != nil {
+			return nil, 0, err
+		}
+		if soa.MinTTL < h.TTL {
+			h.TTL = soa.MinTTL
+		}
+		return nil, time.Duration(h.TTL) * time.Second, nil
+	}
+}
+
+// exchange sends msg to the server over network, udp or tcp, and returns its
+// answer.
+func (p *dnsProvider) exchange(ctx context.Context, network string, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, p.server)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach DNS server: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	// Over TCP messages are prefixed with their length.
+	out := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(out, uint16(len(msg)))
+	copy(out[2:], msg)
+	if _, err := conn.Write(out); err != nil {
+		return nil, err
+	}
+	var n [2]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS answers TXT questions over UDP from records, by name without the
+// trailing dot, counting the questions.
+type fakeDNS struct {
+	conn net.PacketConn
+
+	mu        sync.Mutex
+	records   map[string][]string
+	questions int
+}
+
+func newFakeDNS(t *testing.T, records map[string][]string) *fakeDNS {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDNS{conn: conn, records: records}
+	t.Cleanup(func() { conn.Close() })
+	go d.serve()
+	return d
+}
+
+func (d *fakeDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err != nil {
+			continue
+		}
+		q, err := p.Question()
+		if err != nil {
+			continue
+		}
+		name := strings.TrimSuffix(q.Name.String(), ".")
+
+		d.mu.Lock()
+		d.questions++
+		txt, ok := d.records[name]
+		d.mu.Unlock()
+
+		rh := dnsmessage.Header{ID: h.ID, Response: true}
+		if !ok {
+			rh.RCode = dnsmessage.RCodeNameError
+		}
+		b := dnsmessage.NewBuilder(nil, rh)
+		b.StartQuestions()
+		b.Question(q)
+		b.StartAnswers()
+		for _, v := range txt {
+			b.TXTResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.TXTResource{TXT: []string{v}})
+		}
+		if msg, err := b.Finish(); err == nil {
+			d.conn.WriteTo(msg, addr)
+		}
+	}
+}
+
+func (d *fakeDNS) set(name string, txt ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.records[name] = txt
+}
+
+func (d *fakeDNS) asked() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.questions
+}
+
+func TestDNSProvider(t *testing.T) {
+	d := newFakeDNS(t, map[string][]string{
+		"_links.links.example.com":    {"go team/wiki", "bad.name missing"},
+		"go.links.example.com":        {"https://go.dev/"},
+		"wiki.team.links.example.com": {"https://wiki.example.com/team"},
+	})
+	p, err := newProvider("dns", func(k string) string {
+		return map[string]string{"DNS_ZONE": "links.example.com.", "DNS_SERVER": d.conn.LocalAddr().String()}[k]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	m, err := p.Query(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m["go"].URL.String() != "https://go.dev/" || m["team/wiki"].URL.String() != "https://wiki.example.com/team" {
+		t.Errorf("Query = %v, want go and team/wiki", m)
+	}
+	// The index and three of its shortcuts.
+	if n := d.asked(); n != 4 {
+		t.Errorf("asked %d questions, want 4", n)
+	}
+
+	// Answers are cached for their TTL.
+	if _, err := p.Query(ctx); !errors.Is(err, ErrNotModified) {
+		t.Errorf("second query: err = %v, want ErrNotModified", err)
+	}
+	if n := d.asked(); n != 4 {
+		t.Errorf("asked %d questions after the second query, want 4", n)
+	}
+
+	d.set("go.links.example.com", "https://go.dev/doc/")
+	dp := p.(*dnsProvider)
+	rec := dp.records["go.links.example.com"]
+	rec.expires = time.Now()
+	dp.records["go.links.example.com"] = rec
+	m, err = p.Query(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m["go"].URL.String(); got != "https://go.dev/doc/" {
+		t.Errorf("go after its TTL = %s, want the new destination", got)
+	}
+	if n := d.asked(); n != 5 {
+		t.Errorf("asked %d questions after the TTL, want 5", n)
+	}
+}
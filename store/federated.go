@@ -0,0 +1,236 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+func init() {
+	registerProvider("federated", func(getenv func(string) string) (Provider, error) {
+		return newFederation(getenv("PROVIDERS"), getenv)
+	})
+}
+
+// sourceNamePattern matches the names given to the sources of a federation,
+// which prefix their settings.
+var sourceNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// federatedSource is one of the providers of a federation.
+type federatedSource struct {
+	name     string
+	provider Provider
+	// last is the map of the last successful query, used while the source
+	// is unchanged or failing.
+	last URLMap
+}
+
+// federatedProvider queries several providers concurrently and merges their
+// maps. Sources come in order of precedence: a shortcut is taken from the
+// first source that has it, so a team sheet listed first can override the
+// company-wide one.
+type federatedProvider struct {
+	mu      sync.Mutex
+	sources []*federatedSource
+}
+
+// newFederation parses a comma-separated list of sources such as
+// "team:sheets,global:csv". Each source is a backend, optionally named:
+// named sources read their settings with the upper-cased name as a prefix,
+// such as TEAM_GOOGLE_SHEET_ID, falling back to the unprefixed ones.
+func newFederation(spec string, getenv func(string) string) (Provider, error) {
+	f := &federatedProvider{}
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, backend := "", entry
+		if i := strings.IndexByte(entry, ':'); i >= 0 {
+			name, backend = strings.ToLower(strings.TrimSpace(entry[:i])), strings.TrimSpace(entry[i+1:])
+			if !sourceNamePattern.MatchString(name) {
+				return nil, fmt.Errorf("invalid source name %q in PROVIDERS", name)
+			}
+		}
+		if backend == "federated" {
+			return nil, errors.New("federations can't be nested")
+		}
+		key := name
+		if key == "" {
+			key = backend
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("source %q is listed twice in PROVIDERS, name them apart like team:%s", key, backend)
+		}
+		seen[key] = true
+
+		lookup := getenv
+		if name != "" {
+			prefix := strings.ToUpper(name) + "_"
+			lookup = func(key string) string {
+				if v := getenv(prefix + key); v != "" {
+					return v
+				}
+				return getenv(key)
+			}
+		}
+		p, err := newProvider(backend, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("source %s: %w", sourceLabel(name, backend), err)
+		}
+		f.sources = append(f.sources, &federatedSource{name: sourceLabel(name, backend), provider: p})
+	}
+	if len(f.sources) == 0 {
+		return nil, errors.New("PROVIDERS lists no sources")
+	}
+
+	for _, s := range f.sources {
+		if w, ok := s.provider.(writeEditor); ok {
+			log.Printf("New links are stored in %s", s.name)
+			return &writableFederation{federatedProvider: f, writer: w}, nil
+		}
+	}
+	return f, nil
+}
+
+// sourceLabel names a source in logs and errors.
+func sourceLabel(name, backend string) string {
+	if name == "" {
+		return backend
+	}
+	return name + " (" + backend + ")"
+}
+
+// Query fetches the maps of all sources at once and merges them. A source
+// that fails keeps its last map; the query only fails while a source has
+// never loaded. It returns ErrNotModified when no source changed.
+func (f *federatedProvider) Query(ctx context.Context) (URLMap, error) {
+	maps := make([]URLMap, len(f.sources))
+	errs := make([]error, len(f.sources))
+	var wg sync.WaitGroup
+	for i, s := range f.sources {
+		wg.Add(1)
+		go func(i int, s *federatedSource) {
+			defer wg.Done()
+			maps[i], errs[i] = s.provider.Query(ctx)
+		}(i, s)
+	}
+	wg.Wait()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changed := false
+	for i, s := range f.sources {
+		switch err := errs[i]; {
+		case err == nil:
+			s.last, changed = maps[i], true
+		case errors.Is(err, ErrNotModified) && s.last != nil:
+		case s.last == nil:
+			return nil, fmt.Errorf("source %s: %w", s.name, err)
+		default:
+			log.Printf("warn: source %s failed, using its last links: %v", s.name, err)
+		}
+	}
+	if !changed {
+		return nil, ErrNotModified
+	}
+
+	out := make(URLMap)
+	for _, s := range f.sources {
+		for k, l := range s.last {
+			if _, ok := out[k]; !ok {
+				out[k] = l
+			}
+		}
+	}
+	return out, nil
+}
+
+// ReservedShortcuts implements ReservedSource with the reserved shortcuts of
+// all sources.
+func (f *federatedProvider) ReservedShortcuts() []string {
+	var out []string
+	for _, s := range f.sources {
+		if rs, ok := s.provider.(ReservedSource); ok {
+			out = append(out, rs.ReservedShortcuts()...)
+		}
+	}
+	return out
+}
+
+// Watch implements Watcher for the sources that do.
+func (f *federatedProvider) Watch(ctx context.Context, changed func()) {
+	for _, s := range f.sources {
+		if w, ok := s.provider.(Watcher); ok {
+			go w.Watch(ctx, changed)
+		}
+	}
+}
+
+// source returns the source shortcut was last loaded from, or nil.
+func (f *federatedProvider) source(shortcut string) *federatedSource {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.sources {
+		if _, ok := s.last[shortcut]; ok {
+			return s
+		}
+	}
+	return nil
+}
+
+// writableFederation is a federation with a source that can store links:
+// new links go to the first such source, and changes to the source the
+// shortcut comes from.
+type writableFederation struct {
+	*federatedProvider
+	writer writeEditor
+}
+
+type writeEditor interface {
+	Writer
+	Editor
+}
+
+// Add stores a new link unless a source has the shortcut already, where
+// the writer wouldn't notice it.
+func (f *writableFederation) Add(ctx context.Context, shortcut string, link *Link) error {
+	if f.source(shortcut) != nil {
+		return ErrLinkExists
+	}
+	return f.writer.Add(ctx, shortcut, link)
+}
+
+func (f *writableFederation) Update(ctx context.Context, shortcut string, link *Link) error {
+	e, err := f.editor(shortcut)
+	if err != nil {
+		return err
+	}
+	return e.Update(ctx, shortcut, link)
+}
+
+func (f *writableFederation) Delete(ctx context.Context, shortcut string) error {
+	e, err := f.editor(shortcut)
+	if err != nil {
+		return err
+	}
+	return e.Delete(ctx, shortcut)
+}
+
+// editor returns the editor of the source of shortcut. Shortcuts not loaded
+// yet can only have been added to the writer.
+func (f *writableFederation) editor(shortcut string) (Editor, error) {
+	s := f.source(shortcut)
+	if s == nil {
+		return f.writer, nil
+	}
+	e, ok := s.provider.(Editor)
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrReadOnly, s.name)
+	}
+	return e, nil
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func init() {
+	// fake serves the links of FAKE_LINKS, "shortcut=url;...", and is
+	// read-only when FAKE_READONLY is set.
+	registerProvider("fake", func(getenv func(string) string) (Provider, error) {
+		p := &fakeProvider{links: make(URLMap)}
+		for _, entry := range strings.Split(getenv("FAKE_LINKS"), ";") {
+			if i := strings.IndexByte(entry, '='); i > 0 {
+				u, _ := url.Parse(entry[i+1:])
+				p.links[entry[:i]] = &Link{URL: u}
+			}
+		}
+		fakeProviders = append(fakeProviders, p)
+		if getenv("FAKE_READONLY") != "" {
+			return struct{ Provider }{p}, nil
+		}
+		return p, nil
+	})
+}
+
+// fakeProviders are the fakes created, in order.
+var fakeProviders []*fakeProvider
+
+type fakeProvider struct {
+	links URLMap
+	err   error
+}
+
+func (p *fakeProvider) Query(ctx context.Context) (URLMap, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	out := make(URLMap, len(p.links))
+	for k, v := range p.links {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (p *fakeProvider) Add(ctx context.Context, shortcut string, link *Link) error {
+	p.links[shortcut] = link
+	return nil
+}
+
+func (p *fakeProvider) Update(ctx context.Context, shortcut string, link *Link) error {
+	p.links[shortcut] = link
+	return nil
+}
+
+func (p *fakeProvider) Delete(ctx context.Context, shortcut string) error {
+	delete(p.links, shortcut)
+	return nil
+}
+
+func TestFederation(t *testing.T) {
+	fakeProviders = nil
+	vars := map[string]string{
+		"PROVIDERS":            "team:fake, global:fake",
+		"TEAM_FAKE_LINKS":      "docs=https://team.example.com/docs",
+		"GLOBAL_FAKE_LINKS":    "docs=https://example.com/docs;wiki=https://example.com/wiki",
+		"GLOBAL_FAKE_READONLY": "true",
+	}
+	p, err := newProvider("federated", func(key string) string { return vars[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	team, global := fakeProviders[0], fakeProviders[1]
+	ctx := context.Background()
+
+	m, err := p.Query(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The team sheet comes first and overrides the global one.
+	if got := m["docs"].URL.String(); got != "https://team.example.com/docs" {
+		t.Errorf("docs = %s, want the team link", got)
+	}
+	if got := m["wiki"].URL.String(); got != "https://example.com/wiki" {
+		t.Errorf("wiki = %s, want the global link", got)
+	}
+
+	editor := p.(Editor)
+	if err := editor.Update(ctx, "wiki", m["docs"]); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("updating a global link: err = %v, want ErrReadOnly", err)
+	}
+	if err := p.(Writer).Add(ctx, "wiki", m["docs"]); !errors.Is(err, ErrLinkExists) {
+		t.Errorf("adding a global shortcut: err = %v, want ErrLinkExists", err)
+	}
+	if err := p.(Writer).Add(ctx, "new", m["docs"]); err != nil || team.links["new"] == nil {
+		t.Errorf("adding a new shortcut: err = %v, want it stored in the team source", err)
+	}
+
+	// A failing source keeps its last links.
+	global.err = errors.New("quota exceeded")
+	if m, err = p.Query(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if m["wiki"] == nil || m["new"] == nil {
+		t.Errorf("after a failure got %v, want wiki and new", m)
+	}
+
+	if _, err := newProvider("federated", func(key string) string {
+		return map[string]string{"PROVIDERS": "fake,fake"}[key]
+	}); err == nil {
+		t.Error("sources listed twice: got no error")
+	}
+}
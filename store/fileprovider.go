@@ -0,0 +1,267 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileWatchInterval is how often Watch checks the file for changes, unless
+// LINKS_WATCH_INTERVAL says otherwise.
+const fileWatchInterval = time.Second
+
+func init() {
+	registerProvider("file", func(getenv func(string) string) (Provider, error) {
+		path := getenv("LINKS_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("LINKS_FILE not set")
+		}
+		if !isLinksFile(path) {
+			return nil, fmt.Errorf("LINKS_FILE %q must end in .yaml, .yml, .json or .csv", path)
+		}
+		interval, err := watchInterval(getenv)
+		if err != nil {
+			return nil, err
+		}
+		return &fileProvider{path: path, interval: interval}, nil
+	})
+}
+
+// watchInterval returns how often the links files are checked for changes.
+// They are polled rather than watched with inotify and the like, which
+// would need a dependency and misses changes on network and FUSE mounts.
+func watchInterval(getenv func(string) string) (time.Duration, error) {
+	v := getenv("LINKS_WATCH_INTERVAL")
+	if v == "" {
+		return fileWatchInterval, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid LINKS_WATCH_INTERVAL %q, expected a duration such as \"1s\"", v)
+	}
+	return d, nil
+}
+
+// fileColumns names the keys of links in YAML and JSON files, by the sheet
+// column they stand for.
+var fileColumns = map[string]int{
+	"url": 1, "expires": 2, "status": 3, "private": 4, "preview": 5, "params": 6,
+	"owner": 7, "password": 8, "condition": 9, "cache": 10, "type": 11,
+	"description": 12, "tags": 13, "active_from": 15, "canary": 16,
+	"max_clicks": 17, "disabled": 18, "unapproved": 19,
+}
+
+// fileProvider reads links from a local YAML, JSON or CSV file. It is
+// read-only and needs no network access. CSV files have the columns of the
+// sheet; YAML and JSON files map shortcuts to a URL or to the settings of the
+// link:
+//
+//	go: https://go.dev/
+//	docs:
+//	  url: https://example.com/docs
+//	  tags: [onboarding]
+//	  variants:
+//	    - condition: country=DE
+//	      url: https://example.com/de/docs
+type fileProvider struct {
+	path string
+	// interval is how often Watch checks the file, fileWatchInterval if 0.
+	interval time.Duration
+	// checksum of the contents read by the previous query.
+	checksum [sha256.Size]byte
+}
+
+func (p *fileProvider) Query(ctx context.Context) (URLMap, error) {
+	b, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read links file: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	if sum == p.checksum {
+		return nil, ErrNotModified
+	}
+
+	rows, err := parseLinksFile(ctx, p.path, b)
+	if err != nil {
+		return nil, err
+	}
+	p.checksum = sum
+	log.Printf("read %d rows from %s", len(rows), p.path)
+	return urlMap(ctx, rows), nil
+}
+
+// Watch implements Watcher, checking the modification time and size of the
+// file every interval. Editors that replace the file are noticed as well.
+func (p *fileProvider) Watch(ctx context.Context, changed func()) {
+	pollChanges(ctx, p.path, p.interval, func() string {
+		fi, err := os.Stat(p.path)
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprint(fi.ModTime().UnixNano(), fi.Size())
+	}, changed)
+}
+
+// pollChanges calls changed whenever the signature of what changes, checked
+// every interval, until ctx is done.
+func pollChanges(ctx context.Context, what string, interval time.Duration, signature func() string, changed func()) {
+	if interval <= 0 {
+		interval = fileWatchInterval
+	}
+	last := signature()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if sig := signature(); sig != last {
+			last = sig
+			log.Printf("%s changed, reloading links", what)
+			changed()
+		}
+	}
+}
+
+// isLinksFile reports whether path has the extension of a supported links
+// file.
+func isLinksFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json", ".csv":
+		return true
+	}
+	return false
+}
+
+// parseLinksFile parses the contents of a YAML, JSON or CSV links file into
+// rows for urlMap, by the extension of path.
+func parseLinksFile(ctx context.Context, path string, b []byte) ([][]interface{}, error) {
+	var rows [][]interface{}
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		rows, err = csvRows(b)
+	case ".json":
+		var doc map[string]interface{}
+		if err = json.Unmarshal(b, &doc); err == nil {
+			rows = documentRows(ctx, doc)
+		}
+	default:
+		var doc map[string]interface{}
+		if err = yaml.Unmarshal(b, &doc); err == nil {
+			rows = documentRows(ctx, doc)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid links file %s: %w", path, err)
+	}
+	return rows, nil
+}
+
+// csvRows parses CSV records into rows for urlMap.
+func csvRows(b []byte) ([][]interface{}, error) {
+	cr := csv.NewReader(bytes.NewReader(b))
+	cr.FieldsPerRecord = -1
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	rows := make([][]interface{}, len(records))
+	for i, rec := range records {
+		row := make([]interface{}, len(rec))
+		for j, v := range rec {
+			row[j] = v
+		}
+		rows[i] = row
+	}
+	return rows, nil
+}
+
+// documentRows converts the links of a YAML or JSON document into rows for
+// urlMap, in shortcut order.
+func documentRows(ctx context.Context, doc map[string]interface{}) [][]interface{} {
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var rows [][]interface{}
+	for _, k := range keys {
+		switch v := doc[k].(type) {
+		case string:
+			rows = append(rows, []interface{}{k, v})
+		case map[string]interface{}:
+			rows = append(rows, documentRow(ctx, k, v))
+			variants, _ := v["variants"].([]interface{})
+			for _, variant := range variants {
+				if fields, ok := variant.(map[string]interface{}); ok {
+					rows = append(rows, documentRow(ctx, k, fields))
+				} else {
+					Warnf(ctx, "%s has an invalid variant, ignoring it", k)
+				}
+			}
+		default:
+			Warnf(ctx, "%s must be a URL or the settings of a link, ignoring it", k)
+		}
+	}
+	return rows
+}
+
+// documentRow lays out the settings of the link of shortcut like a sheet
+// row.
+func documentRow(ctx context.Context, shortcut string, fields map[string]interface{}) []interface{} {
+	row := make([]interface{}, 16)
+	row[0] = shortcut
+	for name, v := range fields {
+		col, ok := fileColumns[name]
+		if !ok {
+			if name != "variants" {
+				Warnf(ctx, "%s has unknown setting %q", shortcut, name)
+			}
+			continue
+		}
+		row[col] = documentCell(v)
+	}
+	return row
+}
+
+// documentCell formats a YAML or JSON value as a sheet cell: lists are
+// comma-separated and maps, such as params, become query strings.
+func documentCell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		return FormatExpiry(v)
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, p := range v {
+			parts[i] = documentCell(p)
+		}
+		return strings.Join(parts, ",")
+	case map[string]interface{}:
+		q := url.Values{}
+		for k, p := range v {
+			q.Set(k, documentCell(p))
+		}
+		return q.Encode()
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,184 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileProvider(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"links.json": `{
+			"go": "https://go.dev/",
+			"docs": {
+				"url": "https://example.com/docs",
+				"status": 301,
+				"private": true,
+				"params": {"utm_source": "go"},
+				"tags": ["Onboarding", "docs"],
+				"active_from": "2020-01-01T09:00:00Z",
+				"variants": [{"condition": "country=DE", "url": "https://example.com/de/docs"}]
+			},
+			"bad": 42
+		}`,
+		"links.csv": "go,https://go.dev/\ndocs,https://example.com/docs,,301,private,,utm_source=go,,,country=XX\ndocs,https://example.com/docs,,301,private,,utm_source=go\n",
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			p, err := newProvider("file", func(key string) string {
+				return map[string]string{"LINKS_FILE": path}[key]
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := p.Query(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l := m["go"]; l == nil || l.URL.String() != "https://go.dev/" {
+				t.Errorf("go = %+v", l)
+			}
+			docs := m["docs"]
+			if docs == nil {
+				t.Fatal("docs not loaded")
+			}
+			if docs.Status != 301 || !docs.Private || docs.Params.Get("utm_source") != "go" || len(docs.Variants) != 1 {
+				t.Errorf("docs = %+v, want status 301, private, params and a variant", docs)
+			}
+			if m["bad"] != nil {
+				t.Error("bad was loaded")
+			}
+			if _, err := p.Query(context.Background()); !errors.Is(err, ErrNotModified) {
+				t.Errorf("second query: err = %v, want ErrNotModified", err)
+			}
+		})
+	}
+
+	// Settings only YAML and JSON files have.
+	p := &fileProvider{path: filepath.Join(dir, "links.json")}
+	m, err := p.Query(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := m["docs"]
+	if want := []string{"onboarding", "docs"}; !reflect.DeepEqual(docs.Tags, want) {
+		t.Errorf("tags = %q, want %q", docs.Tags, want)
+	}
+	if want := time.Date(2020, 1, 1, 9, 0, 0, 0, time.UTC); !docs.ActiveFrom.Equal(want) {
+		t.Errorf("active_from = %v, want %v", docs.ActiveFrom, want)
+	}
+
+	if _, err := newProvider("file", func(string) string { return "links.txt" }); err == nil {
+		t.Error("unsupported extension: got no error")
+	}
+}
+
+func TestDirProvider(t *testing.T) {
+	// Lay the directory out like a mounted ConfigMap: each key links to
+	// "..data/key" and updates swap the "..data" link.
+	dir := t.TempDir()
+	writeVersion := func(version string, files map[string]string) {
+		t.Helper()
+		if err := os.Mkdir(filepath.Join(dir, version), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, version, name), []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			os.Symlink(filepath.Join(configMapDataLink, name), filepath.Join(dir, name))
+		}
+		tmp := filepath.Join(dir, "..data_tmp")
+		if err := os.Symlink(version, tmp); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, configMapDataLink)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeVersion("..v1", map[string]string{
+		"team.json": `{"go": "https://go.dev/"}`,
+		"more.csv":  "docs,https://example.com/docs\n",
+	})
+
+	p, err := newProvider("dir", func(key string) string {
+		return map[string]string{"LINKS_DIR": dir}[key]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	m, err := p.Query(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m["go"] == nil || m["docs"] == nil {
+		t.Errorf("links = %v, want go and docs", m)
+	}
+	if _, err := p.Query(ctx); !errors.Is(err, ErrNotModified) {
+		t.Errorf("second query: err = %v, want ErrNotModified", err)
+	}
+
+	writeVersion("..v2", map[string]string{
+		"team.json": `{"go": "https://golang.org/"}`,
+		"more.csv":  "docs,https://example.com/docs\n",
+	})
+	if m, err = p.Query(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := m["go"].URL.String(); got != "https://golang.org/" {
+		t.Errorf("after the update go = %s", got)
+	}
+}
+
+func TestFileProviderWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.yaml")
+	if err := os.WriteFile(path, []byte("go: https://go.dev/\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := newProvider("file", func(key string) string {
+		return map[string]string{"LINKS_FILE": path, "LINKS_WATCH_INTERVAL": "10ms"}[key]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	go p.(Watcher).Watch(ctx, func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	// Replace the file by renaming another over it, as editors do.
+	time.Sleep(50 * time.Millisecond)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte("go: https://golang.org/\ndocs: https://example.com/\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Error("the replaced file wasn't noticed within a second")
+	}
+
+	if _, err := newProvider("file", func(key string) string {
+		return map[string]string{"LINKS_FILE": path, "LINKS_WATCH_INTERVAL": "0"}[key]
+	}); err == nil {
+		t.Error("LINKS_WATCH_INTERVAL=0: got no error")
+	}
+}
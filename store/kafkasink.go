@@ -0,0 +1,95 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerSink("kafka", func(getenv func(string) string) (AnalyticsSink, error) {
+		s := &kafkaSink{
+			topic:  getenv("KAFKA_TOPIC"),
+			client: &http.Client{Timeout: 30 * time.Second},
+		}
+		raw := getenv("KAFKA_REST_URL")
+		if raw == "" {
+			return nil, fmt.Errorf("KAFKA_REST_URL not set")
+		}
+		if s.topic == "" {
+			return nil, fmt.Errorf("KAFKA_TOPIC not set")
+		}
+		u, err := url.Parse(strings.TrimSuffix(raw, "/"))
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid KAFKA_REST_URL %q", raw)
+		}
+		s.url = u.String() + "/topics/" + url.PathEscape(s.topic)
+		return s, nil
+	})
+}
+
+// kafkaSink produces clicks to a Kafka topic through a REST proxy speaking
+// the Confluent REST Proxy v2 API, such as Confluent's or Redpanda's, keyed
+// by shortcut. Credentials go in the userinfo of KAFKA_REST_URL.
+type kafkaSink struct {
+	url, topic string
+	client     *http.Client
+}
+
+func (s *kafkaSink) Name() string { return "kafka" }
+
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value Click  `json:"value"`
+}
+
+func (s *kafkaSink) ExportClicks(ctx context.Context, clicks []Click) error {
+	in := struct {
+		Records []kafkaRecord `json:"records"`
+	}{make([]kafkaRecord, len(clicks))}
+	for i, c := range clicks {
+		in.Records[i] = kafkaRecord{Key: c.Shortcut, Value: c}
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to produce clicks to Kafka: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("failed to produce clicks to Kafka: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	// The proxy answers 200 even when some records failed.
+	var out struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return fmt.Errorf("failed to read Kafka proxy response: %w", err)
+	}
+	for _, o := range out.Offsets {
+		if o.ErrorCode != nil && *o.ErrorCode != 0 {
+			return fmt.Errorf("failed to produce clicks to Kafka: %s (error code %d)", o.Error, *o.ErrorCode)
+		}
+	}
+	return nil
+}
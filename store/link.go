@@ -0,0 +1,610 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Link is the destination of a shortcut and its metadata.
+type Link struct {
+	URL *url.URL
+	// ActiveFrom is when the link starts resolving; zero means right away.
+	// Together with Expires it makes an activation window.
+	ActiveFrom time.Time
+	// Expires is when the link stops resolving; zero means never.
+	Expires time.Time
+	// Status is the redirect status code; zero means defaultRedirectStatus.
+	Status int
+	// Private links only resolve for authenticated requests.
+	Private bool
+	// Preview shows an interstitial page instead of redirecting.
+	Preview bool
+	// Params are added to the query of every redirect, e.g. UTM tags.
+	Params url.Values
+	// Owner is the principal that created the link, empty for links
+	// created without authentication or before owners were recorded.
+	Owner string
+	// Password, if set, must be entered before the link redirects.
+	Password string
+	// CacheControl overrides the Cache-Control of redirects, see
+	// ParseCacheControl. Empty uses the server default.
+	CacheControl string
+	// Type is empty for redirects. Other types are shown in place: Content
+	// holds the text and URL is empty.
+	Type    string
+	Content string
+	// Description says what the link is for, to help find it, see
+	// MaxDescriptionLength.
+	Description string
+	// Tags group related links, such as by team or topic, see ParseTags.
+	Tags []string
+	// Deleted is when the link was moved to the trash, zero for live links.
+	// Deleted links don't resolve but can be restored until they are
+	// purged.
+	Deleted time.Time
+	// Variants are tried in order before the link itself; the first whose
+	// When matches the visitor is followed instead, see For.
+	Variants []*Link
+	When     *Condition
+	// Canary, if set, sends some visitors to a new destination first.
+	Canary *Canary
+	// MaxClicks is the click budget of the link: once it was followed that
+	// many times it answers 410 Gone. Zero means no limit.
+	MaxClicks int64
+	// Disabled links answer 410 Gone until they are enabled again, such as
+	// while they are being abused.
+	Disabled bool
+	// Unapproved links were created or redirected elsewhere while link
+	// approval is on and resolve like unknown ones until an admin approves
+	// them.
+	Unapproved bool
+}
+
+// MaxDescriptionLength bounds the descriptions accepted by the API, in
+// characters.
+const MaxDescriptionLength = 1000
+
+// Limits on the tags of a link accepted by the API.
+const (
+	MaxTags      = 20
+	MaxTagLength = 50
+)
+
+// Link types that show Content instead of redirecting.
+const (
+	TypeText     = "text"
+	TypeMarkdown = "markdown"
+	TypeSnippet  = "snippet"
+)
+
+// MaxContentLength bounds the content of text links, a bit below the
+// 50000 characters a sheet cell holds.
+const MaxContentLength = 40000
+
+// ParseLinkType parses a type cell. Empty, "url" and "redirect" are
+// redirects, returned as "".
+func ParseLinkType(s string) (string, error) {
+	switch t := strings.ToLower(strings.TrimSpace(s)); t {
+	case "", "url", "redirect":
+		return "", nil
+	case TypeText, TypeSnippet:
+		return t, nil
+	case TypeMarkdown, "md":
+		return TypeMarkdown, nil
+	default:
+		return "", fmt.Errorf("unknown link type %q, expected url, text, markdown or snippet", s)
+	}
+}
+
+// NewLink returns a link of type typ (see ParseLinkType) leading to the URL
+// v, or showing the content v.
+func NewLink(typ, v string) (*Link, error) {
+	if typ != "" {
+		if len(v) > MaxContentLength {
+			return nil, fmt.Errorf("content is longer than %d bytes", MaxContentLength)
+		}
+		return &Link{URL: &url.URL{}, Type: typ, Content: v}, nil
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, err
+	}
+	return &Link{URL: u}, nil
+}
+
+// Target is the destination URL of l, or its content for text links, as
+// stored in the url column.
+func (l *Link) Target() string {
+	if l.Type != "" {
+		return l.Content
+	}
+	return l.URL.String()
+}
+
+// AliasScheme is the scheme of destinations naming another shortcut, such
+// as go:new, so that a renamed shortcut keeps working under its old name.
+const AliasScheme = "go"
+
+// Alias returns the shortcut l leads to when its destination names one,
+// such as "new" for go:new, or "".
+func (l *Link) Alias() string {
+	if l == nil || l.Type != "" || l.URL == nil || !strings.EqualFold(l.URL.Scheme, AliasScheme) {
+		return ""
+	}
+	s := l.URL.Path
+	if l.URL.Opaque != "" {
+		s = l.URL.Opaque
+		if u, err := url.PathUnescape(s); err == nil {
+			s = u
+		}
+	}
+	return strings.Trim(s, "/")
+}
+
+// defaultRedirectStatus is temporary so that browsers don't cache redirects
+// whose destination may still change.
+const defaultRedirectStatus = http.StatusFound
+
+// ValidRedirectStatus reports whether code may be configured on a link.
+func ValidRedirectStatus(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// RedirectStatus returns the status code to redirect with.
+func (l *Link) RedirectStatus() int {
+	if l.Status == 0 {
+		return defaultRedirectStatus
+	}
+	return l.Status
+}
+
+// Expired reports whether the link is past its expiry at now.
+func (l *Link) Expired(now time.Time) bool {
+	return !l.Expires.IsZero() && !now.Before(l.Expires)
+}
+
+// ErrLinkExpired is returned when resolving a shortcut whose link is past its
+// expiry.
+var ErrLinkExpired = errors.New("link expired")
+
+// Pending reports whether the link is not active yet at now.
+func (l *Link) Pending(now time.Time) bool {
+	return !l.ActiveFrom.IsZero() && now.Before(l.ActiveFrom)
+}
+
+// ErrLinkPending is returned when resolving a shortcut whose link is not
+// active yet.
+var ErrLinkPending = errors.New("link not active yet")
+
+// ErrLinkDisabled is returned when resolving a shortcut whose link is
+// disabled. It is an ErrLinkExpired, so disabled links are gone the same way.
+var ErrLinkDisabled = fmt.Errorf("%w: disabled", ErrLinkExpired)
+
+// ErrLinkUnapproved is returned when resolving a shortcut whose link awaits
+// approval. It is an ErrLinkPending, so such links are unknown until then.
+var ErrLinkUnapproved = fmt.Errorf("%w: awaiting approval", ErrLinkPending)
+
+// ShortcutPattern matches the shortcuts accepted by the API: lower case or
+// uncased letters in any script, digits and '.', '-' and '_', in
+// '/'-separated segments.
+var ShortcutPattern = regexp.MustCompile(`^[\p{Ll}\p{Lm}\p{Lo}\p{Nd}][\p{Ll}\p{Lm}\p{Lo}\p{M}\p{Nd}._-]*(/[\p{Ll}\p{Lm}\p{Lo}\p{M}\p{Nd}._-]+)*$`)
+
+// RegexPrefix marks shortcuts that are regular expressions, such as
+// "re:jira/([a-z]+-[0-9]+)".
+const RegexPrefix = "re:"
+
+// IsPatternKey reports whether a shortcut is a wildcard or regex pattern
+// rather than a literal. In wildcards, "*" matches one path segment or part
+// of one.
+func IsPatternKey(k string) bool {
+	return strings.HasPrefix(k, RegexPrefix) || strings.Contains(k, "*")
+}
+
+// URLMap maps lower-cased shortcuts to their links.
+type URLMap map[string]*Link
+
+// expiryLayouts are the formats accepted for expiry timestamps. Values
+// without a zone are taken as UTC.
+var expiryLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// ParseExpiry parses an expiry timestamp in one of expiryLayouts.
+func ParseExpiry(s string) (time.Time, error) {
+	for _, layout := range expiryLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized timestamp %q, use YYYY-MM-DD or RFC 3339", s)
+}
+
+// FormatStatus renders a link status for a sheet cell, "" for the default.
+func FormatStatus(code int) string {
+	if code == 0 {
+		return ""
+	}
+	return strconv.Itoa(code)
+}
+
+// ParseFlag reports whether a sheet cell sets a flag column such as
+// "private": the cell holds the flag's name or a yes-like value.
+func ParseFlag(s, name string) bool {
+	switch v := strings.ToLower(strings.TrimSpace(s)); v {
+	case name, "yes", "y", "true", "x", "1":
+		return true
+	}
+	return false
+}
+
+// ParseParams parses a params cell such as "utm_source=golink&utm_campaign=q3".
+func ParseParams(s string) (url.Values, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "?")
+	if s == "" {
+		return nil, nil
+	}
+	return url.ParseQuery(s)
+}
+
+// FormatParams renders params for a sheet cell.
+func FormatParams(params url.Values) string {
+	if len(params) == 0 {
+		return ""
+	}
+	return params.Encode()
+}
+
+// ParseTags parses a comma-separated tags cell such as "oncall, Infra" into
+// trimmed, lowercase tags without empty entries or duplicates.
+func ParseTags(s string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	return tags
+}
+
+// FormatTags renders tags for a sheet cell.
+func FormatTags(tags []string) string {
+	return strings.Join(tags, ",")
+}
+
+// HasTag reports whether the link is tagged tag, ignoring case.
+func (l *Link) HasTag(tag string) bool {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	for _, t := range l.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMaxClicks parses a max clicks cell; empty means no limit.
+func ParseMaxClicks(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a number of clicks", s)
+	}
+	return n, nil
+}
+
+// FormatMaxClicks renders a click budget for a sheet cell, "" for none.
+func FormatMaxClicks(n int64) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// FormatFlag renders a flag column for a sheet cell.
+func FormatFlag(set bool, name string) string {
+	if set {
+		return name
+	}
+	return ""
+}
+
+// FormatExpiry is the inverse of ParseExpiry, returning "" for no expiry.
+func FormatExpiry(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// maxWarnings bounds the number of warnings kept per refresh.
+const maxWarnings = 100
+
+// LinkWarnings collects the warnings about invalid link data raised during a
+// refresh, so they can be reported by /api/reload.
+type LinkWarnings struct {
+	sync.Mutex
+	list    []string
+	dropped int
+	// issues are the warnings as reported by GET /api/lint, see Issuef.
+	issues        []LinkIssue
+	droppedIssues int
+	// rows maps shortcuts to the row they were loaded from.
+	rows map[string]LinkIssue
+}
+
+type linkWarningsKey struct{}
+
+// WithLinkWarnings returns a context collecting the warnings raised by Warnf.
+func WithLinkWarnings(ctx context.Context) (context.Context, *LinkWarnings) {
+	w := &LinkWarnings{}
+	return context.WithValue(ctx, linkWarningsKey{}, w), w
+}
+
+// Warnf logs a warning about link data and records it in the collector of
+// ctx, if any.
+func Warnf(ctx context.Context, format string, args ...interface{}) {
+	Issuef(ctx, LinkIssue{}, format, args...)
+}
+
+// Warnings returns the collected warnings.
+func (w *LinkWarnings) Warnings() []string {
+	w.Lock()
+	defer w.Unlock()
+	out := append([]string{}, w.list...)
+	if w.dropped > 0 {
+		out = append(out, fmt.Sprintf("%d more warnings not shown", w.dropped))
+	}
+	return out
+}
+
+// urlMap builds a URLMap from rows of cells laid out like the sheet:
+// shortcut, destination URL, and optionally an expiry timestamp, a redirect
+// status code, a private flag, a preview flag, query parameters, the owner,
+// a password, a condition, a cache policy, a link type, a description,
+// comma-separated tags, when it was deleted, when it becomes active, a
+// canary, a click budget, a disabled flag and an unapproved flag. Rows with
+// a condition are variants of the row of the same shortcut without one.
+//
+// When the rows are numbered, a first row naming the shortcut and URL
+// columns is a header, and the columns are read by their names instead, in
+// any order, see columnNames.
+func urlMap(ctx context.Context, in [][]interface{}) URLMap {
+	out := make(URLMap)
+	variants := make(map[string][]*Link)
+	source, numbered := rowsOf(ctx)
+	var cols sheetColumns
+	for i, row := range in {
+		var at LinkIssue
+		if numbered {
+			at.Source, at.Row = source, i+1
+		}
+		warn := func(kind string, skipped bool, format string, args ...interface{}) {
+			issue := at
+			issue.Kind, issue.Skipped = kind, skipped
+			Issuef(ctx, issue, format, args...)
+		}
+		if numbered && i == 0 {
+			if c, unknown := parseHeader(row); c != nil {
+				for _, name := range unknown {
+					warn(IssueOther, false, "column %q is unknown or repeated, ignoring it", name)
+				}
+				cols = c
+				continue
+			}
+		}
+		row = cols.defaultRow(row)
+
+		var k, v string
+		if len(row) > 0 {
+			var ok bool
+			if k, ok = row[0].(string); !ok {
+				warn(IssueInvalidCell, true, "shortcut %v is not text, ignoring the row", row[0])
+				continue
+			}
+		}
+		if len(row) > 1 {
+			var ok bool
+			if v, ok = row[1].(string); !ok {
+				warn(IssueInvalidCell, true, "%s url %v is not text, ignoring the row", k, row[1])
+				continue
+			}
+		}
+		switch blankK, blankV := strings.TrimSpace(k) == "", strings.TrimSpace(v) == ""; {
+		case blankK && blankV:
+			continue
+		case numbered && i == 0 && strings.EqualFold(strings.TrimSpace(k), "shortcut"):
+			// The header row.
+			continue
+		case blankK:
+			warn(IssueEmptyCell, true, "shortcut is empty, ignoring the row for %s", v)
+			continue
+		case blankV:
+			warn(IssueEmptyCell, true, "%s url is empty, ignoring the row", k)
+			continue
+		}
+
+		// Regular expressions are case sensitive to write (\D vs \d) but
+		// match case-insensitively, see compilePattern.
+		if !IsPatternKey(k) {
+			k = Norm.Canonical(k)
+		}
+		at.Shortcut = k
+
+		var typ string
+		if len(row) > 11 {
+			cell, _ := row[11].(string)
+			var err error
+			if typ, err = ParseLinkType(cell); err != nil {
+				warn(IssueInvalidCell, true, "%s type is invalid, ignoring the row: %v", k, err)
+				continue
+			}
+		}
+		link, err := NewLink(typ, v)
+		if err != nil && typ != "" {
+			warn(IssueInvalidCell, true, "%s %s is invalid: %v", k, typ, err)
+			continue
+		} else if err != nil {
+			warn(IssueInvalidURL, true, "%s=%s url is invalid", k, v)
+			continue
+		}
+
+		if len(row) > 2 {
+			if exp, _ := row[2].(string); strings.TrimSpace(exp) != "" {
+				link.Expires, err = ParseExpiry(strings.TrimSpace(exp))
+				if err != nil {
+					warn(IssueInvalidCell, true, "%s expiry is invalid: %v", k, err)
+					continue
+				}
+			}
+		}
+
+		if len(row) > 3 {
+			if code, _ := row[3].(string); strings.TrimSpace(code) != "" {
+				link.Status, err = strconv.Atoi(strings.TrimSpace(code))
+				if err != nil || !ValidRedirectStatus(link.Status) {
+					warn(IssueInvalidCell, false, "%s status %q is not a redirect status, using %d", k, code, defaultRedirectStatus)
+					link.Status = 0
+				}
+			}
+		}
+
+		if len(row) > 4 {
+			private, _ := row[4].(string)
+			link.Private = ParseFlag(private, "private")
+		}
+		if len(row) > 5 {
+			preview, _ := row[5].(string)
+			link.Preview = ParseFlag(preview, "preview")
+		}
+		if len(row) > 6 {
+			params, _ := row[6].(string)
+			link.Params, err = ParseParams(params)
+			if err != nil {
+				warn(IssueInvalidCell, false, "%s params are invalid, ignoring them: %v", k, err)
+				link.Params = nil
+			}
+		}
+		if len(row) > 7 {
+			owner, _ := row[7].(string)
+			link.Owner = strings.TrimSpace(owner)
+		}
+		if len(row) > 8 {
+			password, _ := row[8].(string)
+			link.Password = strings.TrimSpace(password)
+		}
+		if len(row) > 10 {
+			cache, _ := row[10].(string)
+			if link.CacheControl, err = ParseCacheControl(cache); err != nil {
+				warn(IssueInvalidCell, false, "%s cache column is invalid, ignoring it: %v", k, err)
+			}
+		}
+		if len(row) > 12 {
+			desc, _ := row[12].(string)
+			link.Description = strings.TrimSpace(desc)
+		}
+		if len(row) > 13 {
+			tags, _ := row[13].(string)
+			link.Tags = ParseTags(tags)
+		}
+		if len(row) > 14 {
+			if deleted, _ := row[14].(string); strings.TrimSpace(deleted) != "" {
+				if link.Deleted, err = ParseExpiry(strings.TrimSpace(deleted)); err != nil {
+					warn(IssueInvalidCell, true, "%s deletion time is invalid, ignoring the row: %v", k, err)
+					continue
+				}
+			}
+		}
+		if len(row) > 15 {
+			if from, _ := row[15].(string); strings.TrimSpace(from) != "" {
+				if link.ActiveFrom, err = ParseExpiry(strings.TrimSpace(from)); err != nil {
+					warn(IssueInvalidCell, true, "%s activation time is invalid, ignoring the row: %v", k, err)
+					continue
+				}
+			}
+		}
+		if len(row) > 16 {
+			if canary, _ := row[16].(string); strings.TrimSpace(canary) != "" {
+				if link.Canary, err = ParseCanary(canary); err != nil {
+					warn(IssueInvalidCell, false, "%s canary is invalid, ignoring it: %v", k, err)
+				} else if link.Type != "" {
+					warn(IssueInvalidCell, false, "%s is a %s link, ignoring its canary", k, link.Type)
+					link.Canary = nil
+				}
+			}
+		}
+		if len(row) > 17 {
+			budget, _ := row[17].(string)
+			if link.MaxClicks, err = ParseMaxClicks(budget); err != nil {
+				warn(IssueInvalidCell, false, "%s max clicks are invalid, ignoring them: %v", k, err)
+			}
+		}
+		if len(row) > 18 {
+			disabled, _ := row[18].(string)
+			link.Disabled = ParseFlag(disabled, "disabled")
+		}
+		if len(row) > 19 {
+			unapproved, _ := row[19].(string)
+			link.Unapproved = ParseFlag(unapproved, "unapproved")
+		}
+		if len(row) > 9 {
+			if when, _ := row[9].(string); strings.TrimSpace(when) != "" {
+				if link.When, err = ParseCondition(when); err != nil {
+					warn(IssueInvalidCell, true, "%s condition is invalid, ignoring the row: %v", k, err)
+					continue
+				}
+				variants[k] = append(variants[k], link)
+				continue
+			}
+		}
+
+		_, exists := out[k]
+		if exists {
+			warn(IssueDuplicate, false, "shortcut %q redeclare, overwriting", k)
+		}
+
+		out[k] = link
+		loadedFrom(ctx, k, at)
+	}
+
+	for k, vs := range variants {
+		if out[k] == nil {
+			Warnf(ctx, "%s has conditional rows but no default row, ignoring them", k)
+			continue
+		}
+		out[k].Variants = vs
+		weight := 0
+		for _, v := range vs {
+			if len(v.When.Countries)+len(v.When.Devices)+len(v.When.Languages) == 0 {
+				weight += v.When.Weight
+			}
+		}
+		if weight > 100 {
+			Warnf(ctx, "%s weights add up to %d%%, later variants get less than their share", k, weight)
+		}
+	}
+	return out
+}
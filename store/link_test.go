@@ -0,0 +1,407 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+func TestMain(m *testing.M) {
+	// Invalid links are logged as they are skipped.
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestURLMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		rows     [][]interface{}
+		want     map[string]string
+		warnings int
+	}{
+		{
+			name: "basic",
+			rows: [][]interface{}{{"go", "https://go.dev/"}, {"git", "https://github.com/"}},
+			want: map[string]string{"go": "https://go.dev/", "git": "https://github.com/"},
+		},
+		{
+			name:     "short and empty rows are skipped",
+			rows:     [][]interface{}{{}, {"", " "}, {"only"}, {"", "https://x.com"}, {"empty", ""}, {"ok", "https://ok.com"}},
+			want:     map[string]string{"ok": "https://ok.com"},
+			warnings: 3,
+		},
+		{
+			name:     "non-string cells are skipped",
+			rows:     [][]interface{}{{42, "https://x.com"}, {"n", 3.5}},
+			want:     map[string]string{},
+			warnings: 2,
+		},
+		{
+			name: "shortcuts are lower-cased",
+			rows: [][]interface{}{{"On-Call", "https://oc.com"}},
+			want: map[string]string{"on-call": "https://oc.com"},
+		},
+		{
+			name: "regex shortcuts keep their case",
+			rows: [][]interface{}{{`re:Jira/(\D+)`, "https://jira.com/"}},
+			want: map[string]string{`re:Jira/(\D+)`: "https://jira.com/"},
+		},
+		{
+			name:     "invalid URL",
+			rows:     [][]interface{}{{"bad", "http://[::1"}},
+			want:     map[string]string{},
+			warnings: 1,
+		},
+		{
+			name:     "invalid expiry drops the link",
+			rows:     [][]interface{}{{"x", "https://x.com", "tomorrow"}},
+			want:     map[string]string{},
+			warnings: 1,
+		},
+		{
+			name:     "redeclared shortcut, last wins",
+			rows:     [][]interface{}{{"a", "https://one.com"}, {"A", "https://two.com"}},
+			want:     map[string]string{"a": "https://two.com"},
+			warnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, w := WithLinkWarnings(context.Background())
+			got := urlMap(ctx, tt.rows)
+			if len(got) != len(tt.want) {
+				t.Errorf("got %d links, want %d", len(got), len(tt.want))
+			}
+			for k, v := range tt.want {
+				if got[k] == nil {
+					t.Errorf("missing %q", k)
+				} else if got[k].URL.String() != v {
+					t.Errorf("%q = %s, want %s", k, got[k].URL, v)
+				}
+			}
+			if n := len(w.Warnings()); n != tt.warnings {
+				t.Errorf("got %d warnings %q, want %d", n, w.Warnings(), tt.warnings)
+			}
+		})
+	}
+}
+
+func TestURLMapColumns(t *testing.T) {
+	ctx, w := WithLinkWarnings(context.Background())
+	m := urlMap(ctx, [][]interface{}{
+		{"full", "https://x.com", "2030-01-02", "301", "private", "yes", "?utm_source=go", " alice ", "hunter2", "", "1h", "", " Team docs ", "Docs, oncall,,docs"},
+		{"trashed", "https://x.com", "", "", "", "", "", "", "", "", "", "", "", "", "2024-05-06T07:08:09Z"},
+		{"scheduled", "https://x.com", "2030-01-02", "", "", "", "", "", "", "", "", "", "", "", "", "2030-01-01T09:00:00Z"},
+		{"badstatus", "https://x.com", "", "200"},
+		{"badparams", "https://x.com", "", "", "", "", "%zz"},
+		{"badcache", "https://x.com", "", "", "", "", "", "", "", "", "max-age=soon"},
+		{"wifi", "Guest / hunter2", "", "", "", "", "", "", "", "", "", "Text"},
+		{"badtype", "x", "", "", "", "", "", "", "", "", "", "pdf"},
+	})
+
+	full := m["full"]
+	if full == nil {
+		t.Fatal("full not loaded")
+	}
+	if want := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC); !full.Expires.Equal(want) {
+		t.Errorf("Expires = %v, want %v", full.Expires, want)
+	}
+	if full.RedirectStatus() != http.StatusMovedPermanently {
+		t.Errorf("RedirectStatus = %d", full.RedirectStatus())
+	}
+	if !full.Private || !full.Preview {
+		t.Errorf("Private, Preview = %v, %v", full.Private, full.Preview)
+	}
+	if want := (url.Values{"utm_source": {"go"}}); !reflect.DeepEqual(full.Params, want) {
+		t.Errorf("Params = %v, want %v", full.Params, want)
+	}
+	if full.Owner != "alice" || full.Password != "hunter2" || full.CacheControl != "max-age=3600" || full.Description != "Team docs" {
+		t.Errorf("Owner, Password, CacheControl, Description = %q, %q, %q, %q", full.Owner, full.Password, full.CacheControl, full.Description)
+	}
+	if want := []string{"docs", "oncall"}; !reflect.DeepEqual(full.Tags, want) {
+		t.Errorf("Tags = %q, want %q", full.Tags, want)
+	}
+
+	if l := m["badstatus"]; l == nil || l.RedirectStatus() != http.StatusFound {
+		t.Errorf("badstatus = %+v, want the default status", l)
+	}
+	if l := m["badparams"]; l == nil || l.Params != nil {
+		t.Errorf("badparams = %+v, want no params", l)
+	}
+	if l := m["badcache"]; l == nil || l.CacheControl != "" {
+		t.Errorf("badcache = %+v, want the default cache policy", l)
+	}
+	if l := m["wifi"]; l == nil || l.Type != TypeText || l.Target() != "Guest / hunter2" || l.URL.String() != "" {
+		t.Errorf("wifi = %+v, want a text link", l)
+	}
+	if l := m["trashed"]; l == nil || !l.Deleted.Equal(time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)) {
+		t.Errorf("trashed = %+v, want it deleted at 2024-05-06T07:08:09Z", l)
+	}
+	if l := m["scheduled"]; l == nil || !l.ActiveFrom.Equal(time.Date(2030, 1, 1, 9, 0, 0, 0, time.UTC)) || !l.Pending(time.Now()) {
+		t.Errorf("scheduled = %+v, want it active from 2030-01-01T09:00:00Z", l)
+	}
+	if l := m["badtype"]; l != nil {
+		t.Errorf("badtype = %+v, want it skipped", l)
+	}
+	if n := len(w.Warnings()); n != 4 {
+		t.Errorf("got warnings %q, want 4", w.Warnings())
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Time
+		err  bool
+	}{
+		{in: "2030-01-02", want: time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{in: "2030-01-02 15:04", want: time.Date(2030, 1, 2, 15, 4, 0, 0, time.UTC)},
+		{in: "2030-01-02T15:04:05", want: time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{in: "2030-01-02T15:04:05+02:00", want: time.Date(2030, 1, 2, 13, 4, 5, 0, time.UTC)},
+		{in: "02/01/2030", err: true},
+		{in: "", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseExpiry(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseExpiry(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("ParseExpiry(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLinkExpired(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expires time.Time
+		want    bool
+	}{
+		{time.Time{}, false},
+		{now.Add(time.Second), false},
+		{now, true},
+		{now.Add(-time.Second), true},
+	}
+	for _, tt := range tests {
+		if got := (&Link{Expires: tt.expires}).Expired(now); got != tt.want {
+			t.Errorf("Expired with Expires %v = %v, want %v", tt.expires, got, tt.want)
+		}
+	}
+}
+
+func TestURLMapIssues(t *testing.T) {
+	ctx, w := WithLinkWarnings(context.Background())
+	m := urlMap(withRows(ctx, "Links"), [][]interface{}{
+		{"shortcut", "url"},
+		{"go", "https://go.dev/"},
+		{"", "https://x.com"},
+		{"bad", "http://[::1"},
+		{"GO", "https://go.dev/doc/"},
+	})
+	if len(m) != 1 || m["go"].URL.String() != "https://go.dev/doc/" {
+		t.Errorf("got %v, want go only, without the header row", m)
+	}
+	Issuef(ctx, LinkIssue{Kind: IssueReserved, Shortcut: "go", Skipped: true}, "go is reserved")
+
+	issues, more := w.Issues()
+	want := []LinkIssue{
+		{Kind: IssueEmptyCell, Source: "Links", Row: 3, Skipped: true},
+		{Kind: IssueInvalidURL, Source: "Links", Row: 4, Shortcut: "bad", Skipped: true},
+		{Kind: IssueDuplicate, Source: "Links", Row: 5, Shortcut: "go"},
+		{Kind: IssueReserved, Source: "Links", Row: 5, Shortcut: "go", Skipped: true},
+	}
+	if len(issues) != len(want) || more != 0 {
+		t.Fatalf("got issues %+v (%d more), want %d", issues, more, len(want))
+	}
+	for i, got := range issues {
+		got.Message = ""
+		if got != want[i] {
+			t.Errorf("issue %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+	if got := w.Warnings()[1]; !strings.HasPrefix(got, `row 4 of "Links": `) {
+		t.Errorf("warning = %q, want it to name the row", got)
+	}
+	if got, want := SummarizeIssues(issues), "1 duplicate, 1 empty_cell, 1 invalid_url, 1 reserved"; got != want {
+		t.Errorf("SummarizeIssues = %q, want %q", got, want)
+	}
+}
+
+func TestURLMapHeader(t *testing.T) {
+	ctx, w := WithLinkWarnings(context.Background())
+	m := urlMap(withRows(ctx, "Links"), [][]interface{}{
+		{"Description", "Shortcut", "Notes for IT", "Destination", "Tags", "Max_Clicks"},
+		{"The Go site", "go", "ask Ana", "https://go.dev/", "lang, docs", "5"},
+		{"", "wiki", "", "https://wiki.example.com/"},
+	})
+	if len(m) != 2 {
+		t.Fatalf("got %v, want go and wiki", m)
+	}
+	golink := m["go"]
+	if golink.URL.String() != "https://go.dev/" || golink.Description != "The Go site" ||
+		len(golink.Tags) != 2 || golink.MaxClicks != 5 {
+		t.Errorf("go = %+v, want its columns read by name", golink)
+	}
+	if m["wiki"].URL.String() != "https://wiki.example.com/" {
+		t.Errorf("wiki = %v", m["wiki"].URL)
+	}
+	issues, _ := w.Issues()
+	if len(issues) != 1 || issues[0].Row != 1 || !strings.Contains(issues[0].Message, `"Notes for IT"`) {
+		t.Errorf("issues = %+v, want the unknown column", issues)
+	}
+
+	// A first row that isn't a header keeps the default order.
+	m = urlMap(withRows(context.Background(), "Links"), [][]interface{}{
+		{"key", "https://example.com/key", "", "307"},
+	})
+	if m["key"] == nil || m["key"].Status != 307 {
+		t.Errorf("got %v, want key read in the default order", m)
+	}
+
+	cols, _ := parseHeader([]interface{}{"shortcut", "owner", "notes", "url", "status"})
+	if got, want := cols.tabRow([]string{"go", "https://go.dev/", "", "301", "", "", "", "ana"}),
+		[]string{"go", "ana", "", "https://go.dev/", "301"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("tabRow = %q, want %q", got, want)
+	}
+	if got := cols.spans(5); len(got) != 2 || got[0] != [2]int{0, 2} || got[1] != [2]int{3, 5} {
+		t.Errorf("spans = %v, want the columns around notes", got)
+	}
+}
+
+func TestWarningsCapped(t *testing.T) {
+	ctx, w := WithLinkWarnings(context.Background())
+	for i := 0; i < maxWarnings+5; i++ {
+		Warnf(ctx, "warning %d", i)
+	}
+	got := w.Warnings()
+	if len(got) != maxWarnings+1 {
+		t.Fatalf("got %d warnings, want %d", len(got), maxWarnings+1)
+	}
+	if last := got[len(got)-1]; !strings.HasPrefix(last, "5 more") {
+		t.Errorf("last warning = %q", last)
+	}
+}
+
+func TestNormalizerKey(t *testing.T) {
+	tests := []struct {
+		n    Normalizer
+		a, b string
+		same bool
+	}{
+		{Norm, "On-Call", "on-call", true},
+		{Norm, "docs/", "docs", true},
+		{Norm, "on-call", "oncall", false},
+		{Normalizer{ignoreSeparators: true}, "on_call", "on call", true},
+		{Normalizer{caseSensitive: true}, "Foo", "foo", false},
+		// "é" precomposed and as "e" with a combining accent.
+		{Norm, "caf\u00e9", "cafe\u0301", true},
+		{Normalizer{}, "caf\u00e9", "cafe\u0301", false},
+		{Norm, "STRASSE", "straße", true},
+		{Norm, "ΣΊΣΥΦΟΣ", "σίσυφος", true},
+		{Norm, "日本語", "日本語", true},
+		// Turkish has a dotted and a dotless i, each with its capital.
+		{Norm, "ırmak", "irmak", false},
+		{Norm, "İSTANBUL", "i̇stanbul", true},
+		{Normalizer{unicode: true, form: norm.NFC, lang: language.Turkish}, "IRMAK", "ırmak", true},
+		{Normalizer{unicode: true, form: norm.NFC, lang: language.Turkish}, "İSTANBUL", "istanbul", true},
+		{Normalizer{unicode: true, form: norm.NFC, lang: language.Turkish}, "irmak", "ırmak", false},
+	}
+	for _, tt := range tests {
+		if got := tt.n.Key(tt.a) == tt.n.Key(tt.b); got != tt.same {
+			t.Errorf("%+v: Key(%q) == Key(%q) is %v, want %v", tt.n, tt.a, tt.b, got, tt.same)
+		}
+	}
+}
+
+func TestShortcutPattern(t *testing.T) {
+	for _, s := range []string{"docs", "on-call/v2", "çay", "ırmak", "日本語/ドキュメント", "한국어", "हिन्दी"} {
+		if !ShortcutPattern.MatchString(s) {
+			t.Errorf("%q is refused", s)
+		}
+	}
+	for _, s := range []string{"Docs", "Çay", "a b", "-x", "a//b", "a/"} {
+		if ShortcutPattern.MatchString(s) {
+			t.Errorf("%q is accepted", s)
+		}
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		in, want string
+		err      bool
+	}{
+		{in: "", want: ""},
+		{in: "90s", want: "max-age=90"},
+		{in: "1h", want: "max-age=3600"},
+		{in: "Public, MAX-AGE=300,s-maxage = 3600", want: "public, max-age=300, s-maxage=3600"},
+		{in: "no-store", want: "no-store"},
+		{in: "-1h", err: true},
+		{in: "max-age", err: true},
+		{in: "max-age=soon", err: true},
+		{in: "public=1", err: true},
+		{in: "forever", err: true},
+		{in: " , ", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCacheControl(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseCacheControl(%q) = %q, %v, want %q, error %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSheetWriteMerge(t *testing.T) {
+	link := &Link{URL: &url.URL{Scheme: "https", Host: "example.com"}}
+	var q sheetWriteQueue
+	merge := func(shortcut string, kind int) error {
+		return q.merge(shortcut, kind, link, make(chan error, 1))
+	}
+
+	if err := merge("new", sheetAdd); err != nil {
+		t.Fatal(err)
+	}
+	if err := merge("New", sheetAdd); !errors.Is(err, ErrLinkExists) {
+		t.Errorf("second add error = %v, want ErrLinkExists", err)
+	}
+	merge("new", sheetUpdate)
+	merge("new", sheetDelete)
+	merge("docs", sheetUpdate)
+	merge("old", sheetDelete)
+	if err := merge("old", sheetUpdate); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("update after delete error = %v, want ErrLinkNotFound", err)
+	}
+	merge("old", sheetAdd)
+
+	want := []struct {
+		shortcut string
+		kind     int
+		upsert   bool
+	}{
+		{"new", sheetCancelled, false},
+		{"docs", sheetUpdate, false},
+		{"old", sheetUpdate, true},
+	}
+	if len(q.pending) != len(want) {
+		t.Fatalf("got %d pending writes, want %d", len(q.pending), len(want))
+	}
+	for i, w := range want {
+		got := q.pending[i]
+		if got.shortcut != w.shortcut || got.kind != w.kind || got.upsert != w.upsert {
+			t.Errorf("write %d = %s kind %d upsert %v, want %+v", i, got.shortcut, got.kind, got.upsert, w)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Kinds of LinkIssue.
+const (
+	IssueInvalidURL  = "invalid_url"
+	IssueInvalidCell = "invalid_cell"
+	IssueEmptyCell   = "empty_cell"
+	IssueDuplicate   = "duplicate"
+	IssueReserved    = "reserved"
+	IssueRefused     = "refused"
+	IssueAlias       = "broken_alias"
+	IssueOther       = "warning"
+)
+
+// maxIssues bounds the number of issues kept per refresh for GET /api/lint.
+const maxIssues = 1000
+
+// LinkIssue is a problem with the link data found during a refresh, as
+// reported by GET /api/lint.
+type LinkIssue struct {
+	Kind string `json:"kind"`
+	// Source is the tab of the row and Row its 1-based number, for backends
+	// made of rows.
+	Source   string `json:"source,omitempty"`
+	Row      int    `json:"row,omitempty"`
+	Shortcut string `json:"shortcut,omitempty"`
+	// Skipped is set when the whole row was left out, not just a cell.
+	Skipped bool   `json:"skipped"`
+	Message string `json:"message"`
+}
+
+// String is the message of i prefixed with its row, if known.
+func (i LinkIssue) String() string {
+	switch {
+	case i.Row > 0 && i.Source != "":
+		return fmt.Sprintf("row %d of %q: %s", i.Row, i.Source, i.Message)
+	case i.Row > 0:
+		return fmt.Sprintf("row %d: %s", i.Row, i.Message)
+	case i.Source != "":
+		return fmt.Sprintf("%q: %s", i.Source, i.Message)
+	}
+	return i.Message
+}
+
+// rowSourceKey marks a context whose rows are numbered as in the backend,
+// see withRows.
+type rowSourceKey struct{}
+
+// withRows returns a context making urlMap report the row numbers of
+// problems, the first row being row 1 of source.
+func withRows(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, rowSourceKey{}, source)
+}
+
+// rowsOf returns the source set by withRows, if any.
+func rowsOf(ctx context.Context) (string, bool) {
+	source, ok := ctx.Value(rowSourceKey{}).(string)
+	return source, ok
+}
+
+// Issuef logs a warning about link data like Warnf, recording it as issue
+// with the formatted message. An issue naming a shortcut but no row gets the
+// row the shortcut was loaded from, if known.
+func Issuef(ctx context.Context, issue LinkIssue, format string, args ...interface{}) {
+	issue.Message = fmt.Sprintf(format, args...)
+	if issue.Kind == "" {
+		issue.Kind = IssueOther
+	}
+	w, ok := ctx.Value(linkWarningsKey{}).(*LinkWarnings)
+	if !ok {
+		log.Printf("warn: %s", issue)
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	if loc, ok := w.rows[issue.Shortcut]; ok && issue.Row == 0 && issue.Source == "" {
+		issue.Source, issue.Row = loc.Source, loc.Row
+	}
+	log.Printf("warn: %s", issue)
+	if len(w.list) < maxWarnings {
+		w.list = append(w.list, issue.String())
+	} else {
+		w.dropped++
+	}
+	if len(w.issues) < maxIssues {
+		w.issues = append(w.issues, issue)
+	} else {
+		w.droppedIssues++
+	}
+}
+
+// loadedFrom records where shortcut was loaded from, for later issues about
+// it. Within a tab the last row wins, across tabs the first one does.
+func loadedFrom(ctx context.Context, shortcut string, loc LinkIssue) {
+	w, ok := ctx.Value(linkWarningsKey{}).(*LinkWarnings)
+	if !ok || loc.Row == 0 {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	if w.rows == nil {
+		w.rows = make(map[string]LinkIssue)
+	}
+	if prev, ok := w.rows[shortcut]; !ok || prev.Source == loc.Source {
+		w.rows[shortcut] = LinkIssue{Source: loc.Source, Row: loc.Row}
+	}
+}
+
+// Issues returns the collected issues and how many more were not kept.
+func (w *LinkWarnings) Issues() ([]LinkIssue, int) {
+	w.Lock()
+	defer w.Unlock()
+	return append([]LinkIssue{}, w.issues...), w.droppedIssues
+}
+
+// SummarizeIssues counts issues by kind, such as "2 invalid_url, 1
+// duplicate", most frequent first.
+func SummarizeIssues(issues []LinkIssue) string {
+	counts := make(map[string]int)
+	for _, i := range issues {
+		counts[i.Kind]++
+	}
+	kinds := make([]string, 0, len(counts))
+	for k := range counts {
+		kinds = append(kinds, k)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if counts[kinds[i]] != counts[kinds[j]] {
+			return counts[kinds[i]] > counts[kinds[j]]
+		}
+		return kinds[i] < kinds[j]
+	})
+	parts := make([]string, len(kinds))
+	for i, k := range kinds {
+		parts[i] = fmt.Sprintf("%d %s", counts[k], k)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/denizyoldas/url-shorter/internal/env"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Norm decides which spellings of a shortcut are equivalent. It is
+// replaced from the environment at startup, see NewNormalizer.
+var Norm = Normalizer{unicode: true, form: norm.NFC}
+
+// Normalizer maps shortcuts to the key their equivalent spellings share.
+type Normalizer struct {
+	// caseSensitive keeps "Foo" and "foo" apart.
+	caseSensitive bool
+	// ignoreSeparators makes "on-call", "on_call", "on call" and "oncall"
+	// equivalent.
+	ignoreSeparators bool
+	// KeepTrailingSlash passes a trailing slash after a shortcut on to its
+	// destination instead of dropping it.
+	KeepTrailingSlash bool
+	// unicode applies the normalization form, so that differently composed
+	// accents match.
+	unicode bool
+	form    norm.Form
+	// lang picks the case mappings of a language, such as Turkish mapping
+	// "I" to "ı" rather than "i".
+	lang language.Tag
+}
+
+// NewNormalizer reads SHORTCUT_CASE_SENSITIVE, SHORTCUT_IGNORE_SEPARATORS,
+// SHORTCUT_TRAILING_SLASH (ignore or keep), SHORTCUT_UNICODE_FORM (nfc,
+// nfkc or none) and SHORTCUT_LANGUAGE.
+func NewNormalizer() (Normalizer, error) {
+	n := Normalizer{
+		caseSensitive:    env.Bool("SHORTCUT_CASE_SENSITIVE", false),
+		ignoreSeparators: env.Bool("SHORTCUT_IGNORE_SEPARATORS", false),
+	}
+	switch v := strings.ToLower(os.Getenv("SHORTCUT_TRAILING_SLASH")); v {
+	case "", "ignore":
+	case "keep":
+		n.KeepTrailingSlash = true
+	default:
+		return n, fmt.Errorf("invalid SHORTCUT_TRAILING_SLASH %q, expected ignore or keep", v)
+	}
+	switch v := strings.ToLower(os.Getenv("SHORTCUT_UNICODE_FORM")); v {
+	case "", "nfc":
+		n.unicode, n.form = true, norm.NFC
+	case "nfkc":
+		n.unicode, n.form = true, norm.NFKC
+	case "none":
+	default:
+		return n, fmt.Errorf("invalid SHORTCUT_UNICODE_FORM %q, expected nfc, nfkc or none", v)
+	}
+	if v := os.Getenv("SHORTCUT_LANGUAGE"); v != "" {
+		var err error
+		if n.lang, err = language.Parse(v); err != nil {
+			return n, fmt.Errorf("invalid SHORTCUT_LANGUAGE %q: %w", v, err)
+		}
+	}
+	return n, nil
+}
+
+// Canonical returns the form shortcuts are stored under.
+func (n Normalizer) Canonical(s string) string {
+	if n.caseSensitive {
+		if n.unicode {
+			s = n.form.String(s)
+		}
+		return s
+	}
+	return n.Lower(s)
+}
+
+// Lower returns s in lower case, as shortcuts are written, whether or not
+// they are case-sensitive.
+func (n Normalizer) Lower(s string) string {
+	if isASCII(s) && n.lang == language.Und {
+		return strings.ToLower(s)
+	}
+	if n.unicode {
+		s = n.form.String(s)
+	}
+	// Casers keep state, so they can't be shared between requests.
+	s = cases.Lower(n.lang).String(s)
+	if n.unicode {
+		s = n.form.String(s)
+	}
+	return s
+}
+
+// Key returns the form two shortcuts share when they are equivalent.
+func (n Normalizer) Key(s string) string {
+	s = strings.TrimSuffix(n.Canonical(s), "/")
+	if !n.caseSensitive && !isASCII(s) {
+		// Folding also matches spellings lowering keeps apart, such as "ß"
+		// and "ss" or "ς" and "σ".
+		s = cases.Fold().String(s)
+		if n.unicode {
+			s = n.form.String(s)
+		}
+	}
+	if n.ignoreSeparators {
+		s = strings.Map(func(r rune) rune {
+			switch r {
+			case '-', '_', ' ':
+				return -1
+			}
+			return r
+		}, s)
+	}
+	return s
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
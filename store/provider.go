@@ -0,0 +1,156 @@
+// Package store defines links and the providers that load and persist them:
+// Google Sheets, CSV, local files, Redis, SQL databases and DNS zones, alone
+// or federated.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrLinkExists is returned by writers when the shortcut is already taken.
+	ErrLinkExists = errors.New("shortcut already exists")
+	// ErrLinkNotFound is returned by editors when the shortcut does not exist.
+	ErrLinkNotFound = errors.New("shortcut not found")
+	// ErrNotModified is returned by Query when the links are unchanged since
+	// the previous successful query.
+	ErrNotModified = errors.New("links not modified")
+	// ErrRateLimited is returned by providers when the backend rejected a
+	// query because a usage quota was exhausted.
+	ErrRateLimited = errors.New("backend rate limit exceeded")
+	// ErrReadOnly is returned by federations when changing a shortcut that
+	// comes from a source that can't be written to.
+	ErrReadOnly = errors.New("shortcut comes from a read-only source")
+)
+
+// spanError returns err as recorded on spans: ErrNotModified is an expected
+// answer of Query rather than a failure.
+func spanError(err error) error {
+	if errors.Is(err, ErrNotModified) {
+		return nil
+	}
+	return err
+}
+
+// Provider loads the full set of shortcuts from a storage backend.
+type Provider interface {
+	Query(ctx context.Context) (URLMap, error)
+}
+
+// Writer is implemented by providers that can persist new shortcuts.
+type Writer interface {
+	Add(ctx context.Context, shortcut string, link *Link) error
+}
+
+// Editor is implemented by providers that can change or remove existing
+// shortcuts.
+type Editor interface {
+	Update(ctx context.Context, shortcut string, link *Link) error
+	Delete(ctx context.Context, shortcut string) error
+}
+
+// Replacer is implemented by providers that can replace every link at once,
+// such as to restore a snapshot: afterwards they hold exactly the links of
+// m, or nothing changed.
+type Replacer interface {
+	Replace(ctx context.Context, m URLMap) error
+}
+
+// Getter is implemented by providers that can read a single shortcut
+// without waiting for the next refresh. It returns nil when shortcut does not
+// exist.
+type Getter interface {
+	Get(ctx context.Context, shortcut string) (*Link, error)
+}
+
+// Watcher is implemented by providers that notice when their links change,
+// such as local files. Watch calls changed after each change until ctx is
+// done.
+type Watcher interface {
+	Watch(ctx context.Context, changed func())
+}
+
+// ReservedSource is implemented by providers that also load reserved
+// shortcuts, such as from a sheet tab. It returns those read by the last
+// Query.
+type ReservedSource interface {
+	ReservedShortcuts() []string
+}
+
+// providers maps a backend name, as selected with the PROVIDER environment
+// variable, to a constructor that reads its settings with getenv: os.Getenv,
+// or a prefixed lookup for the sources of a federation, see PROVIDERS.
+var providers = map[string]func(getenv func(string) string) (Provider, error){}
+
+// registerProvider makes a backend available under name. It is meant to be
+// called from the init function of the file implementing the backend.
+func registerProvider(name string, newProvider func(getenv func(string) string) (Provider, error)) {
+	if _, exists := providers[name]; exists {
+		panic("provider " + name + " registered twice")
+	}
+	providers[name] = newProvider
+}
+
+// DefaultProvider picks a backend from the environment when PROVIDER is not
+// set: a federation if PROVIDERS is configured, then SQL if DATABASE_URL is,
+// then Redis if REDIS_URL is, then a published CSV if SHEET_CSV_URL is, then
+// a local file if LINKS_FILE is, then a directory of files if LINKS_DIR is,
+// then DNS TXT records if DNS_ZONE is, and Google Sheets otherwise.
+func DefaultProvider() string {
+	if name := os.Getenv("PROVIDER"); name != "" {
+		return name
+	}
+	if os.Getenv("PROVIDERS") != "" {
+		return "federated"
+	}
+	if os.Getenv("DATABASE_URL") != "" {
+		return "sql"
+	}
+	if os.Getenv("REDIS_URL") != "" {
+		return "redis"
+	}
+	if os.Getenv("SHEET_CSV_URL") != "" {
+		return "csv"
+	}
+	if os.Getenv("LINKS_FILE") != "" {
+		return "file"
+	}
+	if os.Getenv("LINKS_DIR") != "" {
+		return "dir"
+	}
+	if os.Getenv("DNS_ZONE") != "" {
+		return "dns"
+	}
+	return "sheets"
+}
+
+// NewProvider returns the provider registered under name, configured from
+// the environment.
+func NewProvider(name string) (Provider, error) {
+	return newProvider(name, os.Getenv)
+}
+
+// NewProviderWith returns the provider registered under name, configured
+// from settings alone, keyed like the environment variables, so that it
+// shares nothing with the environment of the process.
+func NewProviderWith(name string, settings map[string]string) (Provider, error) {
+	return newProvider(name, func(key string) string { return settings[key] })
+}
+
+func newProvider(name string, getenv func(string) string) (Provider, error) {
+	fn, ok := providers[name]
+	if !ok {
+		var names []string
+		for n := range providers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown provider %q, available: %s", name, strings.Join(names, ", "))
+	}
+	return fn(getenv)
+}
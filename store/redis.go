@@ -0,0 +1,329 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/tracing"
+)
+
+// RedisTimeout bounds every command that is not already bounded by a context
+// deadline.
+const RedisTimeout = 5 * time.Second
+
+// redisError is an error reply sent by the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// RedisClient is a minimal RESP2 client with a small connection pool. It
+// only implements what the providers need, so that the service doesn't pull
+// in a full client library.
+type RedisClient struct {
+	addr     string
+	useTLS   bool
+	username string
+	password string
+	db       int
+
+	pool chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewRedisClient parses a redis:// or rediss:// URL of the form
+// redis://[user:password@]host:port[/db].
+func NewRedisClient(rawURL string) (*RedisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("invalid redis url scheme %q", u.Scheme)
+	}
+
+	c := &RedisClient{
+		addr:   u.Host,
+		useTLS: u.Scheme == "rediss",
+		pool:   make(chan *redisConn, 8),
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// Do sends a single command and returns its reply, which is one of string,
+// int64, []interface{}, nil or a redisError.
+func (c *RedisClient) Do(ctx context.Context, args ...string) (_ interface{}, err error) {
+	ctx, sp := tracing.Start(ctx, "redis "+args[0], tracing.Client)
+	sp.SetAttr("db.system", "redis")
+	sp.SetAttr("db.operation", args[0])
+	defer func() { sp.End(err) }()
+
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(RedisTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	v, err := conn.do(args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		// The connection is in an unknown state after an I/O error.
+		conn.Close()
+		return nil, err
+	}
+
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+	return v, err
+}
+
+// Multi sends cmds in a single MULTI/EXEC transaction, which Redis applies
+// all together or not at all, and returns their replies. Commands that fail
+// while running, such as HINCRBY on a key of another type, get a redisError
+// reply without undoing the others.
+func (c *RedisClient) Multi(ctx context.Context, cmds ...[]string) (_ []interface{}, err error) {
+	ctx, sp := tracing.Start(ctx, "redis MULTI", tracing.Client)
+	sp.SetAttr("db.system", "redis")
+	sp.SetAttr("db.operation", "MULTI")
+	defer func() { sp.End(err) }()
+
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(RedisTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	v, err := conn.multi(cmds)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		conn.Close()
+		return nil, err
+	}
+
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+	return v, err
+}
+
+func (c *RedisClient) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+
+	tracing.FromContext(ctx).AddEvent("dial")
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.useTLS {
+		host, _, _ := net.SplitHostPort(c.addr)
+		nc = tls.Client(nc, &tls.Config{ServerName: host})
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	conn.SetDeadline(time.Now().Add(RedisTimeout))
+
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := conn.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	var b strings.Builder
+	writeCommand(&b, args)
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// multi pipelines cmds between MULTI and EXEC and returns the replies of
+// EXEC. A command refused while queueing makes EXEC fail with EXECABORT, so
+// nothing is applied; the replies are read either way to keep the
+// connection in sync.
+func (c *redisConn) multi(cmds [][]string) ([]interface{}, error) {
+	var b strings.Builder
+	writeCommand(&b, []string{"MULTI"})
+	for _, args := range cmds {
+		writeCommand(&b, args)
+	}
+	writeCommand(&b, []string{"EXEC"})
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	// +OK for MULTI, then +QUEUED or an error for each command.
+	for i := 0; i <= len(cmds); i++ {
+		var rerr redisError
+		if _, err := c.readReply(); err != nil && !errors.As(err, &rerr) {
+			return nil, err
+		}
+	}
+	v, err := c.readReply()
+	if err != nil {
+		return nil, err
+	}
+	out, ok := v.([]interface{})
+	if !ok {
+		return nil, redisError("transaction aborted")
+	}
+	return out, nil
+}
+
+// writeCommand appends args to b as a RESP array of bulk strings.
+func writeCommand(b *strings.Builder, args []string) {
+	fmt.Fprintf(b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(b, "$%d\r\n%s\r\n", len(a), a)
+	}
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			v, err := c.readReply()
+			var rerr redisError
+			if errors.As(err, &rerr) {
+				// Keep reading so the connection stays in sync.
+				v, err = rerr, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", kind)
+}
+
+// Subscribe listens on channel with a dedicated connection and calls fn with
+// each message until ctx is cancelled or the connection fails.
+func (c *RedisClient) Subscribe(ctx context.Context, channel string, fn func(msg string)) error {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	if _, err := conn.do("SUBSCRIBE", channel); err != nil {
+		return err
+	}
+	// Subscribed connections only receive, so there is no reply to wait for.
+	conn.SetDeadline(time.Time{})
+	for {
+		v, err := conn.readReply()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		// Messages are ["message", channel, payload].
+		if m, ok := v.([]interface{}); ok && len(m) == 3 && m[0] == "message" {
+			payload, _ := m[2].(string)
+			fn(payload)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRedisMulti(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	replies := []string{
+		// The HINCRBY is queued, the unknown command refused.
+		"+OK\r\n+QUEUED\r\n-ERR unknown command 'NOPE'\r\n-EXECABORT Transaction discarded\r\n",
+		"+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n:3\r\n-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+	}
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		for _, reply := range replies {
+			var req strings.Builder
+			for !strings.HasSuffix(req.String(), "$4\r\nEXEC\r\n") {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				req.WriteString(line)
+			}
+			server.Write([]byte(reply))
+		}
+	}()
+	conn := &redisConn{Conn: client, r: bufio.NewReader(client)}
+
+	_, err := conn.multi([][]string{{"HINCRBY", "k", "total", "1"}, {"NOPE"}})
+	var rerr redisError
+	if !errors.As(err, &rerr) || !strings.HasPrefix(string(rerr), "EXECABORT") {
+		t.Fatalf("multi with a refused command = %v, want EXECABORT", err)
+	}
+	out, err := conn.multi([][]string{{"HINCRBY", "k", "total", "3"}, {"HINCRBY", "s", "total", "1"}})
+	if err != nil {
+		t.Fatalf("multi after an aborted one: %v", err)
+	}
+	if len(out) != 2 || out[0] != int64(3) {
+		t.Errorf("replies = %v, want 3 and an error", out)
+	}
+	if _, ok := out[1].(redisError); !ok {
+		t.Errorf("reply %v, want the WRONGTYPE error", out[1])
+	}
+}
@@ -0,0 +1,363 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerProvider("redis", func(getenv func(string) string) (Provider, error) {
+		rawURL := getenv("REDIS_URL")
+		if rawURL == "" {
+			return nil, fmt.Errorf("REDIS_URL not set")
+		}
+		client, err := NewRedisClient(rawURL)
+		if err != nil {
+			return nil, err
+		}
+
+		p := &redisProvider{client: client, prefix: getenv("REDIS_KEY_PREFIX")}
+		if p.prefix == "" {
+			p.prefix = "shortcut:"
+		}
+		if v := getenv("REDIS_TTL"); v != "" {
+			if p.ttl, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("invalid REDIS_TTL %q: %w", v, err)
+			}
+		}
+		return p, nil
+	})
+}
+
+// redisProvider stores each shortcut as a string key holding either the bare
+// destination URL or, for links with metadata, a JSON redisLink. Keys of
+// expiring links get a Redis TTL so they are eventually removed.
+type redisProvider struct {
+	client *RedisClient
+	prefix string
+	// ttl is the default expiry of links created without one; zero means no
+	// expiry.
+	ttl time.Duration
+}
+
+// redisExpiredRetention is how long an expired link is kept around so that it
+// keeps answering 410 Gone rather than 404.
+const redisExpiredRetention = 30 * 24 * time.Hour
+
+type redisLink struct {
+	URL        string `json:"url"`
+	Expires    string `json:"expires,omitempty"`
+	Status     int    `json:"status,omitempty"`
+	Private    bool   `json:"private,omitempty"`
+	Preview    bool   `json:"preview,omitempty"`
+	Params     string `json:"params,omitempty"`
+	Owner      string `json:"owner,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Cache      string `json:"cache,omitempty"`
+	Type       string `json:"type,omitempty"`
+	Desc       string `json:"desc,omitempty"`
+	Tags       string `json:"tags,omitempty"`
+	Deleted    string `json:"deleted,omitempty"`
+	From       string `json:"from,omitempty"`
+	Canary     string `json:"canary,omitempty"`
+	Max        int64  `json:"max,omitempty"`
+	Disabled   bool   `json:"disabled,omitempty"`
+	Unapproved bool   `json:"unapproved,omitempty"`
+}
+
+func encodeRedisLink(link *Link) string {
+	if link.Expires.IsZero() && link.Status == 0 && !link.Private && !link.Preview && len(link.Params) == 0 && link.Owner == "" && link.Password == "" && link.CacheControl == "" && link.Type == "" && link.Description == "" && len(link.Tags) == 0 && link.Deleted.IsZero() && link.ActiveFrom.IsZero() && link.Canary == nil && link.MaxClicks == 0 && !link.Disabled && !link.Unapproved {
+		return link.URL.String()
+	}
+	b, _ := json.Marshal(redisLink{
+		URL:        link.Target(),
+		Expires:    FormatExpiry(link.Expires),
+		Status:     link.Status,
+		Private:    link.Private,
+		Preview:    link.Preview,
+		Params:     FormatParams(link.Params),
+		Owner:      link.Owner,
+		Password:   link.Password,
+		Cache:      link.CacheControl,
+		Type:       link.Type,
+		Desc:       link.Description,
+		Tags:       FormatTags(link.Tags),
+		Deleted:    FormatExpiry(link.Deleted),
+		From:       FormatExpiry(link.ActiveFrom),
+		Canary:     FormatCanary(link.Canary),
+		Max:        link.MaxClicks,
+		Disabled:   link.Disabled,
+		Unapproved: link.Unapproved,
+	})
+	return string(b)
+}
+
+// redisRow converts a stored value into a row for urlMap.
+func redisRow(ctx context.Context, shortcut, value string) []interface{} {
+	if !strings.HasPrefix(value, "{") {
+		return []interface{}{shortcut, value}
+	}
+	var rl redisLink
+	if err := json.Unmarshal([]byte(value), &rl); err != nil {
+		Warnf(ctx, "%s has an invalid stored value: %v", shortcut, err)
+		return nil
+	}
+	return []interface{}{
+		shortcut, rl.URL, rl.Expires, FormatStatus(rl.Status),
+		FormatFlag(rl.Private, "private"), FormatFlag(rl.Preview, "preview"), rl.Params, rl.Owner, rl.Password,
+		"", rl.Cache, rl.Type, rl.Desc, rl.Tags, rl.Deleted, rl.From, rl.Canary,
+		FormatMaxClicks(rl.Max), FormatFlag(rl.Disabled, "disabled"), FormatFlag(rl.Unapproved, "unapproved"),
+	}
+}
+
+// setArgs returns the SET command storing link, with a key TTL when it
+// expires.
+func (p *redisProvider) setArgs(shortcut string, link *Link) []string {
+	args := []string{"SET", p.key(shortcut), encodeRedisLink(link)}
+	if !link.Expires.IsZero() {
+		ttl := time.Until(link.Expires) + redisExpiredRetention
+		if ttl < time.Millisecond {
+			ttl = time.Millisecond
+		}
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	return args
+}
+
+func (p *redisProvider) key(shortcut string) string {
+	return p.prefix + shortcut
+}
+
+func (p *redisProvider) Query(ctx context.Context) (URLMap, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		v, err := p.client.Do(ctx, "SCAN", cursor, "MATCH", p.prefix+"*", "COUNT", "1000")
+		if err != nil {
+			return nil, fmt.Errorf("redis scan failed: %w", err)
+		}
+		reply, ok := v.([]interface{})
+		if !ok || len(reply) != 2 {
+			return nil, fmt.Errorf("redis scan: unexpected reply %v", v)
+		}
+		cursor, _ = reply[0].(string)
+		batch, _ := reply[1].([]interface{})
+		for _, k := range batch {
+			if k, ok := k.(string); ok {
+				keys = append(keys, k)
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+
+	var rows [][]interface{}
+	const batchSize = 500
+	for len(keys) > 0 {
+		n := batchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+		batch := keys[:n]
+		keys = keys[n:]
+
+		v, err := p.client.Do(ctx, append([]string{"MGET"}, batch...)...)
+		if err != nil {
+			return nil, fmt.Errorf("redis mget failed: %w", err)
+		}
+		values, _ := v.([]interface{})
+		for i, val := range values {
+			if i >= len(batch) {
+				break
+			}
+			// Keys that expired between SCAN and MGET come back as nil.
+			if val, ok := val.(string); ok {
+				rows = append(rows, redisRow(ctx, strings.TrimPrefix(batch[i], p.prefix), val))
+			}
+		}
+	}
+
+	log.Printf("queried %d keys from redis", len(rows))
+	return urlMap(ctx, rows), nil
+}
+
+// Get returns the link of a single shortcut, or nil if it does not exist.
+func (p *redisProvider) Get(ctx context.Context, shortcut string) (*Link, error) {
+	v, err := p.client.Do(ctx, "GET", p.key(shortcut))
+	if err != nil {
+		return nil, err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, nil
+	}
+	return urlMap(ctx, [][]interface{}{redisRow(ctx, shortcut, s)})[shortcut], nil
+}
+
+// Add creates shortcut unless it already exists. Links without an expiry get
+// the configured default TTL.
+func (p *redisProvider) Add(ctx context.Context, shortcut string, link *Link) error {
+	if link.Expires.IsZero() && p.ttl > 0 {
+		l := *link
+		l.Expires = time.Now().Add(p.ttl)
+		link = &l
+	}
+
+	v, err := p.client.Do(ctx, append(p.setArgs(shortcut, link), "NX")...)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return ErrLinkExists
+	}
+	return nil
+}
+
+// Update replaces an existing shortcut.
+func (p *redisProvider) Update(ctx context.Context, shortcut string, link *Link) error {
+	v, err := p.client.Do(ctx, append(p.setArgs(shortcut, link), "XX")...)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return ErrLinkNotFound
+	}
+	return nil
+}
+
+// Delete removes shortcut and its click statistics.
+func (p *redisProvider) Delete(ctx context.Context, shortcut string) error {
+	v, err := p.client.Do(ctx, "DEL", p.key(shortcut), p.statsKey(shortcut))
+	if err != nil {
+		return err
+	}
+	if n, _ := v.(int64); n == 0 {
+		return ErrLinkNotFound
+	}
+	return nil
+}
+
+// statsKey is kept outside of the link prefix so SCAN never returns it.
+func (p *redisProvider) statsKey(shortcut string) string {
+	return "stats:" + p.prefix + shortcut
+}
+
+// RecordClicks counts clicks into one hash per shortcut, with a "total"
+// field, a "day:YYYY-MM-DD" field per day, a "ref:<referrer>" field per
+// referrer and a "dest:<url>" field per variant followed.
+func (p *redisProvider) RecordClicks(ctx context.Context, clicks []Click) error {
+	counts := make(map[string]map[string]int64)
+	for _, c := range clicks {
+		key := p.statsKey(c.Shortcut)
+		if counts[key] == nil {
+			counts[key] = make(map[string]int64)
+		}
+		counts[key]["total"]++
+		counts[key]["day:"+Day(c.Time)]++
+		counts[key]["ref:"+c.Referrer]++
+		if c.Destination != "" {
+			counts[key]["dest:"+c.Destination]++
+		}
+	}
+
+	// The caller retries failed batches, so the increments are sent in one
+	// transaction: applying some of them would count those clicks twice.
+	var cmds [][]string
+	for key, fields := range counts {
+		for f, n := range fields {
+			cmds = append(cmds, []string{"HINCRBY", key, f, strconv.FormatInt(n, 10)})
+		}
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	replies, err := p.client.Multi(ctx, cmds...)
+	if err != nil {
+		return err
+	}
+	// The others were applied, so a retry would count them again.
+	for i, r := range replies {
+		if rerr, ok := r.(redisError); ok {
+			log.Printf("warn: failed to count clicks in %s: %v", cmds[i][1], rerr)
+		}
+	}
+	return nil
+}
+
+func (p *redisProvider) ClickStats(ctx context.Context, shortcut string) (*LinkStats, error) {
+	v, err := p.client.Do(ctx, "HGETALL", p.statsKey(shortcut))
+	if err != nil {
+		return nil, err
+	}
+	reply, _ := v.([]interface{})
+
+	ls := NewLinkStats()
+	for i := 0; i+1 < len(reply); i += 2 {
+		field, _ := reply[i].(string)
+		value, _ := reply[i+1].(string)
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		switch {
+		case field == "total":
+			ls.Total = n
+		case strings.HasPrefix(field, "day:"):
+			ls.PerDay[strings.TrimPrefix(field, "day:")] = n
+		case strings.HasPrefix(field, "ref:"):
+			ref := strings.TrimPrefix(field, "ref:")
+			if ref == "" {
+				ref = "(direct)"
+			}
+			ls.Referrers[ref] = n
+		case strings.HasPrefix(field, "dest:"):
+			ls.Destinations[strings.TrimPrefix(field, "dest:")] = n
+		}
+	}
+	return ls, nil
+}
+
+func (p *redisProvider) ClickTotals(ctx context.Context, shortcuts []string) (map[string]int64, error) {
+	out := make(map[string]int64, len(shortcuts))
+	for _, shortcut := range shortcuts {
+		v, err := p.client.Do(ctx, "HGET", p.statsKey(shortcut), "total")
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := v.(string); ok {
+			out[shortcut], _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+	return out, nil
+}
+
+// ClicksSince sums the "day:" fields of each shortcut from since on.
+func (p *redisProvider) ClicksSince(ctx context.Context, shortcuts []string, since time.Time) (map[string]int64, error) {
+	days := Days(since, time.Now())
+	args := make([]string, 0, len(days)+2)
+	out := make(map[string]int64, len(shortcuts))
+	for _, shortcut := range shortcuts {
+		args = append(args[:0], "HMGET", p.statsKey(shortcut))
+		for _, d := range days {
+			args = append(args, "day:"+d)
+		}
+		v, err := p.client.Do(ctx, args...)
+		if err != nil {
+			return nil, err
+		}
+		reply, _ := v.([]interface{})
+		for _, r := range reply {
+			if s, ok := r.(string); ok {
+				n, _ := strconv.ParseInt(s, 10, 64)
+				out[shortcut] += n
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerSink("s3", func(getenv func(string) string) (AnalyticsSink, error) {
+		s := &s3Sink{
+			bucket:       getenv("S3_BUCKET"),
+			prefix:       getenv("S3_PREFIX"),
+			region:       getenv("S3_REGION"),
+			accessKey:    getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: getenv("AWS_SESSION_TOKEN"),
+			client:       &http.Client{Timeout: 30 * time.Second},
+		}
+		if s.bucket == "" {
+			return nil, fmt.Errorf("S3_BUCKET not set")
+		}
+		if s.accessKey == "" || s.secretKey == "" {
+			return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+		}
+		if s.prefix == "" {
+			s.prefix = "clicks/"
+		}
+		if s.region == "" {
+			if s.region = getenv("AWS_REGION"); s.region == "" {
+				s.region = "us-east-1"
+			}
+		}
+		endpoint := getenv("S3_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "https://s3." + s.region + ".amazonaws.com"
+		}
+		var err error
+		if s.endpoint, err = url.Parse(strings.TrimSuffix(endpoint, "/")); err != nil || s.endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+		}
+		return s, nil
+	})
+}
+
+// s3Sink writes each batch of clicks as an object of newline-delimited JSON
+// to an S3 bucket, or any store speaking its API, under
+// PREFIX/dt=YYYY-MM-DD/. Requests are signed with AWS Signature Version 4
+// and use path-style URLs.
+type s3Sink struct {
+	endpoint                           *url.URL
+	bucket, prefix, region             string
+	accessKey, secretKey, sessionToken string
+	client                             *http.Client
+}
+
+func (s *s3Sink) Name() string { return "s3" }
+
+func (s *s3Sink) ExportClicks(ctx context.Context, clicks []Click) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, c := range clicks {
+		if err := enc.Encode(c); err != nil {
+			return err
+		}
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	key := fmt.Sprintf("%sdt=%s/%d-%s.ndjson", s.prefix, now.Format("2006-01-02"), now.UnixNano(), hex.EncodeToString(id[:]))
+
+	u := *s.endpoint
+	u.Path = u.Path + "/" + s.bucket + "/" + key
+	u.RawPath = s.endpoint.EscapedPath() + "/" + awsEscapePath(s.bucket+"/"+key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	s.sign(req, body.Bytes(), now)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload clicks to S3: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("failed to upload clicks to S3: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// sign adds the AWS Signature Version 4 headers of req with body at now.
+func (s *s3Sink) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate, day := now.Format("20060102T150405Z"), now.Format("20060102")
+	payload := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+	req.Header.Set("X-Amz-Date", amzDate)
+	names := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+		names = append(names, "x-amz-security-token")
+	}
+
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, req.URL.EscapedPath(), req.URL.RawQuery)
+	for _, n := range names {
+		v := req.Host
+		if n != "host" {
+			v = req.Header.Get(n)
+		}
+		fmt.Fprintf(&canonical, "%s:%s\n", n, strings.TrimSpace(v))
+	}
+	signed := strings.Join(names, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, hex.EncodeToString(payload[:]))
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// awsEscapePath escapes p as Signature Version 4 expects: everything but
+// unreserved characters and slashes.
+func awsEscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,324 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/tracing"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Kinds of sheetWrite.
+const (
+	// sheetCancelled is a link added then deleted before the batch was
+	// written, which leaves nothing to write.
+	sheetCancelled = iota
+	sheetAdd
+	sheetUpdate
+	sheetDelete
+)
+
+// sheetWrite is the pending change of a shortcut, merged from the calls
+// made since the last batch.
+type sheetWrite struct {
+	shortcut string
+	kind     int
+	// link is nil for deletes.
+	link *Link
+	// upsert appends the row when an update finds none, which happens to
+	// links deleted then added again.
+	upsert bool
+	// done receives the result of each call merged into the write.
+	done []chan error
+	err  error
+}
+
+// sheetWriteQueue coalesces the writes made within delay of each other, so
+// that a burst of changes costs one Sheets batchUpdate instead of a request
+// per change and doesn't exhaust the write quota.
+type sheetWriteQueue struct {
+	delay time.Duration
+
+	mu        sync.Mutex
+	pending   []*sheetWrite
+	byKey     map[string]*sheetWrite
+	scheduled bool
+}
+
+// do queues a change of shortcut and waits until the batch holding it was
+// written by flush. A cancelled ctx stops the wait, not the write.
+func (q *sheetWriteQueue) do(ctx context.Context, shortcut string, kind int, link *Link, flush func([]*sheetWrite)) error {
+	done := make(chan error, 1)
+	q.mu.Lock()
+	err := q.merge(shortcut, kind, link, done)
+	if err == nil && !q.scheduled {
+		q.scheduled = true
+		time.AfterFunc(q.delay, func() {
+			q.mu.Lock()
+			batch := q.pending
+			q.pending, q.byKey, q.scheduled = nil, nil, false
+			q.mu.Unlock()
+			flush(batch)
+		})
+	}
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// merge folds a change into the pending write of its shortcut: an update
+// of a link added in the batch changes the added row, a delete of it
+// cancels both, and so on. Changes that would fail, such as adding a
+// shortcut twice, are rejected right away.
+func (q *sheetWriteQueue) merge(shortcut string, kind int, link *Link, done chan error) error {
+	key := sheetKey(shortcut)
+	w := q.byKey[key]
+	if w == nil {
+		w = &sheetWrite{shortcut: shortcut, kind: kind, link: link}
+		if q.byKey == nil {
+			q.byKey = make(map[string]*sheetWrite)
+		}
+		q.byKey[key] = w
+		q.pending = append(q.pending, w)
+		w.done = append(w.done, done)
+		return nil
+	}
+
+	switch {
+	case kind == sheetAdd && w.kind == sheetDelete:
+		w.kind, w.link, w.upsert = sheetUpdate, link, true
+	case kind == sheetAdd:
+		return ErrLinkExists
+	case w.kind == sheetDelete:
+		return ErrLinkNotFound
+	case kind == sheetUpdate:
+		w.link = link
+	case kind == sheetDelete && w.kind == sheetAdd:
+		w.kind, w.link = sheetCancelled, nil
+		delete(q.byKey, key)
+		for _, ch := range w.done {
+			ch <- nil
+		}
+		w.done = nil
+		done <- nil
+		return nil
+	case kind == sheetDelete:
+		w.kind, w.link = sheetDelete, nil
+	}
+	w.done = append(w.done, done)
+	return nil
+}
+
+// sheetKey returns the key comparing shortcuts as the sheet does.
+func sheetKey(shortcut string) string {
+	if IsPatternKey(shortcut) {
+		return shortcut
+	}
+	return Norm.Canonical(shortcut)
+}
+
+// writeBatch writes batch and reports the results to the waiting calls.
+func (s *sheetsProvider) writeBatch(batch []*sheetWrite) {
+	var writes []*sheetWrite
+	for _, w := range batch {
+		if w.kind != sheetCancelled {
+			writes = append(writes, w)
+		}
+	}
+	if len(writes) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := s.applyWrites(ctx, writes)
+	for _, w := range writes {
+		if w.err == nil {
+			w.err = err
+		}
+		for _, ch := range w.done {
+			ch <- w.err
+		}
+	}
+}
+
+// applyWrites sends writes in one batchUpdate, which the Sheets API applies
+// atomically. Rows are changed first, then removed from the bottom up so
+// that deletes don't shift the rows left to delete, then appended. Writes
+// that can't be applied, such as updates of missing rows, get their own
+// error and are left out of the request.
+func (s *sheetsProvider) applyWrites(ctx context.Context, writes []*sheetWrite) (err error) {
+	ctx, sp := tracing.Start(ctx, "sheets.batch_update", tracing.Client)
+	defer func() { sp.End(err) }()
+	ctx = tracing.WithClientTrace(ctx, sp)
+
+	srv, err := s.service(ctx)
+	if err != nil {
+		return err
+	}
+	var existing []string
+	for _, w := range writes {
+		if w.kind != sheetAdd {
+			existing = append(existing, w.shortcut)
+		}
+	}
+	rows := map[string]*sheetRow{}
+	if len(existing) > 0 {
+		if rows, err = s.locate(ctx, srv, existing); err != nil {
+			return err
+		}
+	}
+	tabs, err := s.tabs(ctx, srv)
+	if err != nil {
+		return err
+	}
+	ids, err := s.sheetIDs(ctx, srv)
+	if err != nil {
+		return err
+	}
+
+	type deletion struct {
+		w *sheetWrite
+		r *sheetRow
+	}
+	var updates, appends []*sheets.Request
+	var deletes []deletion
+	var logs []string
+	for _, w := range writes {
+		r := rows[sheetKey(w.shortcut)]
+		switch {
+		case w.kind == sheetAdd || (w.kind == sheetUpdate && r == nil && w.upsert):
+			// New links go to the tab of their namespace, if it has one, else
+			// to the tab with the highest precedence.
+			tab, name := tabs[0], w.shortcut
+			for _, t := range s.namespaceTabs {
+				if strings.HasPrefix(w.shortcut, t.ns+"/") {
+					tab, name = t.name, strings.TrimPrefix(w.shortcut, t.ns+"/")
+					break
+				}
+			}
+			id, ok := ids[tab]
+			if !ok {
+				w.err = fmt.Errorf("sheet tab %q not found", tab)
+				continue
+			}
+			appends = append(appends, &sheets.Request{AppendCells: &sheets.AppendCellsRequest{
+				SheetId:         id,
+				Rows:            []*sheets.RowData{sheetRowData(name, w.link, s.layout(tab))},
+				Fields:          "userEnteredValue",
+				ForceSendFields: []string{"SheetId"},
+			}})
+			logs = append(logs, fmt.Sprintf("appended shortcut=%q to sheet tab %q", w.shortcut, tab))
+		case r == nil:
+			w.err = ErrLinkNotFound
+		case !hasTab(ids, r.tab):
+			w.err = fmt.Errorf("sheet tab %q not found", r.tab)
+		case w.kind == sheetUpdate:
+			// Keep the spelling of the shortcut column, and the cells of the
+			// columns of the tab that aren't part of links.
+			name := fmt.Sprint(r.values[0])
+			data := sheetRowData(name, w.link, r.cols)
+			for _, span := range r.cols.spans(len(data.Values)) {
+				updates = append(updates, &sheets.Request{UpdateCells: &sheets.UpdateCellsRequest{
+					Start: &sheets.GridCoordinate{
+						SheetId:         ids[r.tab],
+						RowIndex:        int64(r.row - 1),
+						ColumnIndex:     int64(span[0]),
+						ForceSendFields: []string{"SheetId", "RowIndex", "ColumnIndex"},
+					},
+					Rows:   []*sheets.RowData{{Values: data.Values[span[0]:span[1]]}},
+					Fields: "userEnteredValue",
+				}})
+			}
+			logs = append(logs, fmt.Sprintf("updated shortcut=%q in sheet tab %q row %d", w.shortcut, r.tab, r.row))
+		case w.kind == sheetDelete:
+			deletes = append(deletes, deletion{w, r})
+		}
+	}
+	sort.Slice(deletes, func(i, j int) bool { return deletes[i].r.row > deletes[j].r.row })
+	for _, d := range deletes {
+		updates = append(updates, &sheets.Request{DeleteDimension: &sheets.DeleteDimensionRequest{Range: &sheets.DimensionRange{
+			SheetId:         ids[d.r.tab],
+			Dimension:       "ROWS",
+			StartIndex:      int64(d.r.row - 1),
+			EndIndex:        int64(d.r.row),
+			ForceSendFields: []string{"SheetId", "StartIndex"},
+		}}})
+		logs = append(logs, fmt.Sprintf("deleted shortcut=%q from sheet tab %q row %d", d.w.shortcut, d.r.tab, d.r.row))
+	}
+	reqs := append(updates, appends...)
+	if len(reqs) == 0 {
+		return nil
+	}
+
+	req := &sheets.BatchUpdateSpreadsheetRequest{Requests: reqs}
+	if _, err := srv.Spreadsheets.BatchUpdate(s.googleSheetsID, req).Context(ctx).Do(); err != nil {
+		if isQuotaError(err) {
+			return fmt.Errorf("%w: %v", ErrRateLimited, err)
+		}
+		return fmt.Errorf("unable to write %d changes to sheet: %w", len(reqs), err)
+	}
+	for _, l := range logs {
+		log.Print(l)
+	}
+	return nil
+}
+
+// sheetIDs maps the titles of the tabs to their numeric ids, which
+// batchUpdate takes instead of titles.
+func (s *sheetsProvider) sheetIDs(ctx context.Context, srv *sheets.Service) (map[string]int64, error) {
+	resp, err := srv.Spreadsheets.Get(s.googleSheetsID).Fields("sheets.properties(sheetId,title)").Context(ctx).Do()
+	if err != nil {
+		if isQuotaError(err) {
+			return nil, fmt.Errorf("%w: %v", ErrRateLimited, err)
+		}
+		return nil, fmt.Errorf("unable to list sheet tabs: %w", err)
+	}
+	ids := make(map[string]int64)
+	for _, sh := range resp.Sheets {
+		if sh.Properties != nil {
+			ids[sh.Properties.Title] = sh.Properties.SheetId
+		}
+	}
+	return ids, nil
+}
+
+func hasTab(ids map[string]int64, tab string) bool {
+	_, ok := ids[tab]
+	return ok
+}
+
+// sheetRowData returns the cells of the row of link in a tab laid out as
+// cols. Empty cells are cleared rather than set to an empty string.
+func sheetRowData(name string, link *Link, cols sheetColumns) *sheets.RowData {
+	values := []string{
+		name, link.Target(), FormatExpiry(link.Expires), FormatStatus(link.Status),
+		FormatFlag(link.Private, "private"), FormatFlag(link.Preview, "preview"), FormatParams(link.Params),
+		link.Owner, link.Password, "", link.CacheControl, link.Type, link.Description, FormatTags(link.Tags),
+		FormatExpiry(link.Deleted), FormatExpiry(link.ActiveFrom), FormatCanary(link.Canary),
+		FormatMaxClicks(link.MaxClicks), FormatFlag(link.Disabled, "disabled"), FormatFlag(link.Unapproved, "unapproved"),
+	}
+	values = cols.tabRow(values)
+	row := &sheets.RowData{Values: make([]*sheets.CellData, len(values))}
+	for i := range values {
+		cell := &sheets.CellData{}
+		if values[i] != "" {
+			cell.UserEnteredValue = &sheets.ExtendedValue{StringValue: &values[i]}
+		}
+		row.Values[i] = cell
+	}
+	return row
+}
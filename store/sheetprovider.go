@@ -0,0 +1,553 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denizyoldas/url-shorter/internal/env"
+	"github.com/denizyoldas/url-shorter/internal/tracing"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+	htransport "google.golang.org/api/transport/http"
+)
+
+func init() {
+	registerProvider("sheets", func(getenv func(string) string) (Provider, error) {
+		p := &sheetsProvider{
+			googleSheetsID:  getenv("GOOGLE_SHEET_ID"),
+			credentialsFile: getenv("GOOGLE_APPLICATION_CREDENTIALS"),
+			apiKey:          getenv("GOOGLE_API_KEY"),
+			reservedTab:     strings.TrimSpace(getenv("RESERVED_SHEET_NAME")),
+			writes:          sheetWriteQueue{delay: env.Duration("SHEETS_WRITE_DELAY", 500*time.Millisecond)},
+		}
+		for _, name := range strings.Split(getenv("SHEET_NAME"), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				if _, err := path.Match(name, ""); err != nil {
+					return nil, fmt.Errorf("invalid SHEET_NAME pattern %q: %w", name, err)
+				}
+				p.sheetNames = append(p.sheetNames, name)
+			}
+		}
+		for _, entry := range strings.Split(getenv("NAMESPACE_SHEETS"), ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			i := strings.IndexByte(entry, '=')
+			if i <= 0 || strings.TrimSpace(entry[i+1:]) == "" {
+				return nil, fmt.Errorf("invalid NAMESPACE_SHEETS entry %q, expected namespace=tab", entry)
+			}
+			ns := strings.ToLower(strings.TrimSpace(entry[:i]))
+			if strings.Contains(ns, "/") || !ShortcutPattern.MatchString(ns) {
+				return nil, fmt.Errorf("invalid namespace %q in NAMESPACE_SHEETS", ns)
+			}
+			p.namespaceTabs = append(p.namespaceTabs, sheetTab{name: strings.TrimSpace(entry[i+1:]), ns: ns})
+		}
+		if p.apiKey != "" {
+			// API keys can only read public sheets; hide Add, Update and
+			// Delete so the API reports that links can't be changed.
+			return struct {
+				Provider
+				ReservedSource
+			}{p, p}, nil
+		}
+		return p, nil
+	})
+}
+
+type sheetsProvider struct {
+	googleSheetsID string
+	// sheetNames are the tabs to read, in order of precedence. Entries may be
+	// path.Match patterns such as "team-*", which expand to the matching tabs
+	// in spreadsheet order.
+	sheetNames []string
+	// credentialsFile is a service account key. When empty, the interactive
+	// OAuth2 flow with credentials.json/token.json is used instead.
+	credentialsFile string
+	// apiKey reads a sheet shared with "anyone with the link" without OAuth.
+	apiKey string
+	// namespaceTabs hold the links of a namespace each, see DOMAINS. They
+	// are read after sheetNames.
+	namespaceTabs []sheetTab
+	// reservedTab lists reserved shortcuts in its first column; reserved
+	// holds those read by the last Query.
+	reservedTab string
+	reserved    []string
+	// layouts are the layouts of the tabs of links by name, as last read.
+	layouts map[string]sheetColumns
+
+	mu  sync.Mutex
+	srv *sheets.Service
+
+	// checksum is the hash of the values returned by the previous Query. The
+	// Sheets values API has no conditional requests, so this is how unchanged
+	// sheets are detected.
+	checksum [sha256.Size]byte
+
+	// writes batches Add, Update and Delete, see SHEETS_WRITE_DELAY.
+	writes sheetWriteQueue
+}
+
+// service returns the Sheets client, creating it on first use. The client
+// outlives the call, so it is not bound to ctx, which may be that of a
+// request.
+func (s *sheetsProvider) service(_ context.Context) (*sheets.Service, error) {
+	ctx := context.Background()
+	if s.googleSheetsID == "" {
+		return nil, fmt.Errorf("GOOGLE_SHEET_ID not set")
+	} else if len(s.sheetNames) == 0 {
+		return nil, fmt.Errorf("SHEET_NAME not set")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.srv != nil {
+		return s.srv, nil
+	}
+
+	if s.apiKey != "" {
+		srv, err := newSheetsService(ctx, option.WithAPIKey(s.apiKey))
+		if err != nil {
+			return nil, fmt.Errorf("unable to create Sheets client from API key: %w", err)
+		}
+		s.srv = srv
+		return srv, nil
+	}
+
+	if s.credentialsFile != "" {
+		srv, err := newSheetsService(ctx,
+			option.WithCredentialsFile(s.credentialsFile),
+			option.WithScopes(sheets.SpreadsheetsScope))
+		if err != nil {
+			return nil, fmt.Errorf("unable to create Sheets client from service account: %w", err)
+		}
+		s.srv = srv
+		return srv, nil
+	}
+
+	b, err := ioutil.ReadFile("credentials.json")
+	if err != nil {
+		log.Fatalf("Unable to read client secret file: %v", err)
+	}
+
+	// If modifying these scopes, delete your previously saved token.json.
+	config, err := google.ConfigFromJSON(b, sheets.SpreadsheetsScope)
+	if err != nil {
+		log.Fatalf("Unable to parse client secret file to config: %v", err)
+	}
+	client := getClient(config)
+
+	srv, err := sheets.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve Sheets client: %w", err)
+	}
+	s.srv = srv
+	return srv, nil
+}
+
+// newSheetsService creates a Sheets client authenticated by opts.
+func newSheetsService(ctx context.Context, opts ...option.ClientOption) (*sheets.Service, error) {
+	client, err := googleClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return sheets.NewService(ctx, client)
+}
+
+// googleClient returns the HTTP client for a Google API authenticated by
+// opts. The client libraries otherwise build a transport of their own,
+// which misses the proxy and TLS settings of http.DefaultTransport, such
+// as OUTBOUND_CA_FILE.
+func googleClient(ctx context.Context, opts ...option.ClientOption) (option.ClientOption, error) {
+	rt, err := htransport.NewTransport(ctx, http.DefaultTransport, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return option.WithHTTPClient(&http.Client{Transport: rt}), nil
+}
+
+func (s *sheetsProvider) Query(ctx context.Context) (_ URLMap, err error) {
+	ctx, sp := tracing.Start(ctx, "sheets.query", tracing.Client)
+	defer func() { sp.End(spanError(err)) }()
+	ctx = tracing.WithClientTrace(ctx, sp)
+
+	srv, err := s.service(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tabs, err := s.linkTabs(ctx, srv)
+	if err != nil {
+		return nil, err
+	}
+	// Columns: shortcut, url, and optionally expires, status, private,
+	// preview, params, owner, password, condition, cache, type, description,
+	// tags and deleted, or those named by a header row, see urlMap.
+	ranges := make([]string, len(tabs), len(tabs)+1)
+	names := make([]string, len(tabs), len(tabs)+1)
+	for i, tab := range tabs {
+		ranges[i] = sheetRange(tab.name, sheetColumnRange)
+		names[i] = tab.name
+	}
+	if s.reservedTab != "" {
+		ranges = append(ranges, sheetRange(s.reservedTab, "A:A"))
+		names = append(names, s.reservedTab)
+	}
+	resp, err := srv.Spreadsheets.Values.BatchGet(s.googleSheetsID).Ranges(ranges...).Context(ctx).Do()
+	if err != nil {
+		if isQuotaError(err) {
+			return nil, fmt.Errorf("%w: %v", ErrRateLimited, err)
+		}
+		return nil, fmt.Errorf("unable to retrieve data from sheet: %w", err)
+	}
+
+	sum, err := valuesChecksum(names, resp.ValueRanges)
+	if err != nil {
+		return nil, err
+	}
+	if sum == s.checksum {
+		return nil, ErrNotModified
+	}
+	s.checksum = sum
+
+	// Earlier tabs take precedence over later ones.
+	out := make(URLMap)
+	source := make(map[string]string)
+	rows := 0
+	for i, vr := range resp.ValueRanges {
+		if i >= len(tabs) {
+			break
+		}
+		rows += len(vr.Values)
+		s.setLayout(tabs[i].name, tabLayout(vr.Values))
+		for k, v := range urlMap(withRows(ctx, tabs[i].name), vr.Values) {
+			if tabs[i].ns != "" && strings.HasPrefix(k, RegexPrefix) {
+				Warnf(ctx, "regular expression shortcut %q can't be used in namespace tab %q", k, tabs[i].name)
+				continue
+			}
+			k = tabs[i].key(k)
+			if prev, ok := source[k]; ok {
+				Issuef(ctx, LinkIssue{Kind: IssueDuplicate, Source: tabs[i].name, Shortcut: k, Skipped: true},
+					"shortcut %q in tab %q is shadowed by tab %q", k, tabs[i].name, prev)
+				continue
+			}
+			out[k] = v
+			source[k] = tabs[i].name
+		}
+	}
+
+	if s.reservedTab != "" && len(resp.ValueRanges) > len(tabs) {
+		var reserved []string
+		for _, row := range resp.ValueRanges[len(tabs)].Values {
+			if len(row) > 0 {
+				if w, ok := row[0].(string); ok {
+					reserved = append(reserved, w)
+				}
+			}
+		}
+		s.mu.Lock()
+		s.reserved = reserved
+		s.mu.Unlock()
+	}
+
+	log.Printf("queried %d rows from %d tabs", rows, len(tabs))
+
+	return out, nil
+}
+
+// Add appends a new shortcut row to the end of the sheet. Writes are
+// batched, see sheetWriteQueue.
+func (s *sheetsProvider) Add(ctx context.Context, shortcut string, link *Link) (err error) {
+	ctx, sp := tracing.Start(ctx, "sheets.append", tracing.Internal)
+	defer func() { sp.End(err) }()
+	return s.writes.do(ctx, shortcut, sheetAdd, link, s.writeBatch)
+}
+
+// sheetRow is the location of a shortcut in the sheet.
+type sheetRow struct {
+	tab string
+	// row is the 1-based row number.
+	row int
+	// values are the cells of the row in the default layout, and cols the
+	// layout of its tab.
+	values []interface{}
+	cols   sheetColumns
+}
+
+// find returns the default row of shortcut in the tab with the highest
+// precedence, or nil when there is none.
+func (s *sheetsProvider) find(ctx context.Context, srv *sheets.Service, shortcut string) (*sheetRow, error) {
+	rows, err := s.locate(ctx, srv, []string{shortcut})
+	if err != nil {
+		return nil, err
+	}
+	return rows[sheetKey(shortcut)], nil
+}
+
+// locate returns the default rows of shortcuts, by sheetKey, reading the
+// tabs once. The Sheets API has no way to lock rows, so a row inserted or
+// removed by hand between locate and the following write can shift the row
+// that is changed.
+func (s *sheetsProvider) locate(ctx context.Context, srv *sheets.Service, shortcuts []string) (map[string]*sheetRow, error) {
+	tabs, err := s.linkTabs(ctx, srv)
+	if err != nil {
+		return nil, err
+	}
+	ranges := make([]string, len(tabs))
+	for i, tab := range tabs {
+		ranges[i] = sheetRange(tab.name, sheetColumnRange)
+	}
+	resp, err := srv.Spreadsheets.Values.BatchGet(s.googleSheetsID).Ranges(ranges...).Context(ctx).Do()
+	if err != nil {
+		if isQuotaError(err) {
+			return nil, fmt.Errorf("%w: %v", ErrRateLimited, err)
+		}
+		return nil, fmt.Errorf("unable to retrieve data from sheet: %w", err)
+	}
+
+	want := make(map[string]bool, len(shortcuts))
+	for _, k := range shortcuts {
+		want[sheetKey(k)] = true
+	}
+	out := make(map[string]*sheetRow, len(shortcuts))
+	for i, vr := range resp.ValueRanges {
+		if i >= len(tabs) {
+			break
+		}
+		cols := tabLayout(vr.Values)
+		s.setLayout(tabs[i].name, cols)
+		// Only trailing empty rows are omitted, so values start at row 1.
+		for j, row := range vr.Values {
+			if len(row) == 0 || (cols != nil && j == 0) {
+				continue
+			}
+			row = cols.defaultRow(row)
+			k, _ := row[0].(string)
+			if k == "" {
+				continue
+			}
+			k = tabs[i].key(sheetKey(k))
+			if !want[k] || out[k] != nil {
+				continue
+			}
+			// Conditional rows are only edited in the sheet.
+			if len(row) > 9 {
+				if when, _ := row[9].(string); strings.TrimSpace(when) != "" {
+					continue
+				}
+			}
+			out[k] = &sheetRow{tab: tabs[i].name, row: j + 1, values: row, cols: cols}
+		}
+	}
+	return out, nil
+}
+
+// Get reads the current row of shortcut, bypassing the cache.
+func (s *sheetsProvider) Get(ctx context.Context, shortcut string) (_ *Link, err error) {
+	ctx, sp := tracing.Start(ctx, "sheets.get", tracing.Client)
+	defer func() { sp.End(err) }()
+	ctx = tracing.WithClientTrace(ctx, sp)
+
+	srv, err := s.service(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.find(ctx, srv, shortcut)
+	if err != nil || r == nil {
+		return nil, err
+	}
+	for _, link := range urlMap(ctx, [][]interface{}{r.values}) {
+		return link, nil
+	}
+	return nil, nil
+}
+
+// Update overwrites the row of shortcut, keeping the spelling of its first
+// column.
+func (s *sheetsProvider) Update(ctx context.Context, shortcut string, link *Link) (err error) {
+	ctx, sp := tracing.Start(ctx, "sheets.update", tracing.Internal)
+	defer func() { sp.End(err) }()
+	return s.writes.do(ctx, shortcut, sheetUpdate, link, s.writeBatch)
+}
+
+// Delete removes the row of shortcut from its tab.
+func (s *sheetsProvider) Delete(ctx context.Context, shortcut string) (err error) {
+	ctx, sp := tracing.Start(ctx, "sheets.delete", tracing.Internal)
+	defer func() { sp.End(err) }()
+	return s.writes.do(ctx, shortcut, sheetDelete, nil, s.writeBatch)
+}
+
+// ReservedShortcuts implements ReservedSource with the first column of
+// RESERVED_SHEET_NAME.
+func (s *sheetsProvider) ReservedShortcuts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reserved
+}
+
+// sheetTab is a tab holding links, those of namespace ns when it is set.
+type sheetTab struct {
+	name string
+	ns   string
+}
+
+// key returns the shortcut for the first column k of a row of t.
+func (t sheetTab) key(k string) string {
+	if t.ns == "" {
+		return k
+	}
+	return t.ns + "/" + k
+}
+
+// linkTabs returns the tabs holding links: those of sheetNames in order of
+// precedence, then the namespace tabs.
+func (s *sheetsProvider) linkTabs(ctx context.Context, srv *sheets.Service) ([]sheetTab, error) {
+	tabs, err := s.tabs(ctx, srv)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]sheetTab, 0, len(tabs)+len(s.namespaceTabs))
+	for _, name := range tabs {
+		out = append(out, sheetTab{name: name})
+	}
+	return append(out, s.namespaceTabs...), nil
+}
+
+// isSpecialTab reports whether title is the reserved shortcuts tab or a
+// namespace tab, which patterns in sheetNames never match.
+func (s *sheetsProvider) isSpecialTab(title string) bool {
+	if title == s.reservedTab {
+		return true
+	}
+	for _, t := range s.namespaceTabs {
+		if t.name == title {
+			return true
+		}
+	}
+	return false
+}
+
+// tabs resolves sheetNames into the list of tabs to read. Patterns cost an
+// extra request to list the tabs of the spreadsheet.
+func (s *sheetsProvider) tabs(ctx context.Context, srv *sheets.Service) ([]string, error) {
+	var patterns bool
+	for _, name := range s.sheetNames {
+		if strings.ContainsAny(name, "*?[") {
+			patterns = true
+		}
+	}
+	if !patterns {
+		return s.sheetNames, nil
+	}
+
+	resp, err := srv.Spreadsheets.Get(s.googleSheetsID).Fields("sheets.properties.title").Context(ctx).Do()
+	if err != nil {
+		if isQuotaError(err) {
+			return nil, fmt.Errorf("%w: %v", ErrRateLimited, err)
+		}
+		return nil, fmt.Errorf("unable to list sheet tabs: %w", err)
+	}
+
+	var out []string
+	seen := make(map[string]bool)
+	for _, name := range s.sheetNames {
+		matched := false
+		for _, sh := range resp.Sheets {
+			title := sh.Properties.Title
+			if ok, _ := path.Match(name, title); !ok || s.isSpecialTab(title) {
+				continue
+			}
+			matched = true
+			if !seen[title] {
+				seen[title] = true
+				out = append(out, title)
+			}
+		}
+		if !matched {
+			log.Printf("warn: SHEET_NAME entry %q matches no tab", name)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("SHEET_NAME %q matches no tab", strings.Join(s.sheetNames, ","))
+	}
+	return out, nil
+}
+
+// sheetColumnRange are the columns read from the tabs of links, wider than
+// the default layout to leave room for other columns in tabs with a header.
+const sheetColumnRange = "A:Z"
+
+// tabLayout returns the layout of a tab from its values, nil when its first
+// row isn't a header.
+func tabLayout(values [][]interface{}) sheetColumns {
+	if len(values) == 0 {
+		return nil
+	}
+	cols, _ := parseHeader(values[0])
+	return cols
+}
+
+// setLayout remembers the layout of tab for the rows appended to it.
+func (s *sheetsProvider) setLayout(tab string, cols sheetColumns) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.layouts == nil {
+		s.layouts = make(map[string]sheetColumns)
+	}
+	s.layouts[tab] = cols
+}
+
+// layout returns the layout of tab as last read, nil when it has no header
+// or wasn't read yet.
+func (s *sheetsProvider) layout(tab string) sheetColumns {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.layouts[tab]
+}
+
+// sheetRange returns the A1 notation of cols in tab, quoting the tab name so
+// that names with spaces or punctuation work.
+func sheetRange(tab, cols string) string {
+	return "'" + strings.ReplaceAll(tab, "'", "''") + "'!" + cols
+}
+
+func valuesChecksum(tabs []string, values []*sheets.ValueRange) ([sha256.Size]byte, error) {
+	b, err := json.Marshal(struct {
+		Tabs   []string
+		Values []*sheets.ValueRange
+	}{tabs, values})
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("failed to hash sheet values: %w", err)
+	}
+	return sha256.Sum256(b), nil
+}
+
+// isQuotaError reports whether err is a Sheets API response indicating that
+// the per-user or per-project quota was exhausted.
+func isQuotaError(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return false
+	}
+	if gerr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	for _, e := range gerr.Errors {
+		switch e.Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded", "quotaExceeded":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+//go:build integration
+// +build integration
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+// newFixtureSheets returns a provider reading the Links and Team tabs and the
+// Reserved tab. It talks to the emulator at SHEETS_EMULATOR_URL when set and
+// otherwise to a server replaying testdata/sheets/batchget.json.
+func newFixtureSheets(t *testing.T) *sheetsProvider {
+	t.Helper()
+	endpoint := os.Getenv("SHEETS_EMULATOR_URL")
+	if endpoint == "" {
+		fixture, err := os.ReadFile("testdata/sheets/batchget.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !strings.HasSuffix(req.URL.Path, "/values:batchGet") {
+				http.NotFound(w, req)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(fixture)
+		}))
+		t.Cleanup(ts.Close)
+		endpoint = ts.URL
+	}
+
+	srv, err := sheets.NewService(context.Background(),
+		option.WithEndpoint(endpoint), option.WithHTTPClient(http.DefaultClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sheetsProvider{
+		googleSheetsID: "test-sheet",
+		sheetNames:     []string{"Links", "Team"},
+		reservedTab:    "Reserved",
+		srv:            srv,
+	}
+}
+
+func TestSheetsQuery(t *testing.T) {
+	p := newFixtureSheets(t)
+	ctx, w := WithLinkWarnings(context.Background())
+
+	links, err := p.Query(ctx)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	want := map[string]string{
+		"go":      "https://go.dev/",
+		"on-call": "https://oncall.example.com/",
+		"hr":      "https://hr.example.com/",
+		"jira/*":  "https://jira.example.com/browse/%7B1%7D",
+		"wiki":    "https://wiki.example.com/",
+	}
+	if len(links) != len(want) {
+		t.Errorf("got %d links, want %d", len(links), len(want))
+	}
+	for k, v := range want {
+		if links[k] == nil {
+			t.Errorf("missing %q", k)
+		} else if links[k].URL.String() != v {
+			t.Errorf("%q = %s, want %s", k, links[k].URL, v)
+		}
+	}
+	if l := links["on-call"]; l != nil && l.RedirectStatus() != http.StatusMovedPermanently {
+		t.Errorf("on-call status = %d", l.RedirectStatus())
+	}
+	if l := links["hr"]; l != nil && (!l.Private || l.Owner != "alice@example.com") {
+		t.Errorf("hr = %+v", l)
+	}
+	// "go" in Team is shadowed by Links.
+	if n := len(w.Warnings()); n != 1 {
+		t.Errorf("got warnings %q, want 1", w.Warnings())
+	}
+	if got := p.ReservedShortcuts(); len(got) != 2 || got[0] != "admin" {
+		t.Errorf("ReservedShortcuts = %q", got)
+	}
+
+	if _, err := p.Query(context.Background()); !errors.Is(err, ErrNotModified) {
+		t.Errorf("second Query error = %v, want ErrNotModified", err)
+	}
+}
+
+func TestSheetsBatchedWrites(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/sheets/batchget.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var batches []sheets.BatchUpdateSpreadsheetRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/values:batchGet"):
+			w.Write(fixture)
+		case strings.HasSuffix(req.URL.Path, ":batchUpdate"):
+			var body sheets.BatchUpdateSpreadsheetRequest
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Errorf("decoding batchUpdate: %v", err)
+			}
+			mu.Lock()
+			batches = append(batches, body)
+			mu.Unlock()
+			w.Write([]byte(`{}`))
+		case strings.HasSuffix(req.URL.Path, "/test-sheet"):
+			w.Write([]byte(`{"sheets": [{"properties": {"sheetId": 0, "title": "Links"}}, {"properties": {"sheetId": 7, "title": "Team"}}]}`))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer ts.Close()
+	srv, err := sheets.NewService(context.Background(),
+		option.WithEndpoint(ts.URL), option.WithHTTPClient(http.DefaultClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &sheetsProvider{
+		googleSheetsID: "test-sheet",
+		sheetNames:     []string{"Links", "Team"},
+		srv:            srv,
+		writes:         sheetWriteQueue{delay: 50 * time.Millisecond},
+	}
+
+	link := &Link{URL: &url.URL{Scheme: "https", Host: "example.com"}}
+	ctx := context.Background()
+	calls := map[string]func() error{
+		"update go":      func() error { return p.Update(ctx, "GO", link) },
+		"delete wiki":    func() error { return p.Delete(ctx, "wiki") },
+		"add new":        func() error { return p.Add(ctx, "new", link) },
+		"update missing": func() error { return p.Update(ctx, "missing", link) },
+	}
+	errs := make(map[string]error)
+	var wg sync.WaitGroup
+	for name, call := range calls {
+		wg.Add(1)
+		go func(name string, call func() error) {
+			defer wg.Done()
+			err := call()
+			mu.Lock()
+			errs[name] = err
+			mu.Unlock()
+		}(name, call)
+	}
+	wg.Wait()
+
+	for name, err := range errs {
+		if want := name == "update missing"; errors.Is(err, ErrLinkNotFound) != want || (!want && err != nil) {
+			t.Errorf("%s: error = %v", name, err)
+		}
+	}
+	if len(batches) != 1 {
+		t.Fatalf("got %d batchUpdate requests, want 1", len(batches))
+	}
+	reqs := batches[0].Requests
+	if len(reqs) != 3 {
+		t.Fatalf("got %d requests, want 3", len(reqs))
+	}
+	if u := reqs[0].UpdateCells; u == nil || u.Start.SheetId != 0 || u.Start.RowIndex != 0 ||
+		*u.Rows[0].Values[0].UserEnteredValue.StringValue != "go" ||
+		*u.Rows[0].Values[1].UserEnteredValue.StringValue != "https://example.com" {
+		t.Errorf("first request = %+v, want update of Links row 1", reqs[0])
+	}
+	if d := reqs[1].DeleteDimension; d == nil || d.Range.SheetId != 7 || d.Range.StartIndex != 0 || d.Range.EndIndex != 1 {
+		t.Errorf("second request = %+v, want delete of Team row 1", reqs[1])
+	}
+	if a := reqs[2].AppendCells; a == nil || a.SheetId != 0 || *a.Rows[0].Values[0].UserEnteredValue.StringValue != "new" {
+		t.Errorf("third request = %+v, want append to Links", reqs[2])
+	}
+}
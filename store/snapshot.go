@@ -0,0 +1,30 @@
+package store
+
+import (
+	"context"
+	"sort"
+)
+
+// EncodeLink serializes link for snapshots of the link table, the way the
+// Redis backend stores it: as its URL when it has no other settings, as JSON
+// otherwise. Variants are left out, like by every backend that can write.
+func EncodeLink(link *Link) string {
+	return encodeRedisLink(link)
+}
+
+// DecodeLinks parses links serialized with EncodeLink, by shortcut. Links
+// that can't be parsed are reported with Warnf and left out.
+func DecodeLinks(ctx context.Context, encoded map[string]string) URLMap {
+	shortcuts := make([]string, 0, len(encoded))
+	for k := range encoded {
+		shortcuts = append(shortcuts, k)
+	}
+	sort.Strings(shortcuts)
+	rows := make([][]interface{}, 0, len(shortcuts))
+	for _, k := range shortcuts {
+		if row := redisRow(ctx, k, encoded[k]); row != nil {
+			rows = append(rows, row)
+		}
+	}
+	return urlMap(ctx, rows)
+}
@@ -0,0 +1,12 @@
+//go:build sqlite
+// +build sqlite
+
+package store
+
+// SQLite support needs cgo, so it is opt-in: go build -tags sqlite.
+
+import _ "github.com/mattn/go-sqlite3"
+
+func init() {
+	sqliteDriver = "sqlite3"
+}
@@ -0,0 +1,38 @@
+//go:build sqlite
+// +build sqlite
+
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteProvider(t *testing.T) {
+	p, err := NewProviderWith("sql", map[string]string{
+		"DATABASE_URL": "sqlite://" + filepath.Join(t.TempDir(), "links.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	link, err := NewLink("", "https://go.dev/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link.Tags = []string{"lang"}
+	if err := p.(Writer).Add(ctx, "go", link); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := p.(Writer).Add(ctx, "go", link); err != ErrLinkExists {
+		t.Errorf("Add again: %v, want ErrLinkExists", err)
+	}
+	m, err := p.Query(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m["go"]; got == nil || got.URL.String() != "https://go.dev/" || len(got.Tags) != 1 {
+		t.Errorf("Query = %v, want go with its tag", m)
+	}
+}
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMySQLDSN(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "mysql://app:pw@db.example.com:3306/links", want: "app:pw@tcp(db.example.com:3306)/links?parseTime=true"},
+		{url: "mysql://app:pw@/links?socket=/cloudsql/p:r:i", want: "app:pw@unix(/cloudsql/p:r:i)/links?parseTime=true"},
+		{url: "mysql://app:pw@aws.connect.psdb.cloud/links?tls=true", want: "app:pw@tcp(aws.connect.psdb.cloud)/links?parseTime=true&tls=true"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := mysqlDSN(u); got != tt.want {
+			t.Errorf("mysqlDSN(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestParseSQLPool(t *testing.T) {
+	env := map[string]string{
+		"DATABASE_MAX_OPEN_CONNS":    "20",
+		"DATABASE_MAX_IDLE_CONNS":    "5",
+		"DATABASE_CONN_MAX_LIFETIME": "5m",
+	}
+	pool, err := parseSQLPool(func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (sqlPool{maxOpen: 20, maxIdle: 5, maxLifetime: 5 * time.Minute}); pool != want {
+		t.Errorf("parseSQLPool = %+v, want %+v", pool, want)
+	}
+
+	for _, bad := range []map[string]string{
+		{"DATABASE_MAX_OPEN_CONNS": "-1"},
+		{"DATABASE_CONN_MAX_IDLE_TIME": "forever"},
+		{"DATABASE_MAX_OPEN_CONNS": "2", "DATABASE_MAX_IDLE_CONNS": "4"},
+	} {
+		_, err := parseSQLPool(func(k string) string { return bad[k] })
+		if err == nil || !strings.Contains(err.Error(), "DATABASE_") {
+			t.Errorf("parseSQLPool(%v) = %v, want an error naming the setting", bad, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Package storetest provides an in-memory store.Provider for tests.
+package storetest
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"github.com/denizyoldas/url-shorter/store"
+)
+
+// Provider keeps links in memory. It implements store.Writer, store.Editor
+// and store.Getter as well as store.Provider.
+type Provider struct {
+	mu    sync.Mutex
+	links store.URLMap
+	err   error
+	// queries counts the calls of Query.
+	queries int
+}
+
+// New returns a provider holding a link to each destination of links, keyed
+// by shortcut. It panics on invalid URLs.
+func New(links map[string]string) *Provider {
+	p := &Provider{links: make(store.URLMap)}
+	for k, v := range links {
+		p.links[k] = Link(v)
+	}
+	return p
+}
+
+// Link returns a link to rawURL. It panics on invalid URLs.
+func Link(rawURL string) *store.Link {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		panic(err)
+	}
+	return &store.Link{URL: u}
+}
+
+// Set stores link under shortcut, replacing any previous one.
+func (p *Provider) Set(shortcut string, link *store.Link) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.links[shortcut] = link
+}
+
+// Fail makes every later call fail with err, or succeed again when err is
+// nil.
+func (p *Provider) Fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+// Queries returns the number of calls of Query so far.
+func (p *Provider) Queries() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queries
+}
+
+// Query returns a copy of the links.
+func (p *Provider) Query(ctx context.Context) (store.URLMap, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queries++
+	if p.err != nil {
+		return nil, p.err
+	}
+	out := make(store.URLMap, len(p.links))
+	for k, v := range p.links {
+		out[k] = v
+	}
+	return out, nil
+}
+
+// Get implements store.Getter.
+func (p *Provider) Get(ctx context.Context, shortcut string) (*store.Link, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.links[shortcut], nil
+}
+
+// Add implements store.Writer.
+func (p *Provider) Add(ctx context.Context, shortcut string, link *store.Link) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	if _, ok := p.links[shortcut]; ok {
+		return store.ErrLinkExists
+	}
+	p.links[shortcut] = link
+	return nil
+}
+
+// Update implements store.Editor.
+func (p *Provider) Update(ctx context.Context, shortcut string, link *store.Link) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	if _, ok := p.links[shortcut]; !ok {
+		return store.ErrLinkNotFound
+	}
+	p.links[shortcut] = link
+	return nil
+}
+
+// Delete implements store.Editor.
+func (p *Provider) Delete(ctx context.Context, shortcut string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	if _, ok := p.links[shortcut]; !ok {
+		return store.ErrLinkNotFound
+	}
+	delete(p.links, shortcut)
+	return nil
+}
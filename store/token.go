@@ -0,0 +1,51 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Scope is a permission level granted to an API token. Each scope implies
+// the ones below it.
+type Scope int
+
+const (
+	ScopeRead Scope = iota + 1
+	ScopeWrite
+	ScopeAdmin
+)
+
+var scopeNames = map[string]Scope{
+	"read":  ScopeRead,
+	"write": ScopeWrite,
+	"admin": ScopeAdmin,
+}
+
+// ParseScopes returns the highest of the comma-separated scope names.
+func ParseScopes(s string) (Scope, error) {
+	var max Scope
+	for _, name := range strings.Split(s, ",") {
+		sc, ok := scopeNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return 0, fmt.Errorf("unknown scope %q", name)
+		}
+		if sc > max {
+			max = sc
+		}
+	}
+	return max, nil
+}
+
+// Principal is the caller authenticated by a token.
+type Principal struct {
+	Name  string
+	Scope Scope
+}
+
+// TokenStore is implemented by providers that can look up API tokens, for
+// example from a database table. Tokens are identified by hashToken.
+type TokenStore interface {
+	// LookupToken returns nil when no token has the given hash.
+	LookupToken(ctx context.Context, hash string) (*Principal, error)
+}